@@ -48,13 +48,10 @@ static const uint8_t epilogue[] = {
 		JIT_code += (size); \
 	} while (0)
 
-int v4_generate_JIT_code(const struct V4_Instruction* code, v4_random_math_JIT_func buf, const size_t buf_size)
+// Appends the machine code of the random math program
+static int append_random_math(const struct V4_Instruction* code, uint8_t** JIT_code_ptr, const uint8_t* JIT_code_end)
 {
-	uint8_t* JIT_code = (uint8_t*) buf;
-	const uint8_t* JIT_code_end = JIT_code + buf_size;
-
-	APPEND_CODE(prologue, sizeof(prologue));
-
+	uint8_t* JIT_code = *JIT_code_ptr;
 	uint32_t prev_rot_src = 0xFFFFFFFFU;
 
 	for (int i = 0;; ++i)
@@ -94,9 +91,60 @@ int v4_generate_JIT_code(const struct V4_Instruction* code, v4_random_math_JIT_f
 			*(uint32_t*)(JIT_code - 4) = inst.C;
 	}
 
+	*JIT_code_ptr = JIT_code;
+	return 0;
+}
+
+int v4_generate_JIT_code(const struct V4_Instruction* code, v4_random_math_JIT_func buf, const size_t buf_size)
+{
+	uint8_t* JIT_code = (uint8_t*) buf;
+	const uint8_t* JIT_code_end = JIT_code + buf_size;
+
+	APPEND_CODE(prologue, sizeof(prologue));
+
+	if (append_random_math(code, &JIT_code, JIT_code_end) < 0)
+		return -1;
+
 	APPEND_CODE(epilogue, sizeof(epilogue));
 
 	__builtin___clear_cache((char*)buf, (char*)JIT_code);
 
 	return 0;
 }
+
+// Parts of the main loop in CryptonightR_loop_template.S, which loads the
+// state with these offsets
+static_assert(offsetof(struct V4_Loop_State, b) == 16 && offsetof(struct V4_Loop_State, scratchpad) == 48 &&
+	offsetof(struct V4_Loop_State, r) == 72 && offsetof(struct V4_Loop_State, saved_rsp) == 88, "Invalid structure layout");
+void CryptonightR_loop_prologue(void);
+void CryptonightR_loop_part1(void);
+void CryptonightR_loop_part2(void);
+void CryptonightR_loop_epilogue(void);
+void CryptonightR_loop_end(void);
+
+int v4_generate_JIT_loop(const struct V4_Instruction* code, v4_loop_JIT_func buf, const size_t buf_size)
+{
+	uint8_t* JIT_code = (uint8_t*) buf;
+	const uint8_t* JIT_code_end = JIT_code + buf_size;
+
+	APPEND_CODE((const uint8_t*) CryptonightR_loop_prologue, (const uint8_t*) CryptonightR_loop_part1 - (const uint8_t*) CryptonightR_loop_prologue);
+	uint8_t* loop = JIT_code;
+	APPEND_CODE((const uint8_t*) CryptonightR_loop_part1, (const uint8_t*) CryptonightR_loop_part2 - (const uint8_t*) CryptonightR_loop_part1);
+
+	if (append_random_math(code, &JIT_code, JIT_code_end) < 0)
+		return -1;
+
+	APPEND_CODE((const uint8_t*) CryptonightR_loop_part2, (const uint8_t*) CryptonightR_loop_epilogue - (const uint8_t*) CryptonightR_loop_part2);
+
+	// jnz loop
+	uint8_t jump[6] = { 0x0F, 0x85 };
+	const int32_t offset = (int32_t)(loop - (JIT_code + sizeof(jump)));
+	memcpy(jump + 2, &offset, sizeof(offset));
+	APPEND_CODE(jump, sizeof(jump));
+
+	APPEND_CODE((const uint8_t*) CryptonightR_loop_epilogue, (const uint8_t*) CryptonightR_loop_end - (const uint8_t*) CryptonightR_loop_epilogue);
+
+	__builtin___clear_cache((char*)buf, (char*)JIT_code);
+
+	return 0;
+}
@@ -15,4 +15,26 @@ typedef void (*v4_random_math_JIT_func)(uint32_t* r) __attribute__((sysv_abi));
 // Returns -1 if provided buffer was too small
 int v4_generate_JIT_code(const struct V4_Instruction* code, v4_random_math_JIT_func buf, const size_t buf_size);
 
+// What the main loop generated by v4_generate_JIT_loop starts from. The loop
+// reads the scratchpad and registers from it but doesn't write them back, the
+// scratchpad is its only output
+struct V4_Loop_State
+{
+	uint64_t a[2];
+	uint64_t b[4];		// _b, then _b1
+	uint8_t* scratchpad;
+	uint64_t mask;
+	uint64_t iterations;	// at least 1
+	uint32_t r[4];
+	uint64_t saved_rsp;	// used by the loop
+};
+
+typedef void (*v4_loop_JIT_func)(struct V4_Loop_State* state) __attribute__((sysv_abi));
+
+// Generates the whole CryptonightR main loop (x86-64, AES-NI) with the
+// random math sequence inlined, see CryptonightR_loop_template.S
+// Returns 0 if code was generated successfully
+// Returns -1 if provided buffer was too small
+int v4_generate_JIT_loop(const struct V4_Instruction* code, v4_loop_JIT_func buf, const size_t buf_size);
+
 #endif // CRYPTONIGHTR_JIT_H
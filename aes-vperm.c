@@ -0,0 +1,232 @@
+// AES rounds with SSSE3 byte shuffles instead of lookup tables in memory,
+// for x86 CPUs without AES-NI. Same results as aesb_single_round and
+// aesb_pseudo_round in aesb.c, and free of the cache timing side channel
+// of table lookups. The pseudo rounds of the scratchpad explode and
+// implode run several blocks at once, about 1.6 times as fast as aesb's
+// with SSSE3 alone and 2.3 times with AVX2. The main loop, most of a
+// hash, inlines the single round (aes-vperm.h), but it's a chain of
+// dependent shuffles, no shorter than the table lookups it replaces:
+// hashes with SSSE3 alone are no faster than with aesb (the difference
+// is within the noise of BenchmarkAESImplementations), with AVX2 they
+// take about a quarter less time, and AES-NI is still 1.7 times as
+// fast as that.
+//
+// This follows Mike Hamburg's "Accelerating AES with Vector Permute
+// Instructions": pshufb looks up 16 nibbles in a 16 byte table at once,
+// so the S-box is computed in GF(2^8) represented as GF(2^4)[t]/(t^2 + t +
+// 1/2), where inverting only takes inverses in GF(2^4) (GF(2)[x]/(x^4 + x +
+// 1)) and additions. A byte becomes the pair of nibbles (i, k) = (h, 2l) for
+// h t + l, and with j = i + k its inverse is determined by
+//   io = j + 1/(1/i + 2/k)  and  jo = i + 1/(1/j + 2/k),
+// each the inverse of a GF(2^4) coordinate of it. Table entries of 0x80
+// stand for infinity (1/0): pshufb turns indices with the top bit set into
+// 0, which is 1/infinity, and infinity plus anything finite keeps the top
+// bit. The output tables map io and jo back to the AES basis with the
+// S-box's affine transform (minus its constant) applied, and times 2 for
+// MixColumns.
+
+#include <stddef.h>
+#include <stdint.h>
+
+#if defined(__x86_64__) || defined(__i386__)
+
+#include <immintrin.h>
+
+#if defined(_MSC_VER)
+#include <intrin.h>
+#else
+#include <cpuid.h>
+#endif
+
+#include "aes-vperm.h"
+
+int aesv_supported(void)
+{
+  static int supported = -1;
+  if (supported < 0)
+  {
+#if defined(_MSC_VER)
+    int info[4];
+    __cpuid(info, 1);
+    supported = (info[2] >> 9) & 1;
+#else
+    unsigned int eax, ebx, ecx, edx;
+    supported = __get_cpuid(1, &eax, &ebx, &ecx, &edx) && (ecx & bit_SSSE3);
+#endif
+  }
+  return supported;
+}
+
+// Rounds in the GF(2^4)^2 basis with AVX2, two blocks to a register:
+// vpshufb looks up each 128 bit half in its own half of the table, so the
+// tables are simply repeated. Only used for pairs of blocks.
+#define VPERM_TARGET_AVX2 __attribute__((target("avx2")))
+#define T2(n) _mm256_broadcastsi128_si256(T(n))
+
+static inline VPERM_TARGET_AVX2 __m256i aesv_transform2(__m256i x, int lo, int hi)
+{
+  const __m256i nibble = T2(VPERM_NIBBLE);
+  return _mm256_xor_si256(_mm256_shuffle_epi8(T2(lo), _mm256_and_si256(x, nibble)),
+                          _mm256_shuffle_epi8(T2(hi), _mm256_and_si256(_mm256_srli_epi16(x, 4), nibble)));
+}
+
+static inline VPERM_TARGET_AVX2 __m256i aesv_round_in_basis2(__m256i x, __m256i key)
+{
+  const __m256i nibble = T2(VPERM_NIBBLE);
+  x = _mm256_shuffle_epi8(x, T2(VPERM_SHIFT_ROWS));
+  __m256i i = _mm256_and_si256(_mm256_srli_epi16(x, 4), nibble);
+  __m256i k = _mm256_and_si256(x, nibble);
+  __m256i j = _mm256_xor_si256(i, k);
+
+  const __m256i inv = T2(VPERM_INV);
+  __m256i ak = _mm256_shuffle_epi8(T2(VPERM_INV2), k);
+  __m256i iak = _mm256_xor_si256(_mm256_shuffle_epi8(inv, i), ak);
+  __m256i jak = _mm256_xor_si256(_mm256_shuffle_epi8(inv, j), ak);
+  __m256i io = _mm256_xor_si256(_mm256_shuffle_epi8(inv, iak), j);
+  __m256i jo = _mm256_xor_si256(_mm256_shuffle_epi8(inv, jak), i);
+
+  __m256i s = _mm256_xor_si256(_mm256_shuffle_epi8(T2(VPERM_SB1_T), io), _mm256_shuffle_epi8(T2(VPERM_SB2_T), jo));
+  __m256i d = _mm256_xor_si256(_mm256_shuffle_epi8(T2(VPERM_SB1X2_T), io), _mm256_shuffle_epi8(T2(VPERM_SB2X2_T), jo));
+
+  const __m256i rot1 = T2(VPERM_ROT1);
+  __m256i out = _mm256_xor_si256(d, _mm256_shuffle_epi8(_mm256_xor_si256(d, s), rot1));
+  out = _mm256_xor_si256(out, _mm256_shuffle_epi8(_mm256_xor_si256(s, _mm256_shuffle_epi8(s, rot1)), T2(VPERM_ROT2)));
+  return _mm256_xor_si256(out, key);
+}
+
+static VPERM_TARGET_AVX2 void aesv_pseudo_round_pairs(const uint8_t *in, uint8_t *out, const __m128i *keys, const uint8_t *xor, size_t npairs)
+{
+  __m256i keys2[10];
+  for (int r = 0; r < 10; ++r)
+    keys2[r] = _mm256_broadcastsi128_si256(keys[r]);
+
+  size_t p = 0;
+  for (; p + 2 <= npairs; p += 2)
+  {
+    __m256i x[2];
+    for (int q = 0; q < 2; ++q)
+    {
+      x[q] = _mm256_loadu_si256((const __m256i *)(in + (p + q) * 32));
+      if (xor != NULL)
+        x[q] = _mm256_xor_si256(x[q], _mm256_loadu_si256((const __m256i *)(xor + (p + q) * 32)));
+      x[q] = aesv_transform2(x[q], VPERM_IPT_LO, VPERM_IPT_HI);
+    }
+    for (int r = 0; r < 10; ++r)
+    {
+      x[0] = aesv_round_in_basis2(x[0], keys2[r]);
+      x[1] = aesv_round_in_basis2(x[1], keys2[r]);
+    }
+    for (int q = 0; q < 2; ++q)
+      _mm256_storeu_si256((__m256i *)(out + (p + q) * 32), aesv_transform2(x[q], VPERM_OPT_LO, VPERM_OPT_HI));
+  }
+  for (; p < npairs; ++p)
+  {
+    __m256i x = _mm256_loadu_si256((const __m256i *)(in + p * 32));
+    if (xor != NULL)
+      x = _mm256_xor_si256(x, _mm256_loadu_si256((const __m256i *)(xor + p * 32)));
+    x = aesv_transform2(x, VPERM_IPT_LO, VPERM_IPT_HI);
+    for (int r = 0; r < 10; ++r)
+      x = aesv_round_in_basis2(x, keys2[r]);
+    _mm256_storeu_si256((__m256i *)(out + p * 32), aesv_transform2(x, VPERM_OPT_LO, VPERM_OPT_HI));
+  }
+  _mm256_zeroupper();
+}
+
+// Cleared by tests, to run the SSSE3 rounds on CPUs with AVX2 too
+static volatile int aesv_avx2_enabled = 1;
+
+void aesv_set_avx2(int enabled)
+{
+  aesv_avx2_enabled = enabled;
+}
+
+// Whether the CPU has AVX2 and the OS saves the YMM registers
+static int aesv_avx2_supported(void)
+{
+  static int supported = -1;
+  if (supported < 0)
+  {
+#if defined(_MSC_VER)
+    int info[4];
+    __cpuid(info, 1);
+    int osxsave = (info[2] >> 27) & 1;
+    __cpuidex(info, 7, 0);
+    supported = osxsave && ((info[1] >> 5) & 1) && (_xgetbv(0) & 6) == 6;
+#else
+    unsigned int eax, ebx, ecx, edx, xcr0_lo, xcr0_hi;
+    supported = 0;
+    if (__get_cpuid(1, &eax, &ebx, &ecx, &edx) && (ecx & bit_OSXSAVE) &&
+        __get_cpuid_count(7, 0, &eax, &ebx, &ecx, &edx) && (ebx & bit_AVX2))
+    {
+      __asm__ ("xgetbv" : "=a"(xcr0_lo), "=d"(xcr0_hi) : "c"(0));
+      supported = (xcr0_lo & 6) == 6;
+    }
+#endif
+  }
+  return supported;
+}
+
+// Same as aesb_pseudo_round on each of the nblocks blocks at in, after
+// xoring them with the blocks at xor if it isn't NULL. Independent blocks
+// are interleaved, which is where most of the speed comes from, and with
+// AVX2 two of them share a register.
+VPERM_TARGET void aesv_pseudo_round_blocks(const uint8_t *in, uint8_t *out, const uint8_t *expandedKey, const uint8_t *xor, size_t nblocks)
+{
+  __m128i keys[10];
+  for (int r = 0; r < 10; ++r)
+  {
+    __m128i key = _mm_xor_si128(_mm_loadu_si128((const __m128i *)(expandedKey + r * 16)), T(VPERM_0x63));
+    keys[r] = aesv_transform(key, VPERM_IPT_LO, VPERM_IPT_HI);
+  }
+
+  size_t b = 0;
+  if (nblocks >= 2 && aesv_avx2_enabled && aesv_avx2_supported())
+  {
+    b = nblocks & ~(size_t)1;
+    aesv_pseudo_round_pairs(in, out, keys, xor, b / 2);
+  }
+  for (; b + 4 <= nblocks; b += 4)
+  {
+    __m128i x[4];
+    for (int q = 0; q < 4; ++q)
+    {
+      x[q] = _mm_loadu_si128((const __m128i *)(in + (b + q) * 16));
+      if (xor != NULL)
+        x[q] = _mm_xor_si128(x[q], _mm_loadu_si128((const __m128i *)(xor + (b + q) * 16)));
+      x[q] = aesv_transform(x[q], VPERM_IPT_LO, VPERM_IPT_HI);
+    }
+    for (int r = 0; r < 10; ++r)
+    {
+      x[0] = aesv_round_in_basis(x[0], keys[r], VPERM_SB1_T, VPERM_SB2_T, VPERM_SB1X2_T, VPERM_SB2X2_T);
+      x[1] = aesv_round_in_basis(x[1], keys[r], VPERM_SB1_T, VPERM_SB2_T, VPERM_SB1X2_T, VPERM_SB2X2_T);
+      x[2] = aesv_round_in_basis(x[2], keys[r], VPERM_SB1_T, VPERM_SB2_T, VPERM_SB1X2_T, VPERM_SB2X2_T);
+      x[3] = aesv_round_in_basis(x[3], keys[r], VPERM_SB1_T, VPERM_SB2_T, VPERM_SB1X2_T, VPERM_SB2X2_T);
+    }
+    for (int q = 0; q < 4; ++q)
+      _mm_storeu_si128((__m128i *)(out + (b + q) * 16), aesv_transform(x[q], VPERM_OPT_LO, VPERM_OPT_HI));
+  }
+  for (; b < nblocks; ++b)
+  {
+    __m128i x = _mm_loadu_si128((const __m128i *)(in + b * 16));
+    if (xor != NULL)
+      x = _mm_xor_si128(x, _mm_loadu_si128((const __m128i *)(xor + b * 16)));
+    x = aesv_transform(x, VPERM_IPT_LO, VPERM_IPT_HI);
+    for (int r = 0; r < 10; ++r)
+      x = aesv_round_in_basis(x, keys[r], VPERM_SB1_T, VPERM_SB2_T, VPERM_SB1X2_T, VPERM_SB2X2_T);
+    _mm_storeu_si128((__m128i *)(out + b * 16), aesv_transform(x, VPERM_OPT_LO, VPERM_OPT_HI));
+  }
+}
+
+void aesv_pseudo_round(const uint8_t *in, uint8_t *out, const uint8_t *expandedKey)
+{
+  aesv_pseudo_round_blocks(in, out, expandedKey, NULL, 1);
+}
+
+#else
+
+int aesv_supported(void)
+{
+  return 0;
+}
+
+#endif
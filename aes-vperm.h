@@ -0,0 +1,97 @@
+// The vector permute AES round of aes-vperm.c, inline so that the main
+// loops of slow-hash.c don't call a function every iteration. Callers
+// need SSSE3, see VPERM_TARGET.
+
+#pragma once
+
+#include <stdint.h>
+#include <tmmintrin.h>
+
+#define VPERM_TABLE(...) { __VA_ARGS__ }
+
+static const uint8_t vperm_tables[][16] __attribute__((aligned(16))) = {
+  // Input transform, low and high nibble
+  VPERM_TABLE(0x00, 0x02, 0x2b, 0x29, 0x49, 0x4b, 0x62, 0x60, 0x4e, 0x4c, 0x65, 0x67, 0x07, 0x05, 0x2c, 0x2e),
+  VPERM_TABLE(0x00, 0x3c, 0xd9, 0xe5, 0x3f, 0x03, 0xe6, 0xda, 0xee, 0xd2, 0x37, 0x0b, 0xd1, 0xed, 0x08, 0x34),
+  // 1/n and 2/n in GF(2^4)
+  VPERM_TABLE(0x80, 0x01, 0x09, 0x0e, 0x0d, 0x0b, 0x07, 0x06, 0x0f, 0x02, 0x0c, 0x05, 0x0a, 0x04, 0x03, 0x08),
+  VPERM_TABLE(0x80, 0x02, 0x01, 0x0f, 0x09, 0x05, 0x0e, 0x0c, 0x0d, 0x04, 0x0b, 0x0a, 0x07, 0x08, 0x06, 0x03),
+  // S-box output from io and jo, without the 0x63
+  VPERM_TABLE(0x00, 0x5a, 0xcb, 0x7b, 0xd7, 0x3d, 0xb0, 0xea, 0x21, 0xf6, 0x8d, 0x46, 0x67, 0x1c, 0xac, 0x91),
+  VPERM_TABLE(0x00, 0x4b, 0x9f, 0x89, 0x61, 0x3c, 0x16, 0x5d, 0xc2, 0xa3, 0x2a, 0xb5, 0x77, 0xfe, 0xe8, 0xd4),
+  // The same times 2
+  VPERM_TABLE(0x00, 0xb4, 0x8d, 0xf6, 0xb5, 0x7a, 0x7b, 0xcf, 0x42, 0xf7, 0x01, 0x8c, 0xce, 0x38, 0x43, 0x39),
+  VPERM_TABLE(0x00, 0x96, 0x25, 0x09, 0xc2, 0x78, 0x2c, 0xba, 0x9f, 0x5d, 0x54, 0x71, 0xee, 0xe7, 0xcb, 0xb3),
+  // ShiftRows, and rotating every column by one and two rows
+  VPERM_TABLE(0x00, 0x05, 0x0a, 0x0f, 0x04, 0x09, 0x0e, 0x03, 0x08, 0x0d, 0x02, 0x07, 0x0c, 0x01, 0x06, 0x0b),
+  VPERM_TABLE(0x01, 0x02, 0x03, 0x00, 0x05, 0x06, 0x07, 0x04, 0x09, 0x0a, 0x0b, 0x08, 0x0d, 0x0e, 0x0f, 0x0c),
+  VPERM_TABLE(0x02, 0x03, 0x00, 0x01, 0x06, 0x07, 0x04, 0x05, 0x0a, 0x0b, 0x08, 0x09, 0x0e, 0x0f, 0x0c, 0x0d),
+  // The S-box constant, which MixColumns leaves as it is
+  VPERM_TABLE(0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63, 0x63),
+  VPERM_TABLE(0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f, 0x0f),
+  // The output tables again, mapped into the GF(2^4)^2 basis so that rounds
+  // can follow each other without leaving it
+  VPERM_TABLE(0x00, 0x66, 0xb6, 0xbd, 0x8d, 0xe0, 0x0b, 0x6d, 0xdb, 0x56, 0xeb, 0x5d, 0x86, 0x3b, 0x30, 0xd0),
+  VPERM_TABLE(0x00, 0x58, 0xfc, 0xa2, 0xe4, 0xe2, 0x5e, 0x06, 0xfa, 0x1e, 0xbc, 0x40, 0xba, 0x18, 0x46, 0xa4),
+  VPERM_TABLE(0x00, 0x42, 0xeb, 0x56, 0x40, 0xbf, 0xbd, 0xff, 0x14, 0x54, 0x02, 0xe9, 0xfd, 0xab, 0x16, 0xa9),
+  VPERM_TABLE(0x00, 0xb0, 0x92, 0x4c, 0xfa, 0x94, 0xde, 0x6e, 0xfc, 0x06, 0x4a, 0xd8, 0x24, 0x68, 0xb6, 0x22),
+  // Output transform back to the AES basis, low and high nibble
+  VPERM_TABLE(0x00, 0x51, 0x01, 0x50, 0x5c, 0x0d, 0x5d, 0x0c, 0xe0, 0xb1, 0xe1, 0xb0, 0xbc, 0xed, 0xbd, 0xec),
+  VPERM_TABLE(0x00, 0x1e, 0xb2, 0xac, 0xb5, 0xab, 0x07, 0x19, 0x3a, 0x24, 0x88, 0x96, 0x8f, 0x91, 0x3d, 0x23),
+};
+
+enum {
+  VPERM_IPT_LO, VPERM_IPT_HI, VPERM_INV, VPERM_INV2, VPERM_SB1, VPERM_SB2, VPERM_SB1X2, VPERM_SB2X2,
+  VPERM_SHIFT_ROWS, VPERM_ROT1, VPERM_ROT2, VPERM_0x63, VPERM_NIBBLE,
+  VPERM_SB1_T, VPERM_SB2_T, VPERM_SB1X2_T, VPERM_SB2X2_T, VPERM_OPT_LO, VPERM_OPT_HI
+};
+
+#define VPERM_TARGET __attribute__((target("ssse3")))
+#define T(n) _mm_load_si128((const __m128i *)vperm_tables[n])
+
+// Maps the bytes of x from one basis to another, with the tables for the
+// low and high nibbles
+static inline VPERM_TARGET __m128i aesv_transform(__m128i x, int lo, int hi)
+{
+  const __m128i nibble = T(VPERM_NIBBLE);
+  return _mm_xor_si128(_mm_shuffle_epi8(T(lo), _mm_and_si128(x, nibble)),
+                       _mm_shuffle_epi8(T(hi), _mm_and_si128(_mm_srli_epi16(x, 4), nibble)));
+}
+
+// A round on x in the GF(2^4)^2 basis. sb1 to sb2x2 are the output tables,
+// which decide the basis of the result, and key must be in that basis with
+// the S-box constant added
+static inline VPERM_TARGET __m128i aesv_round_in_basis(__m128i x, __m128i key, int sb1, int sb2, int sb1x2, int sb2x2)
+{
+  const __m128i nibble = T(VPERM_NIBBLE);
+  x = _mm_shuffle_epi8(x, T(VPERM_SHIFT_ROWS));
+  __m128i i = _mm_and_si128(_mm_srli_epi16(x, 4), nibble);
+  __m128i k = _mm_and_si128(x, nibble);
+  __m128i j = _mm_xor_si128(i, k);
+
+  // Inverse
+  const __m128i inv = T(VPERM_INV);
+  __m128i ak = _mm_shuffle_epi8(T(VPERM_INV2), k);
+  __m128i iak = _mm_xor_si128(_mm_shuffle_epi8(inv, i), ak);
+  __m128i jak = _mm_xor_si128(_mm_shuffle_epi8(inv, j), ak);
+  __m128i io = _mm_xor_si128(_mm_shuffle_epi8(inv, iak), j);
+  __m128i jo = _mm_xor_si128(_mm_shuffle_epi8(inv, jak), i);
+
+  // S-box and twice the S-box
+  __m128i s = _mm_xor_si128(_mm_shuffle_epi8(T(sb1), io), _mm_shuffle_epi8(T(sb2), jo));
+  __m128i d = _mm_xor_si128(_mm_shuffle_epi8(T(sb1x2), io), _mm_shuffle_epi8(T(sb2x2), jo));
+
+  // MixColumns, row r gets 2 s[r] + 3 s[r + 1] + s[r + 2] + s[r + 3]
+  const __m128i rot1 = T(VPERM_ROT1);
+  __m128i out = _mm_xor_si128(d, _mm_shuffle_epi8(_mm_xor_si128(d, s), rot1));
+  out = _mm_xor_si128(out, _mm_shuffle_epi8(_mm_xor_si128(s, _mm_shuffle_epi8(s, rot1)), T(VPERM_ROT2)));
+  return _mm_xor_si128(out, key);
+}
+
+// Same as _mm_aesenc_si128
+static inline VPERM_TARGET __m128i aesv_round(__m128i x, __m128i key)
+{
+  x = aesv_transform(x, VPERM_IPT_LO, VPERM_IPT_HI);
+  key = _mm_xor_si128(key, T(VPERM_0x63));
+  return aesv_round_in_basis(x, key, VPERM_SB1, VPERM_SB2, VPERM_SB1X2, VPERM_SB2X2);
+}
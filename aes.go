@@ -0,0 +1,117 @@
+package cryptonight
+
+/*
+#include "hash-ops.h"
+
+void aesb_pseudo_round(const uint8_t *in, uint8_t *out, const uint8_t *expandedKey);
+#if defined(__x86_64__) || defined(__i386__)
+int aesv_supported(void);
+void aesv_set_avx2(int enabled);
+void aesv_pseudo_round_blocks(const uint8_t *in, uint8_t *out, const uint8_t *expandedKey, const uint8_t *xor, size_t nblocks);
+#endif
+
+static void cn_aesv_set_avx2(int enabled)
+{
+#if defined(__x86_64__) || defined(__i386__)
+  aesv_set_avx2(enabled);
+#endif
+}
+
+// The pseudo rounds of the scratchpad explode and implode on nblocks
+// blocks, with the vector permute rounds if vperm is set and the CPU
+// has SSSE3, else with the tables
+static void cn_aes_pseudo_round_blocks(int vperm, const uint8_t *in, uint8_t *out, const uint8_t *expandedKey, const uint8_t *xor, size_t nblocks)
+{
+#if defined(__x86_64__) || defined(__i386__)
+  if (vperm && aesv_supported())
+  {
+    aesv_pseudo_round_blocks(in, out, expandedKey, xor, nblocks);
+    return;
+  }
+#endif
+  for (size_t b = 0; b < nblocks; ++b)
+  {
+    uint8_t block[16];
+    for (int i = 0; i < 16; ++i)
+      block[i] = in[b * 16 + i] ^ (xor != NULL ? xor[b * 16 + i] : 0);
+    aesb_pseudo_round(block, out + b * 16, expandedKey);
+  }
+}
+*/
+import "C"
+import "unsafe"
+
+// On x86-64 without AES-NI (older CPUs, some virtual machines, or with
+// MONERO_USE_SOFTWARE_AES set), AES rounds used to go through lookup
+// tables, one memory access per byte. The SSSE3 implementation does
+// the S-box with byte shuffles in registers instead, free of the
+// cache timing side channel, and works on several blocks at once while
+// exploding and imploding the scratchpad. The main loop's single
+// rounds aren't faster though: with SSSE3 alone hashes are no faster
+// than with the tables, with AVX2 about a quarter faster, and still
+// well behind AES-NI. It's picked automatically when AES-NI isn't
+// available.
+
+// An AES implementation, see SetAESImplementation.
+type AESImplementation int
+
+const (
+	// AES-NI if available and MONERO_USE_SOFTWARE_AES isn't set, else
+	// AESVectorPermute if available, else AESTables.
+	AESAuto AESImplementation = C.CN_AES_AUTO
+	// AES-NI, or the ARMv8 crypto extensions.
+	AESHardware AESImplementation = C.CN_AES_HW
+	// SSSE3 byte shuffles.
+	AESVectorPermute AESImplementation = C.CN_AES_VPERM
+	// Lookup tables, which any CPU can run.
+	AESTables AESImplementation = C.CN_AES_TABLES
+)
+
+func (impl AESImplementation) String() string {
+	switch impl {
+	case AESAuto:
+		return "auto"
+	case AESHardware:
+		return "hardware"
+	case AESVectorPermute:
+		return "vperm"
+	case AESTables:
+		return "tables"
+	}
+	return "unknown"
+}
+
+// Selects the AES implementation of hashes started afterwards, on
+// x86-64. If the CPU can't run it, the next one in the order
+// AESHardware, AESVectorPermute, AESTables is used. RandomX follows
+// it too, with AES-NI or its own tables. Mostly useful to compare
+// them, results are the same with all of them.
+func SetAESImplementation(impl AESImplementation) {
+	C.cn_set_aes_impl(C.int(impl))
+}
+
+// Returns the AES implementation hashes use, never AESAuto.
+func CurrentAESImplementation() AESImplementation {
+	return AESImplementation(C.cn_aes_impl())
+}
+
+// Turns the AVX2 rounds of AESVectorPermute off, or back on, so that
+// tests can compare the SSSE3 ones on CPUs with AVX2 too.
+func setAESVectorPermuteAVX2(enabled bool) {
+	C.cn_aesv_set_avx2(boolToCInt(enabled))
+}
+
+// Returns the pseudo rounds (the ten rounds of the scratchpad explode
+// and implode) of the blocks of in, xored with those of xor unless it's
+// nil, with the round keys expanded_key. Uses AESVectorPermute if vperm
+// is set and the CPU can run it, else the tables. For tests and
+// benchmarks.
+func aesPseudoRoundBlocks(vperm bool, in []byte, expanded_key []byte, xor []byte) []byte {
+	out := make([]byte, len(in))
+	var xor_ptr *C.uint8_t
+	if xor != nil {
+		xor_ptr = (*C.uint8_t)(unsafe.Pointer(&xor[0]))
+	}
+	C.cn_aes_pseudo_round_blocks(boolToCInt(vperm), (*C.uint8_t)(unsafe.Pointer(&in[0])), (*C.uint8_t)(unsafe.Pointer(&out[0])), (*C.uint8_t)(unsafe.Pointer(&expanded_key[0])), xor_ptr, C.size_t(len(in)/16))
+	return out
+}
@@ -0,0 +1,144 @@
+package cryptonight
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestAESImplementations(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("AES implementations can only be selected on x86-64")
+	}
+	defer SetAESImplementation(AESAuto)
+
+	// Every implementation the CPU has must match the table based one,
+	// on the light and heavy explodes and implodes and the main loop,
+	// interleaved or not.
+	input := hexutil.MustDecode("0x0305a0dbd6bf05cf16e503f3a66f78007cbf34144332ecbfc22ed95c8700383b309ace1923a0964b00000008ba939a62724c0d7581fce5761e9d8a0e6a1c3f924fdd8493d1115649c05eb601")
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	algorithms := []Algorithm{CN1, CNPico, CNHeavy0, CNHeavyTube, CNDev2, CNDevR}
+	hashes := func() [][]byte {
+		var hashes [][]byte
+		for _, algorithm := range algorithms {
+			hashes = append(hashes, algorithm.Hash(input, 1806260 /*block_height*/))
+		}
+		// The interleaved main loops are separate per variant.
+		for _, algorithm := range []Algorithm{CNLite0, CNDev1, CNDev2, CNDevR, CNHeavyTube} {
+			multi, _ := HashAlgorithmForEthereumHeaderMulti(algorithm, block_header_bytes, 0xc526c0a1000008dc, 2, 1806260 /*block_height*/)
+			hashes = append(hashes, multi...)
+		}
+		return hashes
+	}
+
+	SetAESImplementation(AESTables)
+	if impl := CurrentAESImplementation(); impl != AESTables {
+		t.Fatal("Unexpected implementation: ", impl)
+	}
+	expected := hashes()
+	for _, impl := range []AESImplementation{AESVectorPermute, AESHardware} {
+		SetAESImplementation(impl)
+		if CurrentAESImplementation() != impl {
+			t.Log(impl, " isn't available, got ", CurrentAESImplementation())
+			continue
+		}
+		for i, actual_hash := range hashes() {
+			if !bytes.Equal(actual_hash, expected[i]) {
+				t.Error(impl, ": unexpected result ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected[i]))
+			}
+		}
+	}
+
+	// The same for the SSSE3 rounds, which AVX2 CPUs otherwise skip.
+	SetAESImplementation(AESVectorPermute)
+	if CurrentAESImplementation() == AESVectorPermute {
+		setAESVectorPermuteAVX2(false)
+		for i, actual_hash := range hashes() {
+			if !bytes.Equal(actual_hash, expected[i]) {
+				t.Error("SSSE3: unexpected result ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected[i]))
+			}
+		}
+		setAESVectorPermuteAVX2(true)
+	}
+
+	SetAESImplementation(AESAuto)
+	if impl := CurrentAESImplementation(); impl == AESAuto {
+		t.Error("Unexpected implementation: ", impl)
+	}
+}
+
+func TestAESVectorPermuteBlocks(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("AES implementations can only be selected on x86-64")
+	}
+	defer setAESVectorPermuteAVX2(true)
+
+	// Hashes only take 8 blocks at a time, other counts also go through
+	// the 4 block and single block rounds, and with AVX2 the pairs.
+	random := rand.New(rand.NewSource(1))
+	expanded_key := make([]byte, 160)
+	random.Read(expanded_key)
+	for nblocks := 1; nblocks <= 11; nblocks++ {
+		in := make([]byte, nblocks*16)
+		xor := make([]byte, nblocks*16)
+		random.Read(in)
+		random.Read(xor)
+		for _, x := range [][]byte{nil, xor} {
+			expected := aesPseudoRoundBlocks(false, in, expanded_key, x)
+			for _, avx2 := range []bool{true, false} {
+				setAESVectorPermuteAVX2(avx2)
+				if actual := aesPseudoRoundBlocks(true, in, expanded_key, x); !bytes.Equal(actual, expected) {
+					t.Error("Unexpected rounds of ", nblocks, " blocks, AVX2 ", avx2, ": ", hex.EncodeToString(actual), " versus ", hex.EncodeToString(expected))
+				}
+			}
+		}
+	}
+}
+
+// The explode and implode pseudo rounds on 8 blocks, as hashes run them.
+func BenchmarkAESPseudoRounds(b *testing.B) {
+	defer setAESVectorPermuteAVX2(true)
+	expanded_key := make([]byte, 160)
+	in := make([]byte, 8*16)
+	xor := make([]byte, 8*16)
+	for _, bench := range []struct {
+		name  string
+		vperm bool
+		avx2  bool
+	}{{"tables", false, false}, {"ssse3", true, false}, {"avx2", true, true}} {
+		b.Run(bench.name, func(b *testing.B) {
+			setAESVectorPermuteAVX2(bench.avx2)
+			b.SetBytes(int64(len(in)))
+			for i := 0; i < b.N; i++ {
+				aesPseudoRoundBlocks(bench.vperm, in, expanded_key, xor)
+			}
+		})
+	}
+}
+
+// Whole hashes, whose main loops take single rounds.
+func BenchmarkAESImplementations(b *testing.B) {
+	defer SetAESImplementation(AESAuto)
+	defer setAESVectorPermuteAVX2(true)
+	input := make([]byte, 76)
+	for _, bench := range []struct {
+		name string
+		impl AESImplementation
+		avx2 bool
+	}{{"tables", AESTables, false}, {"ssse3", AESVectorPermute, false}, {"avx2", AESVectorPermute, true}, {"hardware", AESHardware, false}} {
+		b.Run(bench.name, func(b *testing.B) {
+			SetAESImplementation(bench.impl)
+			setAESVectorPermuteAVX2(bench.avx2)
+			if CurrentAESImplementation() != bench.impl {
+				b.Skip(bench.impl, " isn't available")
+			}
+			for i := 0; i < b.N; i++ {
+				CN1.Hash(input, 0 /*block_height*/)
+			}
+		})
+	}
+}
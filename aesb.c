@@ -180,6 +180,30 @@ STATIC INLINE void aesb_pseudo_round(const uint8_t *in, uint8_t *out, uint8_t *e
   state_out(out, b0);
 }
 
+// CryptoNight-Heavy tube's AES round: the input is inverted, and every
+// column of the result is xored into the input before the next column is
+// computed
+STATIC INLINE void aesb_single_round_tweak_div(const uint8_t *in, uint8_t *out, uint8_t *expandedKey)
+{
+  uint32_t b0[4], b1[4];
+  const uint32_t  *kp = (uint32_t *) expandedKey;
+  state_in(b0, in);
+  b0[0] = ~b0[0];
+  b0[1] = ~b0[1];
+  b0[2] = ~b0[2];
+  b0[3] = ~b0[3];
+
+  fwd_rnd(b1, b0, kp, 0);
+  b0[0] ^= b1[0];
+  fwd_rnd(b1, b0, kp, 1);
+  b0[1] ^= b1[1];
+  fwd_rnd(b1, b0, kp, 2);
+  b0[2] ^= b1[2];
+  fwd_rnd(b1, b0, kp, 3);
+
+  state_out(out, b1);
+}
+
 
 #if defined(__cplusplus)
 }
@@ -0,0 +1,271 @@
+package cryptonight
+
+/*
+#include <string.h>
+#include "hash-ops.h"
+#include "variant4_random_math.h"
+
+// cgo can't pass an array of Go pointers, so the inputs of
+// cn_slow_hash_multi come packed one after the other
+static int cn_slow_hash_multi_packed(const void *inputs, size_t length, char *hashes, size_t ways, const struct cn_params *params, uint64_t height, const struct V4_Config *v4_config)
+{
+  const void *data[CN_MULTI_MAX];
+  for (size_t i = 0; i < ways && i < CN_MULTI_MAX; ++i)
+    data[i] = (const char *)inputs + i * length;
+  return cn_slow_hash_multi(data, length, hashes, ways, params, height, v4_config);
+}
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// A member of the CryptoNight family. They all share Keccak, the
+// scratchpad explode/implode and the finalizer hashes, and differ in
+// the scratchpad size, the number of main loop iterations, the mask
+// applied to scratchpad addresses and the variant tweaks on top.
+// Hashes of different members are unrelated.
+type Algorithm struct {
+	// Name used by xmrig and most pools, e.g. "cn/2".
+	Name string
+	// Scratchpad size in bytes, a power of 2 of at least 128.
+	Memory int
+	// Main loop iterations, each one reads and writes the scratchpad
+	// twice. Monero's ITER constant counts those reads, so it's twice
+	// this number.
+	Iterations int
+	// Mask applied to scratchpad addresses. Usually (Memory-1) &^ 15,
+	// some members only use part of their scratchpad.
+	Mask uint32
+	// 0, 1, 2 or 4, which variant's tweaks to apply. See
+	// hashCryptonight.
+	Variant int
+	// Which CryptoNight-Heavy tweaks to apply on top of the variant, if
+	// any.
+	Heavy Heavy
+	// Set for members that are only fit for development networks and
+	// tests. ForkSchedule.Validate rejects them.
+	Dev bool
+}
+
+// The CryptoNight-Heavy tweaks. All of them mix the AES blocks into each
+// other while exploding and imploding the scratchpad, and end every
+// main loop iteration with a division that picks the next address.
+type Heavy int
+
+const (
+	HeavyNone Heavy = C.CN_HEAVY_NONE
+	// Sumokoin and Loki's.
+	Heavy0 Heavy = C.CN_HEAVY_0
+	// Haven's, the divisor is inverted before picking the address.
+	HeavyXHV Heavy = C.CN_HEAVY_XHV
+	// BitTube's, on top of variant 1 and with a tweaked AES round in the
+	// main loop.
+	HeavyTube Heavy = C.CN_HEAVY_TUBE
+)
+
+func (heavy Heavy) String() string {
+	switch heavy {
+	case HeavyNone:
+		return "none"
+	case Heavy0:
+		return "heavy"
+	case HeavyXHV:
+		return "xhv"
+	case HeavyTube:
+		return "tube"
+	}
+	return fmt.Sprintf("Heavy(%d)", int(heavy))
+}
+
+// Named members of the family, parameters as in xmrig.
+var (
+	CN0 = Algorithm{Name: "cn/0", Memory: 2 << 20, Iterations: 0x80000, Mask: 0x1FFFF0, Variant: 0}
+	CN1 = Algorithm{Name: "cn/1", Memory: 2 << 20, Iterations: 0x80000, Mask: 0x1FFFF0, Variant: 1}
+	CN2 = Algorithm{Name: "cn/2", Memory: 2 << 20, Iterations: 0x80000, Mask: 0x1FFFF0, Variant: 2}
+	CNR = Algorithm{Name: "cn/r", Memory: 2 << 20, Iterations: 0x80000, Mask: 0x1FFFF0, Variant: 4}
+	// Variant 2 with half the iterations, aka Masari's "fast v2".
+	CNHalf = Algorithm{Name: "cn/half", Memory: 2 << 20, Iterations: 0x40000, Mask: 0x1FFFF0, Variant: 2}
+	// Variant 2 with twice the iterations, aka X-Cash's "heavy x".
+	CNDouble = Algorithm{Name: "cn/double", Memory: 2 << 20, Iterations: 0x100000, Mask: 0x1FFFF0, Variant: 2}
+	// Variant 2 with 3/4 of the iterations, used by Zelerius.
+	CNZLS = Algorithm{Name: "cn/zls", Memory: 2 << 20, Iterations: 0x60000, Mask: 0x1FFFF0, Variant: 2}
+	// Variant 0 with twice the iterations, used by Alloy.
+	CNXAO = Algorithm{Name: "cn/xao", Memory: 2 << 20, Iterations: 0x100000, Mask: 0x1FFFF0, Variant: 0}
+	// 1MB scratchpad, used by Aeon.
+	CNLite0 = Algorithm{Name: "cn-lite/0", Memory: 1 << 20, Iterations: 0x40000, Mask: 0xFFFF0, Variant: 0}
+	CNLite1 = Algorithm{Name: "cn-lite/1", Memory: 1 << 20, Iterations: 0x40000, Mask: 0xFFFF0, Variant: 1}
+	// 256KB scratchpad of which only the first half is addressed,
+	// used by TurtleCoin.
+	CNPico = Algorithm{Name: "cn-pico", Memory: 256 << 10, Iterations: 0x10000, Mask: 0x1FFF0, Variant: 2}
+	// 4MB scratchpad with the CryptoNight-Heavy tweaks.
+	CNHeavy0    = Algorithm{Name: "cn-heavy/0", Memory: 4 << 20, Iterations: 0x40000, Mask: 0x3FFFF0, Variant: 0, Heavy: Heavy0}
+	CNHeavyXHV  = Algorithm{Name: "cn-heavy/xhv", Memory: 4 << 20, Iterations: 0x40000, Mask: 0x3FFFF0, Variant: 0, Heavy: HeavyXHV}
+	CNHeavyTube = Algorithm{Name: "cn-heavy/tube", Memory: 4 << 20, Iterations: 0x40000, Mask: 0x3FFFF0, Variant: 1, Heavy: HeavyTube}
+	// Development mode: variants 1, 2 and 4 unchanged, but with a 16KB
+	// scratchpad and 1/128 of the iterations, so a hash costs about as
+	// much as its Keccak and finalizer. Each scratchpad block is still
+	// visited 8 times on average, as in cn/2. Worthless as a proof of
+	// work, for local devnets and tests only.
+	CNDev1 = Algorithm{Name: "cn-dev/1", Memory: 16 << 10, Iterations: 0x1000, Mask: 0x3FF0, Variant: 1, Dev: true}
+	CNDev2 = Algorithm{Name: "cn-dev/2", Memory: 16 << 10, Iterations: 0x1000, Mask: 0x3FF0, Variant: 2, Dev: true}
+	CNDevR = Algorithm{Name: "cn-dev/r", Memory: 16 << 10, Iterations: 0x1000, Mask: 0x3FF0, Variant: 4, Dev: true}
+)
+
+// Every named algorithm, for lookups by name.
+var Algorithms = []Algorithm{CN0, CN1, CN2, CNR, CNHalf, CNDouble, CNZLS, CNXAO, CNLite0, CNLite1, CNPico, CNHeavy0, CNHeavyXHV, CNHeavyTube, CNDev1, CNDev2, CNDevR}
+
+// Returns the named algorithm with the given name, as listed in
+// Algorithms.
+func LookupAlgorithm(name string) (Algorithm, error) {
+	for _, algorithm := range Algorithms {
+		if algorithm.Name == name {
+			return algorithm, nil
+		}
+	}
+	return Algorithm{}, fmt.Errorf("cryptonight: unknown algorithm %q", name)
+}
+
+func (algorithm Algorithm) String() string {
+	return algorithm.Name
+}
+
+// Checks that the parameters are usable by the C implementation.
+func (algorithm Algorithm) Validate() error {
+	if algorithm.Memory < 128 || algorithm.Memory&(algorithm.Memory-1) != 0 {
+		return fmt.Errorf("cryptonight: %s: scratchpad size %d isn't a power of 2 of at least 128", algorithm.Name, algorithm.Memory)
+	}
+	if algorithm.Iterations <= 0 {
+		return fmt.Errorf("cryptonight: %s: needs at least one iteration", algorithm.Name)
+	}
+	// Variant 2 touches the whole 64 byte line around an address.
+	if algorithm.Mask&15 != 0 || int64(algorithm.Mask|63) >= int64(algorithm.Memory) {
+		return fmt.Errorf("cryptonight: %s: mask %#x doesn't fit a %d byte scratchpad", algorithm.Name, algorithm.Mask, algorithm.Memory)
+	}
+	switch algorithm.Variant {
+	case 0, 1, 2, 4:
+	default:
+		return fmt.Errorf("cryptonight: %s: unsupported variant %d", algorithm.Name, algorithm.Variant)
+	}
+	switch algorithm.Heavy {
+	case HeavyNone, Heavy0, HeavyXHV:
+	case HeavyTube:
+		// The tweaked AES round replaces variant 1's, there's nothing
+		// to tweak in the others.
+		if algorithm.Variant != 1 {
+			return fmt.Errorf("cryptonight: %s: the tube tweaks need variant 1", algorithm.Name)
+		}
+	default:
+		return fmt.Errorf("cryptonight: %s: unsupported heavy tweaks %d", algorithm.Name, int(algorithm.Heavy))
+	}
+	return nil
+}
+
+var errShortInput = errors.New("cryptonight: variant 1 needs at least 43 bytes of input")
+
+// Hashes input with the algorithm. block_height only matters for
+// variant 4. Panics if the algorithm is invalid, if it's variant 1 and
+// the input is shorter than 43 bytes (the C code would abort the
+// process), or if there's no memory for the scratchpad.
+func (algorithm Algorithm) Hash(input []byte, block_height uint64) []byte {
+	return (*Hasher)(nil).HashAlgorithm(algorithm, input, block_height)
+}
+
+// Same as Algorithm.Hash, but variant 4 uses the Hasher's program
+// generator settings.
+func (h *Hasher) HashAlgorithm(algorithm Algorithm, input []byte, block_height uint64) []byte {
+	if err := algorithm.Validate(); err != nil {
+		panic(err)
+	}
+	if algorithm.Variant == 1 && len(input) < 43 {
+		panic(errShortInput)
+	}
+	var v4_config *C.struct_V4_Config
+	if h != nil {
+		v4_config = &h.c_v4_config
+	}
+	result, err := hashCryptonightWithParams(context.Background(), input, algorithm.toC(), block_height, v4_config)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+func (algorithm Algorithm) toC() C.struct_cn_params {
+	return C.struct_cn_params{
+		memory:     C.size_t(algorithm.Memory),
+		iterations: C.size_t(algorithm.Iterations),
+		mask:       C.uint32_t(algorithm.Mask),
+		variant:    C.int(algorithm.Variant),
+		heavy:      C.int(algorithm.Heavy),
+	}
+}
+
+// Fails if ctx ends while waiting for a scratchpad (see
+// SetScratchpadLimit), or if there's no memory for it.
+func hashCryptonightWithParams(ctx context.Context, input []byte, params C.struct_cn_params, block_height uint64, v4_config *C.struct_V4_Config) ([]byte, error) {
+	result := make([]byte, 32)
+	var input_ptr unsafe.Pointer
+	if len(input) > 0 {
+		input_ptr = unsafe.Pointer(&input[0])
+	}
+	output_ptr := unsafe.Pointer(&result[0])
+	var ret C.int
+	err := withScratchpad(ctx, func() {
+		ret = C.cn_slow_hash_params(input_ptr, C.size_t(len(input)), (*C.char)(output_ptr), &params, 0 /*prehashed*/, (C.uint64_t)(block_height), v4_config)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ret != 0 {
+		return nil, errScratchpadAlloc
+	}
+	return result, nil
+}
+
+// The error of a cn_slow_hash_multi return value, nil for 0.
+func multiHashError(ret C.int) error {
+	switch ret {
+	case 0:
+		return nil
+	case C.CN_INVALID_WAYS:
+		return fmt.Errorf("cryptonight: ways must be 1 to %d", MaxMultiHashWays)
+	case C.CN_SHORT_INPUT:
+		return errShortInput
+	default:
+		return errScratchpadAlloc
+	}
+}
+
+// Hashes inputs, all of the same length and at most MaxMultiHashWays
+// of them, with cn_slow_hash_multi, as many at a time as the
+// scratchpad limit allows: it allocates a scratchpad per way. Fails if
+// cn_slow_hash_multi rejects the inputs, or if there's no memory for
+// the scratchpads.
+func hashCryptonightMultiWithParams(inputs [][]byte, params C.struct_cn_params, block_height uint64, v4_config *C.struct_V4_Config) ([][]byte, error) {
+	length := len(inputs[0])
+	packed := make([]byte, 0, len(inputs)*length)
+	for _, input := range inputs {
+		packed = append(packed, input...)
+	}
+	output := make([]byte, len(inputs)*32)
+	var err error
+	for done := 0; done < len(inputs) && err == nil; {
+		withScratchpadsUpTo(context.Background(), len(inputs)-done, func(ways int) {
+			ret := C.cn_slow_hash_multi_packed(unsafe.Pointer(&packed[done*length]), C.size_t(length), (*C.char)(unsafe.Pointer(&output[done*32])), C.size_t(ways), &params, (C.uint64_t)(block_height), v4_config)
+			err = multiHashError(ret)
+			done += ways
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]byte, len(inputs))
+	for i := range results {
+		results[i] = output[i*32 : (i+1)*32 : (i+1)*32]
+	}
+	return results, nil
+}
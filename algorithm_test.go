@@ -0,0 +1,114 @@
+package cryptonight
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestAlgorithmHash(t *testing.T) {
+	// The first input of xmrig's test set, src/crypto/cn/CryptoNight_test.h.
+	// The expected hashes of the named members are the first 32 bytes of
+	// xmrig's test_output_v0, v1, v2, half, double, zls, xao, v0_lite,
+	// v1_lite, pico_trtl, v0_heavy, xhv_heavy and tube_heavy. The cn-dev
+	// members have no external vectors: their expected hashes are
+	// regression values computed with this implementation.
+	input := hexutil.MustDecode("0x0305a0dbd6bf05cf16e503f3a66f78007cbf34144332ecbfc22ed95c8700383b309ace1923a0964b00000008ba939a62724c0d7581fce5761e9d8a0e6a1c3f924fdd8493d1115649c05eb601")
+	cases := []struct {
+		algorithm     Algorithm
+		expected_hash string
+	}{
+		{CN0, "0x1a3ffbee909b420d91f7be6e5fb56db71b3110d886011e877ee5786afd080100"},
+		{CN1, "0xf22d3d6203d2a08b41d9027278d8bcc983acada9b68e52e3c689692a50e921d9"},
+		{CN2, "0x97378282cf10e7ad033f7b8074c40e14d06e7f609dddda787680b58c05f43d21"},
+		{CNHalf, "0x5d4fbc356097ea6440b0888edeb635ddc84a0e397c868456895c3f29be7312a7"},
+		{CNDouble, "0xaefbb3f0cc88046d119f6c54b96d90c9e884ea3b5983a60d50a42d7d3ebe4821"},
+		{CNZLS, "0x516e33c6e446abbccdad18c04cd9a25e64102853b20a42dfdeaa8b599ecf40e2"},
+		{CNXAO, "0x9a29d0c4afdc639b6553b1c83735114c5d77162142975cb850c0a51f6407bd33"},
+		{CNLite0, "0x3695b4b53bb00358b0ad38dc160feb9e004eece09b83a72ef6ba9864d3510c88"},
+		{CNLite1, "0x6d8cdc444e9bbbfd68fc43fcd4855b228c8a1bd91d9d00285bec02b7ca2d6741"},
+		{CNPico, "0x08f421d7833117300eda66e98f4a2569093df300500173944efc401e9a4a17af"},
+		{CNHeavy0, "0x9983f21bdf2010a8d707bb2f14d78664bbe1187f55014b39e5f3d69328e48fc2"},
+		{CNHeavyXHV, "0x5ac3f785c490c58550ec95d2726563577e7c1c212d0cde591273201e44fdd5b6"},
+		{CNHeavyTube, "0xfe53352076eae689fa3b4fda614634cfc312ee0c387df2b8b74da2a159741235"},
+		{CNDev1, "0x011a8cdc4ca7090666168c71da8194615004ae13c7d0b924c7d6c4ad7ad3f464"},
+		{CNDev2, "0x59465142b92273d48b44e9c93431a2f015dd4a07d63292cbe246c4162eb7e754"},
+		{CNDevR, "0x9be9c3a9ece9226c4956ad6e463e90cc054ede7a2d4851a6d06efe865c9ded33"},
+	}
+	for _, c := range cases {
+		expected_hash := hexutil.MustDecode(c.expected_hash)
+		actual_hash := c.algorithm.Hash(input, 1806260 /*block_height*/)
+		if !bytes.Equal(actual_hash, expected_hash) {
+			t.Error(c.algorithm, ": unexpected result ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+		}
+	}
+
+	// From Monero's tests-slow.txt.
+	input = hexutil.MustDecode("0x6465206f6d6e69627573206475626974616e64756d")
+	expected_hash := hexutil.MustDecode("0x2f8e3df40bd11f9ac90c743ca8e32bb391da4fb98612aa3b6cdc639ee00b31f5")
+	actual_hash := CN0.Hash(input, 0 /*block_height*/)
+	if !bytes.Equal(actual_hash, expected_hash) {
+		t.Error("Unexpected result: ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+	}
+
+	// From Monero's tests-slow-4.txt, see TestHashVariant4.
+	input = hexutil.MustDecode("0x5468697320697320612074657374205468697320697320612074657374205468697320697320612074657374")
+	expected_hash = hexutil.MustDecode("0xf759588ad57e758467295443a9bd71490abff8e9dad1b95b6bf2f5d0d78387bc")
+	actual_hash = CNR.Hash(input, 1806260 /*block_height*/)
+	if !bytes.Equal(actual_hash, expected_hash) {
+		t.Error("Unexpected result: ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+	}
+}
+
+func TestAlgorithmMatchesVariants(t *testing.T) {
+	input := hexutil.MustDecode("0x8519e039172b0d70e5ca7b3383d6b3167315a422747b73f019cf9528f0fde341fd0f2a63030ba6450525cf6de31837669af6f1df8131faf50aaab8d3a7405589")
+	if !bytes.Equal(CN1.Hash(input, 0), hashVariant1(input)) {
+		t.Error("cn/1 differs from variant 1")
+	}
+	if !bytes.Equal(CN2.Hash(input, 0), hashVariant2(input)) {
+		t.Error("cn/2 differs from variant 2")
+	}
+	if !bytes.Equal(CNR.Hash(input, 1806261), hashVariant4(input, 1806261)) {
+		t.Error("cn/r differs from variant 4")
+	}
+	hasher, err := NewHasher(DefaultV4Config)
+	if err != nil {
+		t.Fatal("Config rejected: ", err)
+	}
+	if !bytes.Equal(hasher.HashAlgorithm(CNR, input, 1806261), hashVariant4(input, 1806261)) {
+		t.Error("Hasher's cn/r differs from variant 4")
+	}
+}
+
+func TestAlgorithmValidate(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		if err := algorithm.Validate(); err != nil {
+			t.Error(err)
+		}
+		found, err := LookupAlgorithm(algorithm.Name)
+		if err != nil || found != algorithm {
+			t.Error(algorithm, ": lookup returned ", found, ", ", err)
+		}
+	}
+	if _, err := LookupAlgorithm("cn/3"); err == nil {
+		t.Error("Unknown algorithm found")
+	}
+
+	invalid := []Algorithm{
+		{Name: "small", Memory: 64, Iterations: 1, Mask: 0x30},
+		{Name: "odd", Memory: 3 << 20, Iterations: 0x80000, Mask: 0x1FFFF0},
+		{Name: "lazy", Memory: 2 << 20, Iterations: 0, Mask: 0x1FFFF0},
+		{Name: "unaligned", Memory: 2 << 20, Iterations: 0x80000, Mask: 0x1FFFF8},
+		{Name: "outside", Memory: 1 << 20, Iterations: 0x80000, Mask: 0x1FFFF0},
+		{Name: "v3", Memory: 2 << 20, Iterations: 0x80000, Mask: 0x1FFFF0, Variant: 3},
+		{Name: "tube2", Memory: 4 << 20, Iterations: 0x40000, Mask: 0x3FFFF0, Variant: 2, Heavy: HeavyTube},
+		{Name: "heavier", Memory: 4 << 20, Iterations: 0x40000, Mask: 0x3FFFF0, Heavy: 4},
+	}
+	for _, algorithm := range invalid {
+		if err := algorithm.Validate(); err == nil {
+			t.Error(algorithm, ": accepted")
+		}
+	}
+}
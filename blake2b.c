@@ -0,0 +1,234 @@
+// BLAKE2b as specified by RFC 7693, for RandomX and its Argon2d cache.
+
+#include <string.h>
+
+#include "blake2b.h"
+
+static const uint64_t blake2b_IV[8] = {
+  0x6a09e667f3bcc908ULL, 0xbb67ae8584caa73bULL,
+  0x3c6ef372fe94f82bULL, 0xa54ff53a5f1d36f1ULL,
+  0x510e527fade682d1ULL, 0x9b05688c2b3e6c1fULL,
+  0x1f83d9abfb41bd6bULL, 0x5be0cd19137e2179ULL
+};
+
+static const uint8_t blake2b_sigma[12][16] = {
+  {  0,  1,  2,  3,  4,  5,  6,  7,  8,  9, 10, 11, 12, 13, 14, 15 },
+  { 14, 10,  4,  8,  9, 15, 13,  6,  1, 12,  0,  2, 11,  7,  5,  3 },
+  { 11,  8, 12,  0,  5,  2, 15, 13, 10, 14,  3,  6,  7,  1,  9,  4 },
+  {  7,  9,  3,  1, 13, 12, 11, 14,  2,  6,  5, 10,  4,  0, 15,  8 },
+  {  9,  0,  5,  7,  2,  4, 10, 15, 14,  1, 11, 12,  6,  8,  3, 13 },
+  {  2, 12,  6, 10,  0, 11,  8,  3,  4, 13,  7,  5, 15, 14,  1,  9 },
+  { 12,  5,  1, 15, 14, 13,  4, 10,  0,  7,  6,  3,  9,  2,  8, 11 },
+  { 13, 11,  7, 14, 12,  1,  3,  9,  5,  0, 15,  4,  8,  6,  2, 10 },
+  {  6, 15, 14,  9, 11,  3,  0,  8, 12,  2, 13,  7,  1,  4, 10,  5 },
+  { 10,  2,  8,  4,  7,  6,  1,  5, 15, 11,  9, 14,  3, 12, 13,  0 },
+  {  0,  1,  2,  3,  4,  5,  6,  7,  8,  9, 10, 11, 12, 13, 14, 15 },
+  { 14, 10,  4,  8,  9, 15, 13,  6,  1, 12,  0,  2, 11,  7,  5,  3 }
+};
+
+static inline uint64_t load64_le(const uint8_t *p)
+{
+  return (uint64_t)p[0] | ((uint64_t)p[1] << 8) | ((uint64_t)p[2] << 16) | ((uint64_t)p[3] << 24) |
+    ((uint64_t)p[4] << 32) | ((uint64_t)p[5] << 40) | ((uint64_t)p[6] << 48) | ((uint64_t)p[7] << 56);
+}
+
+static inline void store64_le(uint8_t *p, uint64_t v)
+{
+  for (int i = 0; i < 8; ++i)
+    p[i] = (uint8_t)(v >> (8 * i));
+}
+
+static inline void store32_le(uint8_t *p, uint32_t v)
+{
+  for (int i = 0; i < 4; ++i)
+    p[i] = (uint8_t)(v >> (8 * i));
+}
+
+static inline uint64_t rotr64(uint64_t x, unsigned n)
+{
+  return (x >> n) | (x << (64 - n));
+}
+
+#define G(r, i, a, b, c, d) \
+  do { \
+    a = a + b + m[blake2b_sigma[r][2 * i + 0]]; \
+    d = rotr64(d ^ a, 32); \
+    c = c + d; \
+    b = rotr64(b ^ c, 24); \
+    a = a + b + m[blake2b_sigma[r][2 * i + 1]]; \
+    d = rotr64(d ^ a, 16); \
+    c = c + d; \
+    b = rotr64(b ^ c, 63); \
+  } while (0)
+
+static void blake2b_compress(blake2b_state *S, const uint8_t *block, int last)
+{
+  uint64_t m[16];
+  uint64_t v[16];
+
+  for (int i = 0; i < 16; ++i)
+    m[i] = load64_le(block + 8 * i);
+  for (int i = 0; i < 8; ++i) {
+    v[i] = S->h[i];
+    v[i + 8] = blake2b_IV[i];
+  }
+  v[12] ^= S->t[0];
+  v[13] ^= S->t[1];
+  if (last)
+    v[14] = ~v[14];
+
+  for (int r = 0; r < 12; ++r) {
+    G(r, 0, v[0], v[4], v[8], v[12]);
+    G(r, 1, v[1], v[5], v[9], v[13]);
+    G(r, 2, v[2], v[6], v[10], v[14]);
+    G(r, 3, v[3], v[7], v[11], v[15]);
+    G(r, 4, v[0], v[5], v[10], v[15]);
+    G(r, 5, v[1], v[6], v[11], v[12]);
+    G(r, 6, v[2], v[7], v[8], v[13]);
+    G(r, 7, v[3], v[4], v[9], v[14]);
+  }
+
+  for (int i = 0; i < 8; ++i)
+    S->h[i] ^= v[i] ^ v[i + 8];
+}
+
+#undef G
+
+static void blake2b_increment_counter(blake2b_state *S, uint64_t inc)
+{
+  S->t[0] += inc;
+  S->t[1] += (S->t[0] < inc);
+}
+
+int blake2b_init_key(blake2b_state *S, size_t outlen, const void *key, size_t keylen)
+{
+  if (outlen == 0 || outlen > BLAKE2B_OUTBYTES || keylen > BLAKE2B_KEYBYTES || (key == NULL && keylen > 0))
+    return -1;
+
+  memset(S, 0, sizeof(*S));
+  memcpy(S->h, blake2b_IV, sizeof(S->h));
+  // Parameter block: digest length, key length, fanout 1, depth 1
+  S->h[0] ^= 0x01010000ULL ^ ((uint64_t)keylen << 8) ^ (uint64_t)outlen;
+  S->outlen = outlen;
+
+  if (keylen > 0) {
+    uint8_t block[BLAKE2B_BLOCKBYTES];
+    memset(block, 0, sizeof(block));
+    memcpy(block, key, keylen);
+    blake2b_update(S, block, sizeof(block));
+    memset(block, 0, sizeof(block));
+  }
+  return 0;
+}
+
+int blake2b_init(blake2b_state *S, size_t outlen)
+{
+  return blake2b_init_key(S, outlen, NULL, 0);
+}
+
+int blake2b_update(blake2b_state *S, const void *in, size_t inlen)
+{
+  const uint8_t *pin = (const uint8_t *)in;
+
+  if (inlen == 0)
+    return 0;
+  if (pin == NULL)
+    return -1;
+
+  // The last block is only compressed in blake2b_final, so a full buffer
+  // is kept until more data arrives
+  if (S->buflen + inlen > BLAKE2B_BLOCKBYTES) {
+    size_t fill = BLAKE2B_BLOCKBYTES - S->buflen;
+    memcpy(S->buf + S->buflen, pin, fill);
+    blake2b_increment_counter(S, BLAKE2B_BLOCKBYTES);
+    blake2b_compress(S, S->buf, 0);
+    S->buflen = 0;
+    pin += fill;
+    inlen -= fill;
+    while (inlen > BLAKE2B_BLOCKBYTES) {
+      blake2b_increment_counter(S, BLAKE2B_BLOCKBYTES);
+      blake2b_compress(S, pin, 0);
+      pin += BLAKE2B_BLOCKBYTES;
+      inlen -= BLAKE2B_BLOCKBYTES;
+    }
+  }
+  memcpy(S->buf + S->buflen, pin, inlen);
+  S->buflen += inlen;
+  return 0;
+}
+
+int blake2b_final(blake2b_state *S, void *out, size_t outlen)
+{
+  uint8_t buffer[BLAKE2B_OUTBYTES];
+
+  if (out == NULL || outlen < S->outlen)
+    return -1;
+
+  blake2b_increment_counter(S, S->buflen);
+  memset(S->buf + S->buflen, 0, BLAKE2B_BLOCKBYTES - S->buflen);
+  blake2b_compress(S, S->buf, 1);
+
+  for (int i = 0; i < 8; ++i)
+    store64_le(buffer + 8 * i, S->h[i]);
+  memcpy(out, buffer, S->outlen);
+  memset(buffer, 0, sizeof(buffer));
+  return 0;
+}
+
+int blake2b(void *out, size_t outlen, const void *in, size_t inlen, const void *key, size_t keylen)
+{
+  blake2b_state S;
+
+  if ((in == NULL && inlen > 0) || out == NULL)
+    return -1;
+  if (blake2b_init_key(&S, outlen, key, keylen) < 0)
+    return -1;
+  blake2b_update(&S, in, inlen);
+  return blake2b_final(&S, out, outlen);
+}
+
+int blake2b_long(void *pout, size_t outlen, const void *in, size_t inlen)
+{
+  uint8_t *out = (uint8_t *)pout;
+  uint8_t outlen_bytes[4];
+  blake2b_state S;
+
+  if (outlen == 0 || outlen > 0xFFFFFFFFUL)
+    return -1;
+  store32_le(outlen_bytes, (uint32_t)outlen);
+
+  if (outlen <= BLAKE2B_OUTBYTES) {
+    if (blake2b_init(&S, outlen) < 0)
+      return -1;
+    blake2b_update(&S, outlen_bytes, sizeof(outlen_bytes));
+    blake2b_update(&S, in, inlen);
+    return blake2b_final(&S, out, outlen);
+  }
+
+  // V1 = H(LE32(outlen) || in), then Vi = H(Vi-1); the output is the first
+  // half of every V and all of the last one, which is only as long as needed
+  uint8_t out_buffer[BLAKE2B_OUTBYTES];
+  uint8_t in_buffer[BLAKE2B_OUTBYTES];
+  size_t toproduce;
+
+  blake2b_init(&S, BLAKE2B_OUTBYTES);
+  blake2b_update(&S, outlen_bytes, sizeof(outlen_bytes));
+  blake2b_update(&S, in, inlen);
+  blake2b_final(&S, out_buffer, BLAKE2B_OUTBYTES);
+  memcpy(out, out_buffer, BLAKE2B_OUTBYTES / 2);
+  out += BLAKE2B_OUTBYTES / 2;
+  toproduce = outlen - BLAKE2B_OUTBYTES / 2;
+
+  while (toproduce > BLAKE2B_OUTBYTES) {
+    memcpy(in_buffer, out_buffer, BLAKE2B_OUTBYTES);
+    blake2b(out_buffer, BLAKE2B_OUTBYTES, in_buffer, BLAKE2B_OUTBYTES, NULL, 0);
+    memcpy(out, out_buffer, BLAKE2B_OUTBYTES / 2);
+    out += BLAKE2B_OUTBYTES / 2;
+    toproduce -= BLAKE2B_OUTBYTES / 2;
+  }
+
+  memcpy(in_buffer, out_buffer, BLAKE2B_OUTBYTES);
+  blake2b(out_buffer, toproduce, in_buffer, BLAKE2B_OUTBYTES, NULL, 0);
+  memcpy(out, out_buffer, toproduce);
+  return 0;
+}
@@ -0,0 +1,30 @@
+// BLAKE2b as specified by RFC 7693, for RandomX and its Argon2d cache.
+
+#pragma once
+
+#include <stddef.h>
+#include <stdint.h>
+
+enum {
+  BLAKE2B_BLOCKBYTES = 128,
+  BLAKE2B_OUTBYTES = 64,
+  BLAKE2B_KEYBYTES = 64
+};
+
+typedef struct blake2b_state {
+  uint64_t h[8];
+  uint64_t t[2];
+  uint8_t buf[BLAKE2B_BLOCKBYTES];
+  size_t buflen;
+  size_t outlen;
+} blake2b_state;
+
+// All of these return 0 on success and -1 if a length is out of range
+int blake2b_init(blake2b_state *S, size_t outlen);
+int blake2b_init_key(blake2b_state *S, size_t outlen, const void *key, size_t keylen);
+int blake2b_update(blake2b_state *S, const void *in, size_t inlen);
+int blake2b_final(blake2b_state *S, void *out, size_t outlen);
+int blake2b(void *out, size_t outlen, const void *in, size_t inlen, const void *key, size_t keylen);
+
+// Argon2's variable length hash H', any outlen of at least 1 byte
+int blake2b_long(void *out, size_t outlen, const void *in, size_t inlen);
@@ -0,0 +1,165 @@
+// Command cnminer mines our chain on the CPU, from a node's getwork
+// endpoint or from a Stratum pool:
+//
+//	cnminer -getwork http://127.0.0.1:8545
+//	cnminer -stratum 127.0.0.1:3333 -user wallet
+//
+// Every thread hashes its share of the nonce range with the work's
+// algorithm, which for CryptonightR is HashVariant4ForEthereumHeader,
+// and the hashrate and accepted and rejected counts are printed
+// periodically.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"time"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"github.com/MarconiProtocol/marconi-cryptonight/getwork"
+	"github.com/MarconiProtocol/marconi-cryptonight/internal/mining"
+	"github.com/MarconiProtocol/marconi-cryptonight/stratum"
+)
+
+func main() {
+	getwork_url := flag.String("getwork", "", "URL of the node's getwork endpoint, e.g. http://127.0.0.1:8545")
+	pools := flag.String("stratum", "", "Stratum pools, host:port, comma separated")
+	user := flag.String("user", "", "Stratum login")
+	pass := flag.String("pass", "x", "Stratum password")
+	threads := flag.Int("threads", runtime.NumCPU(), "hashing threads")
+	first_nonce := flag.Uint64("nonce-first", 0, "first nonce searched")
+	last_nonce := flag.Uint64("nonce-last", 0, "last nonce searched, 0 for the last one (Stratum nonces are 4 bytes)")
+	algo := flag.String("algo", "", "hash with this algorithm instead of the work's, e.g. cn/r")
+	interval := flag.Duration("interval", 10*time.Second, "interval of hashrate reports")
+	flag.Parse()
+
+	if (*getwork_url == "") == (*pools == "") {
+		fmt.Fprintln(os.Stderr, "cnminer: exactly one of -getwork and -stratum is needed")
+		flag.Usage()
+		os.Exit(2)
+	}
+	var algorithm cryptonight.Algorithm
+	if *algo != "" {
+		var err error
+		if algorithm, err = cryptonight.LookupAlgorithm(*algo); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var get_stats func() mining.Stats
+	var err error
+	if *getwork_url != "" {
+		get_stats, err = startGetwork(ctx, *getwork_url, getwork.WorkerConfig{
+			Threads:    *threads,
+			Algorithm:  algorithm,
+			FirstNonce: *first_nonce,
+			LastNonce:  *last_nonce,
+		})
+	} else {
+		if *first_nonce > math.MaxUint32 || *last_nonce > math.MaxUint32 {
+			log.Fatal("cnminer: Stratum nonces are 4 bytes")
+		}
+		client_config := stratum.ClientConfig{Pools: strings.Split(*pools, ","), Login: *user, Pass: *pass, Agent: "cnminer"}
+		if *algo != "" {
+			client_config.Algo = []string{*algo}
+		}
+		get_stats, err = startStratum(ctx, client_config, stratum.WorkerConfig{
+			Threads:    *threads,
+			Algorithm:  algorithm,
+			FirstNonce: uint32(*first_nonce),
+			LastNonce:  uint32(*last_nonce),
+		})
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Mining with %d threads", *threads)
+	report(ctx, *interval, get_stats)
+}
+
+// Starts mining from a getwork endpoint, returns the statistics.
+func startGetwork(ctx context.Context, url string, config getwork.WorkerConfig) (func() mining.Stats, error) {
+	client, err := getwork.NewClient(getwork.ClientConfig{URL: url})
+	if err != nil {
+		return nil, err
+	}
+	worker, err := getwork.NewWorker(client, config)
+	if err != nil {
+		return nil, err
+	}
+	go client.Run(ctx)
+	go worker.Run(ctx)
+	go func() {
+		for ctx.Err() == nil {
+			work, changed := client.CurrentWork()
+			if work == nil {
+				log.Printf("Waiting for work from %s", url)
+			} else {
+				log.Printf("New work %#x at height %d, %s, difficulty %s", work.HeaderHash, work.Height, work.Algorithm, cryptonight.TargetToDifficulty(work.Target))
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return worker.Stats, nil
+}
+
+// Starts mining from Stratum pools, returns the statistics.
+func startStratum(ctx context.Context, client_config stratum.ClientConfig, config stratum.WorkerConfig) (func() mining.Stats, error) {
+	client, err := stratum.NewClient(client_config)
+	if err != nil {
+		return nil, err
+	}
+	worker, err := stratum.NewWorker(client, config)
+	if err != nil {
+		return nil, err
+	}
+	go client.Run(ctx)
+	go worker.Run(ctx)
+	go func() {
+		for ctx.Err() == nil {
+			job, changed := client.CurrentJob()
+			if job == nil {
+				log.Printf("Connecting to %s", strings.Join(client_config.Pools, ", "))
+			} else {
+				log.Printf("New job %s from %s at height %d, %s, target %s", job.JobID, job.Pool, job.Height, job.Algorithm, job.Target)
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return worker.Stats, nil
+}
+
+// Prints the hashrate and counts every interval, until ctx ends.
+func report(ctx context.Context, interval time.Duration, get_stats func() mining.Stats) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last, last_time := get_stats(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			current := get_stats()
+			log.Printf("Done: %d hashes, %d accepted, %d rejected, %d stale", current.Hashes, current.Accepted, current.Rejected, current.Stale)
+			return
+		case now := <-ticker.C:
+			current := get_stats()
+			hashrate := float64(current.Hashes-last.Hashes) / now.Sub(last_time).Seconds()
+			log.Printf("%.1f H/s, %d accepted, %d rejected, %d stale", hashrate, current.Accepted, current.Rejected, current.Stale)
+			last, last_time = current, now
+		}
+	}
+}
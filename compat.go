@@ -0,0 +1,46 @@
+package cryptonight
+
+// Monero miner compatibility mode.
+//
+// Monero miners (xmrig, xmr-stak and their GPU cousins) get a blob
+// from the pool and only write a 4 byte nonce at offset 39, leaving
+// the rest of the blob untouched. In our blob (see ethereumHeaderBlob)
+// the nonce is 8 bytes, from offset 39 to 46, little endian. So when
+// such a miner mines a job:
+//
+// - the upper 4 bytes of the nonce, blob bytes 43 to 46, are an
+//   extranonce which comes with the job, and which the pool makes
+//   different for every miner so that they don't search the same
+//   nonces;
+// - the miner iterates the lower 4 bytes, blob bytes 39 to 42.
+//
+// The full nonce is JoinNonce(extranonce, miner_nonce), and hashing it
+// with HashAlgorithmForEthereumHeader (or HashVariant4ForEthereumHeader
+// for CryptonightR) gives the very digest the miner computed.
+// HashAlgorithmForEthereumJob does the same from the two halves.
+
+// Returns the 8 byte nonce a Monero miner hashes when it writes
+// miner_nonce into a job whose blob has the given extranonce.
+func JoinNonce(extranonce uint32, miner_nonce uint32) uint64 {
+	return uint64(extranonce)<<32 | uint64(miner_nonce)
+}
+
+// Splits an 8 byte nonce into the extranonce of the job and the nonce
+// the miner iterated, the inverse of JoinNonce.
+func SplitNonce(nonce uint64) (uint32, uint32) {
+	return uint32(nonce >> 32), uint32(nonce)
+}
+
+// Returns the blob of a job for Monero miners: the blob of the header
+// with the extranonce in bytes 43 to 46, and zeroes where miners write
+// their nonce.
+func EthereumJobBlob(algorithm Algorithm, block_header_hash []byte, extranonce uint32) []byte {
+	return EthereumHeaderBlob(algorithm, block_header_hash, JoinNonce(extranonce, 0))
+}
+
+// Same as HashAlgorithmForEthereumHeader with the nonce
+// JoinNonce(extranonce, miner_nonce): the digest and result a Monero
+// miner gets for miner_nonce in a job with the given extranonce.
+func HashAlgorithmForEthereumJob(algorithm Algorithm, block_header_hash []byte, extranonce uint32, miner_nonce uint32, block_height uint64) ([]byte, []byte) {
+	return HashAlgorithmForEthereumHeader(algorithm, block_header_hash, JoinNonce(extranonce, miner_nonce), block_height)
+}
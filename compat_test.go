@@ -0,0 +1,56 @@
+package cryptonight
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+// The cases of TestHashVariant{1,2,4}ForEthereum, as jobs for Monero
+// miners: the nonce 0xc526c0a1000008dc is the extranonce 0xc526c0a1
+// of the job and the miner's nonce 0x000008dc.
+var compatVectors = []struct {
+	algorithm    Algorithm
+	block_height uint64
+	job_blob     string
+	digest       string
+}{
+	{CN1, 0, "0x07000000000000b34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db800000000a1c026c57777777777777777777777777777777777777777777777777777777777", "0x834d72ab9e78b9a60808b9a49866c6a452826f11eb4a8d3ac4b49c0faf740100"},
+	{CN2, 0, "0x08000000000000b34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db800000000a1c026c57777777777777777777777777777777777777777777777777777777777", "0xa0e217e26c0c5c409a9e7119a8a7b1c4faa5886a2c101116548ab323f11bc4c2"},
+	{CNR, 8111222, "0x0a000000000000b34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db800000000a1c026c57777777777777777777777777777777777777777777777777777777777", "0x1621e81c0910c8167e2c37da637e212e24dd6882f1e9c0e043d6eff0d284a2b8"},
+}
+
+func TestMoneroMinerCompatibility(t *testing.T) {
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var extranonce uint32 = 0xc526c0a1
+	var miner_nonce uint32 = 0x000008dc
+	if nonce := JoinNonce(extranonce, miner_nonce); nonce != 0xc526c0a1000008dc {
+		t.Error("Unexpected nonce: ", nonce, " versus ", uint64(0xc526c0a1000008dc))
+	}
+	if high, low := SplitNonce(0xc526c0a1000008dc); high != extranonce || low != miner_nonce {
+		t.Error("Unexpected split: ", high, " ", low, " versus ", extranonce, " ", miner_nonce)
+	}
+	for _, vector := range compatVectors {
+		job_blob := hexutil.MustDecode(vector.job_blob)
+		expected_digest := hexutil.MustDecode(vector.digest)
+		if blob := EthereumJobBlob(vector.algorithm, block_header_bytes, extranonce); !bytes.Equal(blob, job_blob) {
+			t.Error(vector.algorithm, ": unexpected job blob: ", hex.EncodeToString(blob))
+		}
+
+		// What a Monero miner does with the job: write its 4 byte
+		// nonce at offset 39 and hash the blob.
+		miner_blob := append([]byte(nil), job_blob...)
+		binary.LittleEndian.PutUint32(miner_blob[39:], miner_nonce)
+		if digest := vector.algorithm.Hash(miner_blob, vector.block_height); !bytes.Equal(digest, expected_digest) {
+			t.Error(vector.algorithm, ": unexpected miner digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+		}
+
+		digest, result := HashAlgorithmForEthereumJob(vector.algorithm, block_header_bytes, extranonce, miner_nonce, vector.block_height)
+		if !bytes.Equal(digest, expected_digest) || !bytes.Equal(result, littleEndianResult(expected_digest)) {
+			t.Error(vector.algorithm, ": unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+		}
+	}
+}
@@ -3,6 +3,7 @@ package cryptonight
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"testing"
 
 	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
@@ -287,3 +288,61 @@ func TestHashVariant4ForEthereum(t *testing.T) {
 		t.Error("Unexpected result: ", hex.EncodeToString(result), " versus ", hex.EncodeToString(expected_result))
 	}
 }
+
+func TestHashForEthereumHeaderMulti(t *testing.T) {
+	var block_header_bytes []byte = hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var nonce uint64 = 0xc526c0a1000008dc
+	// Every lane must match the single hash of its nonce, whatever the
+	// number of lanes.
+	for _, algorithm := range []Algorithm{CN1, CN2, CNR, CNHeavyTube, CNDevR} {
+		for ways := 1; ways <= MaxMultiHashWays; ways++ {
+			digests, results := HashAlgorithmForEthereumHeaderMulti(algorithm, block_header_bytes, nonce, ways, 8111222 /*block_height*/)
+			if len(digests) != ways || len(results) != ways {
+				t.Fatal(algorithm, ": ", len(digests), " digests for ", ways, " ways")
+			}
+			for i := 0; i < ways; i++ {
+				expected_digest, expected_result := HashAlgorithmForEthereumHeader(algorithm, block_header_bytes, nonce+uint64(i), 8111222 /*block_height*/)
+				if !bytes.Equal(digests[i], expected_digest) {
+					t.Error(algorithm, ", lane ", i, " of ", ways, ": unexpected digest ", hex.EncodeToString(digests[i]), " versus ", hex.EncodeToString(expected_digest))
+				}
+				if !bytes.Equal(results[i], expected_result) {
+					t.Error(algorithm, ", lane ", i, " of ", ways, ": unexpected result ", hex.EncodeToString(results[i]), " versus ", hex.EncodeToString(expected_result))
+				}
+			}
+		}
+	}
+
+	// Same as TestHashVariant4ForEthereum.
+	digests, _ := HashAlgorithmForEthereumHeaderMulti(CNR, block_header_bytes, nonce-2, 4, 8111222 /*block_height*/)
+	expected_digest := hexutil.MustDecode("0x1621e81c0910c8167e2c37da637e212e24dd6882f1e9c0e043d6eff0d284a2b8")
+	if !bytes.Equal(digests[2], expected_digest) {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digests[2]), " versus ", hex.EncodeToString(expected_digest))
+	}
+
+	// Bad inputs are errors, not the end of the process.
+	short := [][]byte{make([]byte, 42), make([]byte, 42)}
+	if _, err := hashCryptonightMultiWithParams(short, CN1.toC(), 0 /*block_height*/, nil); err != errShortInput {
+		t.Error("Unexpected error: ", err)
+	}
+	too_many := make([][]byte, MaxMultiHashWays+1)
+	for i := range too_many {
+		too_many[i] = make([]byte, 76)
+	}
+	if _, err := hashCryptonightMultiWithParams(too_many, CN0.toC(), 0 /*block_height*/, nil); err == nil {
+		t.Error("Accepted ", len(too_many), " ways")
+	}
+}
+
+func BenchmarkHashAlgorithmForEthereumHeaderMulti(b *testing.B) {
+	var block_header_bytes []byte = hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	for _, algorithm := range []Algorithm{CN1, CN2, CNR} {
+		for ways := 1; ways <= MaxMultiHashWays; ways++ {
+			b.Run(fmt.Sprintf("%s/%d", algorithm.Name, ways), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					HashAlgorithmForEthereumHeaderMulti(algorithm, block_header_bytes, uint64(i*ways), ways, 8111222 /*block_height*/)
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*ways), "ns/hash")
+			})
+		}
+	}
+}
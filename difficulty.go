@@ -0,0 +1,69 @@
+package cryptonight
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// Monero's check_hash (src/cryptonote_basic/difficulty.cpp): whether
+// the raw 32 byte digest, read as a little endian 256 bit number,
+// times difficulty is below 2^256. Like Monero, it multiplies the
+// digest's little endian 64 bit words by the difficulty one at a time,
+// and the highest word alone decides for almost every digest.
+//
+// It agrees with DigestMeetsTarget against DifficultyToTarget(difficulty),
+// except when difficulty is a power of 2 and the result equals that
+// target exactly: our chain accepts that result, Monero doesn't.
+// CheckHashTarget gives the target Monero's check amounts to.
+func CheckHash(digest []byte, difficulty uint64) bool {
+	high, top := bits.Mul64(binary.LittleEndian.Uint64(digest[24:]), difficulty)
+	if high != 0 {
+		return false
+	}
+	cur, _ := bits.Mul64(binary.LittleEndian.Uint64(digest[0:]), difficulty)
+	high, low := bits.Mul64(binary.LittleEndian.Uint64(digest[8:]), difficulty)
+	_, carry := bits.Add64(cur, low, 0)
+	cur = high
+	high, low = bits.Mul64(binary.LittleEndian.Uint64(digest[16:]), difficulty)
+	_, carry = bits.Add64(cur, low, carry)
+	_, carry = bits.Add64(high, top, carry)
+	return carry == 0
+}
+
+// The largest result CheckHash accepts for difficulty, (2^256 - 1) /
+// difficulty: CheckHash(digest, difficulty) is
+// DigestMeetsTarget(digest, CheckHashTarget(difficulty)). The
+// difficulty must be positive.
+func CheckHashTarget(difficulty uint64) *big.Int {
+	max := new(big.Int).Sub(two256, big.NewInt(1))
+	return max.Div(max, new(big.Int).SetUint64(difficulty))
+}
+
+// Returns the difficulty a raw 32 byte digest achieves: the largest
+// difficulty CheckHash accepts it for, (2^256 - 1) / digest, without a
+// 64 bit limit. Returns 2^256 for a zero digest.
+func DigestDifficulty(digest []byte) *big.Int {
+	return ResultDifficulty(littleEndianResult(digest))
+}
+
+// Same as DigestDifficulty, for the reversed (big endian) result.
+func ResultDifficulty(result []byte) *big.Int {
+	value := new(big.Int).SetBytes(result)
+	if value.Sign() == 0 {
+		return new(big.Int).Set(two256)
+	}
+	max := new(big.Int).Sub(two256, big.NewInt(1))
+	return max.Div(max, value)
+}
+
+// The average number of hashes it takes to find a result meeting
+// DifficultyToTarget(difficulty): 2^256 over the number of results
+// meeting it, which is about the difficulty. The difficulty must be
+// positive.
+func ExpectedHashes(difficulty *big.Int) float64 {
+	meeting := DifficultyToTarget(difficulty)
+	meeting.Add(meeting, big.NewInt(1))
+	expected, _ := new(big.Float).Quo(new(big.Float).SetInt(two256), new(big.Float).SetInt(meeting)).Float64()
+	return expected
+}
@@ -0,0 +1,84 @@
+package cryptonight
+
+import (
+	"encoding/hex"
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// CheckHash and the difficulty helpers agree with big integer
+// arithmetic on the digest, for random digests and difficulties of
+// every magnitude.
+func TestCheckHash(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	digest := make([]byte, 32)
+	accepted := 0
+	for i := 0; i < 100000; i++ {
+		random.Read(digest)
+		// Clear the top bits of the digest and of the difficulty so
+		// that both outcomes are common.
+		zero_bits := random.Intn(64)
+		for bit := 0; bit < zero_bits; bit++ {
+			digest[31-bit/8] &^= 0x80 >> uint(bit%8)
+		}
+		difficulty := random.Uint64() >> uint(random.Intn(64))
+		if difficulty == 0 {
+			difficulty = 1
+		}
+		value := new(big.Int).SetBytes(littleEndianResult(digest))
+		expected := new(big.Int).Mul(value, new(big.Int).SetUint64(difficulty)).Cmp(two256) < 0
+		if CheckHash(digest, difficulty) != expected {
+			t.Fatal("Unexpected check of ", hex.EncodeToString(digest), " at difficulty ", difficulty, ": ", !expected, " versus ", expected)
+		}
+		if expected {
+			accepted++
+		}
+		if DigestMeetsTarget(digest, CheckHashTarget(difficulty)) != expected {
+			t.Fatal("Unexpected CheckHashTarget check of ", hex.EncodeToString(digest), " at difficulty ", difficulty, ": ", !expected, " versus ", expected)
+		}
+		if DigestMeetsTarget(digest, DifficultyToTarget(new(big.Int).SetUint64(difficulty))) != expected {
+			t.Fatal("Unexpected DifficultyToTarget check of ", hex.EncodeToString(digest), " at difficulty ", difficulty, ": ", !expected, " versus ", expected)
+		}
+		achieved := DigestDifficulty(digest)
+		if (achieved.Cmp(new(big.Int).SetUint64(difficulty)) >= 0) != expected {
+			t.Fatal("Unexpected difficulty of ", hex.EncodeToString(digest), ": ", achieved, " versus ", difficulty, " checked ", expected)
+		}
+		if achieved.IsUint64() && achieved.Uint64() < math.MaxUint64 && (!CheckHash(digest, achieved.Uint64()) || CheckHash(digest, achieved.Uint64()+1)) {
+			t.Fatal("Unexpected difficulty of ", hex.EncodeToString(digest), ": ", achieved, " isn't the largest")
+		}
+	}
+	if accepted < 10000 || accepted > 90000 {
+		t.Error("Unbalanced test: ", accepted, " accepted")
+	}
+}
+
+func TestCheckHashEdges(t *testing.T) {
+	zero := make([]byte, 32)
+	if !CheckHash(zero, math.MaxUint64) || DigestDifficulty(zero).Cmp(two256) != 0 {
+		t.Error("Zero digest rejected")
+	}
+	// The result 2^255 exactly meets our target for difficulty 2, but
+	// not Monero's.
+	half := make([]byte, 32)
+	half[31] = 0x80
+	if CheckHash(half, 2) || !CheckHash(half, 1) || !DigestMeetsTarget(half, DifficultyToTarget(big.NewInt(2))) {
+		t.Error("Unexpected check of 2^255")
+	}
+	if difficulty := DigestDifficulty(half); difficulty.Cmp(big.NewInt(1)) != 0 {
+		t.Error("Unexpected difficulty ", difficulty)
+	}
+	if difficulty := ResultDifficulty(littleEndianResult(half)); difficulty.Cmp(big.NewInt(1)) != 0 {
+		t.Error("Unexpected difficulty ", difficulty)
+	}
+}
+
+func TestExpectedHashes(t *testing.T) {
+	for _, difficulty := range []int64{1, 2, 3, 1000, 1 << 40} {
+		expected := ExpectedHashes(big.NewInt(difficulty))
+		if math.Abs(expected-float64(difficulty)) > float64(difficulty)*1e-9 {
+			t.Error("Unexpected hashes: ", expected, " versus ", difficulty)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package getwork
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+)
+
+type ClientConfig struct {
+	// The node's getwork endpoint, e.g. http://127.0.0.1:8545.
+	URL string
+	// Interval of cn_getWork requests. 500 milliseconds if 0.
+	PollInterval time.Duration
+	// Timeout of requests. 10 seconds if 0.
+	Timeout time.Duration
+}
+
+// Work from the node, decoded.
+type ClientWork struct {
+	Work
+	// The blob to hash, nonce in bytes 39 to 46.
+	Blob []byte
+}
+
+// A getwork client. Run polls the node for work; CurrentWork and
+// SubmitWork are for the miners, e.g. a Worker.
+type Client struct {
+	config      ClientConfig
+	http_client *http.Client
+	next_id     atomic.Uint64
+
+	mu      sync.Mutex
+	work    *ClientWork
+	changed chan struct{}
+}
+
+func NewClient(config ClientConfig) (*Client, error) {
+	if config.URL == "" {
+		return nil, errors.New("getwork: no URL")
+	}
+	if config.PollInterval == 0 {
+		config.PollInterval = 500 * time.Millisecond
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &Client{
+		config:      config,
+		http_client: &http.Client{Timeout: config.Timeout},
+		changed:     make(chan struct{}),
+	}, nil
+}
+
+// Polls the node for work until ctx ends. Work is replaced when the
+// node's changes, and cleared while the node can't be reached.
+func (c *Client) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		work, err := c.GetWork(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		current, _ := c.CurrentWork()
+		if err != nil {
+			work = nil
+		}
+		if !sameWork(work, current) {
+			c.setWork(work)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func sameWork(a *ClientWork, b *ClientWork) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.Blob, b.Blob) && a.Height == b.Height && a.Algorithm.Name == b.Algorithm.Name && a.Target.Cmp(b.Target) == 0
+}
+
+// Returns the current work, nil while the node can't be reached, and a
+// channel closed as soon as it's replaced.
+func (c *Client) CurrentWork() (*ClientWork, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.work, c.changed
+}
+
+func (c *Client) setWork(work *ClientWork) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.work = work
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Requests the node's current work.
+func (c *Client) GetWork(ctx context.Context) (*ClientWork, error) {
+	var result WorkResult
+	if err := c.call(ctx, "cn_getWork", []string{}, &result); err != nil {
+		return nil, err
+	}
+	header, err := decodeHex(result.HeaderHash)
+	if err != nil {
+		return nil, err
+	}
+	height, err := strconv.ParseUint(strings.TrimPrefix(result.Height, "0x"), 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("getwork: invalid height %q", result.Height)
+	}
+	algorithm, err := cryptonight.LookupAlgorithm(result.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := decodeHex(result.Blob)
+	if err != nil || len(blob) < 47 {
+		return nil, fmt.Errorf("getwork: invalid blob %q", result.Blob)
+	}
+	target_bytes, err := decodeHex(result.Target)
+	if err != nil {
+		return nil, fmt.Errorf("getwork: invalid target %q", result.Target)
+	}
+	return &ClientWork{
+		Work: Work{
+			HeaderHash: header,
+			Height:     height,
+			Algorithm:  algorithm,
+			Target:     new(big.Int).SetBytes(target_bytes),
+		},
+		Blob: blob,
+	}, nil
+}
+
+// Submits a seal of work: the 8 byte nonce and its digest. Returns
+// whether the node accepted it.
+func (c *Client) SubmitWork(ctx context.Context, work *ClientWork, nonce uint64, digest []byte) (bool, error) {
+	params := []string{
+		"0x" + strconv.FormatUint(nonce, 16),
+		fmt.Sprintf("%#x", work.HeaderHash),
+		fmt.Sprintf("%#x", digest),
+	}
+	var accepted bool
+	err := c.call(ctx, "cn_submitWork", params, &accepted)
+	return accepted, err
+}
+
+// Sends a request and decodes its result into result. Returns the
+// node's *Error if it fails the request.
+func (c *Client) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      c.next_id.Add(1),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	http_resp, err := c.http_client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer http_resp.Body.Close()
+	if http_resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("getwork: %s", http_resp.Status)
+	}
+	var resp struct {
+		Result json.RawMessage
+		Error  *Error
+	}
+	if err := json.NewDecoder(http_resp.Body).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	return json.Unmarshal(resp.Result, result)
+}
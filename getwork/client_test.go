@@ -0,0 +1,145 @@
+package getwork
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestClientAndWorker(t *testing.T) {
+	var mu sync.Mutex
+	var nonces []uint64
+	handler := NewHandler(Config{OnSeal: func(seal Seal) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		nonces = append(nonces, seal.Nonce)
+		return true
+	}})
+	requests := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- struct{}{}:
+		default:
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client, err := NewClient(ClientConfig{URL: server.URL, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go client.Run(ctx)
+
+	// No work yet. The client handles a poll before sending the next.
+	<-requests
+	<-requests
+	if work, _ := client.CurrentWork(); work != nil {
+		t.Error("Unexpected work: ", work)
+	}
+
+	// Every nonce seals the block: the 3 nonces of the range are
+	// accepted, and only them.
+	work := Work{
+		HeaderHash: hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8"),
+		Height:     8111222,
+		Algorithm:  cryptonight.CNDevR,
+		Target:     new(big.Int).Lsh(big.NewInt(1), 256),
+	}
+	handler.SetWork(work)
+	worker, err := NewWorker(client, WorkerConfig{Threads: 2, FirstNonce: 1 << 40, LastNonce: 1<<40 + 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go worker.Run(ctx)
+	for stats, changed := worker.CurrentStats(); stats.Accepted < 3; stats, changed = worker.CurrentStats() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for accepted seals")
+		}
+	}
+	if stats := worker.Stats(); stats != (WorkerStats{Hashes: 3, Accepted: 3}) {
+		t.Error("Unexpected stats: ", stats)
+	}
+	mu.Lock()
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	if len(nonces) != 3 || nonces[0] != 1<<40 || nonces[2] != 1<<40+2 {
+		t.Error("Unexpected nonces: ", nonces)
+	}
+	mu.Unlock()
+	// The node sends targets in 32 bytes, 2^256 - 1 accepts the same.
+	current, _ := client.CurrentWork()
+	max_target := new(big.Int).Sub(work.Target, big.NewInt(1))
+	if current == nil || current.Height != work.Height || current.Algorithm != work.Algorithm || current.Target.Cmp(max_target) != 0 ||
+		hexutil.Encode(current.Blob) != hexutil.Encode(cryptonight.EthereumHeaderBlob(work.Algorithm, work.HeaderHash, 0)) {
+		t.Error("Unexpected work: ", current)
+	}
+
+	// New work is mined too.
+	work.Height++
+	handler.SetWork(work)
+	for stats, changed := worker.CurrentStats(); stats.Accepted < 6; stats, changed = worker.CurrentStats() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for accepted seals")
+		}
+	}
+
+	// Hashing with another algorithm than the node's gives seals it
+	// rejects.
+	other_worker, _ := NewWorker(client, WorkerConfig{Threads: 1, Algorithm: cryptonight.CNDev1, LastNonce: 1})
+	go other_worker.Run(ctx)
+	for stats, changed := other_worker.CurrentStats(); stats.Rejected < 2; stats, changed = other_worker.CurrentStats() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for rejected seals")
+		}
+	}
+
+	// Work is cleared while the node is gone.
+	server.Close()
+	for work, changed := client.CurrentWork(); work != nil; work, changed = client.CurrentWork() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for cleared work")
+		}
+	}
+	if stats := worker.Stats(); stats.Rejected != 0 || stats.Stale != 0 {
+		t.Error("Unexpected stats: ", stats)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	if _, err := NewClient(ClientConfig{}); err == nil {
+		t.Error("Accepted a config without URL")
+	}
+	handler := NewHandler(Config{})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client, _ := NewClient(ClientConfig{URL: server.URL})
+	if _, err := client.GetWork(context.Background()); err == nil || err.(*Error).Message != "No work available yet" {
+		t.Error("Unexpected error: ", err)
+	}
+	for _, config := range []WorkerConfig{
+		{},
+		{Threads: 1, FirstNonce: 2, LastNonce: 1},
+		{Threads: 1, Algorithm: cryptonight.Algorithm{Name: "bad"}},
+	} {
+		if _, err := NewWorker(client, config); err == nil {
+			t.Error("Unexpected config accepted: ", config)
+		}
+	}
+}
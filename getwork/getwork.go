@@ -0,0 +1,252 @@
+// Package getwork serves CryptoNight work to solo miners over HTTP
+// JSON-RPC, in the spirit of eth_getWork and eth_submitWork, minus the
+// ethash seed hash and plus what CryptoNight miners need: the blob to
+// hash and the algorithm.
+//
+// cn_getWork takes no parameters and returns the current work:
+//
+//	{"headerHash": "0x…", "height": "0x…", "algorithm": "cn/r",
+//	 "variant": 4, "blob": "0x…", "target": "0x…",
+//	 "compactTarget": "…"}
+//
+// The blob is cryptonight.EthereumHeaderBlob with a zero nonce, in
+// bytes 39 to 46; the target is big endian, results must be at most
+// it; the compact target is in Stratum's little endian form (see
+// cryptonight.EncodeCompactTarget).
+//
+// cn_submitWork takes the nonce (8 bytes, as a big endian quantity),
+// the header hash and optionally the digest, all in 0x hex, and
+// returns whether the seal was valid and accepted.
+//
+// Client and Worker are the miner's end.
+package getwork
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+)
+
+// A work package of the node.
+type Work = cryptonight.Work
+
+// A nonce sealing a Work.
+type Seal struct {
+	Work   Work
+	Nonce  uint64
+	Digest []byte
+	Result []byte
+}
+
+type Config struct {
+	// Called with every valid seal, returns whether the node accepted
+	// it, which is what cn_submitWork returns. Seals are accepted if
+	// nil.
+	OnSeal func(Seal) bool
+}
+
+// Works kept for late submissions, the current one included.
+const recentWorks = 8
+
+// An http.Handler serving the current Work.
+type Handler struct {
+	config Config
+
+	mu     sync.Mutex
+	work   *Work
+	recent []*Work
+}
+
+func NewHandler(config Config) *Handler {
+	return &Handler{config: config}
+}
+
+// Replaces the current work. Seals of the few previous ones are still
+// accepted, as with ethash. work.Target must be positive.
+func (h *Handler) SetWork(work Work) error {
+	if work.Target == nil || work.Target.Sign() <= 0 {
+		return errors.New("getwork: work without a positive target")
+	}
+	work.HeaderHash = append([]byte(nil), work.HeaderHash...)
+	work.Target = new(big.Int).Set(work.Target)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.work = &work
+	h.recent = append(h.recent, &work)
+	if len(h.recent) > recentWorks {
+		h.recent = h.recent[1:]
+	}
+	return nil
+}
+
+type request struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	ID      json.RawMessage `json:"id"`
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// A JSON-RPC error.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("getwork: %s (code %d)", err.Message, err.Code)
+}
+
+// The result of cn_getWork.
+type WorkResult struct {
+	HeaderHash    string `json:"headerHash"`
+	Height        string `json:"height"`
+	Algorithm     string `json:"algorithm"`
+	Variant       int    `json:"variant"`
+	Blob          string `json:"blob"`
+	Target        string `json:"target"`
+	CompactTarget string `json:"compactTarget"`
+}
+
+// The longest request body accepted.
+const maxRequestLength = 1 << 20
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req request
+	var resp response
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestLength)).Decode(&req); err != nil {
+		resp.Error = &Error{Code: -32700, Message: "Parse error"}
+	} else {
+		resp.Result, resp.Error = h.handle(r.Context(), req)
+	}
+	resp.ID = req.ID
+	if resp.ID == nil {
+		resp.ID = json.RawMessage("null")
+	}
+	resp.JSONRPC = "2.0"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) handle(ctx context.Context, req request) (interface{}, *Error) {
+	switch req.Method {
+	case "cn_getWork":
+		h.mu.Lock()
+		work := h.work
+		h.mu.Unlock()
+		if work == nil {
+			return nil, &Error{Code: -32000, Message: "No work available yet"}
+		}
+		return workResult(work), nil
+	case "cn_submitWork":
+		var params []string
+		for _, raw := range req.Params {
+			var param string
+			if err := json.Unmarshal(raw, &param); err != nil {
+				return nil, &Error{Code: -32602, Message: "Invalid params"}
+			}
+			params = append(params, param)
+		}
+		if len(params) != 2 && len(params) != 3 {
+			return nil, &Error{Code: -32602, Message: "Expected nonce, header hash and optionally digest"}
+		}
+		nonce, err := strconv.ParseUint(strings.TrimPrefix(params[0], "0x"), 16, 64)
+		if err != nil || !strings.HasPrefix(params[0], "0x") {
+			return nil, &Error{Code: -32602, Message: "Invalid nonce"}
+		}
+		header, err := decodeHex(params[1])
+		if err != nil {
+			return nil, &Error{Code: -32602, Message: "Invalid header hash"}
+		}
+		var digest []byte
+		if len(params) == 3 {
+			if digest, err = decodeHex(params[2]); err != nil {
+				return nil, &Error{Code: -32602, Message: "Invalid digest"}
+			}
+		}
+		accepted, err := h.submit(ctx, nonce, header, digest)
+		if err != nil {
+			return nil, &Error{Code: -32000, Message: err.Error()}
+		}
+		return accepted, nil
+	}
+	return nil, &Error{Code: -32601, Message: "Method not found"}
+}
+
+// Returns whether a seal is valid and accepted, or an error if ctx ends
+// while waiting for a scratchpad.
+func (h *Handler) submit(ctx context.Context, nonce uint64, header []byte, digest []byte) (bool, error) {
+	h.mu.Lock()
+	var work *Work
+	for _, recent := range h.recent {
+		if bytes.Equal(recent.HeaderHash, header) {
+			work = recent
+		}
+	}
+	h.mu.Unlock()
+	if work == nil {
+		return false, nil
+	}
+	actual_digest, result, err := cryptonight.HashAlgorithmForEthereumHeaderContext(ctx, work.Algorithm, work.HeaderHash, nonce, work.Height)
+	if err != nil {
+		return false, err
+	}
+	if digest != nil && !bytes.Equal(digest, actual_digest) {
+		return false, nil
+	}
+	if !cryptonight.DigestMeetsTarget(actual_digest, work.Target) {
+		return false, nil
+	}
+	if h.config.OnSeal == nil {
+		return true, nil
+	}
+	return h.config.OnSeal(Seal{Work: *work, Nonce: nonce, Digest: actual_digest, Result: result}), nil
+}
+
+func workResult(work *Work) WorkResult {
+	blob := cryptonight.EthereumHeaderBlob(work.Algorithm, work.HeaderHash, 0)
+	target := new(big.Int).Set(work.Target)
+	// Targets of 2^256 and above accept everything, say so in 32 bytes.
+	if target.BitLen() > 256 {
+		target.Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+	}
+	var target_bytes [32]byte
+	target.FillBytes(target_bytes[:])
+	_, compact := cryptonight.EncodeCompactTarget(work.Target)
+	return WorkResult{
+		HeaderHash:    "0x" + hex.EncodeToString(work.HeaderHash),
+		Height:        "0x" + strconv.FormatUint(work.Height, 16),
+		Algorithm:     work.Algorithm.Name,
+		Variant:       work.Algorithm.Variant,
+		Blob:          "0x" + hex.EncodeToString(blob),
+		Target:        "0x" + hex.EncodeToString(target_bytes[:]),
+		CompactTarget: compact,
+	}
+}
+
+func decodeHex(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, "0x") {
+		return nil, fmt.Errorf("getwork: missing 0x prefix in %q", s)
+	}
+	return hex.DecodeString(s[2:])
+}
@@ -0,0 +1,191 @@
+package getwork
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+type testResponse struct {
+	Result json.RawMessage
+	Error  *Error
+}
+
+func call(t *testing.T, url string, method string, params ...interface{}) testResponse {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	http_resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer http_resp.Body.Close()
+	var resp testResponse
+	if err := json.NewDecoder(http_resp.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func submit(t *testing.T, url string, params ...interface{}) bool {
+	resp := call(t, url, "cn_submitWork", params...)
+	var accepted bool
+	if resp.Error != nil || json.Unmarshal(resp.Result, &accepted) != nil {
+		t.Fatal("Unexpected response: ", string(resp.Result), " ", resp.Error)
+	}
+	return accepted
+}
+
+func TestHandler(t *testing.T) {
+	var seals []Seal
+	handler := NewHandler(Config{OnSeal: func(seal Seal) bool {
+		seals = append(seals, seal)
+		return true
+	}})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	if resp := call(t, server.URL, "cn_getWork"); resp.Error == nil || resp.Error.Message != "No work available yet" {
+		t.Error("Unexpected response: ", string(resp.Result), " ", resp.Error)
+	}
+
+	work := Work{
+		HeaderHash: hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8"),
+		Height:     8111222,
+		Algorithm:  cryptonight.CNDevR,
+		Target:     new(big.Int).Lsh(big.NewInt(1), 254),
+	}
+	handler.SetWork(work)
+	resp := call(t, server.URL, "cn_getWork")
+	var result WorkResult
+	if resp.Error != nil || json.Unmarshal(resp.Result, &result) != nil {
+		t.Fatal("Unexpected response: ", string(resp.Result), " ", resp.Error)
+	}
+	expected := WorkResult{
+		HeaderHash:    "0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8",
+		Height:        "0x7bc476",
+		Algorithm:     "cn-dev/r",
+		Variant:       4,
+		Blob:          hexutil.Encode(cryptonight.EthereumHeaderBlob(work.Algorithm, work.HeaderHash, 0)),
+		Target:        "0x4000000000000000000000000000000000000000000000000000000000000000",
+		CompactTarget: "ffffff3f",
+	}
+	if result != expected {
+		t.Error("Unexpected work: ", result, " versus ", expected)
+	}
+
+	// Mine the blob as a miner would and find a nonce which seals the
+	// block and one which doesn't.
+	blob := hexutil.MustDecode(result.Blob)
+	seal_nonce, other_nonce := -1, -1
+	var seal_digest []byte
+	for nonce := 0; nonce < 64 && (seal_nonce < 0 || other_nonce < 0); nonce++ {
+		blob[39] = byte(nonce)
+		digest := work.Algorithm.Hash(blob, work.Height)
+		if cryptonight.DigestMeetsTarget(digest, work.Target) {
+			seal_nonce, seal_digest = nonce, digest
+		} else {
+			other_nonce = nonce
+		}
+	}
+	if seal_nonce < 0 || other_nonce < 0 {
+		t.Fatal("No nonces found")
+	}
+
+	if submit(t, server.URL, fmt.Sprintf("0x%016x", other_nonce), result.HeaderHash) {
+		t.Error("Accepted a nonce not meeting the target")
+	}
+	if submit(t, server.URL, fmt.Sprintf("0x%016x", seal_nonce), result.HeaderHash, hexutil.Encode(make([]byte, 32))) {
+		t.Error("Accepted a wrong digest")
+	}
+	if submit(t, server.URL, fmt.Sprintf("0x%016x", seal_nonce), hexutil.Encode(make([]byte, 32))) {
+		t.Error("Accepted a seal of unknown work")
+	}
+	if len(seals) != 0 {
+		t.Error("Unexpected seals: ", seals)
+	}
+	if !submit(t, server.URL, fmt.Sprintf("0x%016x", seal_nonce), result.HeaderHash, hexutil.Encode(seal_digest)) {
+		t.Error("Rejected a seal")
+	}
+	if len(seals) != 1 || seals[0].Nonce != uint64(seal_nonce) || !bytes.Equal(seals[0].Digest, seal_digest) {
+		t.Error("Unexpected seals: ", seals)
+	}
+
+	// Seals of previous work are still accepted, for a while.
+	next := work
+	next.HeaderHash = make([]byte, 32)
+	handler.SetWork(next)
+	if !submit(t, server.URL, fmt.Sprintf("0x%x", seal_nonce), result.HeaderHash) {
+		t.Error("Rejected a seal of previous work")
+	}
+	for i := 0; i < recentWorks; i++ {
+		handler.SetWork(next)
+	}
+	if submit(t, server.URL, fmt.Sprintf("0x%x", seal_nonce), result.HeaderHash) {
+		t.Error("Accepted a seal of old work")
+	}
+	if len(seals) != 2 {
+		t.Error("Unexpected seals: ", seals)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	handler := NewHandler(Config{OnSeal: func(seal Seal) bool { return false }})
+	handler.SetWork(Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: new(big.Int).Lsh(big.NewInt(1), 256)})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, target := range []*big.Int{nil, big.NewInt(0), big.NewInt(-1)} {
+		if err := handler.SetWork(Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: target}); err == nil {
+			t.Error("Accepted target ", target)
+		}
+	}
+
+	// Every nonce meets the target, but the node refuses the seal.
+	if submit(t, server.URL, "0x0", hexutil.Encode(make([]byte, 32))) {
+		t.Error("Accepted a refused seal")
+	}
+	for _, params := range [][]interface{}{
+		{"0x0"},
+		{"0", hexutil.Encode(make([]byte, 32))},
+		{"0x0", "00"},
+		{"0x0", hexutil.Encode(make([]byte, 32)), "0xzz"},
+		{0, hexutil.Encode(make([]byte, 32))},
+	} {
+		if resp := call(t, server.URL, "cn_submitWork", params...); resp.Error == nil || resp.Error.Code != -32602 {
+			t.Error("Unexpected response to ", params, ": ", string(resp.Result), " ", resp.Error)
+		}
+	}
+	if resp := call(t, server.URL, "eth_getWork"); resp.Error == nil || resp.Error.Code != -32601 {
+		t.Error("Unexpected response: ", string(resp.Result), " ", resp.Error)
+	}
+
+	http_resp, err := http.Post(server.URL, "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp testResponse
+	json.NewDecoder(http_resp.Body).Decode(&resp)
+	http_resp.Body.Close()
+	if resp.Error == nil || resp.Error.Code != -32700 {
+		t.Error("Unexpected response: ", string(resp.Result), " ", resp.Error)
+	}
+
+	http_resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	http_resp.Body.Close()
+	if http_resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Unexpected status: ", http_resp.Status)
+	}
+}
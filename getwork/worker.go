@@ -0,0 +1,115 @@
+package getwork
+
+import (
+	"context"
+	"errors"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"github.com/MarconiProtocol/marconi-cryptonight/internal/mining"
+)
+
+type WorkerConfig struct {
+	// Hashing threads, at least 1. Each thread keeps a scratchpad, see
+	// cryptonight.SetScratchpadLimit.
+	Threads int
+	// Hashes every work with this algorithm instead of the node's, if
+	// its Name isn't empty. The node verifies seals with its own.
+	Algorithm cryptonight.Algorithm
+	// The nonces searched in every work, from FirstNonce to LastNonce,
+	// or to the last one if LastNonce is 0.
+	FirstNonce uint64
+	LastNonce  uint64
+}
+
+func (config WorkerConfig) Validate() error {
+	if config.Threads < 1 {
+		return errors.New("getwork: no threads")
+	}
+	if config.LastNonce != 0 && config.LastNonce < config.FirstNonce {
+		return errors.New("getwork: empty nonce range")
+	}
+	if config.Algorithm.Name != "" {
+		return config.Algorithm.Validate()
+	}
+	return nil
+}
+
+// Statistics of a Worker.
+type WorkerStats = mining.Stats
+
+// Searches nonces for the current work of a Client, hashing its blobs
+// like HashAlgorithmForEthereumHeader, and submits the seals it finds.
+type Worker struct {
+	client *Client
+	config WorkerConfig
+	miner  *mining.Miner
+}
+
+func NewWorker(client *Client, config WorkerConfig) (*Worker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.LastNonce == 0 {
+		config.LastNonce = ^uint64(0)
+	}
+	w := &Worker{client: client, config: config}
+	w.miner = mining.NewMiner(config.Threads, w.currentWork)
+	return w, nil
+}
+
+// Mines until ctx ends. Thread i hashes the nonces FirstNonce + i,
+// FirstNonce + i + Threads... of every work, until the work changes or
+// its nonces run out.
+func (w *Worker) Run(ctx context.Context) {
+	w.miner.Run(ctx)
+}
+
+func (w *Worker) Stats() WorkerStats {
+	return w.miner.Stats()
+}
+
+// Returns the statistics, and a channel closed as soon as a submitted
+// seal's outcome changes them.
+func (w *Worker) CurrentStats() (WorkerStats, <-chan struct{}) {
+	return w.miner.CurrentStats()
+}
+
+// The client's current work to mine, nil if there's none.
+func (w *Worker) currentWork() (*mining.Job, <-chan struct{}) {
+	work, changed := w.client.CurrentWork()
+	if work == nil {
+		return nil, changed
+	}
+	blob := work.Blob
+	algorithm := work.Algorithm
+	if w.config.Algorithm.Name != "" {
+		algorithm = w.config.Algorithm
+		blob = cryptonight.EthereumHeaderBlob(algorithm, work.HeaderHash, 0)
+	}
+	return &mining.Job{
+		Blob:       blob,
+		NonceSize:  8,
+		Algorithm:  algorithm,
+		Height:     work.Height,
+		FirstNonce: w.config.FirstNonce,
+		LastNonce:  w.config.LastNonce,
+		IsSolution: func(digest []byte) bool {
+			return cryptonight.DigestMeetsTarget(digest, work.Target)
+		},
+		Submit: func(ctx context.Context, nonce uint64, digest []byte) mining.Outcome {
+			return w.submit(ctx, work, nonce, digest)
+		},
+	}, changed
+}
+
+func (w *Worker) submit(ctx context.Context, work *ClientWork, nonce uint64, digest []byte) mining.Outcome {
+	accepted, err := w.client.SubmitWork(ctx, work, nonce, digest)
+	switch {
+	case err != nil:
+		return mining.Stale
+	case accepted:
+		return mining.Accepted
+	default:
+		return mining.Rejected
+	}
+}
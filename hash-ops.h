@@ -78,8 +78,136 @@ enum {
   HASH_DATA_AREA = 136
 };
 
+struct V4_Config;
+
 void cn_fast_hash(const void *data, size_t length, char *hash);
+// Exits the process if there's no memory for the scratchpad
 void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int prehashed, uint64_t height);
+// Same as cn_slow_hash, but variant 4 generates its random math programs with
+// v4_config (see variant4_random_math.h). NULL selects the default settings.
+// Returns 0, or -1 if there's no memory for the scratchpad
+int cn_slow_hash_ex(const void *data, size_t length, char *hash, int variant, int prehashed, uint64_t height, const struct V4_Config *v4_config);
+
+// A member of the CryptoNight family. cn_slow_hash uses 2MB, 2^19 iterations,
+// mask 0x1FFFF0 and the variant it's given
+struct cn_params {
+  size_t memory;      // scratchpad size in bytes, a power of 2, at least 128
+  size_t iterations;  // main loop iterations, each one reads and writes the scratchpad twice
+  uint32_t mask;      // scratchpad address mask, usually (memory - 1) & ~15
+  int variant;        // 0, 1, 2 or 4, same as for cn_slow_hash
+  int heavy;          // one of enum cn_heavy
+};
+
+// CryptoNight-Heavy tweaks. All of them mix the AES blocks into each other
+// while exploding and imploding the scratchpad, and add a division to the end
+// of every main loop iteration which picks the next address
+enum cn_heavy {
+  CN_HEAVY_NONE = 0,
+  CN_HEAVY_0,     // cn-heavy/0, Sumokoin and Loki
+  CN_HEAVY_XHV,   // cn-heavy/xhv, Haven: the divisor is inverted before picking the address
+  CN_HEAVY_TUBE,  // cn-heavy/tube, BitTube: on top of variant 1, with a tweaked AES round
+};
+// Same as cn_slow_hash_ex, with the scratchpad size, iterations, address mask
+// and variant taken from params
+int cn_slow_hash_params(const void *data, size_t length, char *hash, const struct cn_params *params, int prehashed, uint64_t height, const struct V4_Config *v4_config);
+
+enum {
+  CN_MULTI_MAX = 4
+};
+// Errors of cn_slow_hash_multi
+enum {
+  CN_NO_MEMORY = -1,    // no memory for the scratchpads
+  CN_INVALID_WAYS = -2, // ways isn't between 1 and CN_MULTI_MAX
+  CN_SHORT_INPUT = -3,  // variant 1 with inputs shorter than 43 bytes
+};
+// Computes ways (1 to CN_MULTI_MAX) hashes at once, data[i] into hashes +
+// i * HASH_SIZE, all inputs of the same length. On x86-64 a single main
+// loop advances every hash in turn, each with its own scratchpad, which
+// keeps the CPU busy while the other hashes wait for memory. Same results
+// as calling cn_slow_hash_params on each input. Returns 0, or one of the
+// errors above
+int cn_slow_hash_multi(const void *const *data, size_t length, char *hashes, size_t ways, const struct cn_params *params, uint64_t height, const struct V4_Config *v4_config);
+
+// The AES implementations cn_slow_hash can use on x86-64. CN_AES_AUTO picks
+// AES-NI if the CPU has it (unless MONERO_USE_SOFTWARE_AES is set), else the
+// SSSE3 vector permute rounds of aes-vperm.c, else the table based rounds of
+// aesb.c. All of them give the same results
+enum {
+  CN_AES_AUTO = 0,
+  CN_AES_HW,      // AES-NI, or the ARMv8 crypto extensions
+  CN_AES_VPERM,   // SSSE3 pshufb
+  CN_AES_TABLES,  // lookup tables, any CPU
+};
+// Selects the implementation for hashes started afterwards. One the CPU
+// can't run falls back to the next one in the order above
+void cn_set_aes_impl(int impl);
+// Returns the implementation hashes use, never CN_AES_AUTO. Other platforms
+// always use the same one
+int cn_aes_impl(void);
+
+void cn_set_v4_jit(int enabled);
+int cn_v4_jit_enabled(void);
+void cn_set_v4_jit_disable_on_failure(int disable);
+uint64_t cn_v4_jit_failures(void);
+void cn_set_v4_jit_buffer_size(size_t size);
+// With this on, CryptonightR hashes on x86-64 with AES-NI run their whole
+// main loop as generated code, with the random math program inlined, rather
+// than the C loop calling the JIT (or interpreter) for the random math.
+// Independent of cn_set_v4_jit, off by default. Not used by
+// cn_slow_hash_multi, 64 bit registers or other variants
+void cn_set_v4_asm_loop(int enabled);
+int cn_v4_asm_loop_enabled(void);
+
+// How scratchpads get their memory, a combination of these flags. Huge pages
+// cut the TLB misses of the main loop's random accesses. Explicit huge pages
+// are tried first, then transparent ones, then malloc; locking applies to
+// whichever was used. The default is CN_SCRATCHPAD_HUGETLB
+enum {
+  CN_SCRATCHPAD_HUGETLB = 1,  // MAP_HUGETLB, or MEM_LARGE_PAGES on Windows
+  CN_SCRATCHPAD_THP = 2,      // an aligned mapping with madvise(MADV_HUGEPAGE), Linux only
+  CN_SCRATCHPAD_MLOCK = 4,    // mlock, or VirtualLock on Windows
+};
+// Only affects scratchpads allocated afterwards. The x86-64 implementation
+// keeps a scratchpad per thread, which is what these apply to; the others
+// allocate theirs on the stack or with malloc for each hash
+void cn_set_scratchpad_policy(int policy);
+int cn_scratchpad_policy(void);
+
+struct cn_scratchpad;
+// Returns the smallest unused kept scratchpad of at least size bytes, or a
+// new one, or NULL if out of memory. Used by slow-hash.c for its per thread
+// scratchpads
+struct cn_scratchpad *cn_scratchpad_acquire(size_t size);
+uint8_t *cn_scratchpad_memory(const struct cn_scratchpad *scratchpad);
+size_t cn_scratchpad_size(const struct cn_scratchpad *scratchpad);
+// Frees the scratchpad, or keeps it for reuse if it was preallocated or
+// reuse allows
+void cn_scratchpad_release(struct cn_scratchpad *scratchpad);
+
+// With reuse on (keep > 0), threads give their scratchpads (and JIT page)
+// back at the end of every hash, and up to keep released scratchpads are kept
+// for whichever thread hashes next. That way there are only as many
+// scratchpads as hashes running at once, rather than one for every thread
+// that ever hashed. 0 turns reuse off and frees the kept scratchpads
+void cn_set_scratchpad_reuse(size_t keep);
+size_t cn_scratchpad_reuse(void);
+
+// Allocates count unused scratchpads of size bytes up front, with the current
+// policy, and touches their pages. Returns how many could be allocated
+size_t cn_preallocate_scratchpads(size_t count, size_t size);
+// Frees the preallocated scratchpads not in use, and makes those in use freed
+// when released. Returns how many were freed
+size_t cn_release_preallocated_scratchpads(void);
+
+struct cn_scratchpad_info {
+  size_t size;
+  int policy;        // the CN_SCRATCHPAD_* flags that took effect
+  int in_use;
+  int preallocated;
+};
+// Copies the details of up to max scratchpads into info, and returns how
+// many scratchpads there are
+size_t cn_scratchpads(struct cn_scratchpad_info *info, size_t max);
 
 void hash_extra_blake(const void *data, size_t length, char *hash);
 void hash_extra_groestl(const void *data, size_t length, char *hash);
@@ -0,0 +1,173 @@
+package cryptonight
+
+/*
+#include <string.h>
+#include "hash-ops.h"
+#include "variant4_random_math.h"
+*/
+import "C"
+import (
+	"context"
+	"fmt"
+)
+
+// Parameters for generating variant 4 (CryptonightR) random math
+// programs. DefaultV4Config reproduces Monero's programs exactly; the
+// other settings exist so that alternative ASIC-resistance parameters
+// can be evaluated on research networks and testnets. Hashes computed
+// with a non-default configuration are of course incompatible with
+// everybody else's CryptonightR.
+//
+// See variant4_random_math.h for what each setting does in the
+// generator.
+type V4Config struct {
+	// Minimal theoretical latency of a program, in cycles of the
+	// generator's abstract CPU. At most 256.
+	TotalLatency int
+	// Bounds on the number of generated instructions (excluding the
+	// final RET). InstructionsMax is at most 256.
+	InstructionsMin int
+	InstructionsMax int
+	// ALUs able to multiply, and ALUs in total, of the abstract CPU.
+	// At most 8.
+	ALUCountMul int
+	ALUCount    int
+	// Byte written into the program seed before it's hashed. Changing
+	// it gives a completely different program for every height.
+	SeedTweak int8
+	// Register width of the random math, 32 or 64. Only 32 bit
+	// programs can use the JIT.
+	RegisterBits int
+}
+
+// The settings Monero uses for CryptonightR.
+var DefaultV4Config = V4Config{
+	TotalLatency:    45,
+	InstructionsMin: 60,
+	InstructionsMax: 70,
+	ALUCountMul:     1,
+	ALUCount:        3,
+	SeedTweak:       -38,
+	RegisterBits:    32,
+}
+
+// Checks that the configuration is within the limits of the C
+// generator.
+func (config V4Config) Validate() error {
+	if config.TotalLatency < 1 || config.TotalLatency > C.V4_MAX_TOTAL_LATENCY {
+		return fmt.Errorf("cryptonight: total latency %d out of range [1, %d]", config.TotalLatency, C.V4_MAX_TOTAL_LATENCY)
+	}
+	if config.InstructionsMin < 1 || config.InstructionsMin > config.InstructionsMax || config.InstructionsMax > C.V4_MAX_INSTRUCTIONS {
+		return fmt.Errorf("cryptonight: instruction bounds [%d, %d] invalid, need 1 <= min <= max <= %d", config.InstructionsMin, config.InstructionsMax, C.V4_MAX_INSTRUCTIONS)
+	}
+	if config.ALUCountMul < 1 || config.ALUCountMul > config.ALUCount || config.ALUCount > C.V4_MAX_ALU_COUNT {
+		return fmt.Errorf("cryptonight: ALU counts (%d MUL, %d total) invalid, need 1 <= MUL <= total <= %d", config.ALUCountMul, config.ALUCount, C.V4_MAX_ALU_COUNT)
+	}
+	if config.RegisterBits != 32 && config.RegisterBits != 64 {
+		return fmt.Errorf("cryptonight: register width %d bits, must be 32 or 64", config.RegisterBits)
+	}
+	return nil
+}
+
+func (config V4Config) toC() C.struct_V4_Config {
+	return C.struct_V4_Config{
+		total_latency:        C.int(config.TotalLatency),
+		num_instructions_min: C.int(config.InstructionsMin),
+		num_instructions_max: C.int(config.InstructionsMax),
+		alu_count_mul:        C.int(config.ALUCountMul),
+		alu_count:            C.int(config.ALUCount),
+		seed_tweak:           C.int8_t(config.SeedTweak),
+		reg_bits:             C.int(config.RegisterBits),
+	}
+}
+
+// A Hasher computes the same hashes as the package level
+// HashVariant{1,2,4}ForEthereumHeader functions, except that variant
+// 4 uses the Hasher's own program generator configuration. A Hasher
+// is immutable and safe for concurrent use.
+type Hasher struct {
+	v4_config   V4Config
+	c_v4_config C.struct_V4_Config
+}
+
+// Returns a Hasher generating variant 4 programs with the given
+// configuration, or an error if the configuration is invalid.
+func NewHasher(v4_config V4Config) (*Hasher, error) {
+	if err := v4_config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Hasher{v4_config: v4_config, c_v4_config: v4_config.toC()}, nil
+}
+
+// Returns the configuration the Hasher was created with.
+func (h *Hasher) V4Config() V4Config {
+	return h.v4_config
+}
+
+func (h *Hasher) HashVariant1ForEthereumHeader(block_header_hash []byte, nonce uint64) ([]byte, []byte) {
+	return h.hashForEthereumHeader(block_header_hash, nonce, CN1, 0 /*block_height*/)
+}
+
+func (h *Hasher) HashVariant2ForEthereumHeader(block_header_hash []byte, nonce uint64) ([]byte, []byte) {
+	return h.hashForEthereumHeader(block_header_hash, nonce, CN2, 0 /*block_height*/)
+}
+
+func (h *Hasher) HashVariant4ForEthereumHeader(block_header_hash []byte, nonce uint64, block_height uint64) ([]byte, []byte) {
+	return h.hashForEthereumHeader(block_header_hash, nonce, CNR, block_height)
+}
+
+// Same as HashAlgorithmForEthereumHeader, but variant 4 uses the
+// Hasher's program generator settings.
+func (h *Hasher) HashAlgorithmForEthereumHeader(algorithm Algorithm, block_header_hash []byte, nonce uint64, block_height uint64) ([]byte, []byte) {
+	if err := algorithm.Validate(); err != nil {
+		panic(err)
+	}
+	return h.hashForEthereumHeader(block_header_hash, nonce, algorithm, block_height)
+}
+
+// Same as HashAlgorithmForEthereumHeaderContext, but variant 4 uses
+// the Hasher's program generator settings.
+func (h *Hasher) HashAlgorithmForEthereumHeaderContext(ctx context.Context, algorithm Algorithm, block_header_hash []byte, nonce uint64, block_height uint64) ([]byte, []byte, error) {
+	if err := algorithm.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return h.hashForEthereumHeaderContext(ctx, block_header_hash, nonce, algorithm, block_height)
+}
+
+// Same as HashAlgorithmForEthereumHeaderMulti, but variant 4 uses the
+// Hasher's program generator settings.
+func (h *Hasher) HashAlgorithmForEthereumHeaderMulti(algorithm Algorithm, block_header_hash []byte, nonce uint64, ways int, block_height uint64) ([][]byte, [][]byte) {
+	if err := algorithm.Validate(); err != nil {
+		panic(err)
+	}
+	if ways < 1 || ways > MaxMultiHashWays {
+		panic(fmt.Errorf("cryptonight: %d ways, must be 1 to %d", ways, MaxMultiHashWays))
+	}
+	var v4_config *C.struct_V4_Config
+	if h != nil {
+		v4_config = &h.c_v4_config
+	}
+	digests, results, err := hashCryptonightForEthereumHeaderMulti(block_header_hash, nonce, ways, algorithm, block_height, v4_config)
+	if err != nil {
+		panic(err)
+	}
+	return digests, results
+}
+
+// A nil Hasher hashes with the default settings, like the package
+// level functions.
+func (h *Hasher) hashForEthereumHeader(block_header_hash []byte, nonce uint64, algorithm Algorithm, block_height uint64) ([]byte, []byte) {
+	var v4_config *C.struct_V4_Config
+	if h != nil {
+		v4_config = &h.c_v4_config
+	}
+	return hashCryptonightForEthereumHeader(block_header_hash, nonce, algorithm, block_height, v4_config)
+}
+
+func (h *Hasher) hashForEthereumHeaderContext(ctx context.Context, block_header_hash []byte, nonce uint64, algorithm Algorithm, block_height uint64) ([]byte, []byte, error) {
+	var v4_config *C.struct_V4_Config
+	if h != nil {
+		v4_config = &h.c_v4_config
+	}
+	return hashCryptonightForEthereumHeaderContext(ctx, block_header_hash, nonce, algorithm, block_height, v4_config)
+}
@@ -0,0 +1,86 @@
+package cryptonight
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestHasherDefaultV4Config(t *testing.T) {
+	hasher, err := NewHasher(DefaultV4Config)
+	if err != nil {
+		t.Fatal("Default config rejected: ", err)
+	}
+	// Same case as TestHashVariant4ForEthereum.
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var nonce uint64 = 0xc526c0a1000008dc
+	digest, result := hasher.HashVariant4ForEthereumHeader(block_header_bytes, nonce, 8111222 /*block_height*/)
+	expected_digest := hexutil.MustDecode("0x1621e81c0910c8167e2c37da637e212e24dd6882f1e9c0e043d6eff0d284a2b8")
+	if !bytes.Equal(digest, expected_digest) {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+	}
+	expected_result := hexutil.MustDecode("0xb8a284d2f0efd643e0c0e9f18268dd242e217e63da372c7e16c810091ce82116")
+	if !bytes.Equal(result, expected_result) {
+		t.Error("Unexpected result: ", hex.EncodeToString(result), " versus ", hex.EncodeToString(expected_result))
+	}
+}
+
+func TestV4ConfigValidate(t *testing.T) {
+	invalid := []func(*V4Config){
+		func(c *V4Config) { c.TotalLatency = 0 },
+		func(c *V4Config) { c.TotalLatency = 257 },
+		func(c *V4Config) { c.InstructionsMin = 0 },
+		func(c *V4Config) { c.InstructionsMin = 71 },
+		func(c *V4Config) { c.InstructionsMax = 257 },
+		func(c *V4Config) { c.ALUCountMul = 0 },
+		func(c *V4Config) { c.ALUCountMul = 4 },
+		func(c *V4Config) { c.ALUCount = 9; c.ALUCountMul = 1 },
+		func(c *V4Config) { c.RegisterBits = 16 },
+	}
+	for i, modify := range invalid {
+		config := DefaultV4Config
+		modify(&config)
+		if _, err := NewHasher(config); err == nil {
+			t.Error("Unexpected config accepted in case ", i, ": ", config)
+		}
+	}
+}
+
+func TestHasherCustomV4Config(t *testing.T) {
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var nonce uint64 = 0xc526c0a1000008dc
+	default_digest, _ := HashVariant4ForEthereumHeader(block_header_bytes, nonce, 8111222 /*block_height*/)
+
+	longer := DefaultV4Config
+	longer.TotalLatency = 90
+	longer.InstructionsMin = 120
+	longer.InstructionsMax = 140
+	longer.ALUCount = 4
+	tweaked := DefaultV4Config
+	tweaked.SeedTweak = 17
+	wide := DefaultV4Config
+	wide.RegisterBits = 64
+
+	was_enabled := V4JITEnabled()
+	defer EnableV4JIT(was_enabled)
+	for _, config := range []V4Config{longer, tweaked, wide} {
+		hasher, err := NewHasher(config)
+		if err != nil {
+			t.Fatal("Config rejected: ", err)
+		}
+		// Every configuration has to give the same hash with and
+		// without the JIT, and a different hash than the default.
+		EnableV4JIT(false)
+		interpreted, _ := hasher.HashVariant4ForEthereumHeader(block_header_bytes, nonce, 8111222 /*block_height*/)
+		EnableV4JIT(true)
+		jitted, _ := hasher.HashVariant4ForEthereumHeader(block_header_bytes, nonce, 8111222 /*block_height*/)
+		if !bytes.Equal(interpreted, jitted) {
+			t.Error("Unexpected JIT result for ", config, ": ", hexutil.Encode(jitted), " versus ", hexutil.Encode(interpreted))
+		}
+		if bytes.Equal(interpreted, default_digest) {
+			t.Error("Unexpected default hash for ", config)
+		}
+	}
+}
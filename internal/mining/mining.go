@@ -0,0 +1,167 @@
+// Package mining is the CPU mining loop of the stratum and getwork
+// workers: threads searching the nonces of the current job, and the
+// statistics of what they found.
+package mining
+
+import (
+	"context"
+	"encoding/binary"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+)
+
+// Statistics of a Miner.
+type Stats struct {
+	Hashes   uint64
+	Accepted uint64
+	Rejected uint64
+	// Solutions which couldn't be submitted, e.g. their connection was
+	// gone or their job was replaced.
+	Stale uint64
+}
+
+// What became of a submitted solution.
+type Outcome int
+
+const (
+	Accepted Outcome = iota
+	Rejected
+	Stale
+)
+
+// A job to search nonces in.
+type Job struct {
+	// The blob to hash, with the nonce at offset 39, NonceSize (4 or 8)
+	// bytes little endian.
+	Blob      []byte
+	NonceSize int
+	Algorithm cryptonight.Algorithm
+	Height    uint64
+	// The nonces searched, from FirstNonce to LastNonce.
+	FirstNonce uint64
+	LastNonce  uint64
+	// Whether a digest is worth submitting.
+	IsSolution func(digest []byte) bool
+	// Submits a nonce and its digest.
+	Submit func(ctx context.Context, nonce uint64, digest []byte) Outcome
+}
+
+// Mines the current job of a source on several threads, and submits
+// the solutions it finds.
+type Miner struct {
+	threads int
+	current func() (*Job, <-chan struct{})
+
+	hashes   atomic.Uint64
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+	stale    atomic.Uint64
+
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// current returns the job to mine, nil if there is none, and a channel
+// closed as soon as it's replaced. threads must be at least 1.
+func NewMiner(threads int, current func() (*Job, <-chan struct{})) *Miner {
+	return &Miner{threads: threads, current: current, changed: make(chan struct{})}
+}
+
+// Mines until ctx ends. Thread i hashes the nonces FirstNonce + i,
+// FirstNonce + i + threads... of every job, until the job changes or
+// its nonces run out.
+func (m *Miner) Run(ctx context.Context) {
+	var wait sync.WaitGroup
+	for i := 0; i < m.threads; i++ {
+		wait.Add(1)
+		go func(thread int) {
+			defer wait.Done()
+			m.mine(ctx, uint64(thread))
+		}(i)
+	}
+	wait.Wait()
+}
+
+func (m *Miner) Stats() Stats {
+	return Stats{
+		Hashes:   m.hashes.Load(),
+		Accepted: m.accepted.Load(),
+		Rejected: m.rejected.Load(),
+		Stale:    m.stale.Load(),
+	}
+}
+
+// Returns the statistics, and a channel closed as soon as the outcome
+// of a submitted solution is counted. Hashes alone don't close it.
+func (m *Miner) CurrentStats() (Stats, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Stats(), m.changed
+}
+
+// Runs on its own OS thread, which keeps its scratchpad between
+// hashes (without a cryptonight.SetScratchpadLimit): scheduled on any
+// thread, the hashes of a thread could leave scratchpads on several.
+func (m *Miner) mine(ctx context.Context, thread uint64) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for ctx.Err() == nil {
+		job, changed := m.current()
+		if job != nil {
+			m.mineJob(ctx, job, changed, thread)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (m *Miner) mineJob(ctx context.Context, job *Job, changed <-chan struct{}, thread uint64) {
+	blob := append([]byte(nil), job.Blob...)
+	step := uint64(m.threads)
+	last := job.LastNonce
+	if job.FirstNonce > last || last-job.FirstNonce < thread {
+		return
+	}
+	for nonce := job.FirstNonce + thread; ; nonce += step {
+		select {
+		case <-changed:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+		if job.NonceSize == 4 {
+			binary.LittleEndian.PutUint32(blob[39:], uint32(nonce))
+		} else {
+			binary.LittleEndian.PutUint64(blob[39:], nonce)
+		}
+		digest := job.Algorithm.Hash(blob, job.Height)
+		m.hashes.Add(1)
+		if job.IsSolution(digest) {
+			go m.submit(ctx, job, nonce, digest)
+		}
+		if last-nonce < step {
+			return
+		}
+	}
+}
+
+func (m *Miner) submit(ctx context.Context, job *Job, nonce uint64, digest []byte) {
+	switch job.Submit(ctx, nonce, digest) {
+	case Accepted:
+		m.accepted.Add(1)
+	case Rejected:
+		m.rejected.Add(1)
+	default:
+		m.stale.Add(1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
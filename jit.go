@@ -0,0 +1,73 @@
+package cryptonight
+
+/*
+#include "hash-ops.h"
+*/
+import "C"
+
+// On x86-64, variant 4 can compile each block height's random math
+// program to machine code instead of interpreting it. The JIT is off
+// unless the MONERO_USE_CNV4_JIT environment variable is set (same as
+// in Monero), or until EnableV4JIT is called.
+//
+// If generating the machine code fails for a hash (the program didn't
+// fit in the buffer, or the thread couldn't get executable memory),
+// that hash is computed with the v4_random_math interpreter instead
+// and the failure is counted. Hash results are identical either way,
+// so a failure only costs speed, never correctness.
+
+// Turns the variant 4 JIT on or off for the whole process. Has no
+// effect on platforms other than x86-64, where the JIT is always off.
+func EnableV4JIT(enable bool) {
+	C.cn_set_v4_jit(boolToCInt(enable))
+}
+
+// Reports whether variant 4 hashes currently try to use the JIT.
+func V4JITEnabled() bool {
+	return C.cn_v4_jit_enabled() != 0
+}
+
+// If disable is true, the first JIT failure turns the JIT off for the
+// rest of the process instead of retrying code generation on every
+// hash. Defaults to false.
+func SetV4JITDisableOnFailure(disable bool) {
+	C.cn_set_v4_jit_disable_on_failure(boolToCInt(disable))
+}
+
+// Returns how many variant 4 hashes fell back to the interpreter
+// because JIT code generation failed, since the process started.
+func V4JITFailures() uint64 {
+	return uint64(C.cn_v4_jit_failures())
+}
+
+// Turns the generated CryptonightR main loop on or off for the whole
+// process. With it on, variant 4 hashes on x86-64 CPUs with AES-NI
+// run the whole main loop as machine code generated for the block
+// height, with the random math program inlined, instead of C code
+// calling the random math separately. It doesn't depend on
+// EnableV4JIT, and is off by default. Hashes the loop doesn't apply
+// to (multi hashes, 64 bit registers, software AES) use the C loop,
+// with the same results.
+func EnableV4AsmLoop(enable bool) {
+	C.cn_set_v4_asm_loop(boolToCInt(enable))
+}
+
+// Reports whether variant 4 hashes currently use the generated main
+// loop where they can.
+func V4AsmLoopEnabled() bool {
+	return C.cn_v4_asm_loop_enabled() != 0
+}
+
+// Limits the buffer the JIT may write machine code into, so that
+// tests can force code generation to fail. Sizes above the 4096 bytes
+// actually mapped are clamped.
+func setV4JITBufferSize(size int) {
+	C.cn_set_v4_jit_buffer_size(C.size_t(size))
+}
+
+func boolToCInt(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package cryptonight
+
+import (
+	"bytes"
+	"encoding/hex"
+	"runtime"
+	"testing"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestV4JITFallback(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("the variant 4 JIT is only available on x86-64")
+	}
+	was_enabled := V4JITEnabled()
+	defer EnableV4JIT(was_enabled)
+	defer SetV4JITDisableOnFailure(false)
+	defer setV4JITBufferSize(4096)
+
+	// First test case from tests-slow-4.txt, see TestHashVariant4.
+	input := hexutil.MustDecode("0x5468697320697320612074657374205468697320697320612074657374205468697320697320612074657374")
+	expected_hash := hexutil.MustDecode("0xf759588ad57e758467295443a9bd71490abff8e9dad1b95b6bf2f5d0d78387bc")
+
+	// With a working JIT nothing gets counted.
+	EnableV4JIT(true)
+	failures := V4JITFailures()
+	actual_hash := hashVariant4(input, 1806260 /*block_height*/)
+	if !bytes.Equal(actual_hash, expected_hash) {
+		t.Error("Unexpected JIT result: ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+	}
+	if V4JITFailures() != failures {
+		t.Error("Unexpected JIT failure count: ", V4JITFailures(), " versus ", failures)
+	}
+
+	// A buffer this small can't even hold the prologue, so code
+	// generation fails and the interpreter has to produce the same
+	// hash.
+	setV4JITBufferSize(16)
+	actual_hash = hashVariant4(input, 1806260 /*block_height*/)
+	if !bytes.Equal(actual_hash, expected_hash) {
+		t.Error("Unexpected fallback result: ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+	}
+	if V4JITFailures() != failures+1 {
+		t.Error("Unexpected JIT failure count: ", V4JITFailures(), " versus ", failures+1)
+	}
+	if !V4JITEnabled() {
+		t.Error("JIT was disabled although SetV4JITDisableOnFailure wasn't called")
+	}
+
+	SetV4JITDisableOnFailure(true)
+	actual_hash = hashVariant4(input, 1806260 /*block_height*/)
+	if !bytes.Equal(actual_hash, expected_hash) {
+		t.Error("Unexpected fallback result: ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+	}
+	if V4JITFailures() != failures+2 {
+		t.Error("Unexpected JIT failure count: ", V4JITFailures(), " versus ", failures+2)
+	}
+	if V4JITEnabled() {
+		t.Error("JIT still enabled after a failure with SetV4JITDisableOnFailure(true)")
+	}
+}
+
+func TestV4AsmLoop(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("the generated main loop is only available on x86-64")
+	}
+	defer EnableV4AsmLoop(V4AsmLoopEnabled())
+	defer setV4JITBufferSize(4096)
+
+	// All of tests-slow-4.txt, see TestHashVariant4, and a smaller
+	// scratchpad. Every hash must match the C loop's, with AES-NI (the
+	// only case the generated loop handles) and without.
+	cases := []struct {
+		input        string
+		block_height uint64
+	}{
+		{"0x5468697320697320612074657374205468697320697320612074657374205468697320697320612074657374", 1806260},
+		{"0x4c6f72656d20697073756d20646f6c6f722073697420616d65742c20636f6e73656374657475722061646970697363696e67", 1806261},
+		{"0x656c69742c2073656420646f20656975736d6f642074656d706f7220696e6369646964756e74207574206c61626f7265", 1806262},
+		{"0x657420646f6c6f7265206d61676e6120616c697175612e20557420656e696d206164206d696e696d2076656e69616d2c", 1806263},
+		{"0x71756973206e6f737472756420657865726369746174696f6e20756c6c616d636f206c61626f726973206e697369", 1806264},
+		{"0x757420616c697175697020657820656120636f6d6d6f646f20636f6e7365717561742e20447569732061757465", 1806265},
+		{"0x697275726520646f6c6f7220696e20726570726568656e646572697420696e20766f6c7570746174652076656c6974", 1806266},
+		{"0x657373652063696c6c756d20646f6c6f726520657520667567696174206e756c6c612070617269617475722e", 1806267},
+		{"0x4578636570746575722073696e74206f6363616563617420637570696461746174206e6f6e2070726f6964656e742c", 1806268},
+		{"0x73756e7420696e2063756c706120717569206f666669636961206465736572756e74206d6f6c6c697420616e696d20696420657374206c61626f72756d2e", 1806269},
+	}
+	for _, impl := range []AESImplementation{AESHardware, AESTables} {
+		SetAESImplementation(impl)
+		for _, algorithm := range []Algorithm{CNR, CNDevR} {
+			for _, c := range cases {
+				input := hexutil.MustDecode(c.input)
+				EnableV4AsmLoop(false)
+				expected_hash := algorithm.Hash(input, c.block_height)
+				EnableV4AsmLoop(true)
+				actual_hash := algorithm.Hash(input, c.block_height)
+				if !bytes.Equal(actual_hash, expected_hash) {
+					t.Error(algorithm, " at ", c.block_height, " with ", CurrentAESImplementation(), ": unexpected result ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+				}
+			}
+		}
+	}
+	SetAESImplementation(AESAuto)
+
+	// A loop that doesn't fit falls back to the C loop.
+	input := hexutil.MustDecode(cases[0].input)
+	expected_hash := hexutil.MustDecode("0xf759588ad57e758467295443a9bd71490abff8e9dad1b95b6bf2f5d0d78387bc")
+	setV4JITBufferSize(64)
+	actual_hash := CNR.Hash(input, cases[0].block_height)
+	if !bytes.Equal(actual_hash, expected_hash) {
+		t.Error("Unexpected fallback result: ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+	}
+}
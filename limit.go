@@ -0,0 +1,212 @@
+package cryptonight
+
+/*
+#include "hash-ops.h"
+*/
+import "C"
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Every OS thread that hashes keeps its scratchpad (and on x86-64 a
+// page for the variant 4 JIT), and Go starts a new thread for every
+// goroutine blocked in a cgo call. A burst of hashes from many
+// goroutines can therefore leave dozens of scratchpads behind, which
+// small machines can't afford.
+//
+// SetScratchpadLimit caps how many scratchpads hashes use at once.
+// Callers beyond the cap wait their turn, in order, and the
+// HashXxxContext functions give up waiting when their context ends.
+// With a limit set, threads also give their scratchpads back after
+// every hash, to be reused by whichever thread hashes next, so the
+// number of scratchpads stays within the limit no matter how many
+// threads there are (apart from preallocated ones, and those threads
+// kept from before the limit was set, until their next hash). RandomX
+// isn't limited, its memory is in the cache or dataset.
+
+// Statistics of the scratchpad limit, see CurrentScratchpadLimitStats.
+type ScratchpadLimitStats struct {
+	// The limit, 0 if there is none.
+	Limit int
+	// Scratchpads used by hashes right now, and the most used at once.
+	InUse int
+	Peak  int
+	// Callers waiting right now.
+	Waiting int
+	// Callers which had to wait before hashing, and callers whose
+	// context ended while waiting.
+	Waits    uint64
+	Canceled uint64
+	// Total and longest time callers waited, canceled ones included.
+	WaitTime time.Duration
+	MaxWait  time.Duration
+}
+
+type scratchpadLimiter struct {
+	lock    sync.Mutex
+	limit   int
+	in_use  int
+	waiters list.List // of *scratchpadWaiter, in arrival order
+	stats   ScratchpadLimitStats
+}
+
+type scratchpadWaiter struct {
+	count int
+	ready chan struct{} // closed once the scratchpads are granted
+}
+
+var scratchpadLimit scratchpadLimiter
+
+// Caps the number of scratchpads hashes use at once, for the whole
+// process. 0 (the default) means no limit. A multi hash takes a
+// scratchpad per way, and one with more ways than the limit hashes
+// them in turns of at most the limit.
+func SetScratchpadLimit(limit int) {
+	if limit < 0 {
+		limit = 0
+	}
+	l := &scratchpadLimit
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = limit
+	C.cn_set_scratchpad_reuse(C.size_t(limit))
+	l.grant()
+}
+
+// Returns the limit set by SetScratchpadLimit.
+func ScratchpadLimit() int {
+	l := &scratchpadLimit
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limit
+}
+
+// Returns the statistics since the process started, or since
+// ResetScratchpadLimitStats.
+func CurrentScratchpadLimitStats() ScratchpadLimitStats {
+	l := &scratchpadLimit
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	stats := l.stats
+	stats.Limit = l.limit
+	stats.InUse = l.in_use
+	stats.Waiting = l.waiters.Len()
+	return stats
+}
+
+// Zeroes the wait statistics and restarts the peak from the number of
+// scratchpads in use.
+func ResetScratchpadLimitStats() {
+	l := &scratchpadLimit
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stats = ScratchpadLimitStats{Peak: l.in_use}
+}
+
+// Runs hash once a scratchpad is free under the limit, or returns
+// ctx's error if it ends first.
+func withScratchpad(ctx context.Context, hash func()) error {
+	return withScratchpadsUpTo(ctx, 1, func(int) { hash() })
+}
+
+// Runs hash once up to count scratchpads, but no more than the limit,
+// are free under the limit, with the number taken, or returns ctx's
+// error if it ends first. hash must not use more than it's given.
+func withScratchpadsUpTo(ctx context.Context, count int, hash func(taken int)) error {
+	taken, err := scratchpadLimit.acquire(ctx, count)
+	if err != nil {
+		return err
+	}
+	defer scratchpadLimit.release(taken)
+	hash(taken)
+	return nil
+}
+
+// Waits until count scratchpads (at most the limit) are free under the
+// limit and takes them, or returns ctx's error if it ends first.
+// Returns how many were taken, to be given back to release, which is
+// less than count if the limit is.
+func (l *scratchpadLimiter) acquire(ctx context.Context, count int) (int, error) {
+	l.lock.Lock()
+	if l.limit > 0 && count > l.limit {
+		count = l.limit
+	}
+	if l.waiters.Len() == 0 && l.fits(count) {
+		l.take(count)
+		l.lock.Unlock()
+		return count, nil
+	}
+	waiter := &scratchpadWaiter{count: count, ready: make(chan struct{})}
+	element := l.waiters.PushBack(waiter)
+	l.lock.Unlock()
+
+	start := time.Now()
+	select {
+	case <-waiter.ready:
+		l.lock.Lock()
+		l.stats.Waits++
+		l.waited(time.Since(start))
+		l.lock.Unlock()
+		return waiter.count, nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		select {
+		case <-waiter.ready:
+			// Granted just as the context ended, so pass them on.
+			l.in_use -= waiter.count
+		default:
+			l.waiters.Remove(element)
+		}
+		l.stats.Canceled++
+		l.waited(time.Since(start))
+		l.grant()
+		return 0, ctx.Err()
+	}
+}
+
+// Gives back the count scratchpads acquire took.
+func (l *scratchpadLimiter) release(count int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.in_use -= count
+	l.grant()
+}
+
+func (l *scratchpadLimiter) fits(count int) bool {
+	return l.limit == 0 || l.in_use+count <= l.limit
+}
+
+func (l *scratchpadLimiter) take(count int) {
+	l.in_use += count
+	if l.in_use > l.stats.Peak {
+		l.stats.Peak = l.in_use
+	}
+}
+
+func (l *scratchpadLimiter) waited(wait time.Duration) {
+	l.stats.WaitTime += wait
+	if wait > l.stats.MaxWait {
+		l.stats.MaxWait = wait
+	}
+}
+
+// Grants scratchpads to waiters in order, as long as they fit. Called
+// with the lock held.
+func (l *scratchpadLimiter) grant() {
+	for front := l.waiters.Front(); front != nil; front = l.waiters.Front() {
+		waiter := front.Value.(*scratchpadWaiter)
+		if l.limit > 0 && waiter.count > l.limit {
+			waiter.count = l.limit
+		}
+		if !l.fits(waiter.count) {
+			return
+		}
+		l.waiters.Remove(front)
+		l.take(waiter.count)
+		close(waiter.ready)
+	}
+}
@@ -0,0 +1,100 @@
+package cryptonight
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestScratchpadLimit(t *testing.T) {
+	defer SetScratchpadLimit(ScratchpadLimit())
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var nonce uint64 = 0xc526c0a1000008dc
+	expected_digest, _ := HashVariant1ForEthereumHeader(block_header_bytes, nonce)
+
+	SetScratchpadLimit(1)
+	ResetScratchpadLimitStats()
+
+	// With the only scratchpad taken, a context that ends gives up.
+	taken, _ := scratchpadLimit.acquire(context.Background(), 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, _, err := HashAlgorithmForEthereumHeaderContext(ctx, CN1, block_header_bytes, nonce, 0 /*block_height*/)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Error("Unexpected error: ", err)
+	}
+
+	// One that doesn't waits until the scratchpad is free.
+	done := make(chan []byte)
+	go func() {
+		digest, _ := HashVariant1ForEthereumHeader(block_header_bytes, nonce)
+		done <- digest
+	}()
+	for CurrentScratchpadLimitStats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	scratchpadLimit.release(taken)
+	if digest := <-done; !bytes.Equal(digest, expected_digest) {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+	}
+	stats := CurrentScratchpadLimitStats()
+	if stats.Limit != 1 || stats.InUse != 0 || stats.Peak != 1 || stats.Waiting != 0 || stats.Waits != 1 || stats.Canceled != 1 {
+		t.Error("Unexpected stats: ", stats)
+	}
+	// Both waits took at least 20ms.
+	if stats.MaxWait < 20*time.Millisecond || stats.WaitTime < 40*time.Millisecond {
+		t.Error("Unexpected wait times: ", stats)
+	}
+
+	// Concurrent hashes never use more scratchpads than the limit, nor
+	// leave more behind, however many threads they run on.
+	SetScratchpadLimit(2)
+	ResetScratchpadLimitStats()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			digest, _, err := HashAlgorithmForEthereumHeaderContext(ctx, CN1, block_header_bytes, nonce, 0 /*block_height*/)
+			if err != nil || !bytes.Equal(digest, expected_digest) {
+				t.Error("Unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest), ", error ", err)
+			}
+		}()
+	}
+	// A multi hash with more ways than the limit hashes them in turns.
+	digests, _ := HashAlgorithmForEthereumHeaderMulti(CN1, block_header_bytes, nonce, 3, 0 /*block_height*/)
+	for i, digest := range digests {
+		expected, _ := HashVariant1ForEthereumHeader(block_header_bytes, nonce+uint64(i))
+		if !bytes.Equal(digest, expected) {
+			t.Error("Unexpected multi digest ", i, ": ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected))
+		}
+	}
+	wg.Wait()
+	if stats := CurrentScratchpadLimitStats(); stats.Peak != 2 || stats.InUse != 0 {
+		t.Error("Unexpected stats: ", stats)
+	}
+	if runtime.GOARCH == "amd64" {
+		kept := func() int {
+			return countScratchpads(func(s ScratchpadInfo) bool { return !s.Preallocated && !s.InUse })
+		}
+		if count := kept(); count == 0 || count > 2 {
+			t.Error("Unexpected number of kept scratchpads: ", count)
+		}
+		// Without a limit, the kept ones are freed.
+		SetScratchpadLimit(0)
+		if count := kept(); count != 0 {
+			t.Error("Kept scratchpads left without a limit: ", count)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// RandomX's AES based generators and hash. They use single x86 style AES
+// rounds (AESENC and AESDEC: one round with the key xored in last), with
+// AES-NI when cn_slow_hash uses it (see cn_aes_impl) and lookup tables
+// otherwise. The AES-NI functions are compiled for it whatever the
+// compiler flags, and only called once cpuid says the CPU has it.
+
+#include <string.h>
+
+#include "hash-ops.h"
+#include "randomx-internal.h"
+
+#if defined(__x86_64__)
+#include <wmmintrin.h>
+#define RX_HAVE_AESNI 1
+#define RX_AESNI_TARGET __attribute__((target("aes")))
+#endif
+
+// The generator keys and the hash state are the first bytes of Blake2b-512
+// of "RandomX AesGenerator1R keys", "RandomX AesGenerator4R keys 0-3",
+// "RandomX AesGenerator4R keys 4-7" and "RandomX AesHash1R state". The
+// extra hash keys are the reference implementation's constants
+static const uint32_t aes_gen_1r_keys[16] = {
+  0x6daca553, 0x62716609, 0xdbb5552b, 0xb4f44917,
+  0x6d7caf07, 0x846a710d, 0x1725d378, 0x0da1dc4e,
+  0x3f1262f1, 0x9f947ec6, 0xf4c0794f, 0x3e20e345,
+  0x6aef8135, 0xb1ba317c, 0x16314c88, 0x49169154
+};
+
+static const uint32_t aes_gen_4r_keys[32] = {
+  0x6421aadd, 0xd1833ddb, 0x2f546d2b, 0x99e5d23f,
+  0xb20e3450, 0xb6913f55, 0x06f79d53, 0xa5dfcde5,
+  0x5c3ed904, 0x515e7baf, 0x0aa4679f, 0x171c02bf,
+  0x85623763, 0xe78f5d08, 0xcd673785, 0xd8ded291,
+  0xb5826f73, 0xe3d6a7a6, 0x3d518b6d, 0x229effb4,
+  0xc7566bf3, 0x9c10b3d9, 0xe9024d4e, 0xb272b7d2,
+  0xf273c9e7, 0xf765a38b, 0x2ba9660a, 0xf63befa7,
+  0x7a7cd609, 0x915839de, 0x0c06d1fd, 0xc0b0762d
+};
+
+static const uint32_t aes_hash_1r_state[16] = {
+  0x92b52c0d, 0x9fa856de, 0xcc82db47, 0xd7983aad,
+  0x338d996e, 0x15c7b798, 0xf59e125a, 0xace78057,
+  0x6a770017, 0xae62c7d0, 0x5079506b, 0xe8a07ce4,
+  0x630a240c, 0x07ad828d, 0x79a10005, 0x7e994948
+};
+
+static const uint32_t aes_hash_1r_xkeys[8] = {
+  0xf6fa8389, 0x8b24949f, 0x90dc56bf, 0x06890201,
+  0x61b263d1, 0x51f4e03c, 0xee1043c6, 0xed18f99b
+};
+
+// A 16 byte AES state as 4 little endian columns
+typedef struct { uint32_t w[4]; } aes_state;
+
+static uint32_t enc_table[4][256];
+static uint32_t dec_table[4][256];
+
+static uint8_t gf_mul(uint8_t a, uint8_t b)
+{
+  uint8_t p = 0;
+  while (b) {
+    if (b & 1)
+      p ^= a;
+    a = (uint8_t)((a << 1) ^ ((a & 0x80) ? 0x1b : 0));
+    b >>= 1;
+  }
+  return p;
+}
+
+// Runs when the program is loaded, so the tables never need locking
+__attribute__((constructor)) static void init_tables(void)
+{
+  uint8_t sbox[256], inv_sbox[256];
+
+  for (int x = 0; x < 256; ++x) {
+    // Multiplicative inverse, then the affine transformation
+    uint8_t inv = 0;
+    for (int y = 1; x != 0 && y < 256; ++y) {
+      if (gf_mul((uint8_t)x, (uint8_t)y) == 1) {
+        inv = (uint8_t)y;
+        break;
+      }
+    }
+    uint8_t s = inv;
+    for (int i = 1; i < 5; ++i)
+      s ^= (uint8_t)((inv << i) | (inv >> (8 - i)));
+    sbox[x] = s ^ 0x63;
+  }
+  for (int x = 0; x < 256; ++x)
+    inv_sbox[sbox[x]] = (uint8_t)x;
+
+  for (int x = 0; x < 256; ++x) {
+    uint8_t s = sbox[x], i = inv_sbox[x];
+    uint32_t e = (uint32_t)gf_mul(s, 2) | ((uint32_t)s << 8) | ((uint32_t)s << 16) | ((uint32_t)gf_mul(s, 3) << 24);
+    uint32_t d = (uint32_t)gf_mul(i, 14) | ((uint32_t)gf_mul(i, 9) << 8) | ((uint32_t)gf_mul(i, 13) << 16) | ((uint32_t)gf_mul(i, 11) << 24);
+    for (int t = 0; t < 4; ++t) {
+      enc_table[t][x] = t == 0 ? e : (e << (8 * t)) | (e >> (32 - 8 * t));
+      dec_table[t][x] = t == 0 ? d : (d << (8 * t)) | (d >> (32 - 8 * t));
+    }
+  }
+}
+
+// Same as AESENC: ShiftRows, SubBytes, MixColumns, xor with the key
+static inline void soft_aesenc(aes_state *s, const aes_state *key)
+{
+  const uint32_t *w = s->w;
+  uint32_t out[4];
+  for (int c = 0; c < 4; ++c) {
+    out[c] = enc_table[0][w[c] & 0xff]
+      ^ enc_table[1][(w[(c + 1) & 3] >> 8) & 0xff]
+      ^ enc_table[2][(w[(c + 2) & 3] >> 16) & 0xff]
+      ^ enc_table[3][w[(c + 3) & 3] >> 24]
+      ^ key->w[c];
+  }
+  memcpy(s->w, out, sizeof(out));
+}
+
+// Same as AESDEC: InvShiftRows, InvSubBytes, InvMixColumns, xor with the key
+static inline void soft_aesdec(aes_state *s, const aes_state *key)
+{
+  const uint32_t *w = s->w;
+  uint32_t out[4];
+  for (int c = 0; c < 4; ++c) {
+    out[c] = dec_table[0][w[c] & 0xff]
+      ^ dec_table[1][(w[(c + 3) & 3] >> 8) & 0xff]
+      ^ dec_table[2][(w[(c + 2) & 3] >> 16) & 0xff]
+      ^ dec_table[3][w[(c + 1) & 3] >> 24]
+      ^ key->w[c];
+  }
+  memcpy(s->w, out, sizeof(out));
+}
+
+static void load_state(aes_state *s, const void *p)
+{
+  for (int i = 0; i < 4; ++i)
+    s->w[i] = rx_load32((const uint8_t *)p + 4 * i);
+}
+
+static void store_state(void *p, const aes_state *s)
+{
+  for (int i = 0; i < 4; ++i)
+    rx_store32((uint8_t *)p + 4 * i, s->w[i]);
+}
+
+static void load_keys(aes_state *keys, const uint32_t *words, int count)
+{
+  for (int i = 0; i < count; ++i)
+    memcpy(keys[i].w, words + 4 * i, sizeof(keys[i].w));
+}
+
+// Same switch as cn_slow_hash: the CPU's AES-NI, unless
+// MONERO_USE_SOFTWARE_AES or cn_set_aes_impl asks for software AES
+static int use_aesni(void)
+{
+#if defined(RX_HAVE_AESNI)
+  return cn_aes_impl() == CN_AES_HW;
+#else
+  return 0;
+#endif
+}
+
+#if defined(RX_HAVE_AESNI)
+static inline __m128i key_vec(const uint32_t *words)
+{
+  return _mm_loadu_si128((const __m128i *)words);
+}
+
+static RX_AESNI_TARGET void fill_aes_1rx4_ni(void *state, size_t output_size, void *buffer)
+{
+  uint8_t *out = (uint8_t *)buffer;
+  const uint8_t *end = out + output_size;
+  __m128i k0 = key_vec(aes_gen_1r_keys), k1 = key_vec(aes_gen_1r_keys + 4);
+  __m128i k2 = key_vec(aes_gen_1r_keys + 8), k3 = key_vec(aes_gen_1r_keys + 12);
+  __m128i s0 = _mm_loadu_si128((const __m128i *)state);
+  __m128i s1 = _mm_loadu_si128((const __m128i *)state + 1);
+  __m128i s2 = _mm_loadu_si128((const __m128i *)state + 2);
+  __m128i s3 = _mm_loadu_si128((const __m128i *)state + 3);
+
+  while (out < end) {
+    s0 = _mm_aesdec_si128(s0, k0);
+    s1 = _mm_aesenc_si128(s1, k1);
+    s2 = _mm_aesdec_si128(s2, k2);
+    s3 = _mm_aesenc_si128(s3, k3);
+    _mm_storeu_si128((__m128i *)out, s0);
+    _mm_storeu_si128((__m128i *)out + 1, s1);
+    _mm_storeu_si128((__m128i *)out + 2, s2);
+    _mm_storeu_si128((__m128i *)out + 3, s3);
+    out += 64;
+  }
+  _mm_storeu_si128((__m128i *)state, s0);
+  _mm_storeu_si128((__m128i *)state + 1, s1);
+  _mm_storeu_si128((__m128i *)state + 2, s2);
+  _mm_storeu_si128((__m128i *)state + 3, s3);
+}
+
+static RX_AESNI_TARGET void fill_aes_4rx4_ni(const void *state, size_t output_size, void *buffer)
+{
+  uint8_t *out = (uint8_t *)buffer;
+  const uint8_t *end = out + output_size;
+  __m128i k[8];
+  for (int i = 0; i < 8; ++i)
+    k[i] = key_vec(aes_gen_4r_keys + 4 * i);
+  __m128i s0 = _mm_loadu_si128((const __m128i *)state);
+  __m128i s1 = _mm_loadu_si128((const __m128i *)state + 1);
+  __m128i s2 = _mm_loadu_si128((const __m128i *)state + 2);
+  __m128i s3 = _mm_loadu_si128((const __m128i *)state + 3);
+
+  while (out < end) {
+    for (int r = 0; r < 4; ++r) {
+      s0 = _mm_aesdec_si128(s0, k[r]);
+      s1 = _mm_aesenc_si128(s1, k[r]);
+      s2 = _mm_aesdec_si128(s2, k[r + 4]);
+      s3 = _mm_aesenc_si128(s3, k[r + 4]);
+    }
+    _mm_storeu_si128((__m128i *)out, s0);
+    _mm_storeu_si128((__m128i *)out + 1, s1);
+    _mm_storeu_si128((__m128i *)out + 2, s2);
+    _mm_storeu_si128((__m128i *)out + 3, s3);
+    out += 64;
+  }
+}
+
+static RX_AESNI_TARGET void hash_aes_1rx4_ni(const void *input, size_t input_size, void *hash)
+{
+  const uint8_t *in = (const uint8_t *)input;
+  const uint8_t *end = in + input_size;
+  __m128i s0 = key_vec(aes_hash_1r_state), s1 = key_vec(aes_hash_1r_state + 4);
+  __m128i s2 = key_vec(aes_hash_1r_state + 8), s3 = key_vec(aes_hash_1r_state + 12);
+
+  while (in < end) {
+    s0 = _mm_aesenc_si128(s0, _mm_loadu_si128((const __m128i *)in));
+    s1 = _mm_aesdec_si128(s1, _mm_loadu_si128((const __m128i *)in + 1));
+    s2 = _mm_aesenc_si128(s2, _mm_loadu_si128((const __m128i *)in + 2));
+    s3 = _mm_aesdec_si128(s3, _mm_loadu_si128((const __m128i *)in + 3));
+    in += 64;
+  }
+  for (int i = 0; i < 2; ++i) {
+    __m128i x = key_vec(aes_hash_1r_xkeys + 4 * i);
+    s0 = _mm_aesenc_si128(s0, x);
+    s1 = _mm_aesdec_si128(s1, x);
+    s2 = _mm_aesenc_si128(s2, x);
+    s3 = _mm_aesdec_si128(s3, x);
+  }
+  _mm_storeu_si128((__m128i *)hash, s0);
+  _mm_storeu_si128((__m128i *)hash + 1, s1);
+  _mm_storeu_si128((__m128i *)hash + 2, s2);
+  _mm_storeu_si128((__m128i *)hash + 3, s3);
+}
+#endif
+
+// Fills buffer with AES rounds of the 64 byte state, one round per 64
+// bytes, and leaves the last output in state. Used for the scratchpad
+void rx_fill_aes_1rx4(void *state, size_t output_size, void *buffer)
+{
+#if defined(RX_HAVE_AESNI)
+  if (use_aesni()) {
+    fill_aes_1rx4_ni(state, output_size, buffer);
+    return;
+  }
+#endif
+  uint8_t *out = (uint8_t *)buffer;
+  const uint8_t *end = out + output_size;
+  aes_state keys[4], s[4];
+
+  load_keys(keys, aes_gen_1r_keys, 4);
+  for (int i = 0; i < 4; ++i)
+    load_state(&s[i], (const uint8_t *)state + 16 * i);
+
+  while (out < end) {
+    soft_aesdec(&s[0], &keys[0]);
+    soft_aesenc(&s[1], &keys[1]);
+    soft_aesdec(&s[2], &keys[2]);
+    soft_aesenc(&s[3], &keys[3]);
+    for (int i = 0; i < 4; ++i)
+      store_state(out + 16 * i, &s[i]);
+    out += 64;
+  }
+  for (int i = 0; i < 4; ++i)
+    store_state((uint8_t *)state + 16 * i, &s[i]);
+}
+
+// Same as rx_fill_aes_1rx4 with 4 rounds per 64 bytes, leaving the state
+// alone. Used for the programs
+void rx_fill_aes_4rx4(const void *state, size_t output_size, void *buffer)
+{
+#if defined(RX_HAVE_AESNI)
+  if (use_aesni()) {
+    fill_aes_4rx4_ni(state, output_size, buffer);
+    return;
+  }
+#endif
+  uint8_t *out = (uint8_t *)buffer;
+  const uint8_t *end = out + output_size;
+  aes_state keys[8], s[4];
+
+  load_keys(keys, aes_gen_4r_keys, 8);
+  for (int i = 0; i < 4; ++i)
+    load_state(&s[i], (const uint8_t *)state + 16 * i);
+
+  while (out < end) {
+    for (int r = 0; r < 4; ++r) {
+      soft_aesdec(&s[0], &keys[r]);
+      soft_aesenc(&s[1], &keys[r]);
+      soft_aesdec(&s[2], &keys[r + 4]);
+      soft_aesenc(&s[3], &keys[r + 4]);
+    }
+    for (int i = 0; i < 4; ++i)
+      store_state(out + 16 * i, &s[i]);
+    out += 64;
+  }
+}
+
+// Hashes input, a multiple of 64 bytes, into 64 bytes. Used for the
+// scratchpad at the end
+void rx_hash_aes_1rx4(const void *input, size_t input_size, void *hash)
+{
+#if defined(RX_HAVE_AESNI)
+  if (use_aesni()) {
+    hash_aes_1rx4_ni(input, input_size, hash);
+    return;
+  }
+#endif
+  const uint8_t *in = (const uint8_t *)input;
+  const uint8_t *end = in + input_size;
+  aes_state s[4], keys[2], block;
+
+  load_keys(s, aes_hash_1r_state, 4);
+  load_keys(keys, aes_hash_1r_xkeys, 2);
+
+  while (in < end) {
+    load_state(&block, in);
+    soft_aesenc(&s[0], &block);
+    load_state(&block, in + 16);
+    soft_aesdec(&s[1], &block);
+    load_state(&block, in + 32);
+    soft_aesenc(&s[2], &block);
+    load_state(&block, in + 48);
+    soft_aesdec(&s[3], &block);
+    in += 64;
+  }
+  for (int i = 0; i < 2; ++i) {
+    soft_aesenc(&s[0], &keys[i]);
+    soft_aesdec(&s[1], &keys[i]);
+    soft_aesenc(&s[2], &keys[i]);
+    soft_aesdec(&s[3], &keys[i]);
+  }
+  for (int i = 0; i < 4; ++i)
+    store_state((uint8_t *)hash + 16 * i, &s[i]);
+}
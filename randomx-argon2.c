@@ -0,0 +1,160 @@
+// Argon2d (RFC 9106, version 0x13) restricted to what RandomX needs: one
+// lane, the memory filled in place and no final tag. The key is the
+// password and RANDOMX_ARGON_SALT the salt.
+
+#include <string.h>
+
+#include "blake2b.h"
+#include "randomx-internal.h"
+
+#define ARGON2_QWORDS_IN_BLOCK (RX_ARGON_BLOCK_SIZE / 8)
+#define ARGON2_SYNC_POINTS     4
+#define ARGON2_PREHASH_DIGEST_LENGTH 64
+#define ARGON2_PREHASH_SEED_LENGTH   72
+#define ARGON2_VERSION_NUMBER  0x13
+#define ARGON2_TYPE_D          0
+
+typedef struct { uint64_t v[ARGON2_QWORDS_IN_BLOCK]; } argon2_block;
+
+static inline uint64_t fBlaMka(uint64_t x, uint64_t y)
+{
+  const uint64_t m = 0xFFFFFFFFULL;
+  return x + y + 2 * ((x & m) * (y & m));
+}
+
+#define G(a, b, c, d) \
+  do { \
+    a = fBlaMka(a, b); d = rx_rotr(d ^ a, 32); \
+    c = fBlaMka(c, d); b = rx_rotr(b ^ c, 24); \
+    a = fBlaMka(a, b); d = rx_rotr(d ^ a, 16); \
+    c = fBlaMka(c, d); b = rx_rotr(b ^ c, 63); \
+  } while (0)
+
+#define BLAKE2_ROUND_NOMSG(v0, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10, v11, v12, v13, v14, v15) \
+  do { \
+    G(v0, v4, v8, v12); G(v1, v5, v9, v13); G(v2, v6, v10, v14); G(v3, v7, v11, v15); \
+    G(v0, v5, v10, v15); G(v1, v6, v11, v12); G(v2, v7, v8, v13); G(v3, v4, v9, v14); \
+  } while (0)
+
+// next = P(prev ^ ref) ^ prev ^ ref, also xored with the old next when
+// overwriting a block in later passes
+static void fill_block(const argon2_block *prev, const argon2_block *ref, argon2_block *next, int with_xor)
+{
+  argon2_block r, tmp;
+
+  for (int i = 0; i < ARGON2_QWORDS_IN_BLOCK; ++i)
+    r.v[i] = ref->v[i] ^ prev->v[i];
+  tmp = r;
+  if (with_xor) {
+    for (int i = 0; i < ARGON2_QWORDS_IN_BLOCK; ++i)
+      tmp.v[i] ^= next->v[i];
+  }
+
+  uint64_t *v = r.v;
+  for (int i = 0; i < 8; ++i) {
+    BLAKE2_ROUND_NOMSG(
+      v[16 * i], v[16 * i + 1], v[16 * i + 2], v[16 * i + 3],
+      v[16 * i + 4], v[16 * i + 5], v[16 * i + 6], v[16 * i + 7],
+      v[16 * i + 8], v[16 * i + 9], v[16 * i + 10], v[16 * i + 11],
+      v[16 * i + 12], v[16 * i + 13], v[16 * i + 14], v[16 * i + 15]);
+  }
+  for (int i = 0; i < 8; ++i) {
+    BLAKE2_ROUND_NOMSG(
+      v[2 * i], v[2 * i + 1], v[2 * i + 16], v[2 * i + 17],
+      v[2 * i + 32], v[2 * i + 33], v[2 * i + 48], v[2 * i + 49],
+      v[2 * i + 64], v[2 * i + 65], v[2 * i + 80], v[2 * i + 81],
+      v[2 * i + 96], v[2 * i + 97], v[2 * i + 112], v[2 * i + 113]);
+  }
+
+  for (int i = 0; i < ARGON2_QWORDS_IN_BLOCK; ++i)
+    next->v[i] = tmp.v[i] ^ r.v[i];
+}
+
+#undef G
+#undef BLAKE2_ROUND_NOMSG
+
+static void load_block(argon2_block *dst, const uint8_t *input)
+{
+  for (int i = 0; i < ARGON2_QWORDS_IN_BLOCK; ++i)
+    dst->v[i] = rx_load64(input + 8 * i);
+}
+
+// H0 over the parameters and inputs, then the first two blocks
+static void initialize(argon2_block *memory, const void *key, size_t key_size)
+{
+  uint8_t blockhash[ARGON2_PREHASH_SEED_LENGTH];
+  uint8_t value[4];
+  uint8_t bytes[RX_ARGON_BLOCK_SIZE];
+  blake2b_state S;
+
+  blake2b_init(&S, ARGON2_PREHASH_DIGEST_LENGTH);
+  rx_store32(value, 1); // lanes
+  blake2b_update(&S, value, sizeof(value));
+  rx_store32(value, 0); // tag length, RandomX doesn't compute the tag
+  blake2b_update(&S, value, sizeof(value));
+  rx_store32(value, RANDOMX_ARGON_MEMORY);
+  blake2b_update(&S, value, sizeof(value));
+  rx_store32(value, RANDOMX_ARGON_ITERATIONS);
+  blake2b_update(&S, value, sizeof(value));
+  rx_store32(value, ARGON2_VERSION_NUMBER);
+  blake2b_update(&S, value, sizeof(value));
+  rx_store32(value, ARGON2_TYPE_D);
+  blake2b_update(&S, value, sizeof(value));
+  rx_store32(value, (uint32_t)key_size);
+  blake2b_update(&S, value, sizeof(value));
+  blake2b_update(&S, key, key_size);
+  rx_store32(value, sizeof(RANDOMX_ARGON_SALT) - 1);
+  blake2b_update(&S, value, sizeof(value));
+  blake2b_update(&S, RANDOMX_ARGON_SALT, sizeof(RANDOMX_ARGON_SALT) - 1);
+  rx_store32(value, 0); // secret
+  blake2b_update(&S, value, sizeof(value));
+  rx_store32(value, 0); // associated data
+  blake2b_update(&S, value, sizeof(value));
+  blake2b_final(&S, blockhash, ARGON2_PREHASH_DIGEST_LENGTH);
+
+  for (uint32_t i = 0; i < 2; ++i) {
+    rx_store32(blockhash + ARGON2_PREHASH_DIGEST_LENGTH, i);
+    rx_store32(blockhash + ARGON2_PREHASH_DIGEST_LENGTH + 4, 0); // lane
+    blake2b_long(bytes, RX_ARGON_BLOCK_SIZE, blockhash, ARGON2_PREHASH_SEED_LENGTH);
+    load_block(&memory[i], bytes);
+  }
+}
+
+void rx_argon2d_fill(uint8_t *cache_memory, const void *key, size_t key_size)
+{
+  argon2_block *memory = (argon2_block *)cache_memory;
+  const uint32_t lane_length = RANDOMX_ARGON_MEMORY;
+  const uint32_t segment_length = lane_length / ARGON2_SYNC_POINTS;
+
+  initialize(memory, key, key_size);
+
+  for (uint32_t pass = 0; pass < RANDOMX_ARGON_ITERATIONS; ++pass) {
+    for (uint32_t slice = 0; slice < ARGON2_SYNC_POINTS; ++slice) {
+      uint32_t starting_index = (pass == 0 && slice == 0) ? 2 : 0;
+      uint32_t curr_offset = slice * segment_length + starting_index;
+      uint32_t prev_offset = (curr_offset % lane_length == 0) ? curr_offset + lane_length - 1 : curr_offset - 1;
+
+      for (uint32_t i = starting_index; i < segment_length; ++i, ++curr_offset, ++prev_offset) {
+        if (curr_offset % lane_length == 1)
+          prev_offset = curr_offset - 1;
+
+        // Argon2d: the reference block depends on the previous block
+        uint64_t pseudo_rand = memory[prev_offset].v[0];
+        uint32_t reference_area_size;
+        if (pass == 0)
+          reference_area_size = slice * segment_length + i - 1;
+        else
+          reference_area_size = lane_length - segment_length + i - 1;
+        uint64_t relative_position = pseudo_rand & 0xFFFFFFFFULL;
+        relative_position = (relative_position * relative_position) >> 32;
+        relative_position = reference_area_size - 1 - ((reference_area_size * relative_position) >> 32);
+        uint32_t start_position = 0;
+        if (pass != 0)
+          start_position = (slice == ARGON2_SYNC_POINTS - 1) ? 0 : (slice + 1) * segment_length;
+        uint32_t ref_index = (uint32_t)((start_position + relative_position) % lane_length);
+
+        fill_block(&memory[prev_offset], &memory[ref_index], &memory[curr_offset], pass != 0);
+      }
+    }
+  }
+}
@@ -0,0 +1,151 @@
+// Internals of the RandomX interpreter, see randomx.h
+
+#pragma once
+
+#include <stddef.h>
+#include <stdint.h>
+
+#include "randomx.h"
+
+// Monero's parameters, see configuration.md in the RandomX repository
+#define RANDOMX_ARGON_MEMORY        262144
+#define RANDOMX_ARGON_ITERATIONS    3
+#define RANDOMX_ARGON_SALT          "RandomX\x03"
+#define RANDOMX_CACHE_ACCESSES      8
+#define RANDOMX_SUPERSCALAR_LATENCY 170
+#define RANDOMX_DATASET_BASE_SIZE   2147483648ULL
+#define RANDOMX_DATASET_EXTRA_SIZE  33554368ULL
+#define RANDOMX_PROGRAM_SIZE        256
+#define RANDOMX_PROGRAM_ITERATIONS  2048
+#define RANDOMX_PROGRAM_COUNT       8
+#define RANDOMX_SCRATCHPAD_L3       2097152
+#define RANDOMX_SCRATCHPAD_L2       262144
+#define RANDOMX_SCRATCHPAD_L1       16384
+#define RANDOMX_JUMP_BITS           8
+#define RANDOMX_JUMP_OFFSET         8
+
+#define RX_ARGON_BLOCK_SIZE   1024
+#define RX_CACHE_SIZE         ((uint64_t)RANDOMX_ARGON_MEMORY * RX_ARGON_BLOCK_SIZE)
+#define RX_CACHE_LINE_SIZE    64
+#define RX_DATASET_ITEMS      ((RANDOMX_DATASET_BASE_SIZE + RANDOMX_DATASET_EXTRA_SIZE) / RX_CACHE_LINE_SIZE)
+#define RX_SUPERSCALAR_MAX_SIZE (3 * RANDOMX_SUPERSCALAR_LATENCY + 2)
+
+// One 8 byte instruction of a program, the same layout for the VM and
+// the superscalar programs
+struct rx_instruction {
+  uint8_t opcode;
+  uint8_t dst;
+  uint8_t src;
+  uint8_t mod;
+  uint32_t imm32;
+};
+
+struct rx_superscalar_program {
+  struct rx_instruction code[RX_SUPERSCALAR_MAX_SIZE];
+  uint32_t size;
+  int address_register;
+};
+
+struct randomx_cache {
+  uint8_t *memory;
+  struct rx_superscalar_program programs[RANDOMX_CACHE_ACCESSES];
+};
+
+struct randomx_dataset {
+  uint8_t *memory;
+};
+
+// Generates pseudo-random bytes by repeatedly hashing a 64 byte buffer
+// with Blake2b, used to generate the superscalar programs
+struct rx_blake2_generator {
+  uint8_t data[64];
+  size_t index;
+};
+
+void rx_blake2_generator_init(struct rx_blake2_generator *gen, const void *seed, size_t seed_size, uint32_t nonce);
+uint8_t rx_blake2_generator_byte(struct rx_blake2_generator *gen);
+uint32_t rx_blake2_generator_uint32(struct rx_blake2_generator *gen);
+
+// Argon2d with RandomX's parameters, fills the cache memory
+void rx_argon2d_fill(uint8_t *memory, const void *key, size_t key_size);
+
+void rx_generate_superscalar(struct rx_superscalar_program *prog, struct rx_blake2_generator *gen);
+void rx_execute_superscalar(uint64_t r[8], const struct rx_superscalar_program *prog);
+void rx_init_dataset_item(const randomx_cache *cache, uint8_t *out, uint64_t item_number);
+uint64_t rx_reciprocal(uint64_t divisor);
+
+// The AES based generators and hash, state and hash are 64 bytes
+void rx_fill_aes_1rx4(void *state, size_t output_size, void *buffer);
+void rx_fill_aes_4rx4(const void *state, size_t output_size, void *buffer);
+void rx_hash_aes_1rx4(const void *input, size_t input_size, void *hash);
+
+static inline uint64_t rx_load64(const void *p)
+{
+  const uint8_t *b = (const uint8_t *)p;
+  return (uint64_t)b[0] | ((uint64_t)b[1] << 8) | ((uint64_t)b[2] << 16) | ((uint64_t)b[3] << 24) |
+    ((uint64_t)b[4] << 32) | ((uint64_t)b[5] << 40) | ((uint64_t)b[6] << 48) | ((uint64_t)b[7] << 56);
+}
+
+static inline uint32_t rx_load32(const void *p)
+{
+  const uint8_t *b = (const uint8_t *)p;
+  return (uint32_t)b[0] | ((uint32_t)b[1] << 8) | ((uint32_t)b[2] << 16) | ((uint32_t)b[3] << 24);
+}
+
+static inline void rx_store64(void *p, uint64_t v)
+{
+  uint8_t *b = (uint8_t *)p;
+  for (int i = 0; i < 8; ++i)
+    b[i] = (uint8_t)(v >> (8 * i));
+}
+
+static inline void rx_store32(void *p, uint32_t v)
+{
+  uint8_t *b = (uint8_t *)p;
+  for (int i = 0; i < 4; ++i)
+    b[i] = (uint8_t)(v >> (8 * i));
+}
+
+static inline uint64_t rx_rotr(uint64_t x, unsigned n)
+{
+  n &= 63;
+  return n == 0 ? x : (x >> n) | (x << (64 - n));
+}
+
+static inline uint64_t rx_rotl(uint64_t x, unsigned n)
+{
+  n &= 63;
+  return n == 0 ? x : (x << n) | (x >> (64 - n));
+}
+
+static inline uint64_t rx_sign_extend(uint32_t x)
+{
+  return (uint64_t)(int64_t)(int32_t)x;
+}
+
+static inline uint64_t rx_mulh(uint64_t a, uint64_t b)
+{
+#if defined(__SIZEOF_INT128__)
+  return (uint64_t)(((unsigned __int128)a * b) >> 64);
+#else
+  uint64_t a_lo = (uint32_t)a, a_hi = a >> 32, b_lo = (uint32_t)b, b_hi = b >> 32;
+  uint64_t lo_lo = a_lo * b_lo, hi_lo = a_hi * b_lo, lo_hi = a_lo * b_hi, hi_hi = a_hi * b_hi;
+  uint64_t cross = (lo_lo >> 32) + (uint32_t)hi_lo + lo_hi;
+  return (hi_lo >> 32) + (cross >> 32) + hi_hi;
+#endif
+}
+
+static inline int64_t rx_smulh(int64_t a, int64_t b)
+{
+  uint64_t hi = rx_mulh((uint64_t)a, (uint64_t)b);
+  if (a < 0)
+    hi -= (uint64_t)b;
+  if (b < 0)
+    hi -= (uint64_t)a;
+  return (int64_t)hi;
+}
+
+static inline int rx_is_zero_or_power_of_2(uint64_t x)
+{
+  return (x & (x - 1)) == 0;
+}
@@ -0,0 +1,642 @@
+// RandomX superscalar programs, which turn the cache into the dataset.
+//
+// The generator simulates an Intel Ivy Bridge style core: each cycle it
+// decodes 16 bytes of x86 code in one of six slot layouts, schedules the
+// resulting macro-ops on ports P0, P1 and P5, and stops once the ports are
+// saturated for RANDOMX_SUPERSCALAR_LATENCY cycles. Every step draws from
+// the Blake2 generator, so the simulation has to match the reference
+// implementation exactly.
+
+#include <string.h>
+
+#include "blake2b.h"
+#include "randomx-internal.h"
+
+void rx_blake2_generator_init(struct rx_blake2_generator *gen, const void *seed, size_t seed_size, uint32_t nonce)
+{
+  memset(gen->data, 0, sizeof(gen->data));
+  if (seed_size > 60)
+    seed_size = 60;
+  memcpy(gen->data, seed, seed_size);
+  rx_store32(gen->data + 60, nonce);
+  gen->index = sizeof(gen->data);
+}
+
+static void blake2_generator_check(struct rx_blake2_generator *gen, size_t bytes_needed)
+{
+  if (gen->index + bytes_needed > sizeof(gen->data)) {
+    uint8_t in[64];
+    memcpy(in, gen->data, sizeof(in));
+    blake2b(gen->data, sizeof(gen->data), in, sizeof(in), NULL, 0);
+    gen->index = 0;
+  }
+}
+
+uint8_t rx_blake2_generator_byte(struct rx_blake2_generator *gen)
+{
+  blake2_generator_check(gen, 1);
+  return gen->data[gen->index++];
+}
+
+uint32_t rx_blake2_generator_uint32(struct rx_blake2_generator *gen)
+{
+  blake2_generator_check(gen, 4);
+  uint32_t v = rx_load32(gen->data + gen->index);
+  gen->index += 4;
+  return v;
+}
+
+enum ss_type {
+  SS_ISUB_R = 0,
+  SS_IXOR_R,
+  SS_IADD_RS,
+  SS_IMUL_R,
+  SS_IROR_C,
+  SS_IADD_C7,
+  SS_IXOR_C7,
+  SS_IADD_C8,
+  SS_IXOR_C8,
+  SS_IADD_C9,
+  SS_IXOR_C9,
+  SS_IMULH_R,
+  SS_ISMULH_R,
+  SS_IMUL_RCP,
+  SS_INVALID = -1
+};
+
+enum ss_port {
+  PORT_NULL = 0,
+  PORT_P0 = 1,
+  PORT_P1 = 2,
+  PORT_P5 = 4,
+  PORT_P01 = PORT_P0 | PORT_P1,
+  PORT_P05 = PORT_P0 | PORT_P5,
+  PORT_P015 = PORT_P0 | PORT_P1 | PORT_P5
+};
+
+struct ss_macro_op {
+  int size;
+  int latency;
+  int uop1;
+  int uop2;
+  int dependent;
+};
+
+static const struct ss_macro_op MOP_SUB_RR = { 3, 1, PORT_P015, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_XOR_RR = { 3, 1, PORT_P015, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_LEA_SIB = { 4, 1, PORT_P01, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_IMUL_RR = { 4, 3, PORT_P1, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_ROR_RI = { 4, 1, PORT_P05, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_ADD_RI = { 7, 1, PORT_P015, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_XOR_RI = { 7, 1, PORT_P015, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_MOV_RR = { 3, 0, PORT_NULL, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_MUL_R = { 3, 4, PORT_P1, PORT_P5, 0 };
+static const struct ss_macro_op MOP_IMUL_R = { 3, 4, PORT_P1, PORT_P5, 0 };
+static const struct ss_macro_op MOP_MOV_RI64 = { 10, 1, PORT_P015, PORT_NULL, 0 };
+static const struct ss_macro_op MOP_IMUL_RR_DEP = { 4, 3, PORT_P1, PORT_NULL, 1 };
+
+struct ss_info {
+  enum ss_type type;
+  int size;
+  const struct ss_macro_op *ops[3];
+  int result_op;
+  int dst_op;
+  int src_op;
+};
+
+static const struct ss_info INFO_ISUB_R = { SS_ISUB_R, 1, { &MOP_SUB_RR }, 0, 0, 0 };
+static const struct ss_info INFO_IXOR_R = { SS_IXOR_R, 1, { &MOP_XOR_RR }, 0, 0, 0 };
+static const struct ss_info INFO_IADD_RS = { SS_IADD_RS, 1, { &MOP_LEA_SIB }, 0, 0, 0 };
+static const struct ss_info INFO_IMUL_R = { SS_IMUL_R, 1, { &MOP_IMUL_RR }, 0, 0, 0 };
+static const struct ss_info INFO_IROR_C = { SS_IROR_C, 1, { &MOP_ROR_RI }, 0, 0, -1 };
+static const struct ss_info INFO_IADD_C7 = { SS_IADD_C7, 1, { &MOP_ADD_RI }, 0, 0, -1 };
+static const struct ss_info INFO_IXOR_C7 = { SS_IXOR_C7, 1, { &MOP_XOR_RI }, 0, 0, -1 };
+static const struct ss_info INFO_IADD_C8 = { SS_IADD_C8, 1, { &MOP_ADD_RI }, 0, 0, -1 };
+static const struct ss_info INFO_IXOR_C8 = { SS_IXOR_C8, 1, { &MOP_XOR_RI }, 0, 0, -1 };
+static const struct ss_info INFO_IADD_C9 = { SS_IADD_C9, 1, { &MOP_ADD_RI }, 0, 0, -1 };
+static const struct ss_info INFO_IXOR_C9 = { SS_IXOR_C9, 1, { &MOP_XOR_RI }, 0, 0, -1 };
+static const struct ss_info INFO_IMULH_R = { SS_IMULH_R, 3, { &MOP_MOV_RR, &MOP_MUL_R, &MOP_MOV_RR }, 1, 0, 1 };
+static const struct ss_info INFO_ISMULH_R = { SS_ISMULH_R, 3, { &MOP_MOV_RR, &MOP_IMUL_R, &MOP_MOV_RR }, 1, 0, 1 };
+static const struct ss_info INFO_IMUL_RCP = { SS_IMUL_RCP, 2, { &MOP_MOV_RI64, &MOP_IMUL_RR_DEP }, 1, 1, -1 };
+static const struct ss_info INFO_NOP = { SS_INVALID, 0, { NULL }, 0, 0, 0 };
+
+static const struct ss_info *const slot_3[] = { &INFO_ISUB_R, &INFO_IXOR_R };
+static const struct ss_info *const slot_3L[] = { &INFO_ISUB_R, &INFO_IXOR_R, &INFO_IMULH_R, &INFO_ISMULH_R };
+static const struct ss_info *const slot_4[] = { &INFO_IROR_C, &INFO_IADD_RS };
+static const struct ss_info *const slot_7[] = { &INFO_IXOR_C7, &INFO_IADD_C7 };
+static const struct ss_info *const slot_8[] = { &INFO_IXOR_C8, &INFO_IADD_C8 };
+static const struct ss_info *const slot_9[] = { &INFO_IXOR_C9, &INFO_IADD_C9 };
+
+// Instruction slot sizes of the 16 byte decode window
+struct ss_decoder_buffer {
+  int index;
+  int size;
+  int counts[4];
+};
+
+static const struct ss_decoder_buffer BUFFER_DEFAULT = { -1, 0, { 0 } };
+static const struct ss_decoder_buffer BUFFER_484 = { 0, 3, { 4, 8, 4 } };
+static const struct ss_decoder_buffer BUFFER_7333 = { 1, 4, { 7, 3, 3, 3 } };
+static const struct ss_decoder_buffer BUFFER_3733 = { 2, 4, { 3, 7, 3, 3 } };
+static const struct ss_decoder_buffer BUFFER_493 = { 3, 3, { 4, 9, 3 } };
+static const struct ss_decoder_buffer BUFFER_4444 = { 4, 4, { 4, 4, 4, 4 } };
+static const struct ss_decoder_buffer BUFFER_3310 = { 5, 3, { 3, 3, 10 } };
+
+static const struct ss_decoder_buffer *const random_buffers[4] = {
+  &BUFFER_484, &BUFFER_7333, &BUFFER_3733, &BUFFER_493
+};
+
+static const struct ss_decoder_buffer *fetch_next(enum ss_type type, int cycle, int mul_count, struct rx_blake2_generator *gen)
+{
+  // The full 128 bit multiplications decode to 2 uOPs on Intel, which
+  // only fits a 3-3-10 window
+  if (type == SS_IMULH_R || type == SS_ISMULH_R)
+    return &BUFFER_3310;
+  // Keep the multiplication port saturated
+  if (mul_count < cycle + 1)
+    return &BUFFER_4444;
+  // IMUL_RCP's multiplication has to start the next window
+  if (type == SS_IMUL_RCP)
+    return (rx_blake2_generator_byte(gen) & 1) ? &BUFFER_484 : &BUFFER_493;
+  return random_buffers[rx_blake2_generator_byte(gen) & 3];
+}
+
+struct ss_register {
+  int latency;
+  int last_op_group;
+  int last_op_par;
+};
+
+struct ss_instruction {
+  const struct ss_info *info;
+  int src;
+  int dst;
+  int mod;
+  uint32_t imm32;
+  int op_group;
+  int op_group_par;
+  int can_reuse;
+  int group_par_is_source;
+};
+
+static void ss_create(struct ss_instruction *ins, const struct ss_info *info, struct rx_blake2_generator *gen)
+{
+  ins->info = info;
+  ins->src = -1;
+  ins->dst = -1;
+  ins->can_reuse = 0;
+  ins->group_par_is_source = 0;
+  ins->mod = 0;
+  ins->imm32 = 0;
+
+  switch (info->type) {
+  case SS_ISUB_R:
+    // Subtraction and addition commute, so they're the same group
+    ins->op_group = SS_IADD_RS;
+    ins->group_par_is_source = 1;
+    break;
+  case SS_IXOR_R:
+    ins->op_group = SS_IXOR_R;
+    ins->group_par_is_source = 1;
+    break;
+  case SS_IADD_RS:
+    ins->mod = rx_blake2_generator_byte(gen);
+    ins->op_group = SS_IADD_RS;
+    ins->group_par_is_source = 1;
+    break;
+  case SS_IMUL_R:
+    ins->op_group = SS_IMUL_R;
+    ins->group_par_is_source = 1;
+    break;
+  case SS_IROR_C:
+    do {
+      ins->imm32 = rx_blake2_generator_byte(gen) & 63;
+    } while (ins->imm32 == 0);
+    ins->op_group = SS_IROR_C;
+    ins->op_group_par = -1;
+    break;
+  case SS_IADD_C7:
+  case SS_IADD_C8:
+  case SS_IADD_C9:
+    ins->imm32 = rx_blake2_generator_uint32(gen);
+    ins->op_group = SS_IADD_C7;
+    ins->op_group_par = -1;
+    break;
+  case SS_IXOR_C7:
+  case SS_IXOR_C8:
+  case SS_IXOR_C9:
+    ins->imm32 = rx_blake2_generator_uint32(gen);
+    ins->op_group = SS_IXOR_C7;
+    ins->op_group_par = -1;
+    break;
+  case SS_IMULH_R:
+    ins->can_reuse = 1;
+    ins->op_group = SS_IMULH_R;
+    ins->op_group_par = (int)rx_blake2_generator_uint32(gen);
+    break;
+  case SS_ISMULH_R:
+    ins->can_reuse = 1;
+    ins->op_group = SS_ISMULH_R;
+    ins->op_group_par = (int)rx_blake2_generator_uint32(gen);
+    break;
+  case SS_IMUL_RCP:
+    do {
+      ins->imm32 = rx_blake2_generator_uint32(gen);
+    } while (rx_is_zero_or_power_of_2(ins->imm32));
+    ins->op_group = SS_IMUL_RCP;
+    ins->op_group_par = -1;
+    break;
+  default:
+    break;
+  }
+}
+
+static void ss_create_for_slot(struct ss_instruction *ins, struct rx_blake2_generator *gen, int slot_size, int fetch_type, int is_last)
+{
+  switch (slot_size) {
+  case 3:
+    // Only the last slot can take the multiplications' extra macro-ops
+    if (is_last)
+      ss_create(ins, slot_3L[rx_blake2_generator_byte(gen) & 3], gen);
+    else
+      ss_create(ins, slot_3[rx_blake2_generator_byte(gen) & 1], gen);
+    break;
+  case 4:
+    // The 4-4-4-4 window issues multiplications in its first 3 slots
+    if (fetch_type == 4 && !is_last)
+      ss_create(ins, &INFO_IMUL_R, gen);
+    else
+      ss_create(ins, slot_4[rx_blake2_generator_byte(gen) & 1], gen);
+    break;
+  case 7:
+    ss_create(ins, slot_7[rx_blake2_generator_byte(gen) & 1], gen);
+    break;
+  case 8:
+    ss_create(ins, slot_8[rx_blake2_generator_byte(gen) & 1], gen);
+    break;
+  case 9:
+    ss_create(ins, slot_9[rx_blake2_generator_byte(gen) & 1], gen);
+    break;
+  case 10:
+    ss_create(ins, &INFO_IMUL_RCP, gen);
+    break;
+  }
+}
+
+static int select_register(const int *available, int count, struct rx_blake2_generator *gen, int *reg)
+{
+  int index;
+
+  if (count == 0)
+    return 0;
+  if (count > 1)
+    index = rx_blake2_generator_uint32(gen) % count;
+  else
+    index = 0;
+  *reg = available[index];
+  return 1;
+}
+
+// r5 can't be the destination of IADD_RS, the x86 lea instruction would
+// need a displacement
+#define REGISTER_NEEDS_DISPLACEMENT 5
+
+static int ss_select_destination(struct ss_instruction *ins, int cycle, int allow_chained_mul, const struct ss_register *registers, struct rx_blake2_generator *gen)
+{
+  int available[8];
+  int count = 0;
+
+  // The destination must be ready, differ from the source unless the
+  // instruction allows it, not be multiplied twice in a row, not have
+  // just been through the same operation, and not be r5 for IADD_RS
+  for (int i = 0; i < 8; ++i) {
+    if (registers[i].latency <= cycle
+        && (ins->can_reuse || i != ins->src)
+        && (allow_chained_mul || ins->op_group != SS_IMUL_R || registers[i].last_op_group != SS_IMUL_R)
+        && (registers[i].last_op_group != ins->op_group || registers[i].last_op_par != ins->op_group_par)
+        && (ins->info->type != SS_IADD_RS || i != REGISTER_NEEDS_DISPLACEMENT))
+      available[count++] = i;
+  }
+  return select_register(available, count, gen, &ins->dst);
+}
+
+static int ss_select_source(struct ss_instruction *ins, int cycle, const struct ss_register *registers, struct rx_blake2_generator *gen)
+{
+  int available[8];
+  int count = 0;
+
+  for (int i = 0; i < 8; ++i) {
+    if (registers[i].latency <= cycle)
+      available[count++] = i;
+  }
+  // With only 2 candidates for IADD_RS and one of them r5, r5 has to be
+  // the source
+  if (count == 2 && ins->info->type == SS_IADD_RS) {
+    if (available[0] == REGISTER_NEEDS_DISPLACEMENT || available[1] == REGISTER_NEEDS_DISPLACEMENT) {
+      ins->op_group_par = ins->src = REGISTER_NEEDS_DISPLACEMENT;
+      return 1;
+    }
+  }
+  if (select_register(available, count, gen, &ins->src)) {
+    if (ins->group_par_is_source)
+      ins->op_group_par = ins->src;
+    return 1;
+  }
+  return 0;
+}
+
+#define CYCLE_MAP_SIZE (RANDOMX_SUPERSCALAR_LATENCY + 4)
+#define LOOK_FORWARD_CYCLES 4
+#define MAX_THROWAWAY_COUNT 256
+
+// Ports are tried in the order P5, P0, P1, to keep P1 free for
+// multiplications
+static int schedule_uop(int uop, int port_busy[CYCLE_MAP_SIZE][3], int cycle, int commit)
+{
+  for (; cycle < CYCLE_MAP_SIZE; ++cycle) {
+    if ((uop & PORT_P5) != 0 && !port_busy[cycle][2]) {
+      if (commit)
+        port_busy[cycle][2] = uop;
+      return cycle;
+    }
+    if ((uop & PORT_P0) != 0 && !port_busy[cycle][0]) {
+      if (commit)
+        port_busy[cycle][0] = uop;
+      return cycle;
+    }
+    if ((uop & PORT_P1) != 0 && !port_busy[cycle][1]) {
+      if (commit)
+        port_busy[cycle][1] = uop;
+      return cycle;
+    }
+  }
+  return -1;
+}
+
+static int schedule_mop(const struct ss_macro_op *mop, int port_busy[CYCLE_MAP_SIZE][3], int cycle, int dep_cycle, int commit)
+{
+  // IMUL_RCP's multiplication waits for the constant to be loaded
+  if (mop->dependent && dep_cycle > cycle)
+    cycle = dep_cycle;
+  // Register moves are eliminated at rename
+  if (mop->uop1 == PORT_NULL)
+    return cycle;
+  if (mop->uop2 == PORT_NULL)
+    return schedule_uop(mop->uop1, port_busy, cycle, commit);
+  // Both uOPs have to go in the same cycle
+  for (; cycle < CYCLE_MAP_SIZE; ++cycle) {
+    int cycle1 = schedule_uop(mop->uop1, port_busy, cycle, 0);
+    int cycle2 = schedule_uop(mop->uop2, port_busy, cycle, 0);
+    if (cycle1 >= 0 && cycle1 == cycle2) {
+      if (commit) {
+        schedule_uop(mop->uop1, port_busy, cycle1, 1);
+        schedule_uop(mop->uop2, port_busy, cycle2, 1);
+      }
+      return cycle1;
+    }
+  }
+  return -1;
+}
+
+static int is_multiplication(enum ss_type type)
+{
+  return type == SS_IMUL_R || type == SS_IMULH_R || type == SS_ISMULH_R || type == SS_IMUL_RCP;
+}
+
+void rx_generate_superscalar(struct rx_superscalar_program *prog, struct rx_blake2_generator *gen)
+{
+  int port_busy[CYCLE_MAP_SIZE][3];
+  struct ss_register registers[8];
+  const struct ss_decoder_buffer *decode_buffer = &BUFFER_DEFAULT;
+  struct ss_instruction current;
+  int macro_op_index = 0;
+  int cycle = 0;
+  int dep_cycle = 0;
+  int ports_saturated = 0;
+  int program_size = 0;
+  int mul_count = 0;
+  int throw_away_count = 0;
+
+  memset(port_busy, 0, sizeof(port_busy));
+  for (int i = 0; i < 8; ++i) {
+    registers[i].latency = 0;
+    registers[i].last_op_group = SS_INVALID;
+    registers[i].last_op_par = -1;
+  }
+  memset(&current, 0, sizeof(current));
+  current.info = &INFO_NOP;
+
+  for (int decode_cycle = 0; decode_cycle < RANDOMX_SUPERSCALAR_LATENCY && !ports_saturated && program_size < RX_SUPERSCALAR_MAX_SIZE; ++decode_cycle) {
+    decode_buffer = fetch_next(current.info->type, decode_cycle, mul_count, gen);
+    int buffer_index = 0;
+
+    while (buffer_index < decode_buffer->size) {
+      int top_cycle = cycle;
+
+      if (macro_op_index >= current.info->size) {
+        if (ports_saturated || program_size >= RX_SUPERSCALAR_MAX_SIZE)
+          break;
+        ss_create_for_slot(&current, gen, decode_buffer->counts[buffer_index], decode_buffer->index, decode_buffer->size == buffer_index + 1);
+        macro_op_index = 0;
+      }
+      const struct ss_macro_op *mop = current.info->ops[macro_op_index];
+
+      int schedule_cycle = schedule_mop(mop, port_busy, cycle, dep_cycle, 0);
+      if (schedule_cycle < 0) {
+        ports_saturated = 1;
+        break;
+      }
+
+      if (macro_op_index == current.info->src_op) {
+        int forward;
+        // Wait up to LOOK_FORWARD_CYCLES for an operand
+        for (forward = 0; forward < LOOK_FORWARD_CYCLES && !ss_select_source(&current, schedule_cycle, registers, gen); ++forward) {
+          ++schedule_cycle;
+          ++cycle;
+        }
+        if (forward == LOOK_FORWARD_CYCLES) {
+          if (throw_away_count < MAX_THROWAWAY_COUNT) {
+            throw_away_count++;
+            macro_op_index = current.info->size;
+            continue;
+          }
+          current.info = &INFO_NOP;
+          break;
+        }
+      }
+      if (macro_op_index == current.info->dst_op) {
+        int forward;
+        for (forward = 0; forward < LOOK_FORWARD_CYCLES && !ss_select_destination(&current, schedule_cycle, throw_away_count > 0, registers, gen); ++forward) {
+          ++schedule_cycle;
+          ++cycle;
+        }
+        if (forward == LOOK_FORWARD_CYCLES) {
+          if (throw_away_count < MAX_THROWAWAY_COUNT) {
+            throw_away_count++;
+            macro_op_index = current.info->size;
+            continue;
+          }
+          current.info = &INFO_NOP;
+          break;
+        }
+      }
+      throw_away_count = 0;
+
+      // Now that the operands are known, schedule for real
+      schedule_cycle = schedule_mop(mop, port_busy, schedule_cycle, schedule_cycle, 1);
+      if (schedule_cycle < 0) {
+        ports_saturated = 1;
+        break;
+      }
+      dep_cycle = schedule_cycle + mop->latency;
+
+      if (macro_op_index == current.info->result_op) {
+        struct ss_register *ri = &registers[current.dst];
+        ri->latency = dep_cycle;
+        ri->last_op_group = current.op_group;
+        ri->last_op_par = current.op_group_par;
+      }
+      buffer_index++;
+      macro_op_index++;
+
+      if (schedule_cycle >= RANDOMX_SUPERSCALAR_LATENCY)
+        ports_saturated = 1;
+      cycle = top_cycle;
+
+      if (macro_op_index >= current.info->size) {
+        struct rx_instruction *instr = &prog->code[program_size++];
+        instr->opcode = (uint8_t)current.info->type;
+        instr->dst = (uint8_t)current.dst;
+        instr->src = (uint8_t)(current.src >= 0 ? current.src : current.dst);
+        instr->mod = (uint8_t)current.mod;
+        instr->imm32 = current.imm32;
+        mul_count += is_multiplication(current.info->type);
+      }
+    }
+    ++cycle;
+  }
+
+  // The address register is the one with the longest dependency chain,
+  // assuming an ASIC with 1 cycle latency and unlimited parallelism
+  int asic_latencies[8] = { 0 };
+  for (int i = 0; i < program_size; ++i) {
+    const struct rx_instruction *instr = &prog->code[i];
+    int lat_dst = asic_latencies[instr->dst] + 1;
+    int lat_src = instr->dst != instr->src ? asic_latencies[instr->src] + 1 : 0;
+    asic_latencies[instr->dst] = lat_dst > lat_src ? lat_dst : lat_src;
+  }
+  int asic_latency_max = 0;
+  int address_reg = 0;
+  for (int i = 0; i < 8; ++i) {
+    if (asic_latencies[i] > asic_latency_max) {
+      asic_latency_max = asic_latencies[i];
+      address_reg = i;
+    }
+  }
+
+  prog->size = program_size;
+  prog->address_register = address_reg;
+}
+
+uint64_t rx_reciprocal(uint64_t divisor)
+{
+  const uint64_t p2exp63 = 1ULL << 63;
+  uint64_t quotient = p2exp63 / divisor, remainder = p2exp63 % divisor;
+  unsigned bsr = 0;
+
+  for (uint64_t bit = divisor; bit > 0; bit >>= 1)
+    bsr++;
+  for (unsigned shift = 0; shift < bsr; shift++) {
+    if (remainder >= divisor - remainder) {
+      quotient = quotient * 2 + 1;
+      remainder = remainder * 2 - divisor;
+    } else {
+      quotient = quotient * 2;
+      remainder = remainder * 2;
+    }
+  }
+  return quotient;
+}
+
+void rx_execute_superscalar(uint64_t r[8], const struct rx_superscalar_program *prog)
+{
+  for (uint32_t j = 0; j < prog->size; ++j) {
+    const struct rx_instruction *instr = &prog->code[j];
+    switch ((enum ss_type)instr->opcode) {
+    case SS_ISUB_R:
+      r[instr->dst] -= r[instr->src];
+      break;
+    case SS_IXOR_R:
+      r[instr->dst] ^= r[instr->src];
+      break;
+    case SS_IADD_RS:
+      r[instr->dst] += r[instr->src] << ((instr->mod >> 2) % 4);
+      break;
+    case SS_IMUL_R:
+      r[instr->dst] *= r[instr->src];
+      break;
+    case SS_IROR_C:
+      r[instr->dst] = rx_rotr(r[instr->dst], instr->imm32);
+      break;
+    case SS_IADD_C7:
+    case SS_IADD_C8:
+    case SS_IADD_C9:
+      r[instr->dst] += rx_sign_extend(instr->imm32);
+      break;
+    case SS_IXOR_C7:
+    case SS_IXOR_C8:
+    case SS_IXOR_C9:
+      r[instr->dst] ^= rx_sign_extend(instr->imm32);
+      break;
+    case SS_IMULH_R:
+      r[instr->dst] = rx_mulh(r[instr->dst], r[instr->src]);
+      break;
+    case SS_ISMULH_R:
+      r[instr->dst] = (uint64_t)rx_smulh((int64_t)r[instr->dst], (int64_t)r[instr->src]);
+      break;
+    case SS_IMUL_RCP:
+      r[instr->dst] *= rx_reciprocal(instr->imm32);
+      break;
+    default:
+      break;
+    }
+  }
+}
+
+static const uint64_t superscalar_mul0 = 6364136223846793005ULL;
+static const uint64_t superscalar_add1 = 9298411001130361340ULL;
+static const uint64_t superscalar_add2 = 12065312585734608966ULL;
+static const uint64_t superscalar_add3 = 9306329213124626780ULL;
+static const uint64_t superscalar_add4 = 5281919268842080866ULL;
+static const uint64_t superscalar_add5 = 10536153434571861004ULL;
+static const uint64_t superscalar_add6 = 3398623926847679864ULL;
+static const uint64_t superscalar_add7 = 9549104520008361294ULL;
+
+void rx_init_dataset_item(const randomx_cache *cache, uint8_t *out, uint64_t item_number)
+{
+  const uint64_t mask = RX_CACHE_SIZE / RX_CACHE_LINE_SIZE - 1;
+  uint64_t rl[8];
+  uint64_t register_value = item_number;
+
+  rl[0] = (item_number + 1) * superscalar_mul0;
+  rl[1] = rl[0] ^ superscalar_add1;
+  rl[2] = rl[0] ^ superscalar_add2;
+  rl[3] = rl[0] ^ superscalar_add3;
+  rl[4] = rl[0] ^ superscalar_add4;
+  rl[5] = rl[0] ^ superscalar_add5;
+  rl[6] = rl[0] ^ superscalar_add6;
+  rl[7] = rl[0] ^ superscalar_add7;
+
+  for (int i = 0; i < RANDOMX_CACHE_ACCESSES; ++i) {
+    const uint8_t *mix_block = cache->memory + (register_value & mask) * RX_CACHE_LINE_SIZE;
+    const struct rx_superscalar_program *prog = &cache->programs[i];
+
+    rx_execute_superscalar(rl, prog);
+    for (int q = 0; q < 8; ++q)
+      rl[q] ^= rx_load64(mix_block + 8 * q);
+    register_value = rl[prog->address_register];
+  }
+
+  for (int q = 0; q < 8; ++q)
+    rx_store64(out + 8 * q, rl[q]);
+}
@@ -0,0 +1,624 @@
+// The RandomX virtual machine, an interpreter of its random programs.
+//
+// Every program is compiled into a table of operand pointers first, the
+// same way tevador's bytecode machine does, then run for
+// RANDOMX_PROGRAM_ITERATIONS iterations over the scratchpad. The floating
+// point instructions rely on the host's IEEE-754 doubles and fesetround for
+// CFROUND; the caller's rounding mode is restored before returning.
+
+#include <fenv.h>
+#include <math.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "blake2b.h"
+#include "randomx-internal.h"
+
+// The rounding mode changes (see set_rounding_mode) and the results are
+// consensus, so the compiler must neither fold nor move floating point
+// operations as if rounding to nearest, nor fuse multiplies and adds into
+// FMAs, which round once instead of twice: -frounding-math and
+// -ffp-contract=off, which cgo doesn't accept as flags.
+#if defined(__clang__)
+#pragma STDC FENV_ACCESS ON
+#pragma STDC FP_CONTRACT OFF
+#elif defined(__GNUC__)
+#pragma GCC optimize("rounding-math", "fp-contract=off")
+#endif
+
+#define SCRATCHPAD_L1_MASK   ((RANDOMX_SCRATCHPAD_L1 / 8 - 1) * 8)
+#define SCRATCHPAD_L2_MASK   ((RANDOMX_SCRATCHPAD_L2 / 8 - 1) * 8)
+#define SCRATCHPAD_L3_MASK   ((RANDOMX_SCRATCHPAD_L3 / 8 - 1) * 8)
+#define SCRATCHPAD_L3_MASK64 ((RANDOMX_SCRATCHPAD_L3 / 64 - 1) * 64)
+#define CACHE_LINE_ALIGN_MASK ((RANDOMX_DATASET_BASE_SIZE - 1) & ~(uint64_t)(RX_CACHE_LINE_SIZE - 1))
+#define DATASET_EXTRA_ITEMS  (RANDOMX_DATASET_EXTRA_SIZE / RX_CACHE_LINE_SIZE)
+#define CONDITION_MASK       ((1 << RANDOMX_JUMP_BITS) - 1)
+#define CONDITION_OFFSET     RANDOMX_JUMP_OFFSET
+#define STORE_L3_CONDITION   14
+#define REGISTER_NEEDS_DISPLACEMENT 5
+
+#define MANTISSA_SIZE 52
+#define DYNAMIC_MANTISSA_MASK ((1ULL << (MANTISSA_SIZE + 4)) - 1)
+#define SCALE_MASK 0x80F0000000000000ULL
+
+enum rx_opcode {
+  IADD_RS, IADD_M, ISUB_R, ISUB_M, IMUL_R, IMUL_M, IMULH_R, IMULH_M,
+  ISMULH_R, ISMULH_M, IMUL_RCP, INEG_R, IXOR_R, IXOR_M, IROR_R, IROL_R,
+  ISWAP_R, FSWAP_R, FADD_R, FADD_M, FSUB_R, FSUB_M, FSCAL_R, FMUL_R,
+  FDIV_M, FSQRT_R, CBRANCH, CFROUND, ISTORE, NOP
+};
+
+// Out of 256, in opcode order
+static const int opcode_frequencies[NOP] = {
+  16, 7, 16, 7, 16, 4, 4, 1,
+  4, 1, 8, 2, 15, 5, 8, 2,
+  4, 4, 16, 5, 16, 5, 6, 32,
+  4, 6, 25, 1, 16
+};
+
+typedef struct { double lo, hi; } rx_vec;
+
+struct rx_native_registers {
+  uint64_t r[8];
+  rx_vec f[4];
+  rx_vec e[4];
+  rx_vec a[4];
+};
+
+struct rx_bytecode {
+  enum rx_opcode type;
+  uint64_t *idst;
+  const uint64_t *isrc;
+  rx_vec *fdst;
+  const rx_vec *fsrc;
+  uint64_t imm;
+  int target;
+  int shift;
+  uint32_t mem_mask;
+};
+
+struct randomx_vm {
+  randomx_cache *cache;
+  randomx_dataset *dataset;
+  uint8_t *scratchpad;
+  uint8_t program[128 + 8 * RANDOMX_PROGRAM_SIZE];
+  struct rx_bytecode bytecode[RANDOMX_PROGRAM_SIZE];
+  struct rx_native_registers nreg;
+  uint64_t ma, mx;
+  uint64_t dataset_offset;
+  int read_reg[4];
+  uint64_t e_mask[2];
+  int rounding_mode;
+};
+
+static inline uint64_t double_bits(double x)
+{
+  uint64_t v;
+  memcpy(&v, &x, sizeof(v));
+  return v;
+}
+
+static inline double bits_double(uint64_t v)
+{
+  double x;
+  memcpy(&x, &v, sizeof(x));
+  return x;
+}
+
+static inline rx_vec load_int_vec(const uint8_t *p)
+{
+  rx_vec v;
+  v.lo = (double)(int32_t)rx_load32(p);
+  v.hi = (double)(int32_t)rx_load32(p + 4);
+  return v;
+}
+
+static inline rx_vec mask_exponent_mantissa(const randomx_vm *vm, rx_vec v)
+{
+  v.lo = bits_double((double_bits(v.lo) & DYNAMIC_MANTISSA_MASK) | vm->e_mask[0]);
+  v.hi = bits_double((double_bits(v.hi) & DYNAMIC_MANTISSA_MASK) | vm->e_mask[1]);
+  return v;
+}
+
+static void set_rounding_mode(randomx_vm *vm, int mode)
+{
+  static const int modes[4] = { FE_TONEAREST, FE_DOWNWARD, FE_UPWARD, FE_TOWARDZERO };
+  if (vm->rounding_mode != mode) {
+    fesetround(modes[mode]);
+    vm->rounding_mode = mode;
+  }
+}
+
+// A positive double in [1, 2^32), from the top and bottom bits of entropy
+static uint64_t small_positive_float_bits(uint64_t entropy)
+{
+  uint64_t exponent = entropy >> 59;
+  uint64_t mantissa = entropy & ((1ULL << MANTISSA_SIZE) - 1);
+  exponent += 1023;
+  exponent &= (1ULL << 11) - 1;
+  return (exponent << MANTISSA_SIZE) | mantissa;
+}
+
+static uint64_t float_mask(uint64_t entropy)
+{
+  const uint64_t mask22bit = (1ULL << 22) - 1;
+  uint64_t exponent = 0x300 | ((entropy >> 60) << 4);
+  return (entropy & mask22bit) | (exponent << MANTISSA_SIZE);
+}
+
+static uint64_t program_entropy(const randomx_vm *vm, int i)
+{
+  return rx_load64(vm->program + 8 * i);
+}
+
+static void program_instruction(const randomx_vm *vm, int i, struct rx_instruction *instr)
+{
+  const uint8_t *p = vm->program + 128 + 8 * i;
+  instr->opcode = p[0];
+  instr->dst = p[1];
+  instr->src = p[2];
+  instr->mod = p[3];
+  instr->imm32 = rx_load32(p + 4);
+}
+
+static const uint64_t zero = 0;
+
+static void compile_program(randomx_vm *vm)
+{
+  struct rx_native_registers *nreg = &vm->nreg;
+  int register_usage[8];
+  int ceil[NOP];
+  int total = 0;
+
+  for (int i = 0; i < NOP; ++i) {
+    total += opcode_frequencies[i];
+    ceil[i] = total;
+  }
+  for (int i = 0; i < 8; ++i)
+    register_usage[i] = -1;
+
+  for (int i = 0; i < RANDOMX_PROGRAM_SIZE; ++i) {
+    struct rx_instruction instr;
+    struct rx_bytecode *ibc = &vm->bytecode[i];
+    enum rx_opcode type = 0;
+
+    program_instruction(vm, i, &instr);
+    while (instr.opcode >= ceil[type])
+      type++;
+
+    const int dst = instr.dst % 8;
+    const int src = instr.src % 8;
+    const int mod_mem = instr.mod % 4;
+    const int mod_shift = (instr.mod >> 2) % 4;
+    const int mod_cond = instr.mod >> 4;
+    memset(ibc, 0, sizeof(*ibc));
+    ibc->type = type;
+
+    switch (type) {
+    case IADD_RS:
+      ibc->idst = &nreg->r[dst];
+      ibc->isrc = &nreg->r[src];
+      ibc->shift = mod_shift;
+      ibc->imm = dst == REGISTER_NEEDS_DISPLACEMENT ? rx_sign_extend(instr.imm32) : 0;
+      register_usage[dst] = i;
+      break;
+
+    case IADD_M:
+    case ISUB_M:
+    case IMUL_M:
+    case IMULH_M:
+    case ISMULH_M:
+    case IXOR_M:
+      ibc->idst = &nreg->r[dst];
+      ibc->imm = rx_sign_extend(instr.imm32);
+      if (src != dst) {
+        ibc->isrc = &nreg->r[src];
+        ibc->mem_mask = mod_mem ? SCRATCHPAD_L1_MASK : SCRATCHPAD_L2_MASK;
+      } else {
+        ibc->isrc = &zero;
+        ibc->mem_mask = SCRATCHPAD_L3_MASK;
+      }
+      register_usage[dst] = i;
+      break;
+
+    case ISUB_R:
+    case IMUL_R:
+    case IXOR_R:
+      ibc->idst = &nreg->r[dst];
+      if (src != dst) {
+        ibc->isrc = &nreg->r[src];
+      } else {
+        ibc->imm = rx_sign_extend(instr.imm32);
+        ibc->isrc = &ibc->imm;
+      }
+      register_usage[dst] = i;
+      break;
+
+    case IMULH_R:
+    case ISMULH_R:
+      ibc->idst = &nreg->r[dst];
+      ibc->isrc = &nreg->r[src];
+      register_usage[dst] = i;
+      break;
+
+    case IMUL_RCP:
+      if (!rx_is_zero_or_power_of_2(instr.imm32)) {
+        ibc->type = IMUL_R;
+        ibc->idst = &nreg->r[dst];
+        ibc->imm = rx_reciprocal(instr.imm32);
+        ibc->isrc = &ibc->imm;
+        register_usage[dst] = i;
+      } else {
+        ibc->type = NOP;
+      }
+      break;
+
+    case INEG_R:
+      ibc->idst = &nreg->r[dst];
+      register_usage[dst] = i;
+      break;
+
+    case IROR_R:
+    case IROL_R:
+      ibc->idst = &nreg->r[dst];
+      if (src != dst) {
+        ibc->isrc = &nreg->r[src];
+      } else {
+        ibc->imm = instr.imm32;
+        ibc->isrc = &ibc->imm;
+      }
+      register_usage[dst] = i;
+      break;
+
+    case ISWAP_R:
+      if (src != dst) {
+        ibc->idst = &nreg->r[dst];
+        ibc->isrc = &nreg->r[src];
+        register_usage[dst] = i;
+        register_usage[src] = i;
+      } else {
+        ibc->type = NOP;
+      }
+      break;
+
+    case FSWAP_R:
+      ibc->fdst = dst < 4 ? &nreg->f[dst] : &nreg->e[dst - 4];
+      break;
+
+    case FADD_R:
+    case FSUB_R:
+      ibc->fdst = &nreg->f[dst % 4];
+      ibc->fsrc = &nreg->a[src % 4];
+      break;
+
+    case FADD_M:
+    case FSUB_M:
+      ibc->fdst = &nreg->f[dst % 4];
+      ibc->isrc = &nreg->r[src];
+      ibc->mem_mask = mod_mem ? SCRATCHPAD_L1_MASK : SCRATCHPAD_L2_MASK;
+      ibc->imm = rx_sign_extend(instr.imm32);
+      break;
+
+    case FSCAL_R:
+      ibc->fdst = &nreg->f[dst % 4];
+      break;
+
+    case FMUL_R:
+      ibc->fdst = &nreg->e[dst % 4];
+      ibc->fsrc = &nreg->a[src % 4];
+      break;
+
+    case FDIV_M:
+      ibc->fdst = &nreg->e[dst % 4];
+      ibc->isrc = &nreg->r[src];
+      ibc->mem_mask = mod_mem ? SCRATCHPAD_L1_MASK : SCRATCHPAD_L2_MASK;
+      ibc->imm = rx_sign_extend(instr.imm32);
+      break;
+
+    case FSQRT_R:
+      ibc->fdst = &nreg->e[dst % 4];
+      break;
+
+    case CBRANCH: {
+      // Jumps back to just after the last instruction that modified the
+      // register; every register counts as modified by the branch itself
+      ibc->idst = &nreg->r[dst];
+      ibc->target = register_usage[dst];
+      int shift = mod_cond + CONDITION_OFFSET;
+      ibc->imm = rx_sign_extend(instr.imm32) | (1ULL << shift);
+      // Clearing the bit below the condition limits successive jumps to 2
+      ibc->imm &= ~(1ULL << (shift - 1));
+      ibc->mem_mask = (uint32_t)CONDITION_MASK << shift;
+      for (int j = 0; j < 8; ++j)
+        register_usage[j] = i;
+      break;
+    }
+
+    case CFROUND:
+      ibc->isrc = &nreg->r[src];
+      ibc->imm = instr.imm32 & 63;
+      break;
+
+    case ISTORE:
+      ibc->idst = &nreg->r[dst];
+      ibc->isrc = &nreg->r[src];
+      ibc->imm = rx_sign_extend(instr.imm32);
+      if (mod_cond < STORE_L3_CONDITION)
+        ibc->mem_mask = mod_mem ? SCRATCHPAD_L1_MASK : SCRATCHPAD_L2_MASK;
+      else
+        ibc->mem_mask = SCRATCHPAD_L3_MASK;
+      break;
+
+    case NOP:
+      break;
+    }
+  }
+}
+
+static inline const uint8_t *scratchpad_address(const randomx_vm *vm, const struct rx_bytecode *ibc)
+{
+  uint32_t addr = (uint32_t)(*ibc->isrc + ibc->imm) & ibc->mem_mask;
+  return vm->scratchpad + addr;
+}
+
+static void execute_bytecode(randomx_vm *vm)
+{
+  for (int pc = 0; pc < RANDOMX_PROGRAM_SIZE; ++pc) {
+    struct rx_bytecode *ibc = &vm->bytecode[pc];
+    rx_vec v;
+
+    switch (ibc->type) {
+    case IADD_RS:
+      *ibc->idst += (*ibc->isrc << ibc->shift) + ibc->imm;
+      break;
+    case IADD_M:
+      *ibc->idst += rx_load64(scratchpad_address(vm, ibc));
+      break;
+    case ISUB_R:
+      *ibc->idst -= *ibc->isrc;
+      break;
+    case ISUB_M:
+      *ibc->idst -= rx_load64(scratchpad_address(vm, ibc));
+      break;
+    case IMUL_R:
+      *ibc->idst *= *ibc->isrc;
+      break;
+    case IMUL_M:
+      *ibc->idst *= rx_load64(scratchpad_address(vm, ibc));
+      break;
+    case IMULH_R:
+      *ibc->idst = rx_mulh(*ibc->idst, *ibc->isrc);
+      break;
+    case IMULH_M:
+      *ibc->idst = rx_mulh(*ibc->idst, rx_load64(scratchpad_address(vm, ibc)));
+      break;
+    case ISMULH_R:
+      *ibc->idst = (uint64_t)rx_smulh((int64_t)*ibc->idst, (int64_t)*ibc->isrc);
+      break;
+    case ISMULH_M:
+      *ibc->idst = (uint64_t)rx_smulh((int64_t)*ibc->idst, (int64_t)rx_load64(scratchpad_address(vm, ibc)));
+      break;
+    case INEG_R:
+      *ibc->idst = ~*ibc->idst + 1;
+      break;
+    case IXOR_R:
+      *ibc->idst ^= *ibc->isrc;
+      break;
+    case IXOR_M:
+      *ibc->idst ^= rx_load64(scratchpad_address(vm, ibc));
+      break;
+    case IROR_R:
+      *ibc->idst = rx_rotr(*ibc->idst, (unsigned)(*ibc->isrc & 63));
+      break;
+    case IROL_R:
+      *ibc->idst = rx_rotl(*ibc->idst, (unsigned)(*ibc->isrc & 63));
+      break;
+    case ISWAP_R: {
+      uint64_t temp = *ibc->isrc;
+      *(uint64_t *)ibc->isrc = *ibc->idst;
+      *ibc->idst = temp;
+      break;
+    }
+    case FSWAP_R: {
+      double temp = ibc->fdst->lo;
+      ibc->fdst->lo = ibc->fdst->hi;
+      ibc->fdst->hi = temp;
+      break;
+    }
+    case FADD_R:
+      ibc->fdst->lo += ibc->fsrc->lo;
+      ibc->fdst->hi += ibc->fsrc->hi;
+      break;
+    case FADD_M:
+      v = load_int_vec(scratchpad_address(vm, ibc));
+      ibc->fdst->lo += v.lo;
+      ibc->fdst->hi += v.hi;
+      break;
+    case FSUB_R:
+      ibc->fdst->lo -= ibc->fsrc->lo;
+      ibc->fdst->hi -= ibc->fsrc->hi;
+      break;
+    case FSUB_M:
+      v = load_int_vec(scratchpad_address(vm, ibc));
+      ibc->fdst->lo -= v.lo;
+      ibc->fdst->hi -= v.hi;
+      break;
+    case FSCAL_R:
+      ibc->fdst->lo = bits_double(double_bits(ibc->fdst->lo) ^ SCALE_MASK);
+      ibc->fdst->hi = bits_double(double_bits(ibc->fdst->hi) ^ SCALE_MASK);
+      break;
+    case FMUL_R:
+      ibc->fdst->lo *= ibc->fsrc->lo;
+      ibc->fdst->hi *= ibc->fsrc->hi;
+      break;
+    case FDIV_M:
+      v = mask_exponent_mantissa(vm, load_int_vec(scratchpad_address(vm, ibc)));
+      ibc->fdst->lo /= v.lo;
+      ibc->fdst->hi /= v.hi;
+      break;
+    case FSQRT_R:
+      ibc->fdst->lo = sqrt(ibc->fdst->lo);
+      ibc->fdst->hi = sqrt(ibc->fdst->hi);
+      break;
+    case CBRANCH:
+      *ibc->idst += ibc->imm;
+      if ((*ibc->idst & ibc->mem_mask) == 0)
+        pc = ibc->target;
+      break;
+    case CFROUND:
+      set_rounding_mode(vm, (int)(rx_rotr(*ibc->isrc, (unsigned)ibc->imm) % 4));
+      break;
+    case ISTORE:
+      rx_store64(vm->scratchpad + ((uint32_t)(*ibc->idst + ibc->imm) & ibc->mem_mask), *ibc->isrc);
+      break;
+    case IMUL_RCP: // compiled into IMUL_R or NOP
+    case NOP:
+      break;
+    }
+  }
+}
+
+static void dataset_read(const randomx_vm *vm, uint64_t address, uint64_t r[8])
+{
+  uint8_t item[RX_CACHE_LINE_SIZE];
+  const uint8_t *p;
+
+  if (vm->dataset != NULL) {
+    p = vm->dataset->memory + address;
+  } else {
+    rx_init_dataset_item(vm->cache, item, address / RX_CACHE_LINE_SIZE);
+    p = item;
+  }
+  for (int i = 0; i < 8; ++i)
+    r[i] ^= rx_load64(p + 8 * i);
+}
+
+// Generates a program from seed, then runs it
+static void run(randomx_vm *vm, const uint8_t seed[64])
+{
+  struct rx_native_registers *nreg = &vm->nreg;
+
+  rx_fill_aes_4rx4(seed, sizeof(vm->program), vm->program);
+
+  memset(nreg->r, 0, sizeof(nreg->r));
+  for (int i = 0; i < 4; ++i) {
+    nreg->a[i].lo = bits_double(small_positive_float_bits(program_entropy(vm, 2 * i)));
+    nreg->a[i].hi = bits_double(small_positive_float_bits(program_entropy(vm, 2 * i + 1)));
+  }
+  vm->ma = program_entropy(vm, 8) & CACHE_LINE_ALIGN_MASK;
+  vm->mx = program_entropy(vm, 10);
+  uint64_t address_registers = program_entropy(vm, 12);
+  for (int i = 0; i < 4; ++i) {
+    vm->read_reg[i] = 2 * i + (int)(address_registers & 1);
+    address_registers >>= 1;
+  }
+  vm->dataset_offset = (program_entropy(vm, 13) % (DATASET_EXTRA_ITEMS + 1)) * RX_CACHE_LINE_SIZE;
+  vm->e_mask[0] = float_mask(program_entropy(vm, 14));
+  vm->e_mask[1] = float_mask(program_entropy(vm, 15));
+
+  compile_program(vm);
+
+  uint32_t sp_addr0 = (uint32_t)vm->mx;
+  uint32_t sp_addr1 = (uint32_t)vm->ma;
+
+  for (int ic = 0; ic < RANDOMX_PROGRAM_ITERATIONS; ++ic) {
+    uint64_t sp_mix = nreg->r[vm->read_reg[0]] ^ nreg->r[vm->read_reg[1]];
+    sp_addr0 ^= (uint32_t)sp_mix;
+    sp_addr0 &= SCRATCHPAD_L3_MASK64;
+    sp_addr1 ^= (uint32_t)(sp_mix >> 32);
+    sp_addr1 &= SCRATCHPAD_L3_MASK64;
+
+    for (int i = 0; i < 8; ++i)
+      nreg->r[i] ^= rx_load64(vm->scratchpad + sp_addr0 + 8 * i);
+    for (int i = 0; i < 4; ++i)
+      nreg->f[i] = load_int_vec(vm->scratchpad + sp_addr1 + 8 * i);
+    for (int i = 0; i < 4; ++i)
+      nreg->e[i] = mask_exponent_mantissa(vm, load_int_vec(vm->scratchpad + sp_addr1 + 8 * (4 + i)));
+
+    execute_bytecode(vm);
+
+    vm->mx ^= nreg->r[vm->read_reg[2]] ^ nreg->r[vm->read_reg[3]];
+    vm->mx &= CACHE_LINE_ALIGN_MASK;
+    dataset_read(vm, vm->dataset_offset + vm->ma, nreg->r);
+    uint64_t temp = vm->mx;
+    vm->mx = vm->ma;
+    vm->ma = temp;
+
+    for (int i = 0; i < 8; ++i)
+      rx_store64(vm->scratchpad + sp_addr1 + 8 * i, nreg->r[i]);
+    for (int i = 0; i < 4; ++i) {
+      rx_store64(vm->scratchpad + sp_addr0 + 16 * i, double_bits(nreg->f[i].lo) ^ double_bits(nreg->e[i].lo));
+      rx_store64(vm->scratchpad + sp_addr0 + 16 * i + 8, double_bits(nreg->f[i].hi) ^ double_bits(nreg->e[i].hi));
+      nreg->f[i].lo = bits_double(double_bits(nreg->f[i].lo) ^ double_bits(nreg->e[i].lo));
+      nreg->f[i].hi = bits_double(double_bits(nreg->f[i].hi) ^ double_bits(nreg->e[i].hi));
+    }
+
+    sp_addr0 = 0;
+    sp_addr1 = 0;
+  }
+}
+
+// The register file as hashed between programs: r0-r7, then f, e and a
+static void register_file(const randomx_vm *vm, uint8_t out[256])
+{
+  const struct rx_native_registers *nreg = &vm->nreg;
+  const rx_vec *groups[3] = { nreg->f, nreg->e, nreg->a };
+
+  for (int i = 0; i < 8; ++i)
+    rx_store64(out + 8 * i, nreg->r[i]);
+  for (int g = 0; g < 3; ++g) {
+    for (int i = 0; i < 4; ++i) {
+      rx_store64(out + 64 + 64 * g + 16 * i, double_bits(groups[g][i].lo));
+      rx_store64(out + 64 + 64 * g + 16 * i + 8, double_bits(groups[g][i].hi));
+    }
+  }
+}
+
+randomx_vm *randomx_create_vm(randomx_cache *cache, randomx_dataset *dataset)
+{
+  randomx_vm *vm = (randomx_vm *)calloc(1, sizeof(randomx_vm));
+  if (vm == NULL)
+    return NULL;
+  vm->scratchpad = (uint8_t *)malloc(RANDOMX_SCRATCHPAD_L3);
+  if (vm->scratchpad == NULL) {
+    free(vm);
+    return NULL;
+  }
+  vm->cache = cache;
+  vm->dataset = dataset;
+  return vm;
+}
+
+void randomx_destroy_vm(randomx_vm *vm)
+{
+  if (vm == NULL)
+    return;
+  free(vm->scratchpad);
+  free(vm);
+}
+
+void randomx_calculate_hash(randomx_vm *vm, const void *input, size_t input_size, void *output)
+{
+  uint8_t temp_hash[64];
+  uint8_t reg[256];
+  const int saved_rounding = fegetround();
+
+  blake2b(temp_hash, sizeof(temp_hash), input, input_size, NULL, 0);
+  rx_fill_aes_1rx4(temp_hash, RANDOMX_SCRATCHPAD_L3, vm->scratchpad);
+  fesetround(FE_TONEAREST);
+  vm->rounding_mode = 0;
+
+  for (int chain = 0; chain < RANDOMX_PROGRAM_COUNT - 1; ++chain) {
+    run(vm, temp_hash);
+    register_file(vm, reg);
+    blake2b(temp_hash, sizeof(temp_hash), reg, sizeof(reg), NULL, 0);
+  }
+  run(vm, temp_hash);
+
+  // The a registers are replaced by the AES hash of the scratchpad
+  register_file(vm, reg);
+  rx_hash_aes_1rx4(vm->scratchpad, RANDOMX_SCRATCHPAD_L3, reg + 192);
+  blake2b(output, RANDOMX_HASH_SIZE, reg, sizeof(reg), NULL, 0);
+
+  fesetround(saved_rounding);
+}
@@ -0,0 +1,67 @@
+// Cache and dataset management for RandomX, see randomx.h
+
+#include <stdlib.h>
+
+#include "randomx-internal.h"
+
+randomx_cache *randomx_alloc_cache(void)
+{
+  randomx_cache *cache = (randomx_cache *)calloc(1, sizeof(randomx_cache));
+  if (cache == NULL)
+    return NULL;
+  cache->memory = (uint8_t *)malloc(RX_CACHE_SIZE);
+  if (cache->memory == NULL) {
+    free(cache);
+    return NULL;
+  }
+  return cache;
+}
+
+void randomx_init_cache(randomx_cache *cache, const void *key, size_t key_size)
+{
+  struct rx_blake2_generator gen;
+
+  rx_argon2d_fill(cache->memory, key, key_size);
+  rx_blake2_generator_init(&gen, key, key_size, 0);
+  for (int i = 0; i < RANDOMX_CACHE_ACCESSES; ++i)
+    rx_generate_superscalar(&cache->programs[i], &gen);
+}
+
+void randomx_release_cache(randomx_cache *cache)
+{
+  if (cache == NULL)
+    return;
+  free(cache->memory);
+  free(cache);
+}
+
+randomx_dataset *randomx_alloc_dataset(void)
+{
+  randomx_dataset *dataset = (randomx_dataset *)calloc(1, sizeof(randomx_dataset));
+  if (dataset == NULL)
+    return NULL;
+  if (sizeof(size_t) < 8 || (dataset->memory = (uint8_t *)malloc((size_t)(RX_DATASET_ITEMS * RX_CACHE_LINE_SIZE))) == NULL) {
+    free(dataset);
+    return NULL;
+  }
+  return dataset;
+}
+
+unsigned long randomx_dataset_item_count(void)
+{
+  return (unsigned long)RX_DATASET_ITEMS;
+}
+
+void randomx_init_dataset(randomx_dataset *dataset, randomx_cache *cache, unsigned long start_item, unsigned long item_count)
+{
+  for (uint64_t item = start_item; item < (uint64_t)start_item + item_count; ++item)
+    rx_init_dataset_item(cache, dataset->memory + item * RX_CACHE_LINE_SIZE, item);
+}
+
+void randomx_release_dataset(randomx_dataset *dataset)
+{
+  if (dataset == NULL)
+    return;
+  free(dataset->memory);
+  free(dataset);
+}
@@ -0,0 +1,344 @@
+package cryptonight
+
+/*
+#cgo LDFLAGS: -lm
+#include <stdlib.h>
+#include "randomx.h"
+*/
+import "C"
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// RandomX is the proof of work Monero switched to from CryptonightR
+// (at its major version 12). Instead of a fixed memory hard loop it
+// runs random programs, over a 256MB cache derived from a seed hash
+// that changes every epoch. Verifying nodes only need the cache
+// ("light mode", about a second per hash); miners expand it into a
+// 2GB dataset first ("full mode", a lot faster per hash).
+//
+// Monero takes the seed hash to be the hash of the block at
+// RandomXSeedHeight(block_height).
+
+// The number of blocks per seed epoch, and how many blocks into an
+// epoch its seed hash takes over, the same as Monero's.
+const (
+	RandomXEpochBlocks = 2048
+	RandomXEpochLag    = 64
+)
+
+// Returns the height of the block whose hash seeds RandomX at the given
+// height, following Monero's rx_seedheight.
+func RandomXSeedHeight(block_height uint64) uint64 {
+	if block_height <= RandomXEpochBlocks+RandomXEpochLag {
+		return 0
+	}
+	return (block_height - RandomXEpochLag - 1) &^ (RandomXEpochBlocks - 1)
+}
+
+var errRandomXAlloc = errors.New("cryptonight: not enough memory for RandomX")
+
+// A RandomX cache for one seed hash, enough to verify hashes. Must be
+// closed once no VM or dataset uses it anymore.
+type RandomXCache struct {
+	seed_hash []byte
+	ptr       *C.randomx_cache
+}
+
+// Allocates the 256MB cache and initializes it from seed_hash, which
+// takes about a second.
+func NewRandomXCache(seed_hash []byte) (*RandomXCache, error) {
+	ptr := C.randomx_alloc_cache()
+	if ptr == nil {
+		return nil, errRandomXAlloc
+	}
+	seed := C.CBytes(seed_hash)
+	C.randomx_init_cache(ptr, seed, C.size_t(len(seed_hash)))
+	C.free(seed)
+	return &RandomXCache{seed_hash: append([]byte(nil), seed_hash...), ptr: ptr}, nil
+}
+
+// Returns the seed hash the cache was initialized with.
+func (cache *RandomXCache) SeedHash() []byte {
+	return append([]byte(nil), cache.seed_hash...)
+}
+
+func (cache *RandomXCache) Close() {
+	C.randomx_release_cache(cache.ptr)
+	cache.ptr = nil
+}
+
+// A RandomX dataset, expanded from a cache for full mode hashing. Must
+// be closed once no VM uses it anymore; the cache can be closed as soon
+// as the dataset is created.
+type RandomXDataset struct {
+	seed_hash []byte
+	ptr       *C.randomx_dataset
+}
+
+// Allocates the 2GB dataset and computes it from the cache with the
+// given number of threads (0 means one per CPU). This takes minutes on
+// a single thread.
+func NewRandomXDataset(cache *RandomXCache, threads int) (*RandomXDataset, error) {
+	ptr := C.randomx_alloc_dataset()
+	if ptr == nil {
+		return nil, errRandomXAlloc
+	}
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	items := uint64(C.randomx_dataset_item_count())
+	per_thread := items / uint64(threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		start := uint64(i) * per_thread
+		count := per_thread
+		if i == threads-1 {
+			count = items - start
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			C.randomx_init_dataset(ptr, cache.ptr, C.ulong(start), C.ulong(count))
+		}()
+	}
+	wg.Wait()
+	return &RandomXDataset{seed_hash: cache.SeedHash(), ptr: ptr}, nil
+}
+
+func (dataset *RandomXDataset) Close() {
+	C.randomx_release_dataset(dataset.ptr)
+	dataset.ptr = nil
+}
+
+// A RandomX virtual machine. A VM computes one hash at a time, so it
+// isn't safe for concurrent use; RandomXHasher keeps a VM per
+// goroutine.
+type RandomXVM struct {
+	ptr *C.randomx_vm
+}
+
+// Returns a VM in full mode if dataset isn't nil, and in light mode
+// over the cache otherwise. Both modes compute the same hashes. The
+// cache or dataset must outlive the VM.
+func NewRandomXVM(cache *RandomXCache, dataset *RandomXDataset) (*RandomXVM, error) {
+	var ptr *C.randomx_vm
+	if dataset != nil {
+		ptr = C.randomx_create_vm(nil, dataset.ptr)
+	} else if cache != nil {
+		ptr = C.randomx_create_vm(cache.ptr, nil)
+	} else {
+		return nil, errors.New("cryptonight: RandomX VM needs a cache or a dataset")
+	}
+	if ptr == nil {
+		return nil, errRandomXAlloc
+	}
+	return &RandomXVM{ptr: ptr}, nil
+}
+
+// Returns the 32 byte RandomX hash of input, which can be of any
+// length.
+func (vm *RandomXVM) Hash(input []byte) []byte {
+	result := make([]byte, C.RANDOMX_HASH_SIZE)
+	var input_ptr unsafe.Pointer
+	if len(input) > 0 {
+		input_ptr = unsafe.Pointer(&input[0])
+	}
+	C.randomx_calculate_hash(vm.ptr, input_ptr, C.size_t(len(input)), unsafe.Pointer(&result[0]))
+	return result
+}
+
+// Same as HashVariant{1,2,4}ForEthereumHeader, but with RandomX: the
+// same blob (with Monero's RandomX major version, 12) and the same
+// byte order for digest and result.
+func (vm *RandomXVM) HashForEthereumHeader(block_header_hash []byte, nonce uint64) ([]byte, []byte) {
+	digest := vm.Hash(ethereumHeaderBlob(block_header_hash, nonce, 12))
+	return digest, littleEndianResult(digest)
+}
+
+func (vm *RandomXVM) Close() {
+	C.randomx_destroy_vm(vm.ptr)
+	vm.ptr = nil
+}
+
+// Hashes Ethereum headers with RandomX at any height, keeping the
+// cache (or dataset) for the current seed hash and the one before, so
+// that blocks from both sides of an epoch change can be verified. Safe
+// for concurrent use.
+//
+// Seed hashes come from the chain, see NewRandomXHasher.
+type RandomXHasher struct {
+	seed_hash func(seed_height uint64) []byte
+	full      bool
+	// NewRandomXCache, replaced by tests
+	new_cache func(seed_hash []byte) (*RandomXCache, error)
+	lock      sync.Mutex
+	// Most recently used first, at most two
+	epochs []*randomXEpoch
+}
+
+type randomXEpoch struct {
+	seed_hash []byte
+	ready     chan struct{} // closed once initialized
+	err       error
+	cache     *RandomXCache
+	dataset   *RandomXDataset
+	idle      []*RandomXVM
+	users     int
+	retired   bool
+}
+
+// Returns a RandomXHasher which seeds every height with
+// seed_hash(RandomXSeedHeight(block_height)), normally the hash of that
+// block. In full mode every new seed hash costs a 2GB dataset and
+// minutes of initialization, so verifying nodes should use light mode.
+func NewRandomXHasher(seed_hash func(seed_height uint64) []byte, full bool) *RandomXHasher {
+	return &RandomXHasher{seed_hash: seed_hash, full: full, new_cache: NewRandomXCache}
+}
+
+// Hashes an Ethereum header like RandomXVM.HashForEthereumHeader,
+// seeded for block_height. Fails if there isn't enough memory for the
+// cache, dataset or VM; the next hash of the epoch tries again.
+func (h *RandomXHasher) HashForEthereumHeader(block_header_hash []byte, nonce uint64, block_height uint64) ([]byte, []byte, error) {
+	epoch, err := h.acquire(h.seed_hash(RandomXSeedHeight(block_height)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer h.release(epoch)
+	vm, err := h.vm(epoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest, result := vm.HashForEthereumHeader(block_header_hash, nonce)
+	h.lock.Lock()
+	epoch.idle = append(epoch.idle, vm)
+	h.lock.Unlock()
+	return digest, result, nil
+}
+
+// Frees all caches, datasets and VMs not currently hashing.
+func (h *RandomXHasher) Close() {
+	h.lock.Lock()
+	epochs := h.epochs
+	h.epochs = nil
+	h.lock.Unlock()
+	for _, epoch := range epochs {
+		h.retire(epoch)
+	}
+}
+
+// Returns the epoch for seed_hash, initialized and counted as in use,
+// or the error initializing it. A failed epoch is dropped, so that the
+// next hash of the epoch initializes it again.
+func (h *RandomXHasher) acquire(seed_hash []byte) (*randomXEpoch, error) {
+	h.lock.Lock()
+	var epoch *randomXEpoch
+	for i, e := range h.epochs {
+		if bytes.Equal(e.seed_hash, seed_hash) {
+			epoch = e
+			copy(h.epochs[1:i+1], h.epochs[:i])
+			h.epochs[0] = epoch
+			break
+		}
+	}
+	initialize := epoch == nil
+	var evicted *randomXEpoch
+	if initialize {
+		epoch = &randomXEpoch{seed_hash: append([]byte(nil), seed_hash...), ready: make(chan struct{})}
+		h.epochs = append([]*randomXEpoch{epoch}, h.epochs...)
+		if len(h.epochs) > 2 {
+			evicted = h.epochs[2]
+			h.epochs = h.epochs[:2]
+		}
+	}
+	epoch.users++
+	h.lock.Unlock()
+
+	if evicted != nil {
+		h.retire(evicted)
+	}
+	if initialize {
+		epoch.err = h.initialize(epoch)
+		close(epoch.ready)
+	}
+	<-epoch.ready
+	if epoch.err != nil {
+		h.lock.Lock()
+		for i, e := range h.epochs {
+			if e == epoch {
+				h.epochs = append(h.epochs[:i:i], h.epochs[i+1:]...)
+				break
+			}
+		}
+		epoch.retired = true
+		h.lock.Unlock()
+		h.release(epoch)
+		return nil, epoch.err
+	}
+	return epoch, nil
+}
+
+func (h *RandomXHasher) initialize(epoch *randomXEpoch) error {
+	cache, err := h.new_cache(epoch.seed_hash)
+	if err != nil {
+		return err
+	}
+	if !h.full {
+		epoch.cache = cache
+		return nil
+	}
+	defer cache.Close()
+	epoch.dataset, err = NewRandomXDataset(cache, 0)
+	return err
+}
+
+// Returns an idle VM of the epoch, or a new one.
+func (h *RandomXHasher) vm(epoch *randomXEpoch) (*RandomXVM, error) {
+	h.lock.Lock()
+	if n := len(epoch.idle); n > 0 {
+		vm := epoch.idle[n-1]
+		epoch.idle = epoch.idle[:n-1]
+		h.lock.Unlock()
+		return vm, nil
+	}
+	h.lock.Unlock()
+	return NewRandomXVM(epoch.cache, epoch.dataset)
+}
+
+func (h *RandomXHasher) release(epoch *randomXEpoch) {
+	h.lock.Lock()
+	epoch.users--
+	free := epoch.retired && epoch.users == 0
+	h.lock.Unlock()
+	if free {
+		epoch.free()
+	}
+}
+
+// Marks the epoch as no longer cached, freeing it once unused.
+func (h *RandomXHasher) retire(epoch *randomXEpoch) {
+	h.lock.Lock()
+	epoch.retired = true
+	free := epoch.users == 0
+	h.lock.Unlock()
+	if free {
+		epoch.free()
+	}
+}
+
+func (epoch *randomXEpoch) free() {
+	for _, vm := range epoch.idle {
+		vm.Close()
+	}
+	epoch.idle = nil
+	if epoch.dataset != nil {
+		epoch.dataset.Close()
+	}
+	if epoch.cache != nil {
+		epoch.cache.Close()
+	}
+}
@@ -0,0 +1,44 @@
+// RandomX, the proof of work that replaced CryptonightR on Monero. See
+// https://github.com/tevador/RandomX/blob/master/doc/specs.md
+//
+// A portable interpreter with the same API as tevador's implementation,
+// using Monero's parameters. A cache is initialized from a key (Monero uses
+// the hash of a recent block) and is enough to verify hashes ("light
+// mode"). Miners additionally expand the cache into a 2GB dataset, which
+// makes every hash a lot cheaper ("full mode").
+
+#pragma once
+
+#include <stddef.h>
+#include <stdint.h>
+
+enum {
+  RANDOMX_HASH_SIZE = 32
+};
+
+typedef struct randomx_cache randomx_cache;
+typedef struct randomx_dataset randomx_dataset;
+typedef struct randomx_vm randomx_vm;
+
+// Returns NULL if the 256MB of memory can't be allocated
+randomx_cache *randomx_alloc_cache(void);
+// Runs Argon2d over the whole cache, takes a second or two
+void randomx_init_cache(randomx_cache *cache, const void *key, size_t key_size);
+void randomx_release_cache(randomx_cache *cache);
+
+// Returns NULL if the 2GB of memory can't be allocated
+randomx_dataset *randomx_alloc_dataset(void);
+unsigned long randomx_dataset_item_count(void);
+// Computes dataset items [start_item, start_item + item_count) from the
+// cache. Disjoint ranges can be initialized from different threads
+void randomx_init_dataset(randomx_dataset *dataset, randomx_cache *cache, unsigned long start_item, unsigned long item_count);
+void randomx_release_dataset(randomx_dataset *dataset);
+
+// A VM in light mode if dataset is NULL, in full mode otherwise. The
+// cache (or the dataset) must outlive the VM. Returns NULL if the 2MB
+// scratchpad can't be allocated
+randomx_vm *randomx_create_vm(randomx_cache *cache, randomx_dataset *dataset);
+void randomx_destroy_vm(randomx_vm *vm);
+// Writes RANDOMX_HASH_SIZE bytes to output. A VM can only compute one
+// hash at a time
+void randomx_calculate_hash(randomx_vm *vm, const void *input, size_t input_size, void *output);
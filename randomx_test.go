@@ -0,0 +1,227 @@
+package cryptonight
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"sync"
+	"testing"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestRandomXSeedHeight(t *testing.T) {
+	cases := []struct {
+		block_height uint64
+		seed_height  uint64
+	}{
+		{0, 0},
+		{2048, 0},
+		{2112, 0},
+		{2113, 2048},
+		{4160, 2048},
+		{4161, 4096},
+		{1806260, 1804288},
+	}
+	for _, c := range cases {
+		if seed_height := RandomXSeedHeight(c.block_height); seed_height != c.seed_height {
+			t.Error("Unexpected seed height at height ", c.block_height, ": ", seed_height, " versus ", c.seed_height)
+		}
+	}
+}
+
+// Test vectors from tevador's RandomX repository (src/tests/tests.cpp).
+func TestRandomXLight(t *testing.T) {
+	cases := []struct {
+		key    string
+		input  []byte
+		result string
+	}{
+		{"test key 000", []byte("This is a test"), "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f"},
+		{"test key 000", []byte("Lorem ipsum dolor sit amet"), "300a0adb47603dedb42228ccb2b211104f4da45af709cd7547cd049e9489c969"},
+		{"test key 001", hexutil.MustDecode("0x0b0b98bea7e805e0010a2126d287a2a0cc833d312cb786385a7c2f9de69d25537f584a9bc9977b00000000666fd8753bf61a8631f12984e3fd44f4014eca629276817b56f32e9b68bd82f416"), "c56414121acda1713c2f2a819d8ae38aed7c80c35c2a769298d34f03833cd5f1"},
+	}
+	var cache *RandomXCache
+	var vm *RandomXVM
+	for _, c := range cases {
+		if cache == nil || !bytes.Equal(cache.SeedHash(), []byte(c.key)) {
+			if cache != nil {
+				vm.Close()
+				cache.Close()
+			}
+			var err error
+			if cache, err = NewRandomXCache([]byte(c.key)); err != nil {
+				t.Fatal(err)
+			}
+			if vm, err = NewRandomXVM(cache, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// With AES-NI, if the CPU has it, and with the tables.
+		for _, impl := range []AESImplementation{AESHardware, AESTables} {
+			SetAESImplementation(impl)
+			if CurrentAESImplementation() != impl {
+				continue
+			}
+			result := vm.Hash(c.input)
+			if hex.EncodeToString(result) != c.result {
+				t.Error(impl, ": unexpected result ", hex.EncodeToString(result), " versus ", c.result)
+			}
+		}
+	}
+	SetAESImplementation(AESAuto)
+	vm.Close()
+	cache.Close()
+}
+
+func TestRandomXForEthereum(t *testing.T) {
+	seed_hash := hexutil.MustDecode("0x5af0e5b4b3b6ff2f9f9e1c0a2d0b0a9f0c3b6a1e7e1d4b2c9a8f7e6d5c4b3a29")
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var nonce uint64 = 0xc526c0a1000008dc
+
+	cache, err := NewRandomXCache(seed_hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	vm, err := NewRandomXVM(cache, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	// Regression values, computed with the standalone C code on the
+	// blob from ethereumHeaderBlob with major version 12.
+	digest, result := vm.HashForEthereumHeader(block_header_bytes, nonce)
+	expected_digest := hexutil.MustDecode("0x57267dbbf621704529ecd6079c3a60bef2e59e9a7abcb21ec27c63f858f4e998")
+	if !bytes.Equal(digest, expected_digest) {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+	}
+	expected_result := hexutil.MustDecode("0x98e9f458f8637cc21eb2bc7a9a9ee5f2be603a9c07d6ec29457021f6bb7d2657")
+	if !bytes.Equal(result, expected_result) {
+		t.Error("Unexpected result: ", hex.EncodeToString(result), " versus ", hex.EncodeToString(expected_result))
+	}
+
+	// The same through a fork schedule, with every block seeded by the
+	// same hash. Heights on both sides of the epoch change share a VM
+	// pool, and concurrent hashes must agree.
+	seed_heights := make(chan uint64, 16)
+	hasher := NewRandomXHasher(func(seed_height uint64) []byte {
+		seed_heights <- seed_height
+		return seed_hash
+	}, false)
+	defer hasher.Close()
+	schedule := ForkSchedule{
+		{Height: 0, Variant: 2},
+		{Height: 100, RandomX: hasher},
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Fatal("Schedule rejected: ", err)
+	}
+	var wg sync.WaitGroup
+	for _, block_height := range []uint64{100, 2113, 4161} {
+		wg.Add(1)
+		go func(block_height uint64) {
+			defer wg.Done()
+			digest, _, err := schedule.HashForEthereumHeader(block_header_bytes, nonce, block_height)
+			if err != nil {
+				t.Error("Height ", block_height, ": ", err)
+				return
+			}
+			if !bytes.Equal(digest, expected_digest) {
+				t.Error("Height ", block_height, ": unexpected digest ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+			}
+		}(block_height)
+	}
+	wg.Wait()
+	close(seed_heights)
+	seen := map[uint64]bool{}
+	for seed_height := range seed_heights {
+		seen[seed_height] = true
+	}
+	if !seen[0] || !seen[2048] || !seen[4096] || len(seen) != 3 {
+		t.Error("Unexpected seed heights: ", seen)
+	}
+
+	if err := (ForkSchedule{{Height: 0, Variant: 4, RandomX: hasher}}).Validate(); err == nil {
+		t.Error("RandomX fork with a Cryptonight variant accepted")
+	}
+}
+
+// Full mode hashes like light mode. Initializing the dataset takes
+// minutes per thread, so the test only runs with RANDOMX_FULL_TEST set,
+// e.g. by make test-randomx-full.
+func TestRandomXFull(t *testing.T) {
+	if os.Getenv("RANDOMX_FULL_TEST") == "" {
+		t.Skip("set RANDOMX_FULL_TEST to initialize a RandomX dataset")
+	}
+	seed_hash := []byte("test key 000")
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var nonce uint64 = 0xc526c0a1000008dc
+
+	cache, err := NewRandomXCache(seed_hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	light, err := NewRandomXVM(cache, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer light.Close()
+	expected_digest, expected_result := light.HashForEthereumHeader(block_header_bytes, nonce)
+
+	hasher := NewRandomXHasher(func(seed_height uint64) []byte { return seed_hash }, true)
+	defer hasher.Close()
+	digest, result, err := hasher.HashForEthereumHeader(block_header_bytes, nonce, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, expected_digest) || !bytes.Equal(result, expected_result) {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+	}
+	// tevador's vector, in full mode.
+	hasher.lock.Lock()
+	dataset := hasher.epochs[0].dataset
+	hasher.lock.Unlock()
+	full, err := NewRandomXVM(nil, dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer full.Close()
+	if result := hex.EncodeToString(full.Hash([]byte("This is a test"))); result != "639183aae1bf4c9a35884cb46b09cad9175f04efd7684e7262a0ac1c2f0b4e3f" {
+		t.Error("Unexpected result: ", result)
+	}
+}
+
+// A failed initialization is returned, not cached: the next hash
+// initializes the epoch again.
+func TestRandomXHasherFailure(t *testing.T) {
+	seed_hash := []byte("test key 000")
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	hasher := NewRandomXHasher(func(seed_height uint64) []byte { return seed_hash }, false)
+	defer hasher.Close()
+	failures := 2
+	hasher.new_cache = func(seed_hash []byte) (*RandomXCache, error) {
+		if failures > 0 {
+			failures--
+			return nil, errRandomXAlloc
+		}
+		return NewRandomXCache(seed_hash)
+	}
+	if _, _, err := hasher.HashForEthereumHeader(block_header_bytes, 0, 100); err != errRandomXAlloc {
+		t.Error("Unexpected error: ", err)
+	}
+	schedule := ForkSchedule{{Height: 0, RandomX: hasher}}
+	if _, _, err := schedule.HashForEthereumHeaderContext(context.Background(), block_header_bytes, 0, 100); err != errRandomXAlloc {
+		t.Error("Unexpected error: ", err)
+	}
+	digest, _, err := schedule.HashForEthereumHeaderContext(context.Background(), block_header_bytes, 0, 100)
+	if err != nil || len(digest) != 32 {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digest), " ", err)
+	}
+	if len(hasher.epochs) != 1 {
+		t.Error("Unexpected epochs: ", len(hasher.epochs))
+	}
+}
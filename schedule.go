@@ -0,0 +1,183 @@
+package cryptonight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Variant 4 generates a new random math program from a 64 bit seed,
+// which Monero (and HashVariant4ForEthereumHeader) simply take to be
+// the block height. With short block times that means miners have to
+// regenerate their GPU kernels every few seconds, so a SeedPolicy can
+// instead keep the same program for a whole epoch, or forever.
+type SeedKind int
+
+const (
+	// Seed is the block height, a new program every block. This is
+	// what Monero does.
+	SeedFromHeight SeedKind = iota
+	// Seed is the block height divided by EpochLength, a new program
+	// every EpochLength blocks.
+	SeedFromEpoch
+	// Seed is always SeedPolicy.Seed, the program never changes.
+	SeedFixed
+)
+
+type SeedPolicy struct {
+	Kind        SeedKind
+	EpochLength uint64 // blocks per epoch, only for SeedFromEpoch
+	Seed        uint64 // only for SeedFixed
+}
+
+func (policy SeedPolicy) Validate() error {
+	switch policy.Kind {
+	case SeedFromHeight, SeedFixed:
+		return nil
+	case SeedFromEpoch:
+		if policy.EpochLength == 0 {
+			return errors.New("cryptonight: epoch seed policy needs a non-zero epoch length")
+		}
+		return nil
+	}
+	return fmt.Errorf("cryptonight: unknown seed kind %d", policy.Kind)
+}
+
+// Returns the seed variant 4 uses for its random math program at the
+// given block height.
+func (policy SeedPolicy) ProgramSeed(block_height uint64) uint64 {
+	switch policy.Kind {
+	case SeedFromEpoch:
+		return block_height / policy.EpochLength
+	case SeedFixed:
+		return policy.Seed
+	}
+	return block_height
+}
+
+// A Fork selects the proof of work for all blocks from Height until
+// the next fork.
+type Fork struct {
+	Height  uint64
+	Variant int // 1, 2 or 4, or 0 for RandomX
+	// How variant 4 seeds its random math program. Ignored by the
+	// other variants.
+	Seed SeedPolicy
+	// Program generator settings for variant 4, nil means the
+	// default ones (see NewHasher).
+	Hasher *Hasher
+	// The family member to hash with, nil means the standard one for
+	// Variant (CN1, CN2 or CNR). Its variant must be Variant. Dev
+	// algorithms like CNDevR are only accepted by ValidateDevnet.
+	Algorithm *Algorithm
+	// Hashes with RandomX instead of Cryptonight when set, in which
+	// case Variant must be 0 and Seed, Hasher and Algorithm are
+	// ignored.
+	RandomX *RandomXHasher
+}
+
+// Returns the algorithm the fork hashes with.
+func (fork Fork) algorithm() Algorithm {
+	if fork.Algorithm != nil {
+		return *fork.Algorithm
+	}
+	switch fork.Variant {
+	case 1:
+		return CN1
+	case 2:
+		return CN2
+	}
+	return CNR
+}
+
+// A ForkSchedule lists a chain's forks by increasing height, the first
+// one at height 0.
+type ForkSchedule []Fork
+
+// Checks that the schedule is usable on a production network, which
+// rules out dev algorithms.
+func (schedule ForkSchedule) Validate() error {
+	return schedule.validate(false)
+}
+
+// Same as Validate, but also accepts dev algorithms, for development
+// networks and tests.
+func (schedule ForkSchedule) ValidateDevnet() error {
+	return schedule.validate(true)
+}
+
+func (schedule ForkSchedule) validate(allow_dev bool) error {
+	if len(schedule) == 0 || schedule[0].Height != 0 {
+		return errors.New("cryptonight: fork schedule must start at height 0")
+	}
+	for i, fork := range schedule {
+		if i > 0 && fork.Height <= schedule[i-1].Height {
+			return fmt.Errorf("cryptonight: fork at height %d isn't after the fork at height %d", fork.Height, schedule[i-1].Height)
+		}
+		if fork.RandomX != nil {
+			if fork.Variant != 0 {
+				return fmt.Errorf("cryptonight: RandomX fork at height %d has variant %d, must be 0", fork.Height, fork.Variant)
+			}
+			continue
+		}
+		if fork.Variant != 1 && fork.Variant != 2 && fork.Variant != 4 {
+			return fmt.Errorf("cryptonight: fork at height %d has unsupported variant %d", fork.Height, fork.Variant)
+		}
+		if err := fork.Seed.Validate(); err != nil {
+			return fmt.Errorf("cryptonight: fork at height %d: %v", fork.Height, err)
+		}
+		if fork.Algorithm != nil {
+			if err := fork.Algorithm.Validate(); err != nil {
+				return fmt.Errorf("cryptonight: fork at height %d: %v", fork.Height, err)
+			}
+			if fork.Algorithm.Variant != fork.Variant {
+				return fmt.Errorf("cryptonight: fork at height %d: %s is variant %d, not %d", fork.Height, fork.Algorithm, fork.Algorithm.Variant, fork.Variant)
+			}
+			if fork.Algorithm.Dev && !allow_dev {
+				return fmt.Errorf("cryptonight: fork at height %d: %s is for development networks only", fork.Height, fork.Algorithm)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the fork in effect at the given height. The schedule must
+// be valid (or valid for a devnet).
+func (schedule ForkSchedule) ForkAt(block_height uint64) Fork {
+	fork := schedule[0]
+	for _, next := range schedule[1:] {
+		if next.Height > block_height {
+			break
+		}
+		fork = next
+	}
+	return fork
+}
+
+// Hashes an Ethereum header with whatever proof of work the schedule
+// says is in effect at block_height. Returns digest and result like
+// HashVariant{1,2,4}ForEthereumHeader, or an error if there isn't
+// enough memory for the scratchpad or for RandomX. The schedule must
+// be valid (or valid for a devnet).
+func (schedule ForkSchedule) HashForEthereumHeader(block_header_hash []byte, nonce uint64, block_height uint64) ([]byte, []byte, error) {
+	return schedule.HashForEthereumHeaderContext(context.Background(), block_header_hash, nonce, block_height)
+}
+
+// Same as HashForEthereumHeader, but returns ctx's error if it ends
+// while waiting for a scratchpad (see SetScratchpadLimit). RandomX
+// forks don't wait; they fail if ctx has already ended. Either fails
+// if there isn't enough memory.
+func (schedule ForkSchedule) HashForEthereumHeaderContext(ctx context.Context, block_header_hash []byte, nonce uint64, block_height uint64) ([]byte, []byte, error) {
+	fork := schedule.ForkAt(block_height)
+	if fork.RandomX != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		return fork.RandomX.HashForEthereumHeader(block_header_hash, nonce, block_height)
+	}
+	seed := uint64(0)
+	if fork.Variant >= 4 {
+		seed = fork.Seed.ProgramSeed(block_height)
+	}
+	return fork.Hasher.hashForEthereumHeaderContext(ctx, block_header_hash, nonce, fork.algorithm(), seed)
+}
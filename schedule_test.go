@@ -0,0 +1,159 @@
+package cryptonight
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestSeedPolicy(t *testing.T) {
+	height := SeedPolicy{Kind: SeedFromHeight}
+	epoch := SeedPolicy{Kind: SeedFromEpoch, EpochLength: 1000}
+	fixed := SeedPolicy{Kind: SeedFixed, Seed: 0xdeadbeef}
+	cases := []struct {
+		policy       SeedPolicy
+		block_height uint64
+		seed         uint64
+	}{
+		{height, 0, 0},
+		{height, 8111222, 8111222},
+		{epoch, 0, 0},
+		{epoch, 999, 0},
+		{epoch, 1000, 1},
+		{epoch, 8111222999, 8111222},
+		{fixed, 0, 0xdeadbeef},
+		{fixed, 8111222, 0xdeadbeef},
+	}
+	for _, c := range cases {
+		if seed := c.policy.ProgramSeed(c.block_height); seed != c.seed {
+			t.Error("Unexpected seed at height ", c.block_height, ": ", seed, " versus ", c.seed)
+		}
+	}
+	if err := (SeedPolicy{Kind: SeedFromEpoch}).Validate(); err == nil {
+		t.Error("Epoch policy without epoch length accepted")
+	}
+	if err := (SeedPolicy{Kind: 7}).Validate(); err == nil {
+		t.Error("Unknown seed kind accepted")
+	}
+}
+
+func TestForkScheduleValidate(t *testing.T) {
+	invalid := []ForkSchedule{
+		{},
+		{{Height: 1, Variant: 4}},
+		{{Height: 0, Variant: 2}, {Height: 0, Variant: 4}},
+		{{Height: 0, Variant: 2}, {Height: 10, Variant: 4}, {Height: 5, Variant: 4}},
+		{{Height: 0, Variant: 3}},
+		{{Height: 0, Variant: 4, Seed: SeedPolicy{Kind: SeedFromEpoch}}},
+	}
+	for i, schedule := range invalid {
+		if err := schedule.Validate(); err == nil {
+			t.Error("Unexpected schedule accepted in case ", i, ": ", schedule)
+		}
+	}
+}
+
+func TestForkScheduleSeedPolicies(t *testing.T) {
+	schedule := ForkSchedule{
+		{Height: 0, Variant: 2},
+		{Height: 100, Variant: 4, Seed: SeedPolicy{Kind: SeedFromEpoch, EpochLength: 1000}},
+		{Height: 9000000000, Variant: 4, Seed: SeedPolicy{Kind: SeedFixed, Seed: 8111222}},
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Fatal("Schedule rejected: ", err)
+	}
+
+	// The expected digests come from TestHashVariant2ForEthereum and
+	// TestHashVariant4ForEthereum: with the epoch and fixed policies,
+	// every height below maps to program seed 8111222, the height used
+	// by the variant 4 test.
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var nonce uint64 = 0xc526c0a1000008dc
+	variant2_digest := hexutil.MustDecode("0xa0e217e26c0c5c409a9e7119a8a7b1c4faa5886a2c101116548ab323f11bc4c2")
+	variant4_digest := hexutil.MustDecode("0x1621e81c0910c8167e2c37da637e212e24dd6882f1e9c0e043d6eff0d284a2b8")
+	variant4_result := hexutil.MustDecode("0xb8a284d2f0efd643e0c0e9f18268dd242e217e63da372c7e16c810091ce82116")
+	cases := []struct {
+		block_height uint64
+		digest       []byte
+	}{
+		{99, variant2_digest},
+		{8111222000, variant4_digest},
+		{8111222999, variant4_digest},
+		{9000000000, variant4_digest},
+		{9876543210, variant4_digest},
+	}
+	for _, c := range cases {
+		digest, result, err := schedule.HashForEthereumHeader(block_header_bytes, nonce, c.block_height)
+		if err != nil {
+			t.Fatal("Height ", c.block_height, ": ", err)
+		}
+		if !bytes.Equal(digest, c.digest) {
+			t.Error("Height ", c.block_height, ": unexpected digest ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(c.digest))
+		}
+		if bytes.Equal(c.digest, variant4_digest) && !bytes.Equal(result, variant4_result) {
+			t.Error("Height ", c.block_height, ": unexpected result ", hex.EncodeToString(result), " versus ", hex.EncodeToString(variant4_result))
+		}
+	}
+
+	// One block before the epoch starts we're still in the previous
+	// epoch, with the previous program.
+	digest, _, err := schedule.HashForEthereumHeader(block_header_bytes, nonce, 8111221999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected_digest, _ := HashVariant4ForEthereumHeader(block_header_bytes, nonce, 8111221)
+	if !bytes.Equal(digest, expected_digest) {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+	}
+	if bytes.Equal(digest, variant4_digest) {
+		t.Error("Previous epoch produced the same digest")
+	}
+}
+
+func TestForkScheduleDevnet(t *testing.T) {
+	schedule := ForkSchedule{
+		{Height: 0, Variant: 2, Algorithm: &CNDev2},
+		{Height: 100, Variant: 4, Algorithm: &CNDevR},
+	}
+	if err := schedule.Validate(); err == nil {
+		t.Error("Dev schedule accepted for a production network")
+	}
+	if err := schedule.ValidateDevnet(); err != nil {
+		t.Fatal("Dev schedule rejected: ", err)
+	}
+	mismatched := ForkSchedule{{Height: 0, Variant: 4, Algorithm: &CNDev2}}
+	if err := mismatched.ValidateDevnet(); err == nil {
+		t.Error("Fork with a variant 2 algorithm accepted as variant 4")
+	}
+	production := ForkSchedule{{Height: 0, Variant: 4, Algorithm: &CNR}}
+	if err := production.Validate(); err != nil {
+		t.Error("Production schedule rejected: ", err)
+	}
+
+	// A regression value computed with this implementation.
+	block_header_bytes := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	var nonce uint64 = 0xc526c0a1000008dc
+	expected_digest := hexutil.MustDecode("0x63590f04dfed2755335cbd167c1ce5268f5f3fabac9f7a907bfe1b311519b885")
+	expected_result := hexutil.MustDecode("0x85b81915311bfe7b907a9facab3f5f8f26e51c7c16bd5c335527eddf040f5963")
+	digest, result, err := schedule.HashForEthereumHeader(block_header_bytes, nonce, 8111222)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(digest, expected_digest) || !bytes.Equal(result, expected_result) {
+		t.Error("Unexpected result: ", hex.EncodeToString(digest), ", ", hex.EncodeToString(result))
+	}
+	digest, _ = HashAlgorithmForEthereumHeader(CNDevR, block_header_bytes, nonce, 8111222)
+	if !bytes.Equal(digest, expected_digest) {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+	}
+
+	// With the standard algorithms, HashAlgorithmForEthereumHeader
+	// agrees with HashVariant{1,2,4}ForEthereumHeader.
+	digest, _ = HashAlgorithmForEthereumHeader(CNR, block_header_bytes, nonce, 8111222)
+	expected_digest, _ = HashVariant4ForEthereumHeader(block_header_bytes, nonce, 8111222)
+	if !bytes.Equal(digest, expected_digest) {
+		t.Error("Unexpected digest: ", hex.EncodeToString(digest), " versus ", hex.EncodeToString(expected_digest))
+	}
+}
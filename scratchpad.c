@@ -0,0 +1,360 @@
+// Scratchpad memory for cn_slow_hash, see cn_set_scratchpad_policy in
+// hash-ops.h
+
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+
+#if defined(_MSC_VER) || defined(__MINGW32__)
+#include <windows.h>
+#else
+#include <sys/mman.h>
+#endif
+
+#include "hash-ops.h"
+
+#define HUGE_PAGE_SIZE (1 << 21)
+
+struct cn_scratchpad
+{
+  uint8_t *memory;
+  size_t size;
+  int policy;        // the CN_SCRATCHPAD_* flags that took effect
+  int mapped;        // unmapped rather than freed
+  int in_use;
+  int preallocated;  // kept for reuse when released, regardless of scratchpad_reuse
+  struct cn_scratchpad *next;
+};
+
+static volatile int scratchpad_policy = CN_SCRATCHPAD_HUGETLB;
+static volatile size_t scratchpad_reuse = 0;
+
+// Every scratchpad there is, guarded by scratchpads_lock. Critical sections
+// are a few pointer updates, so a spin lock will do.
+static struct cn_scratchpad *scratchpads = NULL;
+static volatile char scratchpads_lock = 0;
+
+static void lock_scratchpads(void)
+{
+  while (__atomic_test_and_set(&scratchpads_lock, __ATOMIC_ACQUIRE))
+    ;
+}
+
+static void unlock_scratchpads(void)
+{
+  __atomic_clear(&scratchpads_lock, __ATOMIC_RELEASE);
+}
+
+void cn_set_scratchpad_policy(int policy)
+{
+  scratchpad_policy = policy & (CN_SCRATCHPAD_HUGETLB | CN_SCRATCHPAD_THP | CN_SCRATCHPAD_MLOCK);
+}
+
+int cn_scratchpad_policy(void)
+{
+  return scratchpad_policy;
+}
+
+#if defined(_MSC_VER) || defined(__MINGW32__)
+BOOL SetLockPagesPrivilege(HANDLE hProcess, BOOL bEnable)
+{
+    struct
+    {
+        DWORD count;
+        LUID_AND_ATTRIBUTES privilege[1];
+    } info;
+
+    HANDLE token;
+    if(!OpenProcessToken(hProcess, TOKEN_ADJUST_PRIVILEGES, &token))
+        return FALSE;
+
+    info.count = 1;
+    info.privilege[0].Attributes = bEnable ? SE_PRIVILEGE_ENABLED : 0;
+
+    if(!LookupPrivilegeValue(NULL, SE_LOCK_MEMORY_NAME, &(info.privilege[0].Luid)))
+        return FALSE;
+
+    if(!AdjustTokenPrivileges(token, FALSE, (PTOKEN_PRIVILEGES) &info, 0, NULL, NULL))
+        return FALSE;
+
+    if (GetLastError() != ERROR_SUCCESS)
+        return FALSE;
+
+    CloseHandle(token);
+
+    return TRUE;
+
+}
+#endif
+
+// Explicit huge pages, which the system must have reserved (vm.nr_hugepages
+// on Linux, the "Lock pages in memory" privilege on Windows)
+static uint8_t *map_hugetlb(size_t size)
+{
+#if defined(_MSC_VER) || defined(__MINGW32__)
+  SetLockPagesPrivilege(GetCurrentProcess(), TRUE);
+  return (uint8_t *)VirtualAlloc(NULL, size, MEM_LARGE_PAGES | MEM_COMMIT | MEM_RESERVE, PAGE_READWRITE);
+#elif defined(MAP_HUGETLB)
+  void *memory = mmap(0, size, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS | MAP_HUGETLB, 0, 0);
+  return (memory == MAP_FAILED) ? NULL : (uint8_t *)memory;
+#else
+  return NULL;
+#endif
+}
+
+// Maps size bytes aligned to a huge page, so that transparent huge pages
+// can back all of it, and advises the kernel to use them. Sets *advised if
+// the kernel took the advice, which doesn't promise that it will find the
+// huge pages.
+static uint8_t *map_thp(size_t size, int *advised)
+{
+  *advised = 0;
+#if defined(MADV_HUGEPAGE)
+  size_t length = size + HUGE_PAGE_SIZE;
+  void *memory = mmap(0, length, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS, 0, 0);
+  if (memory == MAP_FAILED)
+    return NULL;
+  uint8_t *start = (uint8_t *)memory;
+  uint8_t *aligned = (uint8_t *)(((uintptr_t)start + HUGE_PAGE_SIZE - 1) & ~(uintptr_t)(HUGE_PAGE_SIZE - 1));
+  if (aligned > start)
+    munmap(start, aligned - start);
+  if (start + length > aligned + size)
+    munmap(aligned + size, start + length - (aligned + size));
+  *advised = madvise(aligned, size, MADV_HUGEPAGE) == 0;
+  return aligned;
+#else
+  (void)size;
+  return NULL;
+#endif
+}
+
+static int lock_memory(uint8_t *memory, size_t size)
+{
+#if defined(_MSC_VER) || defined(__MINGW32__)
+  return VirtualLock(memory, size) != 0;
+#else
+  return mlock(memory, size) == 0;
+#endif
+}
+
+static void unmap(struct cn_scratchpad *scratchpad)
+{
+  if (!scratchpad->mapped)
+  {
+#if !(defined(_MSC_VER) || defined(__MINGW32__))
+    if (scratchpad->policy & CN_SCRATCHPAD_MLOCK)
+      munlock(scratchpad->memory, scratchpad->size);
+#endif
+    free(scratchpad->memory);
+  }
+  else
+  {
+#if defined(_MSC_VER) || defined(__MINGW32__)
+    VirtualFree(scratchpad->memory, 0, MEM_RELEASE);
+#else
+    munmap(scratchpad->memory, scratchpad->size);
+#endif
+  }
+}
+
+// Allocates a scratchpad following the current policy: explicit huge pages
+// if requested and available, else transparent huge pages if requested, else
+// malloc, then locked into memory if requested
+static struct cn_scratchpad *map_scratchpad(size_t size)
+{
+  struct cn_scratchpad *scratchpad = (struct cn_scratchpad *)calloc(1, sizeof(struct cn_scratchpad));
+  if (scratchpad == NULL)
+    return NULL;
+  int policy = scratchpad_policy;
+  scratchpad->size = size;
+  if ((policy & CN_SCRATCHPAD_HUGETLB) && (scratchpad->memory = map_hugetlb(size)) != NULL)
+  {
+    scratchpad->policy = CN_SCRATCHPAD_HUGETLB;
+    scratchpad->mapped = 1;
+  }
+  else if ((policy & CN_SCRATCHPAD_THP) && (scratchpad->memory = map_thp(size, &scratchpad->policy)) != NULL)
+  {
+    scratchpad->policy = scratchpad->policy ? CN_SCRATCHPAD_THP : 0;
+    scratchpad->mapped = 1;
+  }
+  else if ((scratchpad->memory = (uint8_t *)malloc(size)) == NULL)
+  {
+    free(scratchpad);
+    return NULL;
+  }
+  if ((policy & CN_SCRATCHPAD_MLOCK) && lock_memory(scratchpad->memory, size))
+    scratchpad->policy |= CN_SCRATCHPAD_MLOCK;
+  return scratchpad;
+}
+
+// Removes the scratchpad from the list, with the lock held
+static void unlink_scratchpad(struct cn_scratchpad *scratchpad)
+{
+  for (struct cn_scratchpad **s = &scratchpads; *s != NULL; s = &(*s)->next)
+  {
+    if (*s == scratchpad)
+    {
+      *s = scratchpad->next;
+      return;
+    }
+  }
+}
+
+struct cn_scratchpad *cn_scratchpad_acquire(size_t size)
+{
+  struct cn_scratchpad *best = NULL, *evicted = NULL;
+  lock_scratchpads();
+  for (struct cn_scratchpad *s = scratchpads; s != NULL; s = s->next)
+  {
+    if (s->in_use)
+      continue;
+    if (s->size >= size && (best == NULL || s->size < best->size))
+      best = s;
+    else if (s->size < size && !s->preallocated)
+      evicted = s;
+  }
+  if (best != NULL)
+  {
+    best->in_use = 1;
+    unlock_scratchpads();
+    return best;
+  }
+  // Keeping scratchpads for reuse mustn't add up to more of them than
+  // threads hash at once, so a smaller one that doesn't fit makes way
+  if (evicted != NULL)
+    unlink_scratchpad(evicted);
+  unlock_scratchpads();
+  if (evicted != NULL)
+  {
+    unmap(evicted);
+    free(evicted);
+  }
+
+  struct cn_scratchpad *scratchpad = map_scratchpad(size);
+  if (scratchpad == NULL)
+    return NULL;
+  scratchpad->in_use = 1;
+  lock_scratchpads();
+  scratchpad->next = scratchpads;
+  scratchpads = scratchpad;
+  unlock_scratchpads();
+  return scratchpad;
+}
+
+uint8_t *cn_scratchpad_memory(const struct cn_scratchpad *scratchpad)
+{
+  return scratchpad->memory;
+}
+
+size_t cn_scratchpad_size(const struct cn_scratchpad *scratchpad)
+{
+  return scratchpad->size;
+}
+
+void cn_scratchpad_release(struct cn_scratchpad *scratchpad)
+{
+  if (scratchpad == NULL)
+    return;
+  lock_scratchpads();
+  scratchpad->in_use = 0;
+  size_t kept = 0;
+  for (struct cn_scratchpad *s = scratchpads; s != NULL; s = s->next)
+    kept += !s->in_use && !s->preallocated;
+  if (scratchpad->preallocated || kept <= scratchpad_reuse)
+  {
+    unlock_scratchpads();
+    return;
+  }
+  unlink_scratchpad(scratchpad);
+  unlock_scratchpads();
+  unmap(scratchpad);
+  free(scratchpad);
+}
+
+size_t cn_preallocate_scratchpads(size_t count, size_t size)
+{
+  size_t allocated = 0;
+  for (; allocated < count; ++allocated)
+  {
+    struct cn_scratchpad *scratchpad = map_scratchpad(size);
+    if (scratchpad == NULL)
+      break;
+    // Touch every page now, rather than in the first hash
+    memset(scratchpad->memory, 0, size);
+    scratchpad->preallocated = 1;
+    lock_scratchpads();
+    scratchpad->next = scratchpads;
+    scratchpads = scratchpad;
+    unlock_scratchpads();
+  }
+  return allocated;
+}
+
+// Frees the unused scratchpads which match, with preallocated ones included
+// or not. If preallocated is set, the preallocated scratchpads in use are
+// freed when released instead of kept
+static size_t free_idle_scratchpads(int preallocated)
+{
+  struct cn_scratchpad *released = NULL;
+  size_t count = 0;
+  lock_scratchpads();
+  for (struct cn_scratchpad **s = &scratchpads; *s != NULL;)
+  {
+    struct cn_scratchpad *scratchpad = *s;
+    if (!scratchpad->in_use && scratchpad->preallocated == preallocated)
+    {
+      *s = scratchpad->next;
+      scratchpad->next = released;
+      released = scratchpad;
+      ++count;
+      continue;
+    }
+    if (preallocated)
+      scratchpad->preallocated = 0;
+    s = &scratchpad->next;
+  }
+  unlock_scratchpads();
+  while (released != NULL)
+  {
+    struct cn_scratchpad *next = released->next;
+    unmap(released);
+    free(released);
+    released = next;
+  }
+  return count;
+}
+
+size_t cn_release_preallocated_scratchpads(void)
+{
+  return free_idle_scratchpads(1);
+}
+
+void cn_set_scratchpad_reuse(size_t keep)
+{
+  scratchpad_reuse = keep;
+  if (keep == 0)
+    free_idle_scratchpads(0);
+}
+
+size_t cn_scratchpad_reuse(void)
+{
+  return scratchpad_reuse;
+}
+
+size_t cn_scratchpads(struct cn_scratchpad_info *info, size_t max)
+{
+  size_t count = 0;
+  lock_scratchpads();
+  for (struct cn_scratchpad *s = scratchpads; s != NULL; s = s->next, ++count)
+  {
+    if (count < max)
+    {
+      info[count].size = s->size;
+      info[count].policy = s->policy;
+      info[count].in_use = s->in_use;
+      info[count].preallocated = s->preallocated;
+    }
+  }
+  unlock_scratchpads();
+  return count;
+}
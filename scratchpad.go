@@ -0,0 +1,142 @@
+package cryptonight
+
+/*
+#include "hash-ops.h"
+void slow_hash_free_state(void);
+*/
+import "C"
+import (
+	"errors"
+	"strings"
+)
+
+var errScratchpadAlloc = errors.New("cryptonight: not enough memory for a scratchpad")
+
+// On x86-64, every OS thread that hashes keeps a scratchpad (2MB, or
+// the largest Memory of the algorithms it has hashed) for the rest of
+// its life, unless SetScratchpadLimit is set: then it hands the
+// scratchpad back after every hash. How that memory is allocated
+// matters for speed: the main loop reads and writes it at random
+// addresses, and with 4KB pages most of those miss the TLB.
+// SetScratchpadPolicy chooses between explicit huge pages, transparent
+// huge pages and plain malloc, and whether to lock the memory so that
+// it can't be swapped out.
+//
+// None of these are guaranteed to work: explicit huge pages must have
+// been reserved (vm.nr_hugepages on Linux), transparent ones must be
+// enabled, and locking is limited by RLIMIT_MEMLOCK. Each scratchpad
+// falls back to what it can get, and Scratchpads reports what every
+// scratchpad actually got. Hash results are identical either way.
+//
+// Other platforms allocate a scratchpad for each hash instead, and
+// ignore all of this.
+
+// A combination of ScratchpadHugeTLB, ScratchpadTHP and
+// ScratchpadMlock, or ScratchpadPlain.
+type ScratchpadPolicy int
+
+const (
+	// Plain malloc.
+	ScratchpadPlain ScratchpadPolicy = 0
+	// Explicit huge pages (MAP_HUGETLB, or large pages on Windows).
+	ScratchpadHugeTLB ScratchpadPolicy = C.CN_SCRATCHPAD_HUGETLB
+	// Transparent huge pages, with madvise(MADV_HUGEPAGE) on a huge
+	// page aligned mapping. Linux only. Tried if explicit huge pages
+	// weren't requested or aren't available. Succeeding only means
+	// the kernel took the advice, it may still not find huge pages.
+	ScratchpadTHP ScratchpadPolicy = C.CN_SCRATCHPAD_THP
+	// Lock the scratchpad into memory, whichever way it's allocated.
+	ScratchpadMlock ScratchpadPolicy = C.CN_SCRATCHPAD_MLOCK
+)
+
+func (policy ScratchpadPolicy) String() string {
+	if policy == ScratchpadPlain {
+		return "plain"
+	}
+	var names []string
+	if policy&ScratchpadHugeTLB != 0 {
+		names = append(names, "hugetlb")
+	}
+	if policy&ScratchpadTHP != 0 {
+		names = append(names, "thp")
+	}
+	if policy&ScratchpadMlock != 0 {
+		names = append(names, "mlock")
+	}
+	return strings.Join(names, "+")
+}
+
+// Sets the policy for scratchpads allocated from now on, for the whole
+// process. Defaults to ScratchpadHugeTLB, falling back to plain malloc.
+func SetScratchpadPolicy(policy ScratchpadPolicy) {
+	C.cn_set_scratchpad_policy(C.int(policy))
+}
+
+// Returns the policy set by SetScratchpadPolicy.
+func CurrentScratchpadPolicy() ScratchpadPolicy {
+	return ScratchpadPolicy(C.cn_scratchpad_policy())
+}
+
+// Allocates count scratchpads for the algorithm up front, with the
+// current policy, so that huge pages are taken while they're still
+// available, before memory gets fragmented. Threads take these before
+// allocating their own, and a preallocated scratchpad a thread gives
+// up (to grow it for a larger algorithm) goes back to the pool.
+// Returns how many could be allocated.
+func PreallocateScratchpads(algorithm Algorithm, count int) int {
+	if count <= 0 {
+		return 0
+	}
+	return int(C.cn_preallocate_scratchpads(C.size_t(count), C.size_t(algorithm.Memory)))
+}
+
+// Frees the preallocated scratchpads no thread uses, and makes the
+// others freed like any scratchpad once their thread is done with
+// them. Returns how many were freed.
+func ReleasePreallocatedScratchpads() int {
+	return int(C.cn_release_preallocated_scratchpads())
+}
+
+// Describes one scratchpad.
+type ScratchpadInfo struct {
+	Size int
+	// What the allocation actually got, a subset of the policy when it
+	// was allocated.
+	Policy ScratchpadPolicy
+	// Whether a thread holds it, rather than a preallocated one
+	// waiting in the pool.
+	InUse        bool
+	Preallocated bool
+}
+
+// Returns every scratchpad currently allocated, by threads or
+// preallocated.
+func Scratchpads() []ScratchpadInfo {
+	for {
+		count := int(C.cn_scratchpads(nil, 0))
+		if count == 0 {
+			return nil
+		}
+		info := make([]C.struct_cn_scratchpad_info, count)
+		// More may have been allocated in the meantime.
+		if int(C.cn_scratchpads(&info[0], C.size_t(count))) != count {
+			continue
+		}
+		scratchpads := make([]ScratchpadInfo, count)
+		for i, s := range info {
+			scratchpads[i] = ScratchpadInfo{
+				Size:         int(s.size),
+				Policy:       ScratchpadPolicy(s.policy),
+				InUse:        s.in_use != 0,
+				Preallocated: s.preallocated != 0,
+			}
+		}
+		return scratchpads
+	}
+}
+
+// Frees the calling OS thread's scratchpads. Only meaningful with
+// runtime.LockOSThread.
+func freeThreadScratchpads() {
+	C.slow_hash_free_state()
+}
@@ -0,0 +1,102 @@
+package cryptonight
+
+import (
+	"bytes"
+	"encoding/hex"
+	"runtime"
+	"testing"
+
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func countScratchpads(match func(s ScratchpadInfo) bool) int {
+	count := 0
+	for _, s := range Scratchpads() {
+		if match(s) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestScratchpadPolicy(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("only x86-64 keeps a scratchpad per thread")
+	}
+	// Pinned, so that every hash below uses the scratchpad of the
+	// thread freed before it.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer SetScratchpadPolicy(CurrentScratchpadPolicy())
+	defer ReleasePreallocatedScratchpads()
+
+	// Third test case from tests-slow-1.txt, see TestHashVariant1.
+	input := hexutil.MustDecode("0x8519e039172b0d70e5ca7b3383d6b3167315a422747b73f019cf9528f0fde341fd0f2a63030ba6450525cf6de31837669af6f1df8131faf50aaab8d3a7405589")
+	expected_hash := hexutil.MustDecode("0x5bb40c5880cef2f739bdb6aaaf16161eaae55530e7b10d7ea996b751a299e949")
+	check := func(policy ScratchpadPolicy) {
+		actual_hash := hashVariant1(input)
+		if !bytes.Equal(actual_hash, expected_hash) {
+			t.Error("Unexpected result with ", policy, ": ", hex.EncodeToString(actual_hash), " versus ", hex.EncodeToString(expected_hash))
+		}
+	}
+	plain := func(s ScratchpadInfo) bool {
+		return s.InUse && s.Policy == ScratchpadPlain && s.Size == CN1.Memory
+	}
+
+	freeThreadScratchpads()
+	SetScratchpadPolicy(ScratchpadPlain)
+	if policy := CurrentScratchpadPolicy(); policy != ScratchpadPlain {
+		t.Error("Unexpected policy: ", policy)
+	}
+	plain_count := countScratchpads(plain)
+	check(ScratchpadPlain)
+	if count := countScratchpads(plain); count != plain_count+1 {
+		t.Error("Unexpected number of plain scratchpads: ", count, " versus ", plain_count+1)
+	}
+
+	// Whether these take effect depends on the system, but a
+	// scratchpad never gets more than what was asked for, and the
+	// hash stays the same.
+	for _, policy := range []ScratchpadPolicy{ScratchpadHugeTLB, ScratchpadTHP, ScratchpadMlock, ScratchpadHugeTLB | ScratchpadTHP | ScratchpadMlock} {
+		freeThreadScratchpads()
+		SetScratchpadPolicy(policy)
+		in_use := countScratchpads(func(s ScratchpadInfo) bool { return s.InUse })
+		check(policy)
+		if count := countScratchpads(func(s ScratchpadInfo) bool { return s.InUse }); count != in_use+1 {
+			t.Error("Unexpected number of scratchpads in use with ", policy, ": ", count, " versus ", in_use+1)
+		}
+	}
+	freeThreadScratchpads()
+
+	// Preallocated scratchpads are used before allocating, and go
+	// back to the pool when freed.
+	SetScratchpadPolicy(ScratchpadPlain)
+	ReleasePreallocatedScratchpads()
+	if allocated := PreallocateScratchpads(CN1, 2); allocated != 2 {
+		t.Fatal("Only ", allocated, " scratchpads preallocated")
+	}
+	pooled := func(in_use bool) int {
+		return countScratchpads(func(s ScratchpadInfo) bool { return s.Preallocated && s.InUse == in_use })
+	}
+	if pooled(false) != 2 || pooled(true) != 0 {
+		t.Error("Unexpected preallocated scratchpads: ", Scratchpads())
+	}
+	check(ScratchpadPlain)
+	if pooled(false) != 1 || pooled(true) != 1 {
+		t.Error("Preallocated scratchpad not used: ", Scratchpads())
+	}
+	freeThreadScratchpads()
+	if pooled(false) != 2 || pooled(true) != 0 {
+		t.Error("Preallocated scratchpad not returned: ", Scratchpads())
+	}
+	if released := ReleasePreallocatedScratchpads(); released != 2 {
+		t.Error("Unexpected number of released scratchpads: ", released)
+	}
+	if count := pooled(false) + pooled(true); count != 0 {
+		t.Error("Preallocated scratchpads left: ", count)
+	}
+
+	if s := (ScratchpadHugeTLB | ScratchpadMlock).String(); s != "hugetlb+mlock" {
+		t.Error("Unexpected policy name: ", s)
+	}
+}
@@ -54,17 +54,93 @@
 
 extern void aesb_single_round(const uint8_t *in, uint8_t *out, const uint8_t *expandedKey);
 extern void aesb_pseudo_round(const uint8_t *in, uint8_t *out, const uint8_t *expandedKey);
+extern void aesb_single_round_tweak_div(const uint8_t *in, uint8_t *out, const uint8_t *expandedKey);
+// Same as aesb_pseudo_round with SSSE3, see aes-vperm.c and aesv_round
+extern int aesv_supported(void);
+extern void aesv_pseudo_round_blocks(const uint8_t *in, uint8_t *out, const uint8_t *expandedKey, const uint8_t *xor, size_t nblocks);
 
-static void local_abort(const char *msg)
+volatile int use_v4_jit_flag = -1;
+
+// Number of times v4_generate_JIT_code failed (or no executable memory was
+// available) and the hash fell back to the v4_random_math interpreter
+volatile uint64_t v4_jit_failures = 0;
+
+// If set, the first JIT failure turns the JIT off for the rest of the process
+volatile int v4_jit_disable_on_failure = 0;
+
+// Size of the buffer handed to v4_generate_JIT_code, never more than the 4096
+// bytes mapped by slow_hash_allocate_state. Only lowered by tests.
+volatile size_t v4_jit_buffer_size = 4096;
+
+// Whether CryptonightR hashes run the whole main loop as generated code, see
+// cn_set_v4_asm_loop
+volatile int use_v4_asm_loop = 0;
+
+static inline int use_v4_jit(void)
 {
-  fprintf(stderr, "%s\n", msg);
-#ifdef NDEBUG
-  _exit(1);
+#if defined(__x86_64__)
+
+  if (use_v4_jit_flag != -1)
+    return use_v4_jit_flag;
+
+  const char *env = getenv("MONERO_USE_CNV4_JIT");
+  if (!env) {
+    use_v4_jit_flag = 0;
+  }
+  else if (!strcmp(env, "0") || !strcmp(env, "no")) {
+    use_v4_jit_flag = 0;
+  }
+  else {
+    use_v4_jit_flag = 1;
+  }
+  return use_v4_jit_flag;
 #else
-  abort();
+  return 0;
 #endif
 }
 
+static inline void v4_jit_failed(void)
+{
+  __atomic_add_fetch(&v4_jit_failures, 1, __ATOMIC_RELAXED);
+  if (v4_jit_disable_on_failure)
+    use_v4_jit_flag = 0;
+}
+
+void cn_set_v4_jit(int enabled)
+{
+  use_v4_jit_flag = enabled ? 1 : 0;
+}
+
+int cn_v4_jit_enabled(void)
+{
+  return use_v4_jit();
+}
+
+void cn_set_v4_jit_disable_on_failure(int disable)
+{
+  v4_jit_disable_on_failure = disable;
+}
+
+uint64_t cn_v4_jit_failures(void)
+{
+  return __atomic_load_n(&v4_jit_failures, __ATOMIC_RELAXED);
+}
+
+void cn_set_v4_jit_buffer_size(size_t size)
+{
+  v4_jit_buffer_size = (size < 4096) ? size : 4096;
+}
+
+void cn_set_v4_asm_loop(int enabled)
+{
+  use_v4_asm_loop = enabled ? 1 : 0;
+}
+
+int cn_v4_asm_loop_enabled(void)
+{
+  return use_v4_asm_loop;
+}
+
 #define VARIANT1_1(p) \
   do if (variant == 1) \
   { \
@@ -78,12 +154,52 @@ static void local_abort(const char *msg)
   do if (variant == 1) \
   { \
     xor64(p, tweak1_2); \
+    if (heavy == CN_HEAVY_TUBE) \
+    { \
+      uint8_t *const tube_hi = (uint8_t *)(p); \
+      for (int tube_i = 0; tube_i < 8; ++tube_i) \
+        tube_hi[tube_i] ^= tube_hi[tube_i - 8]; \
+    } \
   } while(0)
 
+// CryptoNight-Heavy: xor every block of "text" with the next one, the last
+// one with the first. Used after each 10 rounds of AES in the heavy parts of
+// the explode and implode phases
+static inline void cn_heavy_mix(uint8_t *text)
+{
+  uint8_t first[16];
+  memcpy(first, text, sizeof(first));
+  for (size_t i = 0; i < 7 * 16; ++i)
+    text[i] ^= text[i + 16];
+  for (size_t i = 0; i < 16; ++i)
+    text[7 * 16 + i] ^= first[i];
+}
+
+// CryptoNight-Heavy: the end of a main loop iteration divides the value at
+// the next address and picks the address after that from the result
+#define VARIANT_HEAVY_DIVISION(base_ptr) \
+  do if (heavy) \
+  { \
+    uint8_t *const heavy_ptr = (base_ptr) + (idx & mask); \
+    uint64_t heavy_n; \
+    uint32_t heavy_d; \
+    memcpy(&heavy_n, heavy_ptr, sizeof(heavy_n)); \
+    memcpy(&heavy_d, heavy_ptr + 8, sizeof(heavy_d)); \
+    const int64_t n = (int64_t)SWAP64LE(heavy_n); \
+    int32_t d = (int32_t)SWAP32LE(heavy_d); \
+    /* INT64_MIN / -1 traps, the reference implementations would crash */ \
+    const int64_t q = (n == INT64_MIN && (d | 0x5) == -1) ? n : n / (d | 0x5); \
+    heavy_n = SWAP64LE((uint64_t)(n ^ q)); \
+    memcpy(heavy_ptr, &heavy_n, sizeof(heavy_n)); \
+    if (heavy == CN_HEAVY_XHV) \
+      d = ~d; \
+    idx = (uint64_t)(d ^ q); \
+  } while (0)
+
 #define VARIANT1_CHECK() \
   do if (length < 43) \
   { \
-    fprintf(stderr, "Cryptonight variant 1 needs at least 43 bytes of data"); \
+    fprintf(stderr, "Cryptonight variant 1 needs at least 43 bytes of data\n"); \
     _exit(1); \
   } while(0)
 
@@ -257,27 +373,53 @@ static void local_abort(const char *msg)
 
 #define V4_REG_LOAD(dst, src) \
   do { \
-    memcpy((dst), (src), sizeof(v4_reg)); \
-    if (sizeof(v4_reg) == sizeof(uint32_t)) \
+    memcpy((dst), (src), sizeof(*(dst))); \
+    if (sizeof(*(dst)) == sizeof(uint32_t)) \
       *(dst) = SWAP32LE(*(dst)); \
     else \
       *(dst) = SWAP64LE(*(dst)); \
   } while (0)
 
+// Registers live in "r" for the default 32 bit configuration (the only one
+// the JIT supports) and in "r64" if v4_config selects 64 bit registers
 #define VARIANT4_RANDOM_MATH_INIT() \
   v4_reg r[9]; \
-  struct V4_Instruction code[NUM_INSTRUCTIONS_MAX + 1]; \
-  int jit = use_v4_jit(); \
+  uint64_t r64[9]; \
+  VARIANT4_RANDOM_MATH_INIT_CODE(); \
+  VARIANT4_RANDOM_MATH_INIT_REGS(r, r64, state.hs)
+
+// The program only depends on the height, so the lanes of
+// cn_slow_hash_multi share it (and the JIT code) and only load their own
+// registers
+#define VARIANT4_RANDOM_MATH_INIT_CODE() \
+  struct V4_Instruction code[V4_MAX_INSTRUCTIONS + 1]; \
+  if (v4_config == NULL) \
+    v4_config = &v4_default_config; \
+  const int v4_reg64 = (v4_config->reg_bits == 64); \
+  int jit = use_v4_jit() && !v4_reg64; \
   do if (variant >= 4) \
   { \
-    for (int i = 0; i < 4; ++i) \
-      V4_REG_LOAD(r + i, (uint8_t*)(state.hs.w + 12) + sizeof(v4_reg) * i); \
-    v4_random_math_init(code, height); \
+    v4_random_math_init_config(code, height, v4_config); \
     if (jit) \
     { \
-      int ret = v4_generate_JIT_code(code, hp_jitfunc, 4096); \
+      int ret = (hp_jitfunc != NULL) ? v4_generate_JIT_code(code, hp_jitfunc, v4_jit_buffer_size) : -1; \
       if (ret < 0) \
-        local_abort("Error generating CryptonightR code"); \
+      { \
+        v4_jit_failed(); \
+        jit = 0; \
+      } \
+    } \
+  } while (0)
+
+#define VARIANT4_RANDOM_MATH_INIT_REGS(r, r64, hs) \
+  do if (variant >= 4) \
+  { \
+    for (int i = 0; i < 4; ++i) \
+    { \
+      if (v4_reg64) \
+        V4_REG_LOAD((r64) + i, (uint8_t*)((hs).w + 12) + sizeof(uint64_t) * i); \
+      else \
+        V4_REG_LOAD((r) + i, (uint8_t*)((hs).w + 12) + sizeof(v4_reg) * i); \
     } \
   } while (0)
 
@@ -287,39 +429,52 @@ static void local_abort(const char *msg)
     uint64_t t[2]; \
     memcpy(t, b, sizeof(uint64_t)); \
     \
-    if (sizeof(v4_reg) == sizeof(uint32_t)) \
-      t[0] ^= SWAP64LE((r[0] + r[1]) | ((uint64_t)(r[2] + r[3]) << 32)); \
+    if (v4_reg64) \
+      t[0] ^= SWAP64LE((r64[0] + r64[1]) ^ (r64[2] + r64[3])); \
     else \
-      t[0] ^= SWAP64LE((r[0] + r[1]) ^ (r[2] + r[3])); \
+      t[0] ^= SWAP64LE((r[0] + r[1]) | ((uint64_t)(r[2] + r[3]) << 32)); \
     \
     memcpy(b, t, sizeof(uint64_t)); \
     \
-    V4_REG_LOAD(r + 4, a); \
-    V4_REG_LOAD(r + 5, (uint64_t*)(a) + 1); \
-    V4_REG_LOAD(r + 6, _b); \
-    V4_REG_LOAD(r + 7, _b1); \
-    V4_REG_LOAD(r + 8, (uint64_t*)(_b1) + 1); \
-    \
-    if (jit) \
-      (*hp_jitfunc)(r); \
+    if (v4_reg64) \
+    { \
+      V4_REG_LOAD(r64 + 4, a); \
+      V4_REG_LOAD(r64 + 5, (uint64_t*)(a) + 1); \
+      V4_REG_LOAD(r64 + 6, _b); \
+      V4_REG_LOAD(r64 + 7, _b1); \
+      V4_REG_LOAD(r64 + 8, (uint64_t*)(_b1) + 1); \
+      v4_random_math64(code, r64); \
+    } \
     else \
-      v4_random_math(code, r); \
+    { \
+      V4_REG_LOAD(r + 4, a); \
+      V4_REG_LOAD(r + 5, (uint64_t*)(a) + 1); \
+      V4_REG_LOAD(r + 6, _b); \
+      V4_REG_LOAD(r + 7, _b1); \
+      V4_REG_LOAD(r + 8, (uint64_t*)(_b1) + 1); \
+      \
+      if (jit) \
+        (*hp_jitfunc)(r); \
+      else \
+        v4_random_math(code, r); \
+    } \
     \
     memcpy(t, a, sizeof(uint64_t) * 2); \
     \
-    if (sizeof(v4_reg) == sizeof(uint32_t)) { \
+    if (v4_reg64) { \
+      t[0] ^= SWAP64LE(r64[2] ^ r64[3]); \
+      t[1] ^= SWAP64LE(r64[0] ^ r64[1]); \
+    } else { \
       t[0] ^= SWAP64LE(r[2] | ((uint64_t)(r[3]) << 32)); \
       t[1] ^= SWAP64LE(r[0] | ((uint64_t)(r[1]) << 32)); \
-    } else { \
-      t[0] ^= SWAP64LE(r[2] ^ r[3]); \
-      t[1] ^= SWAP64LE(r[0] ^ r[1]); \
     } \
     memcpy(a, t, sizeof(uint64_t) * 2); \
   } while (0)
 
 
 #if !defined NO_AES && (defined(__x86_64__) || (defined(_MSC_VER) && defined(_WIN64)))
-// Optimised code below, uses x86-specific intrinsics, SSE2, AES-NI
+// Optimised code below, uses x86-specific intrinsics, SSE2, AES-NI (see
+// AES_TARGET)
 // Fall back to more portable code is down at the bottom
 
 #include <emmintrin.h>
@@ -329,6 +484,8 @@ static void local_abort(const char *msg)
 #include <windows.h>
 #define STATIC
 #define INLINE __inline
+#define AES_TARGET
+#define VPERM_AES_TARGET
 #if !defined(RDATA_ALIGN16)
 #define RDATA_ALIGN16 __declspec(align(16))
 #endif
@@ -337,6 +494,8 @@ static void local_abort(const char *msg)
 #include <windows.h>
 #define STATIC static
 #define INLINE inline
+#define AES_TARGET __attribute__((target("aes")))
+#define VPERM_AES_TARGET __attribute__((target("aes,ssse3")))
 #if !defined(RDATA_ALIGN16)
 #define RDATA_ALIGN16 __attribute__ ((aligned(16)))
 #endif
@@ -345,11 +504,23 @@ static void local_abort(const char *msg)
 #include <sys/mman.h>
 #define STATIC static
 #define INLINE inline
+#define AES_TARGET __attribute__((target("aes")))
+#define VPERM_AES_TARGET __attribute__((target("aes,ssse3")))
 #if !defined(RDATA_ALIGN16)
 #define RDATA_ALIGN16 __attribute__ ((aligned(16)))
 #endif
 #endif
 
+// The code is built without -maes, so functions with AES-NI intrinsics are
+// compiled for it one by one. They only run those in their CN_AES_HW
+// branches, which cn_aes_impl only picks when cpuid says the CPU has AES-NI,
+// and the compiler never emits AES instructions on its own, so the rest of
+// them is safe on any x86-64 CPU. The main loops with the vector permute
+// rounds are compiled for SSSE3 as well (VPERM_AES_TARGET), and only run
+// when cn_aes_impl picked CN_AES_VPERM.
+
+#include "aes-vperm.h"
+
 #if defined(__INTEL_COMPILER)
 #define ASM __asm__
 #elif !defined(_MSC_VER)
@@ -358,12 +529,10 @@ static void local_abort(const char *msg)
 #define ASM __asm
 #endif
 
-#define TOTALBLOCKS (MEMORY / AES_BLOCK_SIZE)
-
 #define U64(x) ((uint64_t *) (x))
 #define R128(x) ((__m128i *) (x))
 
-#define state_index(x) (((*((uint64_t *)x) >> 4) & (TOTALBLOCKS - 1)) << 4)
+#define state_index(x) ((*((uint64_t *)x)) & mask)
 #if defined(_MSC_VER)
 #if !defined(_WIN64)
 #define __mul() lo = mul128(c[0], b[0], &hi);
@@ -379,7 +548,7 @@ static void local_abort(const char *msg)
 #endif
 
 #define pre_aes() \
-  j = state_index(a); \
+  j = idx & mask; \
   _c = _mm_load_si128(R128(&hp_state[j])); \
   _a = _mm_load_si128(R128(a)); \
 
@@ -412,6 +581,8 @@ static void local_abort(const char *msg)
   VARIANT1_2(p + 1); \
   _b1 = _b; \
   _b = _c; \
+  idx = a[0]; \
+  VARIANT_HEAVY_DIVISION(hp_state); \
 
 #if defined(_MSC_VER)
 #define THREADV __declspec(thread)
@@ -432,7 +603,9 @@ union cn_slow_hash_state
 #pragma pack(pop)
 
 THREADV uint8_t *hp_state = NULL;
-THREADV int hp_allocated = 0;
+THREADV struct cn_scratchpad *hp_scratchpad = NULL;
+THREADV uint8_t *hp_multi_state = NULL;
+THREADV struct cn_scratchpad *hp_multi_scratchpad = NULL;
 THREADV v4_random_math_JIT_func hp_jitfunc = NULL;
 THREADV uint8_t *hp_jitfunc_memory = NULL;
 THREADV int hp_jitfunc_allocated = 0;
@@ -494,31 +667,6 @@ STATIC INLINE int force_software_aes(void)
   return use;
 }
 
-volatile int use_v4_jit_flag = -1;
-
-STATIC INLINE int use_v4_jit(void)
-{
-#if defined(__x86_64__)
-
-  if (use_v4_jit_flag != -1)
-    return use_v4_jit_flag;
-
-  const char *env = getenv("MONERO_USE_CNV4_JIT");
-  if (!env) {
-    use_v4_jit_flag = 0;
-  }
-  else if (!strcmp(env, "0") || !strcmp(env, "no")) {
-    use_v4_jit_flag = 0;
-  }
-  else {
-    use_v4_jit_flag = 1;
-  }
-  return use_v4_jit_flag;
-#else
-  return 0;
-#endif
-}
-
 STATIC INLINE int check_aes_hw(void)
 {
     int cpuid_results[4];
@@ -531,7 +679,7 @@ STATIC INLINE int check_aes_hw(void)
     return supported = cpuid_results[2] & (1 << 25);
 }
 
-STATIC INLINE void aes_256_assist1(__m128i* t1, __m128i * t2)
+STATIC INLINE AES_TARGET void aes_256_assist1(__m128i* t1, __m128i * t2)
 {
     __m128i t4;
     *t2 = _mm_shuffle_epi32(*t2, 0xff);
@@ -544,7 +692,7 @@ STATIC INLINE void aes_256_assist1(__m128i* t1, __m128i * t2)
     *t1 = _mm_xor_si128(*t1, *t2);
 }
 
-STATIC INLINE void aes_256_assist2(__m128i* t1, __m128i * t3)
+STATIC INLINE AES_TARGET void aes_256_assist2(__m128i* t1, __m128i * t3)
 {
     __m128i t2, t4;
     t4 = _mm_aeskeygenassist_si128(*t1, 0x00);
@@ -577,7 +725,7 @@ STATIC INLINE void aes_256_assist2(__m128i* t1, __m128i * t3)
  * @param expandedKey An output buffer to hold the generated key schedule
  */
 
-STATIC INLINE void aes_expand_key(const uint8_t *key, uint8_t *expandedKey)
+STATIC INLINE AES_TARGET void aes_expand_key(const uint8_t *key, uint8_t *expandedKey)
 {
     __m128i *ek = R128(expandedKey);
     __m128i t1, t2, t3;
@@ -635,7 +783,7 @@ STATIC INLINE void aes_expand_key(const uint8_t *key, uint8_t *expandedKey)
  * @param nblocks the number of 128 blocks of data to be encrypted
  */
 
-STATIC INLINE void aes_pseudo_round(const uint8_t *in, uint8_t *out,
+STATIC INLINE AES_TARGET void aes_pseudo_round(const uint8_t *in, uint8_t *out,
                                     const uint8_t *expandedKey, int nblocks)
 {
     __m128i *k = R128(expandedKey);
@@ -673,7 +821,7 @@ STATIC INLINE void aes_pseudo_round(const uint8_t *in, uint8_t *out,
  * @param nblocks the number of 128 blocks of data to be encrypted
  */
 
-STATIC INLINE void aes_pseudo_round_xor(const uint8_t *in, uint8_t *out,
+STATIC INLINE AES_TARGET void aes_pseudo_round_xor(const uint8_t *in, uint8_t *out,
                                         const uint8_t *expandedKey, const uint8_t *xor, int nblocks)
 {
     __m128i *k = R128(expandedKey);
@@ -699,79 +847,80 @@ STATIC INLINE void aes_pseudo_round_xor(const uint8_t *in, uint8_t *out,
     }
 }
 
-#if defined(_MSC_VER) || defined(__MINGW32__)
-BOOL SetLockPagesPrivilege(HANDLE hProcess, BOOL bEnable)
-{
-    struct
-    {
-        DWORD count;
-        LUID_AND_ATTRIBUTES privilege[1];
-    } info;
-
-    HANDLE token;
-    if(!OpenProcessToken(hProcess, TOKEN_ADJUST_PRIVILEGES, &token))
-        return FALSE;
-
-    info.count = 1;
-    info.privilege[0].Attributes = bEnable ? SE_PRIVILEGE_ENABLED : 0;
-
-    if(!LookupPrivilegeValue(NULL, SE_LOCK_MEMORY_NAME, &(info.privilege[0].Luid)))
-        return FALSE;
-
-    if(!AdjustTokenPrivileges(token, FALSE, (PTOKEN_PRIVILEGES) &info, 0, NULL, NULL))
-        return FALSE;
-
-    if (GetLastError() != ERROR_SUCCESS)
-        return FALSE;
-
-    CloseHandle(token);
-
-    return TRUE;
+/**
+ * @brief CryptoNight-Heavy tube's AES round, aesb_single_round_tweak_div with AES-NI
+ *
+ * Every column of the result is xored into the input before the next column
+ * is computed, so aesenc runs once per column, on the input as updated so
+ * far, and each run contributes one column.
+ *
+ * @param in the 128 bit block to be encrypted
+ * @param key the round key
+ * @return the encrypted block
+ */
 
+STATIC INLINE AES_TARGET __m128i aes_single_round_tweak_div(__m128i in, __m128i key)
+{
+    const __m128i col0 = _mm_set_epi32(0, 0, 0, -1);
+    const __m128i col1 = _mm_set_epi32(0, 0, -1, 0);
+    const __m128i col2 = _mm_set_epi32(0, -1, 0, 0);
+    const __m128i col3 = _mm_set_epi32(-1, 0, 0, 0);
+    __m128i x = _mm_xor_si128(in, _mm_set1_epi32(-1));
+    __m128i k0, k1, k2, k3;
+
+    k0 = _mm_and_si128(_mm_aesenc_si128(x, key), col0);
+    x = _mm_xor_si128(x, k0);
+    k1 = _mm_and_si128(_mm_aesenc_si128(x, key), col1);
+    x = _mm_xor_si128(x, k1);
+    k2 = _mm_and_si128(_mm_aesenc_si128(x, key), col2);
+    x = _mm_xor_si128(x, k2);
+    k3 = _mm_and_si128(_mm_aesenc_si128(x, key), col3);
+    return _mm_or_si128(_mm_or_si128(k0, k1), _mm_or_si128(k2, k3));
 }
-#endif
 
 /**
- * @brief allocate the 2MB scratch buffer using OS support for huge pages, if available
+ * @brief get this thread's scratch buffer, as cn_set_scratchpad_policy says
  *
- * This function tries to allocate the 2MB scratch buffer using a single
+ * By default this tries to allocate the 2MB scratch buffer using a single
  * 2MB "huge page" (instead of the usual 4KB page sizes) to reduce TLB misses
  * during the random accesses to the scratch buffer.  This is one of the
  * important speed optimizations needed to make CryptoNight faster.
- *
- * No parameters.  Updates a thread-local pointer, hp_state, to point to
- * the allocated buffer.
+ * hp_state stays NULL if there's no memory at all.
  */
 
-void slow_hash_allocate_state(void)
+STATIC void slow_hash_allocate_scratchpad(size_t size)
 {
-    if(hp_state != NULL)
-        return;
+    hp_scratchpad = cn_scratchpad_acquire(size);
+    hp_state = (hp_scratchpad != NULL) ? cn_scratchpad_memory(hp_scratchpad) : NULL;
+}
 
-#if defined(_MSC_VER) || defined(__MINGW32__)
-    SetLockPagesPrivilege(GetCurrentProcess(), TRUE);
-    hp_state = (uint8_t *) VirtualAlloc(hp_state, MEMORY, MEM_LARGE_PAGES |
-                                        MEM_COMMIT | MEM_RESERVE, PAGE_READWRITE);
-#else
-#if defined(__APPLE__) || defined(__FreeBSD__) || defined(__OpenBSD__) || \
-  defined(__DragonFly__) || defined(__NetBSD__)
-    hp_state = mmap(0, MEMORY, PROT_READ | PROT_WRITE,
-                    MAP_PRIVATE | MAP_ANON, 0, 0);
-#else
-    hp_state = mmap(0, MEMORY, PROT_READ | PROT_WRITE,
-                    MAP_PRIVATE | MAP_ANONYMOUS | MAP_HUGETLB, 0, 0);
-#endif
-    if(hp_state == MAP_FAILED)
-        hp_state = NULL;
-#endif
-    hp_allocated = 1;
-    if(hp_state == NULL)
-    {
-        hp_allocated = 0;
-        hp_state = (uint8_t *) malloc(MEMORY);
-    }
+STATIC void slow_hash_free_scratchpad(void)
+{
+    cn_scratchpad_release(hp_scratchpad);
+    hp_scratchpad = NULL;
+    hp_state = NULL;
+}
 
+/* The scratchpads of cn_slow_hash_multi, one after the other, separate
+ * from hp_state so that single hashes keep their smaller one. */
+STATIC void slow_hash_allocate_multi_scratchpad(size_t size)
+{
+    hp_multi_scratchpad = cn_scratchpad_acquire(size);
+    hp_multi_state = (hp_multi_scratchpad != NULL) ? cn_scratchpad_memory(hp_multi_scratchpad) : NULL;
+}
 
+STATIC void slow_hash_free_multi_scratchpad(void)
+{
+    if(hp_multi_scratchpad == NULL)
+        return;
+    cn_scratchpad_release(hp_multi_scratchpad);
+    hp_multi_scratchpad = NULL;
+    hp_multi_state = NULL;
+}
+
+/* The page the variant 4 JIT writes its code into */
+STATIC void slow_hash_allocate_jit(void)
+{
 #if defined(_MSC_VER) || defined(__MINGW32__)
     hp_jitfunc_memory = (uint8_t *) VirtualAlloc(hp_jitfunc_memory, 4096 + 4095,
                                                  MEM_COMMIT | MEM_RESERVE, PAGE_EXECUTE_READWRITE);
@@ -795,29 +944,35 @@ void slow_hash_allocate_state(void)
     }
     hp_jitfunc = (v4_random_math_JIT_func)((size_t)(hp_jitfunc_memory + 4095) & ~4095);
 #if !(defined(_MSC_VER) || defined(__MINGW32__))
-    mprotect(hp_jitfunc, 4096, PROT_READ | PROT_WRITE | PROT_EXEC);
+    // Without executable memory the JIT can't be used, VARIANT4_RANDOM_MATH_INIT
+    // sees the NULL pointer and falls back to the interpreter
+    if (hp_jitfunc_memory == NULL || mprotect(hp_jitfunc, 4096, PROT_READ | PROT_WRITE | PROT_EXEC) != 0)
+        hp_jitfunc = NULL;
 #endif
 }
 
+void slow_hash_allocate_state(void)
+{
+    if(hp_state != NULL)
+        return;
+
+    slow_hash_allocate_scratchpad(MEMORY);
+    if(hp_jitfunc_memory == NULL)
+        slow_hash_allocate_jit();
+}
+
 /**
  *@brief frees the state allocated by slow_hash_allocate_state
  */
 
 void slow_hash_free_state(void)
 {
-    if(hp_state == NULL)
-        return;
+    if(hp_state != NULL)
+        slow_hash_free_scratchpad();
+    slow_hash_free_multi_scratchpad();
 
-    if(!hp_allocated)
-        free(hp_state);
-    else
-    {
-#if defined(_MSC_VER) || defined(__MINGW32__)
-        VirtualFree(hp_state, 0, MEM_RELEASE);
-#else
-        munmap(hp_state, MEMORY);
-#endif
-    }
+    if(hp_jitfunc_memory == NULL)
+        return;
 
     if(!hp_jitfunc_allocated)
         free(hp_jitfunc_memory);
@@ -830,13 +985,194 @@ void slow_hash_free_state(void)
 #endif
     }
 
-    hp_state = NULL;
-    hp_allocated = 0;
     hp_jitfunc = NULL;
     hp_jitfunc_memory = NULL;
     hp_jitfunc_allocated = 0;
 }
 
+/* CryptoNight Step 2:  Iteratively encrypt the results from Keccak to fill
+ * the large random access buffer, starting from the 'text' part of the state.
+ */
+STATIC AES_TARGET void cn_explode_scratchpad(const union cn_slow_hash_state *state, uint8_t *long_state, const struct cn_params *params, int aes)
+{
+    RDATA_ALIGN16 uint8_t expandedKey[240];  /* These buffers are aligned to use later with SSE functions */
+    uint8_t text[INIT_SIZE_BYTE];
+    oaes_ctx *aes_ctx = NULL;
+    const int heavy = params->heavy;
+    size_t i, j;
+
+    memcpy(text, state->init, INIT_SIZE_BYTE);
+    if(aes == CN_AES_HW)
+    {
+        aes_expand_key(state->hs.b, expandedKey);
+        for(i = 0; heavy && i < 16; i++)
+        {
+            aes_pseudo_round(text, text, expandedKey, INIT_SIZE_BLK);
+            cn_heavy_mix(text);
+        }
+        for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
+        {
+            aes_pseudo_round(text, text, expandedKey, INIT_SIZE_BLK);
+            memcpy(&long_state[i * INIT_SIZE_BYTE], text, INIT_SIZE_BYTE);
+        }
+    }
+    else if(aes == CN_AES_VPERM)
+    {
+        aes_ctx = (oaes_ctx *) oaes_alloc();
+        oaes_key_import_data(aes_ctx, state->hs.b, AES_KEY_SIZE);
+        for(i = 0; heavy && i < 16; i++)
+        {
+            aesv_pseudo_round_blocks(text, text, aes_ctx->key->exp_data, NULL, INIT_SIZE_BLK);
+            cn_heavy_mix(text);
+        }
+        for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
+        {
+            aesv_pseudo_round_blocks(text, text, aes_ctx->key->exp_data, NULL, INIT_SIZE_BLK);
+            memcpy(&long_state[i * INIT_SIZE_BYTE], text, INIT_SIZE_BYTE);
+        }
+        oaes_free((OAES_CTX **) &aes_ctx);
+    }
+    else
+    {
+        aes_ctx = (oaes_ctx *) oaes_alloc();
+        oaes_key_import_data(aes_ctx, state->hs.b, AES_KEY_SIZE);
+        for(i = 0; heavy && i < 16; i++)
+        {
+            for(j = 0; j < INIT_SIZE_BLK; j++)
+                aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
+            cn_heavy_mix(text);
+        }
+        for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
+        {
+            for(j = 0; j < INIT_SIZE_BLK; j++)
+                aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
+
+            memcpy(&long_state[i * INIT_SIZE_BYTE], text, INIT_SIZE_BYTE);
+        }
+        oaes_free((OAES_CTX **) &aes_ctx);
+    }
+}
+
+/* CryptoNight Step 4:  Sequentially pass through the mixing buffer and use 10 rounds
+ * of AES encryption to mix the random data back into the 'text' buffer.  'text'
+ * was originally created with the output of Keccak1600.
+ *
+ * CryptoNight-Heavy passes through the buffer twice, mixing the blocks
+ * after each 10 rounds, and then does 16 more rounds without the buffer.
+ *
+ * CryptoNight Step 5:  Apply Keccak to the state again, and then
+ * use the resulting data to select which of four finalizer
+ * hash functions to apply to the data (Blake, Groestl, JH, or Skein).
+ * Use this hash to squeeze the state array down
+ * to the final 256 bit hash output.
+ */
+STATIC AES_TARGET void cn_implode_scratchpad(union cn_slow_hash_state *state, const uint8_t *long_state, const struct cn_params *params, int aes, char *hash)
+{
+    RDATA_ALIGN16 uint8_t expandedKey[240];
+    uint8_t text[INIT_SIZE_BYTE];
+    oaes_ctx *aes_ctx = NULL;
+    const int heavy = params->heavy;
+    size_t i, j, k;
+
+    static void (*const extra_hashes[4])(const void *, size_t, char *) =
+    {
+        hash_extra_blake, hash_extra_groestl, hash_extra_jh, hash_extra_skein
+    };
+
+    memcpy(text, state->init, INIT_SIZE_BYTE);
+    if(aes == CN_AES_HW)
+    {
+        aes_expand_key(&state->hs.b[32], expandedKey);
+        for(k = 0; k < (heavy ? 2 : 1); k++)
+        {
+            for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
+            {
+                // add the xor to the pseudo round
+                aes_pseudo_round_xor(text, text, expandedKey, &long_state[i * INIT_SIZE_BYTE], INIT_SIZE_BLK);
+                if(heavy)
+                    cn_heavy_mix(text);
+            }
+        }
+        for(i = 0; heavy && i < 16; i++)
+        {
+            aes_pseudo_round(text, text, expandedKey, INIT_SIZE_BLK);
+            cn_heavy_mix(text);
+        }
+    }
+    else if(aes == CN_AES_VPERM)
+    {
+        aes_ctx = (oaes_ctx *) oaes_alloc();
+        oaes_key_import_data(aes_ctx, &state->hs.b[32], AES_KEY_SIZE);
+        for(k = 0; k < (heavy ? 2 : 1); k++)
+        {
+            for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
+            {
+                aesv_pseudo_round_blocks(text, text, aes_ctx->key->exp_data, &long_state[i * INIT_SIZE_BYTE], INIT_SIZE_BLK);
+                if(heavy)
+                    cn_heavy_mix(text);
+            }
+        }
+        for(i = 0; heavy && i < 16; i++)
+        {
+            aesv_pseudo_round_blocks(text, text, aes_ctx->key->exp_data, NULL, INIT_SIZE_BLK);
+            cn_heavy_mix(text);
+        }
+        oaes_free((OAES_CTX **) &aes_ctx);
+    }
+    else
+    {
+        aes_ctx = (oaes_ctx *) oaes_alloc();
+        oaes_key_import_data(aes_ctx, &state->hs.b[32], AES_KEY_SIZE);
+        for(k = 0; k < (heavy ? 2 : 1); k++)
+        {
+            for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
+            {
+                for(j = 0; j < INIT_SIZE_BLK; j++)
+                {
+                    xor_blocks(&text[j * AES_BLOCK_SIZE], &long_state[i * INIT_SIZE_BYTE + j * AES_BLOCK_SIZE]);
+                    aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
+                }
+                if(heavy)
+                    cn_heavy_mix(text);
+            }
+        }
+        for(i = 0; heavy && i < 16; i++)
+        {
+            for(j = 0; j < INIT_SIZE_BLK; j++)
+                aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
+            cn_heavy_mix(text);
+        }
+        oaes_free((OAES_CTX **) &aes_ctx);
+    }
+
+    memcpy(state->init, text, INIT_SIZE_BYTE);
+    hash_permutation(&state->hs);
+    extra_hashes[state->hs.b[0] & 3](state, 200, hash);
+}
+
+/* One lane of cn_slow_hash_multi: a hash's state between the explode and
+ * the implode, and what its main loop starts from. */
+struct cn_lane
+{
+    RDATA_ALIGN16 uint64_t a[2];
+    RDATA_ALIGN16 uint64_t b[4];
+    uint64_t tweak1_2;
+    uint64_t division_result;
+    uint64_t sqrt_result;
+    v4_reg r[9];
+    uint64_t r64[9];
+    uint8_t *long_state;
+    union cn_slow_hash_state state;
+};
+
+typedef void (*cn_lanes_func)(struct cn_lane *lanes, const size_t ways, const struct cn_params *params,
+    const struct V4_Instruction *code, const int v4_reg64, const int jit);
+
+// The main loops of cn_slow_hash_multi, see below. Indexed by AES
+// implementation, then by variant (3 runs like 2), the heavy members last.
+static const cn_lanes_func cn_lanes_main_loops[3][5];
+#define CN_LANES_LOOP(params) ((params)->heavy ? 4 : (params)->variant == 0 ? 0 : (params)->variant == 1 ? 1 : (params)->variant < 4 ? 2 : 3)
+
 /**
  * @brief the hash function implementing CryptoNight, used for the Monero proof-of-work
  *
@@ -863,15 +1199,17 @@ void slow_hash_free_state(void)
  * A diagram of the inner loop of this function can be found at
  * https://www.cs.cmu.edu/~dga/crypto/xmr/cryptonight.png
  *
+ * The other members of the CryptoNight family change the size of the buffer,
+ * the number of rounds and the address mask, see struct cn_params.
+ *
  * @param data the data to hash
  * @param length the length in bytes of the data
  * @param hash a pointer to a buffer in which the final 256 bit hash will be stored
+ * @param params the family member to compute
+ * @return 0, or -1 if there's no memory for the scratchpad
  */
-void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int prehashed, uint64_t height)
+AES_TARGET int cn_slow_hash_params(const void *data, size_t length, char *hash, const struct cn_params *params, int prehashed, uint64_t height, const struct V4_Config *v4_config)
 {
-    RDATA_ALIGN16 uint8_t expandedKey[240];  /* These buffers are aligned to use later with SSE functions */
-
-    uint8_t text[INIT_SIZE_BYTE];
     RDATA_ALIGN16 uint64_t a[2];
     RDATA_ALIGN16 uint64_t b[4];
     RDATA_ALIGN16 uint64_t c[2];
@@ -881,17 +1219,20 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
 
     size_t i, j;
     uint64_t *p = NULL;
-    oaes_ctx *aes_ctx = NULL;
-    int useAes = !force_software_aes() && check_aes_hw();
-
-    static void (*const extra_hashes[4])(const void *, size_t, char *) =
-    {
-        hash_extra_blake, hash_extra_groestl, hash_extra_jh, hash_extra_skein
-    };
-
-    // this isn't supposed to happen, but guard against it for now.
+    int aes = cn_aes_impl();
+    const int variant = params->variant;
+    const int heavy = params->heavy;
+    const size_t mask = params->mask;
+    uint64_t idx;
+
+    if(hp_state != NULL && cn_scratchpad_size(hp_scratchpad) < params->memory)
+        slow_hash_free_scratchpad();
     if(hp_state == NULL)
-        slow_hash_allocate_state();
+        slow_hash_allocate_scratchpad(params->memory);
+    if(hp_state == NULL)
+        return -1;
+    if(hp_jitfunc_memory == NULL)
+        slow_hash_allocate_jit();
 
     /* CryptoNight Step 1:  Use Keccak1600 to initialize the 'state' (and 'text') buffers from the data. */
     if (prehashed) {
@@ -899,42 +1240,31 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
     } else {
         hash_process(&state.hs, data, length);
     }
-    memcpy(text, state.init, INIT_SIZE_BYTE);
 
     VARIANT1_INIT64();
     VARIANT2_INIT64();
     VARIANT4_RANDOM_MATH_INIT();
 
-    /* CryptoNight Step 2:  Iteratively encrypt the results from Keccak to fill
-     * the 2MB large random access buffer.
-     */
-
-    if(useAes)
+    // The generated main loop takes the JIT page over from the random math
+    // function, which has to be regenerated if the loop doesn't fit
+    int v4_loop = 0;
+    if(use_v4_asm_loop && variant >= 4 && !heavy && !v4_reg64 && aes == CN_AES_HW && hp_jitfunc != NULL)
     {
-        aes_expand_key(state.hs.b, expandedKey);
-        for(i = 0; i < MEMORY / INIT_SIZE_BYTE; i++)
-        {
-            aes_pseudo_round(text, text, expandedKey, INIT_SIZE_BLK);
-            memcpy(&hp_state[i * INIT_SIZE_BYTE], text, INIT_SIZE_BYTE);
-        }
+        v4_loop = v4_generate_JIT_loop(code, (v4_loop_JIT_func)hp_jitfunc, v4_jit_buffer_size) == 0;
+        if(!v4_loop && jit)
+            v4_generate_JIT_code(code, hp_jitfunc, v4_jit_buffer_size);
     }
-    else
-    {
-        aes_ctx = (oaes_ctx *) oaes_alloc();
-        oaes_key_import_data(aes_ctx, state.hs.b, AES_KEY_SIZE);
-        for(i = 0; i < MEMORY / INIT_SIZE_BYTE; i++)
-        {
-            for(j = 0; j < INIT_SIZE_BLK; j++)
-                aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
 
-            memcpy(&hp_state[i * INIT_SIZE_BYTE], text, INIT_SIZE_BYTE);
-        }
-    }
+    /* CryptoNight Step 2:  Iteratively encrypt the results from Keccak to fill
+     * the 2MB large random access buffer.
+     */
+    cn_explode_scratchpad(&state, hp_state, params, aes);
 
     U64(a)[0] = U64(&state.k[0])[0] ^ U64(&state.k[32])[0];
     U64(a)[1] = U64(&state.k[0])[1] ^ U64(&state.k[32])[1];
     U64(b)[0] = U64(&state.k[16])[0] ^ U64(&state.k[48])[0];
     U64(b)[1] = U64(&state.k[16])[1] ^ U64(&state.k[48])[1];
+    idx = a[0];
 
     /* CryptoNight Step 3:  Bounce randomly 1,048,576 times (1<<20) through the mixing buffer,
      * using 524,288 iterations of the following mixing function.  Each execution
@@ -943,20 +1273,67 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
 
     _b = _mm_load_si128(R128(b));
     _b1 = _mm_load_si128(R128(b) + 1);
-    // Two independent versions, one with AES, one without, to ensure that
-    // the useAes test is only performed once, not every iteration.
-    if(useAes)
+    // Independent versions for every AES implementation, to ensure that
+    // the aes test is only performed once, not every iteration.
+    // CryptoNight-Heavy tube's AES round has no vector permute version, it
+    // uses the tables without AES-NI.
+    if(v4_loop)
+    {
+        struct V4_Loop_State loop_state;
+        memcpy(loop_state.a, a, sizeof(loop_state.a));
+        memcpy(loop_state.b, b, sizeof(loop_state.b));
+        loop_state.scratchpad = hp_state;
+        loop_state.mask = mask;
+        loop_state.iterations = params->iterations;
+        memcpy(loop_state.r, r, sizeof(loop_state.r));
+        ((v4_loop_JIT_func)hp_jitfunc)(&loop_state);
+    }
+    else if(heavy == CN_HEAVY_TUBE && aes == CN_AES_HW)
+    {
+        for(i = 0; i < params->iterations; i++)
+        {
+            pre_aes();
+            _c = aes_single_round_tweak_div(_c, _a);
+            post_aes();
+        }
+    }
+    else if(heavy == CN_HEAVY_TUBE)
+    {
+        for(i = 0; i < params->iterations; i++)
+        {
+            pre_aes();
+            aesb_single_round_tweak_div((uint8_t *) &_c, (uint8_t *) &_c, (uint8_t *) &_a);
+            post_aes();
+        }
+    }
+    else if(aes == CN_AES_HW)
     {
-        for(i = 0; i < ITER / 2; i++)
+        for(i = 0; i < params->iterations; i++)
         {
             pre_aes();
             _c = _mm_aesenc_si128(_c, _a);
             post_aes();
         }
     }
+    else if(aes == CN_AES_VPERM)
+    {
+        // The vector permute round needs SSSE3, and this function runs on
+        // CPUs without it: one lane of cn_slow_hash_multi is the same loop,
+        // compiled for SSSE3.
+        struct cn_lane lane;
+        memcpy(lane.a, a, sizeof(lane.a));
+        memcpy(lane.b, b, sizeof(lane.b));
+        lane.tweak1_2 = tweak1_2;
+        lane.division_result = division_result;
+        lane.sqrt_result = sqrt_result;
+        memcpy(lane.r, r, sizeof(lane.r));
+        memcpy(lane.r64, r64, sizeof(lane.r64));
+        lane.long_state = hp_state;
+        cn_lanes_main_loops[CN_AES_VPERM - CN_AES_HW][CN_LANES_LOOP(params)](&lane, 1, params, code, v4_reg64, jit);
+    }
     else
     {
-        for(i = 0; i < ITER / 2; i++)
+        for(i = 0; i < params->iterations; i++)
         {
             pre_aes();
             aesb_single_round((uint8_t *) &_c, (uint8_t *) &_c, (uint8_t *) &_a);
@@ -964,44 +1341,202 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
         }
     }
 
-    /* CryptoNight Step 4:  Sequentially pass through the mixing buffer and use 10 rounds
-     * of AES encryption to mix the random data back into the 'text' buffer.  'text'
-     * was originally created with the output of Keccak1600. */
+    cn_implode_scratchpad(&state, hp_state, params, aes, hash);
 
-    memcpy(text, state.init, INIT_SIZE_BYTE);
-    if(useAes)
+    // Hand the scratchpad back for other threads, see cn_set_scratchpad_reuse
+    if(cn_scratchpad_reuse())
+        slow_hash_free_state();
+    return 0;
+}
+
+/* The lanes run the same random math program, one after the other: through
+ * a single copy of the interpreter its branches are predicted as well as with
+ * one lane, unlike in a copy inlined per lane. */
+static __attribute__((noinline)) void cn_lanes_random_math(const struct V4_Instruction *code, v4_reg *r)
+{
+    v4_random_math(code, r);
+}
+
+/* One iteration of CryptoNight Step 3 for one lane, the same as the loop
+ * bodies of cn_slow_hash_params. The parameters are named like the locals
+ * the pre_aes/post_aes macros expect, hp_state included. */
+static inline __attribute__((always_inline)) AES_TARGET void cn_lane_step(uint8_t *const hp_state, uint64_t *const a, uint64_t *const b, uint64_t *const c,
+    __m128i *const lane_b, __m128i *const lane_b1, uint64_t *const lane_idx, uint64_t *const lane_division_result, uint64_t *const lane_sqrt_result,
+    const uint64_t tweak1_2, v4_reg *const r, uint64_t *const r64,
+    const int variant, const int heavy, const size_t mask, const int aes, const struct V4_Instruction *code, const int v4_reg64, const int jit)
+{
+    uint64_t division_result = *lane_division_result;
+    uint64_t sqrt_result = *lane_sqrt_result;
+    uint64_t idx = *lane_idx;
+    __m128i _a, _c, _b = *lane_b, _b1 = *lane_b1;
+    uint64_t hi, lo;
+    uint64_t *p;
+    size_t j;
+
+#define v4_random_math cn_lanes_random_math
+    pre_aes();
+    if(heavy == CN_HEAVY_TUBE && aes == CN_AES_HW)
+        _c = aes_single_round_tweak_div(_c, _a);
+    else if(heavy == CN_HEAVY_TUBE)
+        aesb_single_round_tweak_div((uint8_t *) &_c, (uint8_t *) &_c, (uint8_t *) &_a);
+    else if(aes == CN_AES_HW)
+        _c = _mm_aesenc_si128(_c, _a);
+    else if(aes == CN_AES_VPERM)
+        _c = aesv_round(_c, _a);
+    else
+        aesb_single_round((uint8_t *) &_c, (uint8_t *) &_c, (uint8_t *) &_a);
+    post_aes();
+#undef v4_random_math
+
+    *lane_b = _b;
+    *lane_b1 = _b1;
+    *lane_idx = idx;
+    *lane_division_result = division_result;
+    *lane_sqrt_result = sqrt_result;
+}
+
+/* CryptoNight Step 3 for all lanes, one iteration of each in turn. The
+ * lanes' registers, scratchpads and tweaks are copied to local arrays the
+ * scratchpad writes can't alias, and the lanes unrolled (CN_MULTI_MAX of
+ * them at most), so that once inlined with a constant number of ways the
+ * compiler keeps them in registers like cn_slow_hash_params does. */
+static inline __attribute__((always_inline)) AES_TARGET void cn_lanes_main_loop(struct cn_lane *lanes, const size_t ways, const size_t iterations, const size_t mask,
+    const int variant, const int heavy, const int aes, const struct V4_Instruction *code, const int v4_reg64, const int jit)
+{
+    RDATA_ALIGN16 uint64_t a[CN_MULTI_MAX][2];
+    RDATA_ALIGN16 uint64_t b[CN_MULTI_MAX][2];
+    RDATA_ALIGN16 uint64_t c[CN_MULTI_MAX][2];
+    __m128i _b[CN_MULTI_MAX], _b1[CN_MULTI_MAX];
+    uint64_t idx[CN_MULTI_MAX], division_result[CN_MULTI_MAX], sqrt_result[CN_MULTI_MAX];
+    uint8_t *long_state[CN_MULTI_MAX];
+    uint64_t tweak1_2[CN_MULTI_MAX];
+    size_t i, w;
+
+    for(w = 0; w < ways; w++)
     {
-        aes_expand_key(&state.hs.b[32], expandedKey);
-        for(i = 0; i < MEMORY / INIT_SIZE_BYTE; i++)
+        long_state[w] = lanes[w].long_state;
+        tweak1_2[w] = lanes[w].tweak1_2;
+        a[w][0] = lanes[w].a[0];
+        a[w][1] = lanes[w].a[1];
+        idx[w] = lanes[w].a[0];
+        _b[w] = _mm_load_si128(R128(lanes[w].b));
+        _b1[w] = _mm_load_si128(R128(lanes[w].b) + 1);
+        division_result[w] = lanes[w].division_result;
+        sqrt_result[w] = lanes[w].sqrt_result;
+    }
+
+    for(i = 0; i < iterations; i++)
+    {
+#pragma GCC unroll 4
+        for(w = 0; w < ways; w++)
         {
-            // add the xor to the pseudo round
-            aes_pseudo_round_xor(text, text, expandedKey, &hp_state[i * INIT_SIZE_BYTE], INIT_SIZE_BLK);
+            cn_lane_step(long_state[w], a[w], b[w], c[w], &_b[w], &_b1[w], &idx[w], &division_result[w], &sqrt_result[w],
+                tweak1_2[w], lanes[w].r, lanes[w].r64, variant, heavy, mask, aes, code, v4_reg64, jit);
         }
     }
-    else
+}
+
+/* The main loops of cn_slow_hash_multi for every number of ways, with the
+ * AES implementation and the variant fixed, so that like the loops of
+ * cn_slow_hash_params they don't test them every iteration. The heavy
+ * members share one per AES implementation. */
+#define CN_LANES_MAIN_LOOPS(name, variant, heavy, aes, target) \
+static __attribute__((noinline)) target void name(struct cn_lane *lanes, const size_t ways, const struct cn_params *params, \
+    const struct V4_Instruction *code, const int v4_reg64, const int jit) \
+{ \
+    switch(ways) \
+    { \
+    case 1: cn_lanes_main_loop(lanes, 1, params->iterations, params->mask, variant, heavy, aes, code, v4_reg64, jit); break; \
+    case 2: cn_lanes_main_loop(lanes, 2, params->iterations, params->mask, variant, heavy, aes, code, v4_reg64, jit); break; \
+    case 3: cn_lanes_main_loop(lanes, 3, params->iterations, params->mask, variant, heavy, aes, code, v4_reg64, jit); break; \
+    default: cn_lanes_main_loop(lanes, 4, params->iterations, params->mask, variant, heavy, aes, code, v4_reg64, jit); break; \
+    } \
+}
+
+CN_LANES_MAIN_LOOPS(cn_lanes_hw_v0, 0, CN_HEAVY_NONE, CN_AES_HW, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_hw_v1, 1, CN_HEAVY_NONE, CN_AES_HW, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_hw_v2, 2, CN_HEAVY_NONE, CN_AES_HW, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_hw_v4, 4, CN_HEAVY_NONE, CN_AES_HW, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_hw_heavy, params->variant, params->heavy, CN_AES_HW, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_vperm_v0, 0, CN_HEAVY_NONE, CN_AES_VPERM, VPERM_AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_vperm_v1, 1, CN_HEAVY_NONE, CN_AES_VPERM, VPERM_AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_vperm_v2, 2, CN_HEAVY_NONE, CN_AES_VPERM, VPERM_AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_vperm_v4, 4, CN_HEAVY_NONE, CN_AES_VPERM, VPERM_AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_vperm_heavy, params->variant, params->heavy, CN_AES_VPERM, VPERM_AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_tables_v0, 0, CN_HEAVY_NONE, CN_AES_TABLES, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_tables_v1, 1, CN_HEAVY_NONE, CN_AES_TABLES, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_tables_v2, 2, CN_HEAVY_NONE, CN_AES_TABLES, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_tables_v4, 4, CN_HEAVY_NONE, CN_AES_TABLES, AES_TARGET)
+CN_LANES_MAIN_LOOPS(cn_lanes_tables_heavy, params->variant, params->heavy, CN_AES_TABLES, AES_TARGET)
+
+static const cn_lanes_func cn_lanes_main_loops[3][5] =
+{
+    { cn_lanes_hw_v0, cn_lanes_hw_v1, cn_lanes_hw_v2, cn_lanes_hw_v4, cn_lanes_hw_heavy },
+    { cn_lanes_vperm_v0, cn_lanes_vperm_v1, cn_lanes_vperm_v2, cn_lanes_vperm_v4, cn_lanes_vperm_heavy },
+    { cn_lanes_tables_v0, cn_lanes_tables_v1, cn_lanes_tables_v2, cn_lanes_tables_v4, cn_lanes_tables_heavy },
+};
+
+AES_TARGET int cn_slow_hash_multi(const void *const *data, size_t length, char *hashes, size_t ways, const struct cn_params *params, uint64_t height, const struct V4_Config *v4_config)
+{
+    struct cn_lane lanes[CN_MULTI_MAX];
+    int aes = cn_aes_impl();
+    const int variant = params->variant;
+
+    if(ways == 0 || ways > CN_MULTI_MAX)
+        return CN_INVALID_WAYS;
+    if(variant == 1 && length < 43)
+        return CN_SHORT_INPUT;
+
+    if(hp_jitfunc_memory == NULL)
+        slow_hash_allocate_jit();
+    if(hp_multi_scratchpad == NULL || cn_scratchpad_size(hp_multi_scratchpad) < ways * params->memory)
+    {
+        slow_hash_free_multi_scratchpad();
+        slow_hash_allocate_multi_scratchpad(ways * params->memory);
+        if(hp_multi_state == NULL)
+            return CN_NO_MEMORY;
+    }
+
+    VARIANT4_RANDOM_MATH_INIT_CODE();
+
+    for(size_t w = 0; w < ways; w++)
     {
-        oaes_key_import_data(aes_ctx, &state.hs.b[32], AES_KEY_SIZE);
-        for(i = 0; i < MEMORY / INIT_SIZE_BYTE; i++)
+        struct cn_lane *lane = &lanes[w];
+        union cn_slow_hash_state state;
+
+        hash_process(&state.hs, data[w], length);
+        lane->long_state = hp_multi_state + w * params->memory;
+        lane->state = state;
+        lane->tweak1_2 = 0;
+        if(variant == 1)
+            lane->tweak1_2 = state.hs.w[24] ^ (*((const uint64_t*)(((const uint8_t*)data[w]) + 35)));
+        lane->division_result = 0;
+        lane->sqrt_result = 0;
+        if(variant >= 2)
         {
-            for(j = 0; j < INIT_SIZE_BLK; j++)
-            {
-                xor_blocks(&text[j * AES_BLOCK_SIZE], &hp_state[i * INIT_SIZE_BYTE + j * AES_BLOCK_SIZE]);
-                aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
-            }
+            U64(lane->b)[2] = state.hs.w[8] ^ state.hs.w[10];
+            U64(lane->b)[3] = state.hs.w[9] ^ state.hs.w[11];
+            lane->division_result = state.hs.w[12];
+            lane->sqrt_result = state.hs.w[13];
         }
-        oaes_free((OAES_CTX **) &aes_ctx);
+        VARIANT4_RANDOM_MATH_INIT_REGS(lane->r, lane->r64, state.hs);
+
+        cn_explode_scratchpad(&lane->state, lane->long_state, params, aes);
+
+        U64(lane->a)[0] = U64(&lane->state.k[0])[0] ^ U64(&lane->state.k[32])[0];
+        U64(lane->a)[1] = U64(&lane->state.k[0])[1] ^ U64(&lane->state.k[32])[1];
+        U64(lane->b)[0] = U64(&lane->state.k[16])[0] ^ U64(&lane->state.k[48])[0];
+        U64(lane->b)[1] = U64(&lane->state.k[16])[1] ^ U64(&lane->state.k[48])[1];
     }
 
-    /* CryptoNight Step 5:  Apply Keccak to the state again, and then
-     * use the resulting data to select which of four finalizer
-     * hash functions to apply to the data (Blake, Groestl, JH, or Skein).
-     * Use this hash to squeeze the state array down
-     * to the final 256 bit hash output.
-     */
+    cn_lanes_main_loops[aes - CN_AES_HW][CN_LANES_LOOP(params)](lanes, ways, params, code, v4_reg64, jit);
 
-    memcpy(state.init, text, INIT_SIZE_BYTE);
-    hash_permutation(&state.hs);
-    extra_hashes[state.hs.b[0] & 3](&state, 200, hash);
+    for(size_t w = 0; w < ways; w++)
+        cn_implode_scratchpad(&lanes[w].state, lanes[w].long_state, params, aes, hashes + w * HASH_SIZE);
+
+    if(cn_scratchpad_reuse())
+        slow_hash_free_state();
+    return 0;
 }
 
 #elif !defined NO_AES && (defined(__arm__) || defined(__aarch64__))
@@ -1055,14 +1590,12 @@ union cn_slow_hash_state
  */
 #include <arm_neon.h>
 
-#define TOTALBLOCKS (MEMORY / AES_BLOCK_SIZE)
-
-#define state_index(x) (((*((uint64_t *)x) >> 4) & (TOTALBLOCKS - 1)) << 4)
+#define state_index(x) ((*((uint64_t *)x)) & mask)
 #define __mul() __asm__("mul %0, %1, %2\n\t" : "=r"(lo) : "r"(c[0]), "r"(b[0]) ); \
   __asm__("umulh %0, %1, %2\n\t" : "=r"(hi) : "r"(c[0]), "r"(b[0]) );
 
 #define pre_aes() \
-  j = state_index(a); \
+  j = idx & mask; \
   _c = vld1q_u8(&hp_state[j]); \
   _a = vld1q_u8((const uint8_t *)a); \
 
@@ -1086,6 +1619,8 @@ union cn_slow_hash_state
   VARIANT1_2(p + 1); \
   _b1 = _b; \
   _b = _c; \
+  idx = a[0]; \
+  VARIANT_HEAVY_DIVISION(hp_state); \
 
 
 /* Note: this was based on a standard 256bit key schedule but
@@ -1216,7 +1751,6 @@ STATIC INLINE void aes_pseudo_round_xor(const uint8_t *in, uint8_t *out, const u
 	}
 }
 
-#ifdef FORCE_USE_HEAP
 STATIC INLINE void* aligned_malloc(size_t size, size_t align)
 {
     void *result;
@@ -1236,17 +1770,20 @@ STATIC INLINE void aligned_free(void *ptr)
     free(ptr);
 #endif
 }
-#endif /* FORCE_USE_HEAP */
 
-void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int prehashed, uint64_t height)
+int cn_slow_hash_params(const void *data, size_t length, char *hash, const struct cn_params *params, int prehashed, uint64_t height, const struct V4_Config *v4_config)
 {
     RDATA_ALIGN16 uint8_t expandedKey[240];
 
+    // The stack only holds the default 2MB, bigger scratchpads go on the heap
 #ifndef FORCE_USE_HEAP
-    RDATA_ALIGN16 uint8_t hp_state[MEMORY];
+    RDATA_ALIGN16 uint8_t hp_state_stack[MEMORY];
+    uint8_t *hp_state = (params->memory <= MEMORY) ? hp_state_stack : (uint8_t *)aligned_malloc(params->memory,16);
 #else
-    uint8_t *hp_state = (uint8_t *)aligned_malloc(MEMORY,16);
+    uint8_t *hp_state = (uint8_t *)aligned_malloc(params->memory,16);
 #endif
+    if(hp_state == NULL)
+        return -1;
 
     uint8_t text[INIT_SIZE_BYTE];
     RDATA_ALIGN16 uint64_t a[2];
@@ -1256,8 +1793,12 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
     uint8x16_t _a, _b, _b1, _c, zero = {0};
     uint64_t hi, lo;
 
-    size_t i, j;
+    size_t i, j, k;
     uint64_t *p = NULL;
+    const int variant = params->variant;
+    const int heavy = params->heavy;
+    const size_t mask = params->mask;
+    uint64_t idx;
 
     static void (*const extra_hashes[4])(const void *, size_t, char *) =
     {
@@ -1282,7 +1823,12 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
      */
 
     aes_expand_key(state.hs.b, expandedKey);
-    for(i = 0; i < MEMORY / INIT_SIZE_BYTE; i++)
+    for(i = 0; heavy && i < 16; i++)
+    {
+        aes_pseudo_round(text, text, expandedKey, INIT_SIZE_BLK);
+        cn_heavy_mix(text);
+    }
+    for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
     {
         aes_pseudo_round(text, text, expandedKey, INIT_SIZE_BLK);
         memcpy(&hp_state[i * INIT_SIZE_BYTE], text, INIT_SIZE_BYTE);
@@ -1292,6 +1838,7 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
     U64(a)[1] = U64(&state.k[0])[1] ^ U64(&state.k[32])[1];
     U64(b)[0] = U64(&state.k[16])[0] ^ U64(&state.k[48])[0];
     U64(b)[1] = U64(&state.k[16])[1] ^ U64(&state.k[48])[1];
+    idx = a[0];
 
     /* CryptoNight Step 3:  Bounce randomly 1,048,576 times (1<<20) through the mixing buffer,
      * using 524,288 iterations of the following mixing function.  Each execution
@@ -1301,26 +1848,51 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
     _b = vld1q_u8((const uint8_t *)b);
     _b1 = vld1q_u8(((const uint8_t *)b) + AES_BLOCK_SIZE);
 
-    for(i = 0; i < ITER / 2; i++)
+    if(heavy == CN_HEAVY_TUBE)
     {
-        pre_aes();
-        _c = vaeseq_u8(_c, zero);
-        _c = vaesmcq_u8(_c);
-        _c = veorq_u8(_c, _a);
-        post_aes();
+        // No hardware version of this AES round
+        for(i = 0; i < params->iterations; i++)
+        {
+            pre_aes();
+            aesb_single_round_tweak_div((uint8_t *) &_c, (uint8_t *) &_c, (uint8_t *) a);
+            post_aes();
+        }
+    }
+    else
+    {
+        for(i = 0; i < params->iterations; i++)
+        {
+            pre_aes();
+            _c = vaeseq_u8(_c, zero);
+            _c = vaesmcq_u8(_c);
+            _c = veorq_u8(_c, _a);
+            post_aes();
+        }
     }
 
     /* CryptoNight Step 4:  Sequentially pass through the mixing buffer and use 10 rounds
      * of AES encryption to mix the random data back into the 'text' buffer.  'text'
-     * was originally created with the output of Keccak1600. */
+     * was originally created with the output of Keccak1600.
+     * CryptoNight-Heavy passes through the buffer twice, mixing the blocks
+     * after each 10 rounds, and then does 16 more rounds without the buffer. */
 
     memcpy(text, state.init, INIT_SIZE_BYTE);
 
     aes_expand_key(&state.hs.b[32], expandedKey);
-    for(i = 0; i < MEMORY / INIT_SIZE_BYTE; i++)
+    for(k = 0; k < (heavy ? 2 : 1); k++)
     {
-        // add the xor to the pseudo round
-        aes_pseudo_round_xor(text, text, expandedKey, &hp_state[i * INIT_SIZE_BYTE], INIT_SIZE_BLK);
+        for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
+        {
+            // add the xor to the pseudo round
+            aes_pseudo_round_xor(text, text, expandedKey, &hp_state[i * INIT_SIZE_BYTE], INIT_SIZE_BLK);
+            if(heavy)
+                cn_heavy_mix(text);
+        }
+    }
+    for(i = 0; heavy && i < 16; i++)
+    {
+        aes_pseudo_round(text, text, expandedKey, INIT_SIZE_BLK);
+        cn_heavy_mix(text);
     }
 
     /* CryptoNight Step 5:  Apply Keccak to the state again, and then
@@ -1334,9 +1906,11 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
     hash_permutation(&state.hs);
     extra_hashes[state.hs.b[0] & 3](&state, 200, hash);
 
-#ifdef FORCE_USE_HEAP
-    aligned_free(hp_state);
+#ifndef FORCE_USE_HEAP
+    if(hp_state != hp_state_stack)
 #endif
+    aligned_free(hp_state);
+    return 0;
 }
 #else /* aarch64 && crypto */
 
@@ -1454,7 +2028,7 @@ STATIC INLINE void xor_blocks(uint8_t* a, const uint8_t* b)
   U64(a)[1] ^= U64(b)[1];
 }
 
-void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int prehashed, uint64_t height)
+int cn_slow_hash_params(const void *data, size_t length, char *hash, const struct cn_params *params, int prehashed, uint64_t height, const struct V4_Config *v4_config)
 {
     uint8_t text[INIT_SIZE_BYTE];
     uint8_t a[AES_BLOCK_SIZE];
@@ -1468,19 +2042,26 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
 
     union cn_slow_hash_state state;
 
-    size_t i, j;
+    size_t i, j, k;
     uint8_t *p = NULL;
     oaes_ctx *aes_ctx;
+    const int variant = params->variant;
+    const int heavy = params->heavy;
+    const uint32_t mask = params->mask;
+    uint64_t idx;
     static void (*const extra_hashes[4])(const void *, size_t, char *) =
     {
         hash_extra_blake, hash_extra_groestl, hash_extra_jh, hash_extra_skein
     };
 
 #ifndef FORCE_USE_HEAP
-    uint8_t long_state[MEMORY];
+    uint8_t long_state_stack[MEMORY];
+    uint8_t *long_state = (params->memory <= MEMORY) ? long_state_stack : (uint8_t *)malloc(params->memory);
 #else
-    uint8_t *long_state = (uint8_t *)malloc(MEMORY);
+    uint8_t *long_state = (uint8_t *)malloc(params->memory);
 #endif
+    if(long_state == NULL)
+        return -1;
 
     if (prehashed) {
         memcpy(&state.hs, data, length);
@@ -1498,7 +2079,13 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
 
     // use aligned data
     memcpy(expandedKey, aes_ctx->key->exp_data, aes_ctx->key->exp_data_len);
-    for(i = 0; i < MEMORY / INIT_SIZE_BYTE; i++)
+    for(i = 0; heavy && i < 16; i++)
+    {
+        for(j = 0; j < INIT_SIZE_BLK; j++)
+            aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], expandedKey);
+        cn_heavy_mix(text);
+    }
+    for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
     {
         for(j = 0; j < INIT_SIZE_BLK; j++)
             aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], expandedKey);
@@ -1509,16 +2096,19 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
     U64(a)[1] = U64(&state.k[0])[1] ^ U64(&state.k[32])[1];
     U64(b)[0] = U64(&state.k[16])[0] ^ U64(&state.k[48])[0];
     U64(b)[1] = U64(&state.k[16])[1] ^ U64(&state.k[48])[1];
+    idx = U64(a)[0];
 
-    for(i = 0; i < ITER / 2; i++)
+    for(i = 0; i < params->iterations; i++)
     {
-      #define MASK ((uint32_t)(((MEMORY / AES_BLOCK_SIZE) - 1) << 4))
-      #define state_index(x) ((*(uint32_t *) x) & MASK)
+      #define state_index(x) ((*(uint32_t *) x) & mask)
 
       // Iteration 1
-      j = state_index(a);
+      j = idx & mask;
       p = &long_state[j];
-      aesb_single_round(p, c1, a);
+      if (heavy == CN_HEAVY_TUBE)
+        aesb_single_round_tweak_div(p, c1, a);
+      else
+        aesb_single_round(p, c1, a);
 
       VARIANT2_PORTABLE_SHUFFLE_ADD(c1, a, long_state, j);
       copy_block(p, c1);
@@ -1547,27 +2137,42 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
       }
       copy_block(b, c1);
       copy_block(a, a1);
+      idx = U64(a)[0];
+      VARIANT_HEAVY_DIVISION(long_state);
     }
 
     memcpy(text, state.init, INIT_SIZE_BYTE);
     oaes_key_import_data(aes_ctx, &state.hs.b[32], AES_KEY_SIZE);
     memcpy(expandedKey, aes_ctx->key->exp_data, aes_ctx->key->exp_data_len);
-    for(i = 0; i < MEMORY / INIT_SIZE_BYTE; i++)
+    for(k = 0; k < (heavy ? 2 : 1); k++)
     {
-        for(j = 0; j < INIT_SIZE_BLK; j++)
+        for(i = 0; i < params->memory / INIT_SIZE_BYTE; i++)
         {
-            xor_blocks(&text[j * AES_BLOCK_SIZE], &long_state[i * INIT_SIZE_BYTE + j * AES_BLOCK_SIZE]);
-            aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], expandedKey);
+            for(j = 0; j < INIT_SIZE_BLK; j++)
+            {
+                xor_blocks(&text[j * AES_BLOCK_SIZE], &long_state[i * INIT_SIZE_BYTE + j * AES_BLOCK_SIZE]);
+                aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], expandedKey);
+            }
+            if(heavy)
+                cn_heavy_mix(text);
         }
     }
+    for(i = 0; heavy && i < 16; i++)
+    {
+        for(j = 0; j < INIT_SIZE_BLK; j++)
+            aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], expandedKey);
+        cn_heavy_mix(text);
+    }
 
     oaes_free((OAES_CTX **) &aes_ctx);
     memcpy(state.init, text, INIT_SIZE_BYTE);
     hash_permutation(&state.hs);
     extra_hashes[state.hs.b[0] & 3](&state, 200, hash);
-#ifdef FORCE_USE_HEAP
-    free(long_state);
+#ifndef FORCE_USE_HEAP
+    if(long_state != long_state_stack)
 #endif
+    free(long_state);
+    return 0;
 }
 #endif /* !aarch64 || !crypto */
 
@@ -1590,7 +2195,7 @@ static void (*const extra_hashes[4])(const void *, size_t, char *) = {
   hash_extra_blake, hash_extra_groestl, hash_extra_jh, hash_extra_skein
 };
 
-static size_t e2i(const uint8_t* a, size_t count) { return (SWAP64LE(*((uint64_t*)a)) / AES_BLOCK_SIZE) & (count - 1); }
+static size_t e2i(const uint8_t* a, uint32_t mask) { return SWAP64LE(*((uint64_t*)a)) & mask; }
 
 static void mul(const uint8_t* a, const uint8_t* b, uint8_t* res) {
   uint64_t a0, b0;
@@ -1657,12 +2262,15 @@ union cn_slow_hash_state {
 };
 #pragma pack(pop)
 
-void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int prehashed, uint64_t height) {
+int cn_slow_hash_params(const void *data, size_t length, char *hash, const struct cn_params *params, int prehashed, uint64_t height, const struct V4_Config *v4_config) {
 #ifndef FORCE_USE_HEAP
-  uint8_t long_state[MEMORY];
+  uint8_t long_state_stack[MEMORY];
+  uint8_t *long_state = (params->memory <= MEMORY) ? long_state_stack : (uint8_t *)malloc(params->memory);
 #else
-  uint8_t *long_state = (uint8_t *)malloc(MEMORY);
+  uint8_t *long_state = (uint8_t *)malloc(params->memory);
 #endif
+  if (long_state == NULL)
+    return -1;
 
   union cn_slow_hash_state state;
   uint8_t text[INIT_SIZE_BYTE];
@@ -1672,9 +2280,13 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
   uint8_t c1[AES_BLOCK_SIZE];
   uint8_t c2[AES_BLOCK_SIZE];
   uint8_t d[AES_BLOCK_SIZE];
-  size_t i, j;
+  size_t i, j, k;
   uint8_t aes_key[AES_KEY_SIZE];
   oaes_ctx *aes_ctx;
+  const int variant = params->variant;
+  const int heavy = params->heavy;
+  const uint32_t mask = params->mask;
+  uint64_t idx;
 
   if (prehashed) {
     memcpy(&state.hs, data, length);
@@ -1690,7 +2302,13 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
   VARIANT4_RANDOM_MATH_INIT();
 
   oaes_key_import_data(aes_ctx, aes_key, AES_KEY_SIZE);
-  for (i = 0; i < MEMORY / INIT_SIZE_BYTE; i++) {
+  for (i = 0; heavy && i < 16; i++) {
+    for (j = 0; j < INIT_SIZE_BLK; j++) {
+      aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
+    }
+    cn_heavy_mix(text);
+  }
+  for (i = 0; i < params->memory / INIT_SIZE_BYTE; i++) {
     for (j = 0; j < INIT_SIZE_BLK; j++) {
       aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
     }
@@ -1701,23 +2319,28 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
     a[i] = state.k[     i] ^ state.k[AES_BLOCK_SIZE * 2 + i];
     b[i] = state.k[AES_BLOCK_SIZE + i] ^ state.k[AES_BLOCK_SIZE * 3 + i];
   }
+  idx = SWAP64LE(*U64(a));
 
-  for (i = 0; i < ITER / 2; i++) {
+  for (i = 0; i < params->iterations; i++) {
     /* Dependency chain: address -> read value ------+
      * written value <-+ hard function (AES or MUL) <+
      * next address  <-+
      */
     /* Iteration 1 */
-    j = e2i(a, MEMORY / AES_BLOCK_SIZE) * AES_BLOCK_SIZE;
+    j = idx & mask;
     copy_block(c1, &long_state[j]);
-    aesb_single_round(c1, c1, a);
+    if (heavy == CN_HEAVY_TUBE) {
+      aesb_single_round_tweak_div(c1, c1, a);
+    } else {
+      aesb_single_round(c1, c1, a);
+    }
     VARIANT2_PORTABLE_SHUFFLE_ADD(c1, a, long_state, j);
     copy_block(&long_state[j], c1);
     xor_blocks(&long_state[j], b);
-    assert(j == e2i(a, MEMORY / AES_BLOCK_SIZE) * AES_BLOCK_SIZE);
+    assert(j == (idx & mask));
     VARIANT1_1(&long_state[j]);
     /* Iteration 2 */
-    j = e2i(c1, MEMORY / AES_BLOCK_SIZE) * AES_BLOCK_SIZE;
+    j = e2i(c1, mask);
     copy_block(c2, &long_state[j]);
     copy_block(a1, a);
     VARIANT2_PORTABLE_INTEGER_MATH(c2, c1);
@@ -1735,15 +2358,28 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
     }
     copy_block(b, c1);
     copy_block(a, a1);
+    idx = SWAP64LE(*U64(a));
+    VARIANT_HEAVY_DIVISION(long_state);
   }
 
   memcpy(text, state.init, INIT_SIZE_BYTE);
   oaes_key_import_data(aes_ctx, &state.hs.b[32], AES_KEY_SIZE);
-  for (i = 0; i < MEMORY / INIT_SIZE_BYTE; i++) {
+  for (k = 0; k < (heavy ? 2 : 1); k++) {
+    for (i = 0; i < params->memory / INIT_SIZE_BYTE; i++) {
+      for (j = 0; j < INIT_SIZE_BLK; j++) {
+        xor_blocks(&text[j * AES_BLOCK_SIZE], &long_state[i * INIT_SIZE_BYTE + j * AES_BLOCK_SIZE]);
+        aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
+      }
+      if (heavy) {
+        cn_heavy_mix(text);
+      }
+    }
+  }
+  for (i = 0; heavy && i < 16; i++) {
     for (j = 0; j < INIT_SIZE_BLK; j++) {
-      xor_blocks(&text[j * AES_BLOCK_SIZE], &long_state[i * INIT_SIZE_BYTE + j * AES_BLOCK_SIZE]);
       aesb_pseudo_round(&text[AES_BLOCK_SIZE * j], &text[AES_BLOCK_SIZE * j], aes_ctx->key->exp_data);
     }
+    cn_heavy_mix(text);
   }
   memcpy(state.init, text, INIT_SIZE_BYTE);
   hash_permutation(&state.hs);
@@ -1751,9 +2387,69 @@ void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int
   extra_hashes[state.hs.b[0] & 3](&state, 200, hash);
   oaes_free((OAES_CTX **) &aes_ctx);
 
-#ifdef FORCE_USE_HEAP
+#ifndef FORCE_USE_HEAP
+  if (long_state != long_state_stack)
+#endif
   free(long_state);
+  return 0;
+}
+
+#endif
+
+#if !(!defined NO_AES && (defined(__x86_64__) || (defined(_MSC_VER) && defined(_WIN64))))
+// Only the x86-64 implementation interleaves the lanes, elsewhere they're
+// hashed one after the other
+int cn_slow_hash_multi(const void *const *data, size_t length, char *hashes, size_t ways, const struct cn_params *params, uint64_t height, const struct V4_Config *v4_config)
+{
+  if (ways == 0 || ways > CN_MULTI_MAX)
+    return CN_INVALID_WAYS;
+  if (params->variant == 1 && length < 43)
+    return CN_SHORT_INPUT;
+  for (size_t w = 0; w < ways; ++w)
+  {
+    if (cn_slow_hash_params(data[w], length, hashes + w * HASH_SIZE, params, 0, height, v4_config) != 0)
+      return CN_NO_MEMORY;
+  }
+  return 0;
+}
 #endif
+
+static volatile int aes_impl = CN_AES_AUTO;
+
+void cn_set_aes_impl(int impl)
+{
+  aes_impl = impl;
 }
 
+int cn_aes_impl(void)
+{
+#if !defined NO_AES && (defined(__x86_64__) || (defined(_MSC_VER) && defined(_WIN64)))
+  int impl = aes_impl;
+  if (impl == CN_AES_HW && !check_aes_hw())
+    impl = CN_AES_AUTO;
+  if (impl == CN_AES_AUTO)
+    impl = (!force_software_aes() && check_aes_hw()) ? CN_AES_HW : CN_AES_VPERM;
+  if (impl == CN_AES_VPERM && !aesv_supported())
+    impl = CN_AES_TABLES;
+  return impl;
+#elif !defined NO_AES && defined(__aarch64__) && defined(__ARM_FEATURE_CRYPTO)
+  return CN_AES_HW;
+#else
+  return CN_AES_TABLES;
 #endif
+}
+
+int cn_slow_hash_ex(const void *data, size_t length, char *hash, int variant, int prehashed, uint64_t height, const struct V4_Config *v4_config)
+{
+  const struct cn_params params = { MEMORY, ITER / 2, (MEMORY - 1) & ~15, variant, CN_HEAVY_NONE };
+  return cn_slow_hash_params(data, length, hash, &params, prehashed, height, v4_config);
+}
+
+void cn_slow_hash(const void *data, size_t length, char *hash, int variant, int prehashed, uint64_t height)
+{
+  if (cn_slow_hash_ex(data, length, hash, variant, prehashed, height, NULL) != 0)
+  {
+    fprintf(stderr, "cn_slow_hash: no memory for the scratchpad\n");
+    _exit(1);
+  }
+}
@@ -0,0 +1,402 @@
+package stratum
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+)
+
+type ClientConfig struct {
+	// Pool addresses, host:port. The client connects to the first one,
+	// and fails over to the next whenever a connection or login fails.
+	Pools []string
+	Login string
+	Pass  string
+	// Mining software name and version, "marconi-cryptonight" if empty.
+	Agent string
+	// Algorithms offered at login, by name. Every named algorithm if
+	// empty. Jobs without an algorithm are only accepted if there's
+	// exactly one, and are mined with it.
+	Algo []string
+	// Wait before reconnecting after a failure, doubled after every
+	// further failure up to MaxBackoff. 1 second and 1 minute if 0.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Timeout of connecting, and of requests. 10 seconds if 0.
+	Timeout time.Duration
+	// Interval of keepalived requests, for pools which support them. 1
+	// minute if 0.
+	KeepaliveInterval time.Duration
+}
+
+// A job from the pool, decoded.
+type ClientJob struct {
+	Job
+	// The pool which sent it.
+	Pool      string
+	Blob      []byte
+	Algorithm cryptonight.Algorithm
+	// Hashes are shares if digest[24:32], little endian, is below
+	// Target64.
+	Target64 uint64
+	// Set if the pool has the "nicehash" extension: blob byte 42 is
+	// part of the job, miners only iterate bytes 39 to 41.
+	NiceHash bool
+
+	session *clientSession
+}
+
+// Whether a digest of the job's blob is a share.
+func (job *ClientJob) IsShare(digest []byte) bool {
+	return cryptonight.DigestPassesCompact64(digest, job.Target64)
+}
+
+var (
+	ErrStaleJob     = errors.New("stratum: job from a closed connection")
+	ErrNotConnected = errors.New("stratum: not connected")
+)
+
+// A Stratum client, connected to one pool at a time. Run keeps it
+// connected; CurrentJob and Submit are for the miners, e.g. a Worker.
+type Client struct {
+	config ClientConfig
+
+	mu      sync.Mutex
+	job     *ClientJob
+	changed chan struct{}
+}
+
+// One connection to a pool.
+type clientSession struct {
+	client   *Client
+	pool     string
+	net_conn net.Conn
+	write_mu sync.Mutex
+
+	mu        sync.Mutex
+	miner_id  string
+	next_id   uint64
+	pending   map[uint64]chan Message
+	keepalive bool
+	nicehash  bool
+	// A job pushed before the login response, see read.
+	early_job *Job
+	closed    chan struct{}
+}
+
+func NewClient(config ClientConfig) (*Client, error) {
+	if len(config.Pools) == 0 {
+		return nil, errors.New("stratum: no pools")
+	}
+	if config.Agent == "" {
+		config.Agent = "marconi-cryptonight"
+	}
+	if len(config.Algo) == 0 {
+		for _, algorithm := range cryptonight.Algorithms {
+			config.Algo = append(config.Algo, algorithm.Name)
+		}
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = time.Second
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = time.Minute
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.KeepaliveInterval == 0 {
+		config.KeepaliveInterval = time.Minute
+	}
+	return &Client{config: config, changed: make(chan struct{})}, nil
+}
+
+// Connects to the pools and keeps connected, until ctx ends. After a
+// failed connection or login the client waits, with exponential
+// backoff, and tries the next pool; after losing a connection it
+// starts over from the first pool.
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.config.MinBackoff
+	pool := 0
+	for {
+		logged_in, _ := c.runSession(ctx, c.config.Pools[pool])
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if logged_in {
+			backoff = c.config.MinBackoff
+			pool = 0
+		} else {
+			pool = (pool + 1) % len(c.config.Pools)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if !logged_in {
+			backoff *= 2
+			if backoff > c.config.MaxBackoff {
+				backoff = c.config.MaxBackoff
+			}
+		}
+	}
+}
+
+// Returns the current job, nil while disconnected, and a channel
+// closed as soon as it's replaced.
+func (c *Client) CurrentJob() (*ClientJob, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.job, c.changed
+}
+
+func (c *Client) setJob(job *ClientJob) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.job = job
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Submits a share of job: the 4 byte nonce at blob bytes 39 to 42 and
+// the digest. Returns the pool's *Error if it rejects the share, or
+// ErrStaleJob if the job's connection is gone.
+func (c *Client) Submit(ctx context.Context, job *ClientJob, nonce uint32, digest []byte) error {
+	var nonce_bytes [4]byte
+	binary.LittleEndian.PutUint32(nonce_bytes[:], nonce)
+	params := SubmitParams{
+		ID:     job.session.miner_id,
+		JobID:  job.JobID,
+		Nonce:  hex.EncodeToString(nonce_bytes[:]),
+		Result: hex.EncodeToString(digest),
+	}
+	var status StatusResult
+	err := job.session.call(ctx, "submit", params, &status)
+	if err == ErrNotConnected {
+		return ErrStaleJob
+	}
+	return err
+}
+
+// Connects to pool, logs in and handles its messages until the
+// connection fails or ctx ends. Tells whether the login succeeded.
+func (c *Client) runSession(ctx context.Context, pool string) (bool, error) {
+	dialer := net.Dialer{Timeout: c.config.Timeout}
+	net_conn, err := dialer.DialContext(ctx, "tcp", pool)
+	if err != nil {
+		return false, err
+	}
+	session := &clientSession{
+		client:   c,
+		pool:     pool,
+		net_conn: net_conn,
+		pending:  make(map[uint64]chan Message),
+		closed:   make(chan struct{}),
+	}
+	defer session.close()
+	stop := context.AfterFunc(ctx, session.close)
+	defer stop()
+	go session.read()
+
+	var login LoginResult
+	err = session.call(ctx, "login", LoginParams{Login: c.config.Login, Pass: c.config.Pass, Agent: c.config.Agent, Algo: c.config.Algo}, &login)
+	if err != nil {
+		return false, err
+	}
+	defer c.setJob(nil)
+	session.mu.Lock()
+	session.miner_id = login.ID
+	session.keepalive = contains(login.Extensions, "keepalive")
+	session.nicehash = contains(login.Extensions, "nicehash")
+	err = session.handleJob(login.Job)
+	if err == nil && session.early_job != nil {
+		err = session.handleJob(*session.early_job)
+	}
+	session.mu.Unlock()
+	if err != nil {
+		return true, err
+	}
+
+	ticker := time.NewTicker(c.config.KeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.closed:
+			return true, ErrNotConnected
+		case <-ticker.C:
+			if session.keepalive {
+				var status StatusResult
+				go session.call(ctx, "keepalived", KeepalivedParams{ID: login.ID}, &status)
+			}
+		}
+	}
+}
+
+// Decodes a job from the pool and makes it current. A bad job closes
+// the connection, as the pool can't be mined. Called with session.mu
+// held, so that jobs become current in the order the pool sent them.
+func (session *clientSession) handleJob(job Job) error {
+	blob, err := hex.DecodeString(job.Blob)
+	if err != nil || len(blob) < 47 {
+		session.closeLocked()
+		return errors.New("stratum: invalid blob " + job.Blob)
+	}
+	target64, err := cryptonight.DecodeCompactTarget(job.Target)
+	if err != nil {
+		session.closeLocked()
+		return err
+	}
+	if job.Algo == "" {
+		if len(session.client.config.Algo) != 1 {
+			session.closeLocked()
+			return errors.New("stratum: job without an algorithm")
+		}
+		job.Algo = session.client.config.Algo[0]
+	}
+	algorithm, err := cryptonight.LookupAlgorithm(job.Algo)
+	if err != nil {
+		session.closeLocked()
+		return err
+	}
+	session.client.setJob(&ClientJob{
+		Job:       job,
+		Pool:      session.pool,
+		Blob:      blob,
+		Algorithm: algorithm,
+		Target64:  target64,
+		NiceHash:  session.nicehash,
+		session:   session,
+	})
+	return nil
+}
+
+// Sends a request and waits for its response, decoded into result.
+func (session *clientSession) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	raw_params, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	response := make(chan Message, 1)
+	session.mu.Lock()
+	select {
+	case <-session.closed:
+		session.mu.Unlock()
+		return ErrNotConnected
+	default:
+	}
+	session.next_id++
+	id := session.next_id
+	session.pending[id] = response
+	session.mu.Unlock()
+	defer func() {
+		session.mu.Lock()
+		delete(session.pending, id)
+		session.mu.Unlock()
+	}()
+
+	raw_id, _ := json.Marshal(id)
+	line, _ := json.Marshal(Message{ID: raw_id, JSONRPC: "2.0", Method: method, Params: raw_params})
+	session.write_mu.Lock()
+	session.net_conn.SetWriteDeadline(time.Now().Add(session.client.config.Timeout))
+	_, err = session.net_conn.Write(append(line, '\n'))
+	session.write_mu.Unlock()
+	if err != nil {
+		session.close()
+		return ErrNotConnected
+	}
+
+	timer := time.NewTimer(session.client.config.Timeout)
+	defer timer.Stop()
+	select {
+	case message := <-response:
+		if message.Error != nil {
+			return message.Error
+		}
+		return json.Unmarshal(message.Result, result)
+	case <-session.closed:
+		return ErrNotConnected
+	case <-timer.C:
+		session.close()
+		return ErrNotConnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Dispatches responses and job notifications until the connection
+// fails.
+func (session *clientSession) read() {
+	defer session.close()
+	reader := bufio.NewReaderSize(session.net_conn, maxLineLength)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err != nil {
+			return
+		}
+		var message Message
+		if err := json.Unmarshal(line, &message); err != nil {
+			return
+		}
+		if message.Method == "job" {
+			var job Job
+			if err := json.Unmarshal(message.Params, &job); err != nil {
+				return
+			}
+			// The pool may push a job before the login response, and
+			// it's then newer than the login's.
+			session.mu.Lock()
+			if session.miner_id == "" {
+				session.early_job = &job
+				err = nil
+			} else {
+				err = session.handleJob(job)
+			}
+			session.mu.Unlock()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		var id uint64
+		if json.Unmarshal(message.ID, &id) != nil {
+			continue
+		}
+		session.mu.Lock()
+		response := session.pending[id]
+		session.mu.Unlock()
+		// The caller only waits for one response, a repeated one
+		// mustn't block the connection.
+		if response != nil {
+			select {
+			case response <- message:
+			default:
+			}
+		}
+	}
+}
+
+func (session *clientSession) close() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.closeLocked()
+}
+
+func (session *clientSession) closeLocked() {
+	select {
+	case <-session.closed:
+	default:
+		close(session.closed)
+		session.net_conn.Close()
+	}
+}
@@ -0,0 +1,290 @@
+package stratum
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestClientAndWorker(t *testing.T) {
+	solutions := make(chan Solution, 1024)
+	server, address := startTestServer(t, ServerConfig{
+		Difficulty: 1,
+		OnSolution: func(solution Solution) { solutions <- solution },
+	})
+	work := Work{
+		HeaderHash: hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8"),
+		Height:     8111222,
+		Algorithm:  cryptonight.CNDevR,
+		Target:     new(big.Int).Lsh(big.NewInt(1), 254),
+	}
+	server.SetWork(work)
+
+	// Nobody listens on the first pool, the client fails over.
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := listener.Addr().String()
+	listener.Close()
+	client, err := NewClient(ClientConfig{
+		Pools:      []string{dead, address},
+		Login:      "wallet",
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go client.Run(ctx)
+	worker, err := NewWorker(client, WorkerConfig{Threads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go worker.Run(ctx)
+
+	select {
+	case solution := <-solutions:
+		_, result := cryptonight.HashAlgorithmForEthereumHeader(work.Algorithm, work.HeaderHash, solution.Nonce, work.Height)
+		if new(big.Int).SetBytes(result).Cmp(work.Target) > 0 || solution.Login != "wallet" {
+			t.Error("Unexpected solution: ", solution.Nonce)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("No solution")
+	}
+	for stats, changed := worker.CurrentStats(); stats.Accepted < 2; stats, changed = worker.CurrentStats() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for accepted shares")
+		}
+	}
+
+	// New work reaches the client.
+	work.Height++
+	server.SetWork(work)
+	for job, changed := client.CurrentJob(); job == nil || job.Height != work.Height; job, changed = client.CurrentJob() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the new job")
+		}
+	}
+
+	// The client reconnects once the pool is back.
+	server.Close()
+	for job, changed := client.CurrentJob(); job != nil; job, changed = client.CurrentJob() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the disconnection")
+		}
+	}
+	server, _ = NewServer(ServerConfig{Difficulty: 1})
+	defer server.Close()
+	work.Height++
+	server.SetWork(work)
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	for job, changed := client.CurrentJob(); job == nil || job.Height != work.Height || job.Pool != address; job, changed = client.CurrentJob() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the reconnection")
+		}
+	}
+	accepted := worker.Stats().Accepted
+	for stats, changed := worker.CurrentStats(); stats.Accepted <= accepted; stats, changed = worker.CurrentStats() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for accepted shares")
+		}
+	}
+	// Shares in flight when new work arrives are rejected as stale.
+	if stats := worker.Stats(); stats.Hashes < stats.Accepted+stats.Rejected {
+		t.Error("Unexpected stats: ", stats)
+	}
+}
+
+func TestClientRejectedShare(t *testing.T) {
+	server, address := startTestServer(t, ServerConfig{Difficulty: 1 << 40})
+	defer server.Close()
+	server.SetWork(Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: big.NewInt(1)})
+	client, _ := NewClient(ClientConfig{Pools: []string{address}, Login: "wallet"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go client.Run(ctx)
+	job, changed := client.CurrentJob()
+	for ; job == nil; job, changed = client.CurrentJob() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for a job")
+		}
+	}
+	if job.Target64 != ^uint64(0)/(1<<40) || job.Algorithm != cryptonight.CNDev2 {
+		t.Error("Unexpected job: ", job.Target, " ", job.Algo)
+	}
+	digest := job.Algorithm.Hash(job.Blob, job.Height)
+	err := client.Submit(ctx, job, 0, digest)
+	if rpc_err, ok := err.(*Error); !ok || rpc_err.Message != "Low difficulty share" {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestWorkerNiceHash(t *testing.T) {
+	server, address := startTestServer(t, ServerConfig{Difficulty: 1, NonceLayout: NiceHashNonceLayout})
+	defer server.Close()
+	server.SetWork(Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: big.NewInt(1)})
+	client, _ := NewClient(ClientConfig{Pools: []string{address}, Login: "wallet"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go client.Run(ctx)
+	worker, _ := NewWorker(client, WorkerConfig{Threads: 1})
+	go worker.Run(ctx)
+	for stats, changed := worker.CurrentStats(); stats.Accepted < 2; stats, changed = worker.CurrentStats() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for accepted shares")
+		}
+	}
+	if job, _ := client.CurrentJob(); job == nil || !job.NiceHash {
+		t.Error("Unexpected job: ", job)
+	}
+	if stats := worker.Stats(); stats.Rejected != 0 {
+		t.Error("Unexpected stats: ", stats)
+	}
+}
+
+func TestWorkerConfig(t *testing.T) {
+	server, address := startTestServer(t, ServerConfig{Difficulty: 1})
+	defer server.Close()
+	server.SetWork(Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: big.NewInt(1)})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Every hash is a share: the 4 nonces of the range are accepted,
+	// and only them.
+	client, _ := NewClient(ClientConfig{Pools: []string{address}, Login: "wallet"})
+	go client.Run(ctx)
+	worker, err := NewWorker(client, WorkerConfig{Threads: 3, FirstNonce: 100, LastNonce: 103})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go worker.Run(ctx)
+	for stats, changed := worker.CurrentStats(); stats.Accepted < 4; stats, changed = worker.CurrentStats() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for accepted shares")
+		}
+	}
+	if stats := worker.Stats(); stats != (WorkerStats{Hashes: 4, Accepted: 4}) {
+		t.Error("Unexpected stats: ", stats)
+	}
+
+	// Hashing with another algorithm than the job's gives bad hashes.
+	other_client, _ := NewClient(ClientConfig{Pools: []string{address}, Login: "wallet"})
+	go other_client.Run(ctx)
+	other_worker, _ := NewWorker(other_client, WorkerConfig{Threads: 1, Algorithm: cryptonight.CNDev1, LastNonce: 1})
+	go other_worker.Run(ctx)
+	for stats, changed := other_worker.CurrentStats(); stats.Rejected < 2; stats, changed = other_worker.CurrentStats() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for rejected shares")
+		}
+	}
+	if stats := other_worker.Stats(); stats.Accepted != 0 {
+		t.Error("Unexpected stats: ", stats)
+	}
+
+	for _, config := range []WorkerConfig{
+		{},
+		{Threads: 1, FirstNonce: 2, LastNonce: 1},
+		{Threads: 1, Algorithm: cryptonight.Algorithm{Name: "bad"}},
+	} {
+		if _, err := NewWorker(client, config); err == nil {
+			t.Error("Unexpected config accepted: ", config)
+		}
+	}
+}
+
+func TestClientJobWithoutAlgo(t *testing.T) {
+	// A pool which doesn't name algorithms, and repeats its login
+	// response.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var login Message
+		json.Unmarshal(line, &login)
+		job := Job{Blob: hex.EncodeToString(make([]byte, 76)), JobID: "1", Target: "ffffffff", Height: 1}
+		result, _ := json.Marshal(LoginResult{ID: "miner", Job: job, Status: "OK"})
+		response, _ := json.Marshal(Message{ID: login.ID, JSONRPC: "2.0", Result: result})
+		job.JobID, job.Height = "2", 2
+		params, _ := json.Marshal(job)
+		notification, _ := json.Marshal(Message{JSONRPC: "2.0", Method: "job", Params: params})
+		conn.Write(append(append(append(response, '\n'), response...), '\n'))
+		conn.Write(append(notification, '\n'))
+		reader.ReadBytes('\n')
+	}()
+
+	// With a single algorithm configured, jobs are mined with it, and
+	// the repeated response doesn't hold up the next job.
+	client, _ := NewClient(ClientConfig{Pools: []string{listener.Addr().String()}, Login: "wallet", Algo: []string{"cn-dev/2"}})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go client.Run(ctx)
+	for job, changed := client.CurrentJob(); job == nil || job.Height != 2; job, changed = client.CurrentJob() {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the job")
+		}
+	}
+	if job, _ := client.CurrentJob(); job.Algorithm != cryptonight.CNDev2 || job.Algo != "cn-dev/2" {
+		t.Error("Unexpected job: ", job.Algo)
+	}
+
+	// With several, the job can't be mined and the connection closes.
+	other_client, _ := NewClient(ClientConfig{Pools: []string{"pool"}, Algo: []string{"cn-dev/1", "cn-dev/2"}})
+	client_conn, pool_conn := net.Pipe()
+	defer pool_conn.Close()
+	session := &clientSession{client: other_client, net_conn: client_conn, closed: make(chan struct{})}
+	if err := session.handleJob(Job{Blob: hex.EncodeToString(make([]byte, 76)), Target: "ffffffff"}); err == nil {
+		t.Error("Accepted a job without an algorithm")
+	}
+	if job, _ := other_client.CurrentJob(); job != nil {
+		t.Error("Unexpected job: ", job.Algo)
+	}
+	select {
+	case <-session.closed:
+	default:
+		t.Error("The connection wasn't closed")
+	}
+}
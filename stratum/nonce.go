@@ -0,0 +1,209 @@
+package stratum
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+)
+
+// How the 64 bit nonce (blob bytes 39 to 46, little endian) is split,
+// from the most significant bits down: an extranonce assigned by the
+// pool to each connection, a prefix reserved for a proxy to assign to
+// each of its miners, and the bits the miners iterate.
+type NonceLayout struct {
+	ExtranonceBits int
+	PrefixBits     int
+}
+
+var (
+	// Monero miners write the 4 bytes at blob offset 39, the pool
+	// assigns the other 4: the compatibility mode of
+	// cryptonight.JoinNonce.
+	MoneroNonceLayout = NonceLayout{ExtranonceBits: 32}
+	// NiceHash-style proxies also reserve the top byte of the miners' 4
+	// bytes, blob byte 42, and their miners iterate the other 3.
+	NiceHashNonceLayout = NonceLayout{ExtranonceBits: 32, PrefixBits: 8}
+)
+
+func (layout NonceLayout) Validate() error {
+	if layout.ExtranonceBits < 0 || layout.PrefixBits < 0 || layout.ExtranonceBits+layout.PrefixBits > 63 {
+		return fmt.Errorf("stratum: invalid nonce layout %+v", layout)
+	}
+	return nil
+}
+
+// The bits miners iterate.
+func (layout NonceLayout) MinerBits() int {
+	return 64 - layout.ExtranonceBits - layout.PrefixBits
+}
+
+var ErrNonceSpaceExhausted = errors.New("stratum: nonce space exhausted")
+
+// The nonces of one worker: those with the given extranonce and, if
+// HasPrefix, the given prefix. Without one, the prefix bits are left
+// for a proxy downstream to assign, and vary like the miner bits.
+type NonceRange struct {
+	Layout     NonceLayout
+	Extranonce uint64
+	Prefix     uint64
+	HasPrefix  bool
+}
+
+// The number of low bits which vary within the range.
+func (r NonceRange) VaryingBits() int {
+	if r.HasPrefix {
+		return r.Layout.MinerBits()
+	}
+	return r.Layout.MinerBits() + r.Layout.PrefixBits
+}
+
+// The first nonce of the range, the one with all varying bits 0.
+func (r NonceRange) First() uint64 {
+	nonce := r.Extranonce << uint(64-r.Layout.ExtranonceBits)
+	if r.HasPrefix {
+		nonce |= r.Prefix << uint(r.Layout.MinerBits())
+	}
+	return nonce
+}
+
+// The last nonce of the range.
+func (r NonceRange) Last() uint64 {
+	return r.First() | (1<<uint(r.VaryingBits()) - 1)
+}
+
+func (r NonceRange) Contains(nonce uint64) bool {
+	return nonce&^(1<<uint(r.VaryingBits())-1) == r.First()
+}
+
+// Returns the nonce after nonce in the range, or false once the range
+// is exhausted.
+func (r NonceRange) Next(nonce uint64) (uint64, bool) {
+	if nonce == r.Last() {
+		return 0, false
+	}
+	return nonce + 1, true
+}
+
+// Returns the blob a worker of the range hashes, with its first nonce:
+// a Monero miner only writes its 4 bytes at offset 39 (3 with a
+// prefix), the rest of the nonce is already in place. The first nonce
+// is cryptonight.JoinNonce(extranonce, 0) without a prefix, e.g. with
+// MoneroNonceLayout, which makes this cryptonight.EthereumJobBlob.
+func (r NonceRange) Template(algorithm cryptonight.Algorithm, block_header_hash []byte) []byte {
+	return cryptonight.EthereumHeaderBlob(algorithm, block_header_hash, r.First())
+}
+
+// Reassembles the full 64 bit nonce of a submission: 4 bytes, the
+// little endian bytes 39 to 42 of the miner's blob, joined with the
+// upper 4 bytes of the range's first nonce (see cryptonight.JoinNonce),
+// or all 8 bytes. Fails if the nonce isn't in the range, e.g. a miner
+// changed its prefix.
+func (r NonceRange) NonceFromMiner(submitted []byte) (uint64, error) {
+	var nonce uint64
+	switch len(submitted) {
+	case 4:
+		extranonce, _ := cryptonight.SplitNonce(r.First())
+		nonce = cryptonight.JoinNonce(extranonce, binary.LittleEndian.Uint32(submitted))
+	case 8:
+		nonce = binary.LittleEndian.Uint64(submitted)
+	default:
+		return 0, fmt.Errorf("stratum: %d byte nonce", len(submitted))
+	}
+	if !r.Contains(nonce) {
+		return 0, fmt.Errorf("stratum: nonce %#x out of range", nonce)
+	}
+	return nonce, nil
+}
+
+// Hands out NonceRanges which don't overlap: on a pool, one per
+// extranonce with the prefix left to proxies, and on a proxy, one per
+// prefix within the range it got from its pool.
+type NonceAllocator struct {
+	upstream NonceRange
+	proxy    bool
+	slots    uint64
+
+	mu     sync.Mutex
+	next   uint64
+	in_use map[uint64]struct{}
+}
+
+// Returns a pool's allocator, handing out extranonces.
+func NewNonceAllocator(layout NonceLayout) (*NonceAllocator, error) {
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+	return &NonceAllocator{
+		upstream: NonceRange{Layout: layout},
+		slots:    1 << uint(layout.ExtranonceBits),
+		in_use:   make(map[uint64]struct{}),
+	}, nil
+}
+
+// Returns a proxy's allocator, handing out the prefixes of the range
+// it got from its pool, which must have a prefix left to assign.
+func NewProxyNonceAllocator(upstream NonceRange) (*NonceAllocator, error) {
+	if err := upstream.Layout.Validate(); err != nil {
+		return nil, err
+	}
+	if upstream.HasPrefix || upstream.Layout.PrefixBits == 0 {
+		return nil, errors.New("stratum: no prefix to assign")
+	}
+	return &NonceAllocator{
+		upstream: upstream,
+		proxy:    true,
+		slots:    1 << uint(upstream.Layout.PrefixBits),
+		in_use:   make(map[uint64]struct{}),
+	}, nil
+}
+
+// Returns a range no other allocated range overlaps, or
+// ErrNonceSpaceExhausted if they're all taken. Ranges are handed out
+// in order, and released ones only once the others ran out.
+func (a *NonceAllocator) Allocate() (NonceRange, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if uint64(len(a.in_use)) >= a.slots {
+		return NonceRange{}, ErrNonceSpaceExhausted
+	}
+	for {
+		slot := a.next
+		a.next = (a.next + 1) % a.slots
+		if _, taken := a.in_use[slot]; !taken {
+			a.in_use[slot] = struct{}{}
+			return a.rangeOf(slot), nil
+		}
+	}
+}
+
+func (a *NonceAllocator) rangeOf(slot uint64) NonceRange {
+	r := a.upstream
+	if a.proxy {
+		r.Prefix = slot
+		r.HasPrefix = true
+	} else {
+		r.Extranonce = slot
+	}
+	return r
+}
+
+// Makes an allocated range available again.
+func (a *NonceAllocator) Release(r NonceRange) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.proxy {
+		delete(a.in_use, r.Prefix)
+	} else {
+		delete(a.in_use, r.Extranonce)
+	}
+}
+
+// The number of ranges which can still be allocated.
+func (a *NonceAllocator) Available() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.slots - uint64(len(a.in_use))
+}
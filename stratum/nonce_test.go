@@ -0,0 +1,117 @@
+package stratum
+
+import (
+	"bytes"
+	"testing"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestNonceRange(t *testing.T) {
+	pool := NonceRange{Layout: NiceHashNonceLayout, Extranonce: 0x01020304}
+	proxy := pool
+	proxy.Prefix = 0xab
+	proxy.HasPrefix = true
+	cases := []struct {
+		r            NonceRange
+		varying_bits int
+		first, last  uint64
+	}{
+		{pool, 32, 0x0102030400000000, 0x01020304ffffffff},
+		{proxy, 24, 0x01020304ab000000, 0x01020304abffffff},
+		{NonceRange{Layout: NonceLayout{ExtranonceBits: 16}, Extranonce: 0xbeef}, 48, 0xbeef000000000000, 0xbeefffffffffffff},
+		{NonceRange{Layout: NonceLayout{}}, 64, 0, 0xffffffffffffffff},
+	}
+	for _, c := range cases {
+		if c.r.VaryingBits() != c.varying_bits || c.r.First() != c.first || c.r.Last() != c.last {
+			t.Error("Unexpected range ", c.r, ": ", c.r.VaryingBits(), " bits from ", c.r.First(), " to ", c.r.Last(), " versus ", c.varying_bits, " bits from ", c.first, " to ", c.last)
+		}
+		if !c.r.Contains(c.first) || !c.r.Contains(c.last) || (c.first > 0 && c.r.Contains(c.first-1)) || (c.last < ^uint64(0) && c.r.Contains(c.last+1)) {
+			t.Error("Unexpected bounds of ", c.r)
+		}
+		if next, ok := c.r.Next(c.first); !ok || next != c.first+1 {
+			t.Error("Unexpected next nonce in ", c.r, ": ", next, " versus ", c.first+1)
+		}
+		if _, ok := c.r.Next(c.last); ok {
+			t.Error("Range not exhausted at its last nonce: ", c.r)
+		}
+	}
+
+	// A NiceHash miner behind the proxy keeps byte 42 of its blob.
+	header := hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8")
+	blob := proxy.Template(cryptonight.CNR, header)
+	if !bytes.Equal(blob[39:47], []byte{0, 0, 0, 0xab, 4, 3, 2, 1}) || !bytes.Equal(blob, cryptonight.EthereumHeaderBlob(cryptonight.CNR, header, proxy.First())) {
+		t.Error("Unexpected template: ", hexutil.Encode(blob))
+	}
+	copy(blob[39:42], []byte{0x11, 0x22, 0x33})
+	if nonce, err := proxy.NonceFromMiner(blob[39:43]); err != nil || nonce != 0x01020304ab332211 {
+		t.Error("Unexpected nonce: ", nonce, " (", err, ")")
+	}
+	if _, err := proxy.NonceFromMiner([]byte{0x11, 0x22, 0x33, 0xac}); err == nil {
+		t.Error("Other prefix accepted")
+	}
+	if nonce, err := pool.NonceFromMiner([]byte{0x11, 0x22, 0x33, 0xac}); err != nil || nonce != 0x01020304ac332211 {
+		t.Error("Unexpected nonce: ", nonce, " (", err, ")")
+	}
+	if nonce, err := pool.NonceFromMiner(blob[39:47]); err != nil || nonce != 0x01020304ab332211 {
+		t.Error("Unexpected nonce: ", nonce, " (", err, ")")
+	}
+	if _, err := pool.NonceFromMiner([]byte{0x11, 0x22, 0x33, 0x44, 5, 3, 2, 1}); err == nil {
+		t.Error("Other extranonce accepted")
+	}
+	if _, err := pool.NonceFromMiner([]byte{1, 2, 3}); err == nil {
+		t.Error("3 byte nonce accepted")
+	}
+
+	// Monero miners get the blob of cryptonight's compatibility mode.
+	monero := NonceRange{Layout: MoneroNonceLayout, Extranonce: 0x01020304}
+	if blob := monero.Template(cryptonight.CNR, header); !bytes.Equal(blob, cryptonight.EthereumJobBlob(cryptonight.CNR, header, 0x01020304)) {
+		t.Error("Unexpected template: ", hexutil.Encode(blob))
+	}
+	if nonce, err := monero.NonceFromMiner([]byte{0x11, 0x22, 0x33, 0x44}); err != nil || nonce != cryptonight.JoinNonce(0x01020304, 0x44332211) {
+		t.Error("Unexpected nonce: ", nonce, " (", err, ")")
+	}
+}
+
+func TestNonceAllocator(t *testing.T) {
+	allocator, err := NewNonceAllocator(NonceLayout{ExtranonceBits: 2, PrefixBits: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges []NonceRange
+	for i := 0; i < 4; i++ {
+		r, err := allocator.Allocate()
+		if err != nil || r.Extranonce != uint64(i) || r.HasPrefix {
+			t.Fatal("Unexpected range: ", r, " (", err, ")")
+		}
+		ranges = append(ranges, r)
+	}
+	if _, err := allocator.Allocate(); err != ErrNonceSpaceExhausted || allocator.Available() != 0 {
+		t.Error("Unexpected error: ", err)
+	}
+	allocator.Release(ranges[2])
+	if r, err := allocator.Allocate(); err != nil || r.Extranonce != 2 {
+		t.Error("Unexpected range: ", r, " (", err, ")")
+	}
+
+	// A proxy splits its range between its miners by prefix.
+	proxy, err := NewProxyNonceAllocator(ranges[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.Available() != 256 {
+		t.Error("Unexpected available prefixes: ", proxy.Available())
+	}
+	first, _ := proxy.Allocate()
+	second, _ := proxy.Allocate()
+	if !first.HasPrefix || first.Prefix != 0 || second.Prefix != 1 || second.Extranonce != 1 || first.Contains(second.First()) || !ranges[1].Contains(second.Last()) {
+		t.Error("Unexpected ranges: ", first, " and ", second)
+	}
+	if _, err := NewProxyNonceAllocator(second); err == nil {
+		t.Error("Proxy allocator without a prefix to assign")
+	}
+	if _, err := NewNonceAllocator(NonceLayout{ExtranonceBits: 60, PrefixBits: 4}); err == nil {
+		t.Error("Layout without miner bits accepted")
+	}
+}
@@ -0,0 +1,104 @@
+// Package stratum speaks the Stratum dialect of Monero pools and
+// xmrig: newline separated JSON-RPC messages over TCP, with the login,
+// job, submit and keepalived methods. Miners hash the 76 byte blob of
+// cryptonight.EthereumHeaderBlob, so Monero mining software works
+// with few changes. Like Monero miners, they only write the low 4
+// bytes of the nonce (blob bytes 39 to 42); the server assigns every
+// connection its own upper 4 bytes (bytes 43 to 46) so that miners
+// don't search the same nonces.
+package stratum
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Any message on the wire. Requests and notifications have a Method,
+// notifications no ID, and responses a Result or an Error.
+type Message struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	JSONRPC string          `json:"jsonrpc,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// The error of a response, e.g. a rejected share.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("stratum: %s (code %d)", err.Message, err.Code)
+}
+
+// Error codes. Rejected shares and other refusals all use
+// CodeRejected, like Monero pools do; miners only show the message.
+const (
+	CodeRejected       = -1
+	CodeParseError     = -32700
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+)
+
+// Parameters of "login", the first request of a miner.
+type LoginParams struct {
+	// Usually a wallet address, optionally followed by the worker name.
+	Login string `json:"login"`
+	Pass  string `json:"pass"`
+	// Mining software, e.g. "xmrig/6.21.0".
+	Agent string `json:"agent,omitempty"`
+	// Algorithms the miner supports, see cryptonight.Algorithm.Name.
+	Algo  []string `json:"algo,omitempty"`
+	RigID string   `json:"rigid,omitempty"`
+}
+
+// Result of "login".
+type LoginResult struct {
+	// Identifies the miner in its submit and keepalived requests.
+	ID     string `json:"id"`
+	Job    Job    `json:"job"`
+	Status string `json:"status"`
+	// Supported extensions, "keepalive" for the keepalived method.
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+// A job, in the login result and in "job" notifications.
+type Job struct {
+	// Blob to hash, in hex, with the nonce bytes to search zeroed.
+	Blob  string `json:"blob"`
+	JobID string `json:"job_id"`
+	// Compact share target, in little endian hex: 4 bytes T for which
+	// hashes must satisfy digest[24:32] (little endian) <
+	// 0xFFFFFFFFFFFFFFFF / (0xFFFFFFFF / T), or 8 bytes which are the
+	// bound itself.
+	Target string `json:"target"`
+	// The miner's ID, as in the login result.
+	ID     string `json:"id,omitempty"`
+	Height uint64 `json:"height"`
+	// Algorithm name, see cryptonight.Algorithm.Name.
+	Algo string `json:"algo"`
+}
+
+// Parameters of "submit".
+type SubmitParams struct {
+	ID    string `json:"id"`
+	JobID string `json:"job_id"`
+	// Little endian hex, 4 bytes for the miner's part of the nonce or 8
+	// bytes for the whole nonce.
+	Nonce string `json:"nonce"`
+	// The digest, in hex.
+	Result string `json:"result"`
+}
+
+// Parameters of "keepalived".
+type KeepalivedParams struct {
+	ID string `json:"id"`
+}
+
+// Result of "submit" ("OK") and "keepalived" ("KEEPALIVED").
+type StatusResult struct {
+	Status string `json:"status"`
+}
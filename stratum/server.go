@@ -0,0 +1,439 @@
+package stratum
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+)
+
+// An Ethereum work package: what the node wants mined.
+type Work = cryptonight.Work
+
+// A nonce solving the block of a Work.
+type Solution struct {
+	Work   Work
+	Nonce  uint64
+	Digest []byte
+	Result []byte
+	// Login of the miner who found it.
+	Login string
+}
+
+type ServerConfig struct {
+	// Share difficulty of every miner, at least 1. A share's result must
+	// be at most about 2^256 / Difficulty.
+	Difficulty uint64
+	// If set, every miner's difficulty starts at Difficulty and varies
+	// within the configured bounds. Retargets happen on shares and
+	// keepalived requests, and send the miner a job with the new target.
+	VarDiff *VarDiffConfig
+	// Called with every share which solves its block, from the
+	// goroutine of the miner's connection.
+	OnSolution func(Solution)
+	// How nonces are split between the server, proxies and miners.
+	// MoneroNonceLayout if zero. With a prefix, the login result has
+	// the "nicehash" extension, which tells xmrig to keep blob byte 42.
+	NonceLayout NonceLayout
+	// Connections without any request for this long are closed. 10
+	// minutes if 0; xmrig sends keepalived every minute.
+	IdleTimeout time.Duration
+}
+
+// The longest line accepted from a miner.
+const maxLineLength = 16 << 10
+
+var ErrServerClosed = errors.New("stratum: server closed")
+
+// A Stratum server handing out jobs for the current Work. Every
+// connection gets its own NonceRange, and a job for every new Work.
+type Server struct {
+	config    ServerConfig
+	ctx       context.Context
+	cancel    context.CancelFunc
+	validator *Validator
+	nonces    *NonceAllocator
+
+	mu        sync.Mutex
+	work      *Work
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	next_job  uint64
+	closed    bool
+}
+
+type serverConn struct {
+	server   *Server
+	net_conn net.Conn
+	write_mu sync.Mutex
+
+	// Guarded by server.mu.
+	id         string
+	login      string
+	nonces     NonceRange
+	difficulty uint64
+	vardiff    *VarDiff
+	// Job with a new target, to send after the current response.
+	retarget_job *Job
+}
+
+func NewServer(config ServerConfig) (*Server, error) {
+	if config.Difficulty == 0 {
+		return nil, errors.New("stratum: difficulty must be at least 1")
+	}
+	if config.VarDiff != nil {
+		if err := config.VarDiff.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.NonceLayout == (NonceLayout{}) {
+		config.NonceLayout = MoneroNonceLayout
+	}
+	nonces, err := NewNonceAllocator(config.NonceLayout)
+	if err != nil {
+		return nil, err
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = 10 * time.Minute
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		validator: NewValidator(0),
+		nonces:    nonces,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*serverConn]struct{}),
+	}, nil
+}
+
+// Accepts miners on listener until Close, then returns
+// ErrServerClosed, or any other error of Accept.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, listener)
+		s.mu.Unlock()
+	}()
+
+	for {
+		net_conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		conn := &serverConn{server: s, net_conn: net_conn}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			net_conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go conn.serve()
+	}
+}
+
+// Closes the listeners and every connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cancel()
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.net_conn.Close()
+	}
+	return nil
+}
+
+// Replaces the current work, and sends a job for it to every miner.
+// Shares for jobs of older work are rejected as stale from then on.
+// work.Target must be positive.
+func (s *Server) SetWork(work Work) error {
+	if work.Target == nil || work.Target.Sign() <= 0 {
+		return errors.New("stratum: work without a positive target")
+	}
+	work.HeaderHash = append([]byte(nil), work.HeaderHash...)
+	work.Target = new(big.Int).Set(work.Target)
+	s.mu.Lock()
+	s.work = &work
+	s.validator.SetWork(s.work)
+	jobs := make(map[*serverConn]Job)
+	for conn := range s.conns {
+		if conn.id != "" {
+			jobs[conn] = conn.newJob()
+		}
+	}
+	s.mu.Unlock()
+	for conn, job := range jobs {
+		conn.notify("job", job)
+	}
+	return nil
+}
+
+// Returns the share statistics of every miner, by login.
+func (s *Server) Stats() map[string]ShareStats {
+	return s.validator.Stats()
+}
+
+// Hands out a job for the current work. Called with server.mu held.
+func (conn *serverConn) newJob() Job {
+	s := conn.server
+	s.next_job++
+	target64, compact := cryptonight.EncodeCompactTarget(cryptonight.DifficultyToTarget(new(big.Int).SetUint64(conn.difficulty)))
+	job := ValidatorJob{
+		ID:         strconv.FormatUint(s.next_job, 10),
+		Work:       s.work,
+		Worker:     conn.login,
+		Difficulty: conn.difficulty,
+		Target:     cryptonight.Compact64ToTarget(target64),
+	}
+	s.validator.AddJob(job)
+	blob := conn.nonces.Template(job.Work.Algorithm, job.Work.HeaderHash)
+	return Job{
+		Blob:   hex.EncodeToString(blob),
+		JobID:  job.ID,
+		Target: compact,
+		ID:     conn.id,
+		Height: job.Work.Height,
+		Algo:   job.Work.Algorithm.Name,
+	}
+}
+
+func (conn *serverConn) serve() {
+	s := conn.server
+	defer func() {
+		conn.net_conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		if conn.id != "" {
+			s.nonces.Release(conn.nonces)
+		}
+		s.mu.Unlock()
+	}()
+	reader := bufio.NewReaderSize(conn.net_conn, maxLineLength)
+	for {
+		conn.net_conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+		line, err := reader.ReadSlice('\n')
+		if err != nil {
+			return
+		}
+		var request Message
+		if err := json.Unmarshal(line, &request); err != nil {
+			conn.respond(nil, nil, &Error{Code: CodeParseError, Message: "Parse error"})
+			return
+		}
+		result, rpc_err := conn.handle(request)
+		conn.respond(request.ID, result, rpc_err)
+		s.mu.Lock()
+		job := conn.retarget_job
+		conn.retarget_job = nil
+		s.mu.Unlock()
+		if job != nil {
+			conn.notify("job", *job)
+		}
+	}
+}
+
+func (conn *serverConn) handle(request Message) (interface{}, *Error) {
+	switch request.Method {
+	case "login":
+		var params LoginParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: "Invalid params"}
+		}
+		return conn.handleLogin(params)
+	case "submit":
+		var params SubmitParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: "Invalid params"}
+		}
+		return conn.handleSubmit(params)
+	case "keepalived":
+		var params KeepalivedParams
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			return nil, &Error{Code: CodeInvalidParams, Message: "Invalid params"}
+		}
+		if !conn.authorized(params.ID) {
+			return nil, &Error{Code: CodeRejected, Message: "Unauthenticated"}
+		}
+		conn.retarget(false)
+		return StatusResult{Status: "KEEPALIVED"}, nil
+	}
+	return nil, &Error{Code: CodeMethodNotFound, Message: "Method not found"}
+}
+
+func (conn *serverConn) handleLogin(params LoginParams) (interface{}, *Error) {
+	if params.Login == "" {
+		return nil, &Error{Code: CodeRejected, Message: "Missing login"}
+	}
+	s := conn.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn.id != "" {
+		return nil, &Error{Code: CodeRejected, Message: "Already logged in"}
+	}
+	if s.work == nil {
+		return nil, &Error{Code: CodeRejected, Message: "No work available yet"}
+	}
+	if len(params.Algo) > 0 && !contains(params.Algo, s.work.Algorithm.Name) {
+		return nil, &Error{Code: CodeRejected, Message: "Unsupported algorithm " + s.work.Algorithm.Name}
+	}
+	nonces, err := s.nonces.Allocate()
+	if err != nil {
+		return nil, &Error{Code: CodeRejected, Message: "Server full"}
+	}
+	conn.nonces = nonces
+	conn.id = strconv.FormatUint(nonces.Extranonce, 16)
+	conn.login = params.Login
+	conn.difficulty = s.config.Difficulty
+	if s.config.VarDiff != nil {
+		conn.vardiff = NewVarDiff(*s.config.VarDiff, s.config.Difficulty, time.Now())
+		conn.difficulty = conn.vardiff.Difficulty()
+	}
+	extensions := []string{"keepalive"}
+	if s.config.NonceLayout.PrefixBits > 0 {
+		extensions = append(extensions, "nicehash")
+	}
+	return LoginResult{
+		ID:         conn.id,
+		Job:        conn.newJob(),
+		Status:     "OK",
+		Extensions: extensions,
+	}, nil
+}
+
+func (conn *serverConn) handleSubmit(params SubmitParams) (interface{}, *Error) {
+	s := conn.server
+	s.mu.Lock()
+	authorized := conn.id != "" && params.ID == conn.id
+	login, nonces := conn.login, conn.nonces
+	s.mu.Unlock()
+	if !authorized {
+		return nil, &Error{Code: CodeRejected, Message: "Unauthenticated"}
+	}
+	nonce_bytes, err := hex.DecodeString(params.Nonce)
+	if err != nil {
+		return nil, &Error{Code: CodeRejected, Message: "Invalid nonce"}
+	}
+	nonce, err := nonces.NonceFromMiner(nonce_bytes)
+	if err != nil {
+		return nil, &Error{Code: CodeRejected, Message: "Invalid nonce"}
+	}
+	var digest []byte
+	if params.Result != "" {
+		if digest, err = hex.DecodeString(params.Result); err != nil {
+			return nil, ErrBadHash
+		}
+	}
+	share, err := s.validator.Validate(s.ctx, login, params.JobID, nonce, digest)
+	if err != nil {
+		if rpc_err, ok := err.(*Error); ok {
+			return nil, rpc_err
+		}
+		return nil, &Error{Code: CodeRejected, Message: "Server shutting down"}
+	}
+	if share.Block && s.config.OnSolution != nil {
+		s.config.OnSolution(Solution{
+			Work:   *share.Job.Work,
+			Nonce:  nonce,
+			Digest: share.Digest,
+			Result: share.Result,
+			Login:  login,
+		})
+	}
+	conn.retarget(true)
+	return StatusResult{Status: "OK"}, nil
+}
+
+// Updates the miner's variable difficulty, after a share or without
+// one, and queues a job with the new target if it changed.
+func (conn *serverConn) retarget(share bool) {
+	s := conn.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn.vardiff == nil {
+		return
+	}
+	var changed bool
+	if share {
+		conn.difficulty, changed = conn.vardiff.Share(time.Now())
+	} else {
+		conn.difficulty, changed = conn.vardiff.Retarget(time.Now())
+	}
+	if changed {
+		job := conn.newJob()
+		conn.retarget_job = &job
+	}
+}
+
+func (conn *serverConn) authorized(id string) bool {
+	conn.server.mu.Lock()
+	defer conn.server.mu.Unlock()
+	return conn.id != "" && id == conn.id
+}
+
+func (conn *serverConn) respond(id json.RawMessage, result interface{}, rpc_err *Error) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	message := Message{ID: id, JSONRPC: "2.0", Error: rpc_err}
+	if rpc_err == nil {
+		message.Result, _ = json.Marshal(result)
+	}
+	conn.write(message)
+}
+
+func (conn *serverConn) notify(method string, params interface{}) {
+	message := Message{JSONRPC: "2.0", Method: method}
+	message.Params, _ = json.Marshal(params)
+	conn.write(message)
+}
+
+func (conn *serverConn) write(message Message) {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	conn.write_mu.Lock()
+	defer conn.write_mu.Unlock()
+	conn.net_conn.SetWriteDeadline(time.Now().Add(conn.server.config.IdleTimeout))
+	if _, err := conn.net_conn.Write(append(line, '\n')); err != nil {
+		conn.net_conn.Close()
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
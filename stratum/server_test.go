@@ -0,0 +1,314 @@
+package stratum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+// A miner as xmrig would be one: it only knows the blob, the target
+// and the algorithm of its jobs.
+type testMiner struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	id     int
+}
+
+func dialTestMiner(t *testing.T, address string) *testMiner {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal("Dial failed: ", err)
+	}
+	return &testMiner{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (miner *testMiner) send(method string, params interface{}) {
+	miner.id++
+	raw_params, _ := json.Marshal(params)
+	line, _ := json.Marshal(Message{ID: json.RawMessage(strconv.Itoa(miner.id)), JSONRPC: "2.0", Method: method, Params: raw_params})
+	if _, err := miner.conn.Write(append(line, '\n')); err != nil {
+		miner.t.Fatal("Write failed: ", err)
+	}
+}
+
+func (miner *testMiner) receive() Message {
+	miner.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := miner.reader.ReadBytes('\n')
+	if err != nil {
+		miner.t.Fatal("Read failed: ", err)
+	}
+	var message Message
+	if err := json.Unmarshal(line, &message); err != nil {
+		miner.t.Fatal("Bad message: ", string(line))
+	}
+	return message
+}
+
+// Sends a request and returns the result of its response, decoded
+// into result, or its error.
+func (miner *testMiner) call(method string, params interface{}, result interface{}) *Error {
+	miner.send(method, params)
+	response := miner.receive()
+	if response.Error != nil {
+		return response.Error
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		miner.t.Fatal("Bad result: ", string(response.Result))
+	}
+	return nil
+}
+
+// Hashes the job's blob with the given 4 byte nonce, and tells whether
+// the digest meets the job's target, as xmrig does.
+func mineNonce(t *testing.T, job Job, nonce uint32) ([]byte, bool) {
+	blob, err := hex.DecodeString(job.Blob)
+	if err != nil || len(blob) != 76 {
+		t.Fatal("Bad blob: ", job.Blob)
+	}
+	algorithm, err := cryptonight.LookupAlgorithm(job.Algo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(blob[39:], nonce)
+	digest := algorithm.Hash(blob, job.Height)
+	target, _ := hex.DecodeString(job.Target)
+	var target64 uint64
+	if len(target) == 4 {
+		target64 = ^uint64(0) / (0xFFFFFFFF / uint64(binary.LittleEndian.Uint32(target)))
+	} else {
+		target64 = binary.LittleEndian.Uint64(target)
+	}
+	return digest, binary.LittleEndian.Uint64(digest[24:]) < target64
+}
+
+func startTestServer(t *testing.T, config ServerConfig) (*Server, string) {
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	solutions := make(chan Solution, 16)
+	server, address := startTestServer(t, ServerConfig{
+		Difficulty: 1,
+		OnSolution: func(solution Solution) { solutions <- solution },
+	})
+	defer server.Close()
+	// About one nonce in 4 solves the block.
+	work := Work{
+		HeaderHash: hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8"),
+		Height:     8111222,
+		Algorithm:  cryptonight.CNDevR,
+		Target:     new(big.Int).Lsh(big.NewInt(1), 254),
+	}
+	server.SetWork(work)
+
+	miner := dialTestMiner(t, address)
+	defer miner.conn.Close()
+	var login LoginResult
+	if err := miner.call("login", LoginParams{Login: "wallet", Pass: "x", Agent: "test", Algo: []string{"cn-dev/r"}}, &login); err != nil {
+		t.Fatal("Login failed: ", err)
+	}
+	other := dialTestMiner(t, address)
+	defer other.conn.Close()
+	var other_login LoginResult
+	if err := other.call("login", LoginParams{Login: "other", Pass: "x"}, &other_login); err != nil {
+		t.Fatal("Login failed: ", err)
+	}
+	if login.Job.Blob == other_login.Job.Blob {
+		t.Error("Miners got the same blob: ", login.Job.Blob)
+	}
+	if login.Job.Target != "ffffffff" || login.Job.Height != 8111222 || login.Job.Algo != "cn-dev/r" {
+		t.Error("Unexpected job: ", login.Job)
+	}
+
+	// Submit shares until one solves the block, and check it's the
+	// nonce the miner hashed.
+	var found bool
+	for nonce := uint32(0); nonce < 64 && !found; nonce++ {
+		digest, ok := mineNonce(t, login.Job, nonce)
+		if !ok {
+			continue
+		}
+		var nonce_bytes [4]byte
+		binary.LittleEndian.PutUint32(nonce_bytes[:], nonce)
+		var status StatusResult
+		err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: hex.EncodeToString(nonce_bytes[:]), Result: hex.EncodeToString(digest)}, &status)
+		if err != nil || status.Status != "OK" {
+			t.Fatal("Share rejected: ", err)
+		}
+		select {
+		case solution := <-solutions:
+			found = true
+			blob, _ := hex.DecodeString(login.Job.Blob)
+			binary.LittleEndian.PutUint32(blob[39:], nonce)
+			if solution.Nonce != binary.LittleEndian.Uint64(blob[39:]) || solution.Login != "wallet" {
+				t.Error("Unexpected solution: ", solution.Nonce, " ", solution.Login)
+			}
+			expected_digest, expected_result := cryptonight.HashAlgorithmForEthereumHeader(work.Algorithm, work.HeaderHash, solution.Nonce, work.Height)
+			if !bytes.Equal(solution.Digest, digest) || !bytes.Equal(solution.Digest, expected_digest) || !bytes.Equal(solution.Result, expected_result) {
+				t.Error("Unexpected digest: ", hex.EncodeToString(solution.Digest), " versus ", hex.EncodeToString(expected_digest))
+			}
+		default:
+		}
+	}
+	if !found {
+		t.Fatal("No solution in 64 nonces")
+	}
+
+	var status StatusResult
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "00000000"}, &status); err == nil || err.Message != "Duplicate share" {
+		t.Error("Unexpected error: ", err)
+	}
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "ffffffff", Result: hex.EncodeToString(make([]byte, 32))}, &status); err == nil || err.Message != "Bad hash" {
+		t.Error("Unexpected error: ", err)
+	}
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: "nope", Nonce: "00000000"}, &status); err == nil || err.Message != "Invalid job id" {
+		t.Error("Unexpected error: ", err)
+	}
+	if err := miner.call("submit", SubmitParams{ID: other_login.ID, JobID: login.Job.JobID, Nonce: "00000000"}, &status); err == nil || err.Message != "Unauthenticated" {
+		t.Error("Unexpected error: ", err)
+	}
+	// The 8 byte form must stay within the miner's extranonce.
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "00000000ffffffff"}, &status); err == nil || err.Message != "Invalid nonce" {
+		t.Error("Unexpected error: ", err)
+	}
+	if err := miner.call("keepalived", KeepalivedParams{ID: login.ID}, &status); err != nil || status.Status != "KEEPALIVED" {
+		t.Error("Unexpected keepalived response: ", status, err)
+	}
+
+	// New work is pushed to miners, and makes older jobs stale.
+	work.Height++
+	server.SetWork(work)
+	notification := miner.receive()
+	var job Job
+	if notification.Method != "job" || json.Unmarshal(notification.Params, &job) != nil || job.Height != work.Height || job.JobID == login.Job.JobID {
+		t.Fatal("Unexpected notification: ", notification)
+	}
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "00000000"}, &status); err == nil || err.Message != "Block expired" {
+		t.Error("Unexpected error: ", err)
+	}
+	if stats := server.Stats()["wallet"]; stats.Accepted == 0 || stats.Rejected != 4 || stats.Duplicate != 1 || stats.Stale != 1 {
+		t.Error("Unexpected stats: ", stats)
+	}
+}
+
+func TestServerInvalidWork(t *testing.T) {
+	server, _ := NewServer(ServerConfig{Difficulty: 1})
+	defer server.Close()
+	for _, target := range []*big.Int{nil, big.NewInt(0), big.NewInt(-1)} {
+		if err := server.SetWork(Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: target}); err == nil {
+			t.Error("Accepted target ", target)
+		}
+	}
+}
+
+func TestServerLowDifficultyShare(t *testing.T) {
+	server, address := startTestServer(t, ServerConfig{Difficulty: 1 << 40})
+	defer server.Close()
+	server.SetWork(Work{
+		HeaderHash: make([]byte, 32),
+		Algorithm:  cryptonight.CNDev2,
+		Target:     big.NewInt(1),
+	})
+	miner := dialTestMiner(t, address)
+	defer miner.conn.Close()
+	var login LoginResult
+	if err := miner.call("login", LoginParams{Login: "wallet"}, &login); err != nil {
+		t.Fatal("Login failed: ", err)
+	}
+	if len(login.Job.Target) != 16 {
+		t.Error("Unexpected target: ", login.Job.Target)
+	}
+	if _, ok := mineNonce(t, login.Job, 0); ok {
+		t.Fatal("Nonce 0 meets the target")
+	}
+	var status StatusResult
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "00000000"}, &status); err == nil || err.Message != "Low difficulty share" {
+		t.Error("Unexpected error: ", err)
+	}
+}
+
+func TestServerVarDiff(t *testing.T) {
+	server, address := startTestServer(t, ServerConfig{
+		Difficulty: 1,
+		VarDiff: &VarDiffConfig{
+			TargetTime:    365 * 24 * time.Hour,
+			RetargetTime:  time.Millisecond,
+			MinDifficulty: 1,
+			MaxDifficulty: 1 << 20,
+		},
+	})
+	defer server.Close()
+	server.SetWork(Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: big.NewInt(1)})
+	miner := dialTestMiner(t, address)
+	defer miner.conn.Close()
+	var login LoginResult
+	if err := miner.call("login", LoginParams{Login: "wallet"}, &login); err != nil {
+		t.Fatal("Login failed: ", err)
+	}
+	if login.Job.Target != "ffffffff" {
+		t.Error("Unexpected target: ", login.Job.Target)
+	}
+
+	// Shares much faster than one a year send the difficulty to its
+	// maximum, with a new job right after the response.
+	time.Sleep(2 * time.Millisecond)
+	var status StatusResult
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "00000000"}, &status); err != nil {
+		t.Fatal("Share rejected: ", err)
+	}
+	notification := miner.receive()
+	var job Job
+	if notification.Method != "job" || json.Unmarshal(notification.Params, &job) != nil {
+		t.Fatal("Unexpected notification: ", notification)
+	}
+	if _, compact := cryptonight.EncodeCompactTarget(cryptonight.DifficultyToTarget(big.NewInt(1 << 20))); job.Target != compact || job.Blob != login.Job.Blob {
+		t.Error("Unexpected job: ", job)
+	}
+	// The old job keeps its target.
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "01000000"}, &status); err != nil {
+		t.Error("Share rejected: ", err)
+	}
+}
+
+func TestServerNiceHash(t *testing.T) {
+	server, address := startTestServer(t, ServerConfig{Difficulty: 1, NonceLayout: NiceHashNonceLayout})
+	defer server.Close()
+	server.SetWork(Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: big.NewInt(1)})
+	miner := dialTestMiner(t, address)
+	defer miner.conn.Close()
+	var login LoginResult
+	if err := miner.call("login", LoginParams{Login: "wallet"}, &login); err != nil {
+		t.Fatal("Login failed: ", err)
+	}
+	if !contains(login.Extensions, "nicehash") {
+		t.Error("Unexpected extensions: ", login.Extensions)
+	}
+	// The prefix byte is left to proxies.
+	var status StatusResult
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "010000ab"}, &status); err != nil {
+		t.Error("Share rejected: ", err)
+	}
+	if err := miner.call("submit", SubmitParams{ID: login.ID, JobID: login.Job.JobID, Nonce: "010000ac"}, &status); err != nil {
+		t.Error("Share rejected: ", err)
+	}
+}
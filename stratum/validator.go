@@ -0,0 +1,230 @@
+package stratum
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"sync"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+)
+
+// A job handed to a worker, as a Validator tracks it.
+type ValidatorJob struct {
+	ID     string
+	Work   *Work
+	Worker string
+	// Share difficulty, for statistics, and the share target it stands
+	// for: a share's result must be at most Target.
+	Difficulty uint64
+	Target     *big.Int
+}
+
+// A share which passed validation.
+type Share struct {
+	Job    ValidatorJob
+	Nonce  uint64
+	Digest []byte
+	Result []byte
+	// Whether it solves the block, i.e. its result is at most the
+	// network target of the job's work.
+	Block bool
+}
+
+// Share statistics of a worker.
+type ShareStats struct {
+	Accepted uint64
+	// Sum of the difficulties of the accepted shares: about the hashes
+	// the worker computed, divided by a time span its hashrate.
+	AcceptedDifficulty uint64
+	Blocks             uint64
+	// All rejected shares, then by reason. Invalid counts unknown job
+	// ids and bad hashes.
+	Rejected      uint64
+	Stale         uint64
+	Duplicate     uint64
+	LowDifficulty uint64
+	Invalid       uint64
+}
+
+// Share rejections, as Monero pools word them.
+var (
+	ErrUnknownJob         = &Error{Code: CodeRejected, Message: "Invalid job id"}
+	ErrStaleShare         = &Error{Code: CodeRejected, Message: "Block expired"}
+	ErrDuplicateShare     = &Error{Code: CodeRejected, Message: "Duplicate share"}
+	ErrLowDifficultyShare = &Error{Code: CodeRejected, Message: "Low difficulty share"}
+	ErrBadHash            = &Error{Code: CodeRejected, Message: "Bad hash"}
+)
+
+// Outstanding jobs kept by default, see NewValidator.
+const DefaultValidatorJobs = 1 << 16
+
+// Checks shares against the jobs they were issued for, and keeps
+// per-worker statistics. Jobs are for the current Work; once a newer
+// one is set, their shares are rejected as stale.
+type Validator struct {
+	max_jobs int
+
+	mu        sync.Mutex
+	work      *Work
+	previous  *Work
+	jobs      map[string]*ValidatorJob
+	job_order []string
+	// Nonces submitted for the current work.
+	seen  map[uint64]struct{}
+	stats map[string]*ShareStats
+}
+
+// Returns a validator keeping at most max_jobs outstanding jobs
+// (DefaultValidatorJobs if 0), forgetting the oldest ones first.
+func NewValidator(max_jobs int) *Validator {
+	if max_jobs <= 0 {
+		max_jobs = DefaultValidatorJobs
+	}
+	return &Validator{
+		max_jobs: max_jobs,
+		jobs:     make(map[string]*ValidatorJob),
+		seen:     make(map[uint64]struct{}),
+		stats:    make(map[string]*ShareStats),
+	}
+}
+
+// Makes work the current work. Jobs of the previous one are kept to
+// tell stale shares from unknown jobs, older jobs are forgotten.
+func (v *Validator) SetWork(work *Work) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if work == v.work {
+		return
+	}
+	v.previous, v.work = v.work, work
+	v.seen = make(map[uint64]struct{})
+	order := v.job_order[:0]
+	for _, id := range v.job_order {
+		job := v.jobs[id]
+		if job.Work == v.work || job.Work == v.previous {
+			order = append(order, id)
+		} else {
+			delete(v.jobs, id)
+		}
+	}
+	v.job_order = order
+}
+
+// Starts tracking a job. Its ID must be new.
+func (v *Validator) AddJob(job ValidatorJob) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.jobs[job.ID] = &job
+	v.job_order = append(v.job_order, job.ID)
+	if len(v.job_order) > v.max_jobs {
+		delete(v.jobs, v.job_order[0])
+		v.job_order = v.job_order[1:]
+	}
+}
+
+// Validates worker's share of a job: the nonce (all 8 bytes), and the
+// digest the worker claims if not nil. Hashes with the work's
+// algorithm, which for CryptonightR is HashVariant4ForEthereumHeader.
+// Returns one of the ErrXxx *Error values if the share is rejected, or
+// ctx's error if it ends while waiting for a scratchpad.
+func (v *Validator) Validate(ctx context.Context, worker string, job_id string, nonce uint64, digest []byte) (Share, error) {
+	v.mu.Lock()
+	job := v.jobs[job_id]
+	if job == nil || job.Worker != worker {
+		v.reject(worker, ErrUnknownJob)
+		v.mu.Unlock()
+		return Share{}, ErrUnknownJob
+	}
+	if job.Work != v.work {
+		v.reject(worker, ErrStaleShare)
+		v.mu.Unlock()
+		return Share{}, ErrStaleShare
+	}
+	if _, seen := v.seen[nonce]; seen {
+		v.reject(worker, ErrDuplicateShare)
+		v.mu.Unlock()
+		return Share{}, ErrDuplicateShare
+	}
+	v.seen[nonce] = struct{}{}
+	v.mu.Unlock()
+
+	work := job.Work
+	actual_digest, result, err := cryptonight.HashAlgorithmForEthereumHeaderContext(ctx, work.Algorithm, work.HeaderHash, nonce, work.Height)
+	if err != nil {
+		v.mu.Lock()
+		delete(v.seen, nonce)
+		v.mu.Unlock()
+		return Share{}, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if digest != nil && !bytes.Equal(digest, actual_digest) {
+		v.reject(worker, ErrBadHash)
+		return Share{}, ErrBadHash
+	}
+	if !cryptonight.DigestMeetsTarget(actual_digest, job.Target) {
+		v.reject(worker, ErrLowDifficultyShare)
+		return Share{}, ErrLowDifficultyShare
+	}
+	share := Share{
+		Job:    *job,
+		Nonce:  nonce,
+		Digest: actual_digest,
+		Result: result,
+		Block:  cryptonight.DigestMeetsTarget(actual_digest, work.Target),
+	}
+	stats := v.workerStats(worker)
+	stats.Accepted++
+	stats.AcceptedDifficulty += job.Difficulty
+	if share.Block {
+		stats.Blocks++
+	}
+	return share, nil
+}
+
+// Counts a rejected share. Called with v.mu held.
+func (v *Validator) reject(worker string, err *Error) {
+	stats := v.workerStats(worker)
+	stats.Rejected++
+	switch err {
+	case ErrStaleShare:
+		stats.Stale++
+	case ErrDuplicateShare:
+		stats.Duplicate++
+	case ErrLowDifficultyShare:
+		stats.LowDifficulty++
+	default:
+		stats.Invalid++
+	}
+}
+
+func (v *Validator) workerStats(worker string) *ShareStats {
+	stats := v.stats[worker]
+	if stats == nil {
+		stats = &ShareStats{}
+		v.stats[worker] = stats
+	}
+	return stats
+}
+
+// Returns the statistics of a worker.
+func (v *Validator) WorkerStats(worker string) ShareStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if stats := v.stats[worker]; stats != nil {
+		return *stats
+	}
+	return ShareStats{}
+}
+
+// Returns the statistics of every worker seen so far.
+func (v *Validator) Stats() map[string]ShareStats {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	stats := make(map[string]ShareStats, len(v.stats))
+	for worker, worker_stats := range v.stats {
+		stats[worker] = *worker_stats
+	}
+	return stats
+}
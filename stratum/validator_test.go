@@ -0,0 +1,142 @@
+package stratum
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"gitlab.neji.vm.tc/marconi/go-ethereum/common/hexutil"
+)
+
+func TestValidator(t *testing.T) {
+	ctx := context.Background()
+	work := &Work{
+		HeaderHash: hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8"),
+		Height:     8111222,
+		Algorithm:  cryptonight.CNDevR,
+		Target:     new(big.Int).Lsh(big.NewInt(1), 254),
+	}
+	validator := NewValidator(0)
+	validator.SetWork(work)
+	any_share := new(big.Int).Lsh(big.NewInt(1), 256)
+	validator.AddJob(ValidatorJob{ID: "1", Work: work, Worker: "alice", Difficulty: 1, Target: any_share})
+	validator.AddJob(ValidatorJob{ID: "2", Work: work, Worker: "bob", Difficulty: 1 << 60, Target: new(big.Int).Lsh(big.NewInt(1), 196)})
+
+	// Find a nonce which solves the block and one which doesn't.
+	block_nonce, share_nonce := -1, -1
+	for nonce := 0; nonce < 64 && (block_nonce < 0 || share_nonce < 0); nonce++ {
+		_, result := cryptonight.HashAlgorithmForEthereumHeader(work.Algorithm, work.HeaderHash, uint64(nonce), work.Height)
+		if new(big.Int).SetBytes(result).Cmp(work.Target) <= 0 {
+			block_nonce = nonce
+		} else {
+			share_nonce = nonce
+		}
+	}
+	if block_nonce < 0 || share_nonce < 0 {
+		t.Fatal("No nonces found")
+	}
+
+	share, err := validator.Validate(ctx, "alice", "1", uint64(share_nonce), nil)
+	if err != nil || share.Block || share.Job.ID != "1" {
+		t.Error("Unexpected share: ", share, err)
+	}
+	expected_digest, expected_result := cryptonight.HashAlgorithmForEthereumHeader(work.Algorithm, work.HeaderHash, uint64(block_nonce), work.Height)
+	if _, err := validator.Validate(ctx, "alice", "1", uint64(block_nonce), make([]byte, 32)); err != ErrBadHash {
+		t.Error("Unexpected error: ", err)
+	}
+	// A bad hash still uses up the nonce.
+	if _, err := validator.Validate(ctx, "alice", "1", uint64(block_nonce), expected_digest); err != ErrDuplicateShare {
+		t.Error("Unexpected error: ", err)
+	}
+	if _, err := validator.Validate(ctx, "alice", "1", uint64(share_nonce), nil); err != ErrDuplicateShare {
+		t.Error("Unexpected error: ", err)
+	}
+	if _, err := validator.Validate(ctx, "alice", "2", 100, nil); err != ErrUnknownJob {
+		t.Error("Unexpected error: ", err)
+	}
+	if _, err := validator.Validate(ctx, "bob", "3", 100, nil); err != ErrUnknownJob {
+		t.Error("Unexpected error: ", err)
+	}
+	if _, err := validator.Validate(ctx, "bob", "2", 100, nil); err != ErrLowDifficultyShare {
+		t.Error("Unexpected error: ", err)
+	}
+
+	// New work: shares of the old jobs are stale, then unknown once
+	// their work is two works old.
+	next := *work
+	next.Height++
+	validator.SetWork(&next)
+	validator.AddJob(ValidatorJob{ID: "3", Work: &next, Worker: "alice", Difficulty: 2, Target: any_share})
+	if _, err := validator.Validate(ctx, "alice", "1", 101, nil); err != ErrStaleShare {
+		t.Error("Unexpected error: ", err)
+	}
+	next_digest, next_result := cryptonight.HashAlgorithmForEthereumHeader(next.Algorithm, next.HeaderHash, uint64(block_nonce), next.Height)
+	next_block := new(big.Int).SetBytes(next_result).Cmp(next.Target) <= 0
+	share, err = validator.Validate(ctx, "alice", "3", uint64(block_nonce), next_digest)
+	if err != nil || !bytes.Equal(share.Result, next_result) || share.Block != next_block {
+		t.Error("Unexpected share: ", hex.EncodeToString(share.Result), " ", err)
+	}
+	third := next
+	third.Height++
+	validator.SetWork(&third)
+	if _, err := validator.Validate(ctx, "alice", "1", 102, nil); err != ErrUnknownJob {
+		t.Error("Unexpected error: ", err)
+	}
+
+	// Block detection.
+	validator.SetWork(work)
+	validator.AddJob(ValidatorJob{ID: "4", Work: work, Worker: "alice", Difficulty: 1, Target: any_share})
+	share, err = validator.Validate(ctx, "alice", "4", uint64(block_nonce), expected_digest)
+	if err != nil || !share.Block || !bytes.Equal(share.Result, expected_result) {
+		t.Error("Unexpected share: ", hex.EncodeToString(share.Result), " ", err)
+	}
+
+	alice := validator.WorkerStats("alice")
+	expected_alice := ShareStats{Accepted: 3, AcceptedDifficulty: 4, Blocks: 1, Rejected: 6, Stale: 1, Duplicate: 2, Invalid: 3}
+	if next_block {
+		expected_alice.Blocks++
+	}
+	if alice != expected_alice {
+		t.Error("Unexpected stats: ", alice, " versus ", expected_alice)
+	}
+	if bob := validator.Stats()["bob"]; bob != (ShareStats{Rejected: 2, LowDifficulty: 1, Invalid: 1}) {
+		t.Error("Unexpected stats: ", bob)
+	}
+}
+
+// CryptonightR work is hashed as HashVariant4ForEthereumHeader does.
+func TestValidatorVariant4(t *testing.T) {
+	work := &Work{
+		HeaderHash: hexutil.MustDecode("0xb34f93a7c65392053cbbf073e9ad3bc7a7c0c3a45bfa0795f954b53686849db8"),
+		Height:     8111222,
+		Algorithm:  cryptonight.CNR,
+		Target:     big.NewInt(0),
+	}
+	validator := NewValidator(0)
+	validator.SetWork(work)
+	validator.AddJob(ValidatorJob{ID: "1", Work: work, Worker: "alice", Difficulty: 1, Target: new(big.Int).Lsh(big.NewInt(1), 256)})
+	var nonce uint64 = 0xc526c0a1000008dc
+	expected_digest, expected_result := cryptonight.HashVariant4ForEthereumHeader(work.HeaderHash, nonce, work.Height)
+	share, err := validator.Validate(context.Background(), "alice", "1", nonce, expected_digest)
+	if err != nil || share.Block || !bytes.Equal(share.Result, expected_result) {
+		t.Error("Unexpected share: ", hex.EncodeToString(share.Result), " ", err)
+	}
+}
+
+func TestValidatorMaxJobs(t *testing.T) {
+	work := &Work{HeaderHash: make([]byte, 32), Algorithm: cryptonight.CNDev2, Target: big.NewInt(0)}
+	validator := NewValidator(2)
+	validator.SetWork(work)
+	for _, id := range []string{"1", "2", "3"} {
+		validator.AddJob(ValidatorJob{ID: id, Work: work, Worker: "alice", Target: new(big.Int).Lsh(big.NewInt(1), 256)})
+	}
+	if _, err := validator.Validate(context.Background(), "alice", "1", 0, nil); err != ErrUnknownJob {
+		t.Error("Unexpected error: ", err)
+	}
+	if _, err := validator.Validate(context.Background(), "alice", "3", 0, nil); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+}
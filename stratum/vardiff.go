@@ -0,0 +1,114 @@
+package stratum
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// Settings of variable share difficulty: each miner's difficulty is
+// adjusted so that it submits a share about every TargetTime.
+type VarDiffConfig struct {
+	// Time between shares aimed at.
+	TargetTime time.Duration
+	// Time between retargets. The shares submitted in that time give
+	// the miner's average time between shares.
+	RetargetTime time.Duration
+	// Fraction of TargetTime the average may stray from it before the
+	// difficulty changes, in [0, 1). E.g. 0.3 for 7 to 13 seconds with a
+	// TargetTime of 10 seconds.
+	Variance float64
+	// Bounds of the difficulty, at least 1.
+	MinDifficulty uint64
+	MaxDifficulty uint64
+}
+
+// Settings suitable for CPU and GPU miners of full-size algorithms, a
+// share every 30 seconds.
+var DefaultVarDiffConfig = VarDiffConfig{
+	TargetTime:    30 * time.Second,
+	RetargetTime:  2 * time.Minute,
+	Variance:      0.3,
+	MinDifficulty: 100,
+	MaxDifficulty: 1 << 40,
+}
+
+func (config VarDiffConfig) Validate() error {
+	if config.TargetTime <= 0 || config.RetargetTime <= 0 {
+		return errors.New("stratum: vardiff times must be positive")
+	}
+	if config.Variance < 0 || config.Variance >= 1 {
+		return errors.New("stratum: vardiff variance out of range [0, 1)")
+	}
+	if config.MinDifficulty < 1 || config.MaxDifficulty < config.MinDifficulty {
+		return errors.New("stratum: vardiff difficulty bounds out of order")
+	}
+	return nil
+}
+
+// The variable difficulty of one miner. It only sees the times of its
+// shares, so any share validator can use it. Not safe for concurrent
+// use.
+type VarDiff struct {
+	config     VarDiffConfig
+	difficulty uint64
+	// Start of the current retarget window, and shares since.
+	since  time.Time
+	shares int
+}
+
+// Returns the variable difficulty of a miner starting at difficulty
+// (within the configured bounds) at time now. The configuration must
+// be valid.
+func NewVarDiff(config VarDiffConfig, difficulty uint64, now time.Time) *VarDiff {
+	v := &VarDiff{config: config, since: now}
+	v.difficulty = v.clamp(float64(difficulty))
+	return v
+}
+
+func (v *VarDiff) Difficulty() uint64 {
+	return v.difficulty
+}
+
+// Records a share accepted at time now, and retargets if it's time to.
+// Returns the difficulty and whether it changed.
+func (v *VarDiff) Share(now time.Time) (uint64, bool) {
+	v.shares++
+	return v.Retarget(now)
+}
+
+// Retargets if RetargetTime has passed since the last retarget, even
+// without shares: miners which are too slow to find any still get
+// their difficulty lowered, as if they'd found one right now. Returns
+// the difficulty and whether it changed.
+func (v *VarDiff) Retarget(now time.Time) (uint64, bool) {
+	elapsed := now.Sub(v.since)
+	if elapsed < v.config.RetargetTime {
+		return v.difficulty, false
+	}
+	shares := v.shares
+	if shares == 0 {
+		shares = 1
+	}
+	average := elapsed.Seconds() / float64(shares)
+	target := v.config.TargetTime.Seconds()
+	v.since = now
+	v.shares = 0
+	if math.Abs(average-target) <= target*v.config.Variance {
+		return v.difficulty, false
+	}
+	difficulty := v.clamp(float64(v.difficulty) * target / average)
+	changed := difficulty != v.difficulty
+	v.difficulty = difficulty
+	return difficulty, changed
+}
+
+func (v *VarDiff) clamp(difficulty float64) uint64 {
+	if difficulty <= float64(v.config.MinDifficulty) {
+		return v.config.MinDifficulty
+	}
+	if difficulty >= float64(v.config.MaxDifficulty) {
+		return v.config.MaxDifficulty
+	}
+	return uint64(math.Round(difficulty))
+}
@@ -0,0 +1,83 @@
+package stratum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVarDiff(t *testing.T) {
+	config := VarDiffConfig{
+		TargetTime:    10 * time.Second,
+		RetargetTime:  time.Minute,
+		Variance:      0.3,
+		MinDifficulty: 100,
+		MaxDifficulty: 100000,
+	}
+	start := time.Unix(1500000000, 0)
+	v := NewVarDiff(config, 1000, start)
+
+	// A share a second: nothing changes until the retarget time, then
+	// the difficulty goes 10 times up.
+	now := start
+	for i := 1; i < 60; i++ {
+		now = start.Add(time.Duration(i) * time.Second)
+		if difficulty, changed := v.Share(now); changed || difficulty != 1000 {
+			t.Fatal("Unexpected retarget to ", difficulty, " after ", i, " shares")
+		}
+	}
+	now = now.Add(time.Second)
+	if difficulty, changed := v.Share(now); !changed || difficulty != 10000 {
+		t.Error("Unexpected difficulty: ", difficulty, " ", changed)
+	}
+
+	// Within the variance, it stays.
+	for i := 0; i < 5; i++ {
+		now = now.Add(12 * time.Second)
+		v.Share(now)
+	}
+	if difficulty, changed := v.Retarget(now); changed || difficulty != 10000 {
+		t.Error("Unexpected difficulty: ", difficulty, " ", changed)
+	}
+
+	// No shares for 2 minutes: as slow as one share in 2 minutes.
+	now = now.Add(2 * time.Minute)
+	if difficulty, changed := v.Retarget(now); !changed || difficulty != 833 {
+		t.Error("Unexpected difficulty: ", difficulty, " ", changed)
+	}
+
+	// Bounds.
+	now = now.Add(time.Hour)
+	if difficulty, _ := v.Retarget(now); difficulty != 100 {
+		t.Error("Unexpected difficulty: ", difficulty)
+	}
+	for i := 0; i < 10000; i++ {
+		now = now.Add(10 * time.Millisecond)
+		v.Share(now)
+	}
+	if difficulty := v.Difficulty(); difficulty != 100000 {
+		t.Error("Unexpected difficulty: ", difficulty)
+	}
+	if difficulty := NewVarDiff(config, 1, start).Difficulty(); difficulty != 100 {
+		t.Error("Unexpected difficulty: ", difficulty)
+	}
+}
+
+func TestVarDiffConfigValidate(t *testing.T) {
+	if err := DefaultVarDiffConfig.Validate(); err != nil {
+		t.Error("Default config rejected: ", err)
+	}
+	invalid := []func(*VarDiffConfig){
+		func(c *VarDiffConfig) { c.TargetTime = 0 },
+		func(c *VarDiffConfig) { c.RetargetTime = -time.Second },
+		func(c *VarDiffConfig) { c.Variance = 1 },
+		func(c *VarDiffConfig) { c.MinDifficulty = 0 },
+		func(c *VarDiffConfig) { c.MaxDifficulty = c.MinDifficulty - 1 },
+	}
+	for i, modify := range invalid {
+		config := DefaultVarDiffConfig
+		modify(&config)
+		if err := config.Validate(); err == nil {
+			t.Error("Unexpected config accepted in case ", i, ": ", config)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package stratum
+
+import (
+	"context"
+	"errors"
+
+	cryptonight "github.com/MarconiProtocol/marconi-cryptonight"
+	"github.com/MarconiProtocol/marconi-cryptonight/internal/mining"
+)
+
+type WorkerConfig struct {
+	// Hashing threads, at least 1. Each thread keeps a scratchpad, see
+	// cryptonight.SetScratchpadLimit.
+	Threads int
+	// Hashes every job with this algorithm instead of the job's, if its
+	// Name isn't empty.
+	Algorithm cryptonight.Algorithm
+	// The miner nonces searched in every job, from FirstNonce to
+	// LastNonce, or to the last one if LastNonce is 0.
+	FirstNonce uint32
+	LastNonce  uint32
+}
+
+func (config WorkerConfig) Validate() error {
+	if config.Threads < 1 {
+		return errors.New("stratum: no threads")
+	}
+	if config.LastNonce != 0 && config.LastNonce < config.FirstNonce {
+		return errors.New("stratum: empty nonce range")
+	}
+	if config.Algorithm.Name != "" {
+		return config.Algorithm.Validate()
+	}
+	return nil
+}
+
+// Statistics of a Worker.
+type WorkerStats = mining.Stats
+
+// Searches nonces for the current job of a Client, hashing its blobs
+// with the job's algorithm, and submits the shares it finds.
+type Worker struct {
+	client *Client
+	config WorkerConfig
+	miner  *mining.Miner
+}
+
+func NewWorker(client *Client, config WorkerConfig) (*Worker, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.LastNonce == 0 {
+		config.LastNonce = ^uint32(0)
+	}
+	w := &Worker{client: client, config: config}
+	w.miner = mining.NewMiner(config.Threads, w.currentJob)
+	return w, nil
+}
+
+// Mines until ctx ends. Thread i hashes the nonces FirstNonce + i,
+// FirstNonce + i + Threads... of every job, until the job changes or
+// its nonces run out: those up to LastNonce, and below 2^24 for
+// NiceHash pools.
+func (w *Worker) Run(ctx context.Context) {
+	w.miner.Run(ctx)
+}
+
+func (w *Worker) Stats() WorkerStats {
+	return w.miner.Stats()
+}
+
+// Returns the statistics, and a channel closed as soon as a submitted
+// share's outcome changes them.
+func (w *Worker) CurrentStats() (WorkerStats, <-chan struct{}) {
+	return w.miner.CurrentStats()
+}
+
+// The client's current job to mine, nil if there's none or its nonces
+// are out of the configured range.
+func (w *Worker) currentJob() (*mining.Job, <-chan struct{}) {
+	job, changed := w.client.CurrentJob()
+	if job == nil {
+		return nil, changed
+	}
+	algorithm := job.Algorithm
+	if w.config.Algorithm.Name != "" {
+		algorithm = w.config.Algorithm
+	}
+	first, last := uint64(w.config.FirstNonce), uint64(w.config.LastNonce)
+	var prefix uint64
+	if job.NiceHash {
+		if last > 1<<24-1 {
+			last = 1<<24 - 1
+		}
+		prefix = uint64(job.Blob[42]) << 24
+	}
+	if first > last {
+		return nil, changed
+	}
+	return &mining.Job{
+		Blob:       job.Blob,
+		NonceSize:  4,
+		Algorithm:  algorithm,
+		Height:     job.Height,
+		FirstNonce: prefix | first,
+		LastNonce:  prefix | last,
+		IsSolution: job.IsShare,
+		Submit: func(ctx context.Context, nonce uint64, digest []byte) mining.Outcome {
+			return w.submit(ctx, job, uint32(nonce), digest)
+		},
+	}, changed
+}
+
+func (w *Worker) submit(ctx context.Context, job *ClientJob, nonce uint32, digest []byte) mining.Outcome {
+	switch err := w.client.Submit(ctx, job, nonce, digest); err {
+	case nil:
+		return mining.Accepted
+	case ErrStaleJob:
+		return mining.Stale
+	default:
+		if _, rejected := err.(*Error); rejected {
+			return mining.Rejected
+		}
+		return mining.Stale
+	}
+}
@@ -0,0 +1,139 @@
+package cryptonight
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/big"
+)
+
+// Our chain, like Ethereum, accepts a nonce if its result (the digest
+// reversed, read big endian) is at most the target 2^256 / difficulty.
+// Monero-style miners compare the last 8 bytes of the digest, read
+// little endian, which are the first 8 bytes of the result, to a
+// compact target from their job:
+//
+// - 8 bytes: the compact target T64 itself, the digest passes if those
+//   bytes are below T64.
+// - 4 bytes T32: expanded to T64 = 0xFFFFFFFFFFFFFFFF / (0xFFFFFFFF /
+//   T32), see Compact32ToCompact64.
+//
+// The functions below convert between the three, and check digests
+// with a 64 bit comparison first.
+
+var two256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// Returns 2^256 / difficulty. The difficulty must be positive.
+func DifficultyToTarget(difficulty *big.Int) *big.Int {
+	return new(big.Int).Div(two256, difficulty)
+}
+
+// Returns 2^256 / target, the inverse of DifficultyToTarget up to
+// rounding. The target must be positive.
+func TargetToDifficulty(target *big.Int) *big.Int {
+	return new(big.Int).Div(two256, target)
+}
+
+// Returns the 64 bit compact target of a target: the first 8 bytes of
+// the largest result meeting it, all ones for targets of 2^256 and
+// above. Digests passing the compact target meet the target, and the
+// only results meeting the target that fail it start with the compact
+// target's 8 bytes.
+func TargetToCompact64(target *big.Int) uint64 {
+	largest := new(big.Int).Sub(target, big.NewInt(1))
+	if largest.Sign() < 0 {
+		return 0
+	}
+	if largest.BitLen() > 256 {
+		return math.MaxUint64
+	}
+	return new(big.Int).Rsh(largest, 192).Uint64()
+}
+
+// Returns the 32 bit compact target of a target, as Monero pools
+// compute it: the first 4 bytes of the largest result meeting it. It
+// expands to about the same 64 bit compact target, within a relative
+// error of 1 / (the 32 bit compact target).
+func TargetToCompact32(target *big.Int) uint32 {
+	return uint32(TargetToCompact64(target) >> 32)
+}
+
+// Expands a 32 bit compact target as xmrig does. 0 expands to 0, which
+// no digest passes.
+func Compact32ToCompact64(compact uint32) uint64 {
+	if compact == 0 {
+		return 0
+	}
+	return math.MaxUint64 / uint64(math.MaxUint32/compact)
+}
+
+// Returns the target which results meet exactly when their digest
+// passes the 64 bit compact target: compact * 2^192 - 1.
+func Compact64ToTarget(compact uint64) *big.Int {
+	target := new(big.Int).Lsh(new(big.Int).SetUint64(compact), 192)
+	return target.Sub(target, big.NewInt(1))
+}
+
+// The 64 bit pre-check of miners: whether the last 8 bytes of the raw
+// 32 byte digest, read little endian, are below the 64 bit compact
+// target.
+func DigestPassesCompact64(digest []byte, compact uint64) bool {
+	return binary.LittleEndian.Uint64(digest[24:]) < compact
+}
+
+// Whether the result of the raw 32 byte digest is at most target.
+// Decides from the last 8 bytes of the digest alone unless they match
+// the target's first 8 bytes, which is rare.
+func DigestMeetsTarget(digest []byte, target *big.Int) bool {
+	if target.Sign() <= 0 {
+		return false
+	}
+	if target.BitLen() > 256 {
+		return true
+	}
+	high := binary.LittleEndian.Uint64(digest[24:])
+	target_high := new(big.Int).Rsh(target, 192).Uint64()
+	if high != target_high {
+		return high < target_high
+	}
+	return new(big.Int).SetBytes(littleEndianResult(digest)).Cmp(target) <= 0
+}
+
+// Returns the 64 bit compact target miners compare digests to for a
+// target, and its encoding in Stratum job messages, little endian hex:
+// 4 bytes while the target's difficulty fits in them, which every
+// miner supports, 8 bytes above.
+func EncodeCompactTarget(target *big.Int) (uint64, string) {
+	if target.Sign() > 0 {
+		difficulty := TargetToDifficulty(target)
+		if difficulty.IsUint64() && difficulty.Uint64() <= math.MaxUint32 {
+			compact := TargetToCompact32(target)
+			var bytes [4]byte
+			binary.LittleEndian.PutUint32(bytes[:], compact)
+			return Compact32ToCompact64(compact), hex.EncodeToString(bytes[:])
+		}
+	}
+	compact := TargetToCompact64(target)
+	var bytes [8]byte
+	binary.LittleEndian.PutUint64(bytes[:], compact)
+	return compact, hex.EncodeToString(bytes[:])
+}
+
+// Returns the 64 bit compact target of an encoded one, see
+// EncodeCompactTarget.
+func DecodeCompactTarget(compact string) (uint64, error) {
+	bytes, err := hex.DecodeString(compact)
+	if err != nil {
+		return 0, errors.New("cryptonight: invalid compact target " + compact)
+	}
+	switch len(bytes) {
+	case 4:
+		if compact32 := binary.LittleEndian.Uint32(bytes); compact32 != 0 {
+			return Compact32ToCompact64(compact32), nil
+		}
+	case 8:
+		return binary.LittleEndian.Uint64(bytes), nil
+	}
+	return 0, errors.New("cryptonight: invalid compact target " + compact)
+}
@@ -0,0 +1,118 @@
+package cryptonight
+
+import (
+	"encoding/hex"
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+func TestDifficultyTargetConversions(t *testing.T) {
+	cases := []struct {
+		difficulty uint64
+		compact64  uint64
+		compact32  uint32
+	}{
+		{1, 0xFFFFFFFFFFFFFFFF, 0xFFFFFFFF},
+		{2, 0x7FFFFFFFFFFFFFFF, 0x7FFFFFFF},
+		{1000, 0x004189374BC6A7EF, 0x00418937},
+		{1 << 32, 0xFFFFFFFF, 0},
+		{math.MaxUint64, 1, 0},
+	}
+	for _, c := range cases {
+		difficulty := new(big.Int).SetUint64(c.difficulty)
+		target := DifficultyToTarget(difficulty)
+		if TargetToDifficulty(target).Cmp(difficulty) != 0 {
+			t.Error("Unexpected round trip: ", TargetToDifficulty(target), " versus ", c.difficulty)
+		}
+		if compact64 := TargetToCompact64(target); compact64 != c.compact64 {
+			t.Error("Unexpected compact64 for difficulty ", c.difficulty, ": ", compact64, " versus ", c.compact64)
+		}
+		if compact32 := TargetToCompact32(target); compact32 != c.compact32 {
+			t.Error("Unexpected compact32 for difficulty ", c.difficulty, ": ", compact32, " versus ", c.compact32)
+		}
+	}
+	if compact := Compact32ToCompact64(0x7FFFFFFF); compact != 0x7FFFFFFFFFFFFFFF {
+		t.Error("Unexpected expansion: ", compact, " versus ", uint64(0x7FFFFFFFFFFFFFFF))
+	}
+	if compact := Compact32ToCompact64(0x418937); compact != 0x4189374BC6A7EF {
+		t.Error("Unexpected expansion: ", compact, " versus ", uint64(0x4189374BC6A7EF))
+	}
+	if Compact32ToCompact64(0) != 0 || TargetToCompact64(big.NewInt(0)) != 0 {
+		t.Error("Unexpected zero target")
+	}
+	if expected, _ := new(big.Int).SetString("ffffffffffffffffffffffffffffffffffffffffffffffffff", 16); Compact64ToTarget(1<<8).Cmp(expected) != 0 {
+		t.Error("Unexpected target ", Compact64ToTarget(1<<8).Text(16))
+	}
+}
+
+// The 64 bit checks agree with the big integer comparison of the
+// result, including when the first 8 bytes of result and target match.
+func TestDigestChecks(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	digest := make([]byte, 32)
+	for i := 0; i < 10000; i++ {
+		random.Read(digest)
+		result := new(big.Int).SetBytes(littleEndianResult(digest))
+		var target *big.Int
+		switch i % 4 {
+		case 0:
+			target = new(big.Int).Rand(random, two256)
+		case 1:
+			// Same first 8 bytes as the result.
+			target = new(big.Int).Rand(random, new(big.Int).Lsh(big.NewInt(1), 192))
+			target.Or(target, new(big.Int).Lsh(new(big.Int).Rsh(result, 192), 192))
+		case 2:
+			target = new(big.Int).Set(result)
+		case 3:
+			target = DifficultyToTarget(big.NewInt(1 + random.Int63n(1000)))
+		}
+		expected := result.Cmp(target) <= 0
+		if DigestMeetsTarget(digest, target) != expected {
+			t.Fatal("Unexpected check of ", hex.EncodeToString(digest), " against ", target.Text(16), ": ", !expected, " versus ", expected)
+		}
+		compact := TargetToCompact64(target)
+		if DigestPassesCompact64(digest, compact) && !expected {
+			t.Fatal("Unexpected compact check of ", hex.EncodeToString(digest), " against ", target.Text(16))
+		}
+		if DigestPassesCompact64(digest, compact) != (result.Cmp(Compact64ToTarget(compact)) <= 0) {
+			t.Fatal("Unexpected compact check of ", hex.EncodeToString(digest), " against ", compact, " versus Compact64ToTarget")
+		}
+	}
+	if DigestMeetsTarget(digest, big.NewInt(0)) || !DigestMeetsTarget(digest, two256) {
+		t.Error("Unexpected edge targets")
+	}
+}
+
+func TestCompactTargetEncoding(t *testing.T) {
+	cases := []struct {
+		difficulty uint64
+		target64   uint64
+		compact    string
+	}{
+		{1, 0xFFFFFFFFFFFFFFFF, "ffffffff"},
+		{2, 0x7FFFFFFFFFFFFFFF, "ffffff7f"},
+		{1000, 0x4189374BC6A7EF, "37894100"},
+		{1 << 32, 0xFFFFFFFF, "ffffffff00000000"},
+	}
+	for _, c := range cases {
+		target64, compact := EncodeCompactTarget(DifficultyToTarget(new(big.Int).SetUint64(c.difficulty)))
+		if target64 != c.target64 || compact != c.compact {
+			t.Error("Unexpected encoding for difficulty ", c.difficulty, ": ", target64, " ", compact, " versus ", c.target64, " ", c.compact)
+		}
+	}
+
+	for _, difficulty := range []uint64{1, 2, 1000, 123456789, 1 << 32, 1 << 50} {
+		target64, compact := EncodeCompactTarget(DifficultyToTarget(new(big.Int).SetUint64(difficulty)))
+		decoded, err := DecodeCompactTarget(compact)
+		if err != nil || decoded != target64 {
+			t.Error("Unexpected decoding of ", compact, ": ", decoded, " versus ", target64, " (", err, ")")
+		}
+	}
+	for _, compact := range []string{"", "00000000", "ffff", "ffffffffff", "zzzzzzzz"} {
+		if _, err := DecodeCompactTarget(compact); err == nil {
+			t.Error("Unexpected compact target accepted: \"", compact, "\"")
+		}
+	}
+}
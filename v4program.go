@@ -0,0 +1,163 @@
+package cryptonight
+
+/*
+#include <string.h>
+#include "hash-ops.h"
+#include "variant4_random_math.h"
+
+// Runs a program on registers R0-R8, widened to 64 bits so Go can hold
+// them whatever the register size
+static void v4_run_program(const struct V4_Instruction* code, uint64_t* r, int reg64)
+{
+	if (reg64)
+	{
+		v4_random_math64(code, r);
+		return;
+	}
+	v4_reg r32[9];
+	for (int i = 0; i < 9; ++i)
+		r32[i] = (v4_reg)r[i];
+	v4_random_math(code, r32);
+	for (int i = 0; i < 9; ++i)
+		r[i] = r32[i];
+}
+*/
+import "C"
+
+// Operations of variant 4's random math, in the order of
+// V4_InstructionList in variant4_random_math.h.
+type V4Opcode uint8
+
+const (
+	V4Mul V4Opcode = C.MUL // a*b
+	V4Add V4Opcode = C.ADD // a+b + C, C is an unsigned 32-bit constant
+	V4Sub V4Opcode = C.SUB // a-b
+	V4Ror V4Opcode = C.ROR // rotate right "a" by "b & 31" bits
+	V4Rol V4Opcode = C.ROL // rotate left "a" by "b & 31" bits
+	V4Xor V4Opcode = C.XOR // a^b
+	V4Ret V4Opcode = C.RET // finish execution
+
+	V4OpcodeCount = int(C.V4_INSTRUCTION_COUNT) // number of opcodes other than RET
+)
+
+func (opcode V4Opcode) String() string {
+	switch opcode {
+	case V4Mul:
+		return "MUL"
+	case V4Add:
+		return "ADD"
+	case V4Sub:
+		return "SUB"
+	case V4Ror:
+		return "ROR"
+	case V4Rol:
+		return "ROL"
+	case V4Xor:
+		return "XOR"
+	case V4Ret:
+		return "RET"
+	}
+	return "???"
+}
+
+// What the program generator knows about one random math program.
+// Latencies are in cycles; the CPU is the abstract one the generator
+// schedules instructions for (one multiplier, three ALUs with the
+// default settings), the ASIC is a theoretical one with unlimited
+// ALUs and 1 cycle latency for everything but MUL. See
+// v4_random_math_init in variant4_random_math.h for the details.
+type V4ProgramStats struct {
+	// Number of instructions, excluding the final RET.
+	Instructions int
+	// Instruction mix, indexed by V4Opcode.
+	OpcodeCounts [V4OpcodeCount]int
+	// How many of the instructions are ROR/MUL appended at the end
+	// to make the program slow enough for the ASIC.
+	ASICPadding int
+	// Critical path of the program, the highest of the register
+	// latencies below.
+	CPULatency  int
+	ASICLatency int
+	// Latency of registers R0-R3 at the end of the program.
+	RegisterLatency     [4]int
+	RegisterASICLatency [4]int
+	// Instructions the generator scheduled on each ALU of the
+	// abstract CPU (the ASIC padding isn't scheduled). The first
+	// V4Config.ALUCountMul ALUs are the ones that can multiply.
+	ALUInstructions []int
+	// Bit i of RegistersRead is set if register Ri is used as a
+	// source by the program, bit i of RegistersWritten if it's used
+	// as a destination. Every instruction also reads its
+	// destination, but that only counts in RegistersWritten.
+	RegistersRead    uint16
+	RegistersWritten uint16
+	// Whether the program reads R8. Monero's generator retries until
+	// it does, but with unusual settings it can give up.
+	R8Used bool
+	// Number of programs generated and discarded (because R8 was
+	// unused or the size was out of bounds) before this one.
+	Retries int
+}
+
+// Generates the variant 4 program for the given block height with
+// the default settings, and reports its statistics. If a SeedPolicy
+// is in use, pass its ProgramSeed instead of the height.
+func AnalyzeV4Program(block_height uint64) V4ProgramStats {
+	return (*Hasher)(nil).AnalyzeV4Program(block_height)
+}
+
+// Same as AnalyzeV4Program, but with the Hasher's program generator
+// settings.
+func (h *Hasher) AnalyzeV4Program(block_height uint64) V4ProgramStats {
+	_, stats := h.generateV4Program(block_height)
+	return stats
+}
+
+func (h *Hasher) generateV4Program(block_height uint64) ([]C.struct_V4_Instruction, V4ProgramStats) {
+	v4_config := DefaultV4Config
+	c_v4_config := default_c_v4_config
+	if h != nil {
+		v4_config = h.v4_config
+		c_v4_config = h.c_v4_config
+	}
+	code := make([]C.struct_V4_Instruction, C.V4_MAX_INSTRUCTIONS+1)
+	var c_stats C.struct_V4_Stats
+	code_size := C.v4_random_math_init_stats(&code[0], C.uint64_t(block_height), &c_v4_config, &c_stats)
+
+	stats := V4ProgramStats{
+		Instructions:     int(c_stats.code_size),
+		ASICPadding:      int(c_stats.asic_padding),
+		ALUInstructions:  make([]int, v4_config.ALUCount),
+		RegistersRead:    uint16(c_stats.registers_read),
+		RegistersWritten: uint16(c_stats.registers_written),
+		R8Used:           c_stats.registers_read&(1<<8) != 0,
+		Retries:          int(c_stats.retries),
+	}
+	for i := range stats.OpcodeCounts {
+		stats.OpcodeCounts[i] = int(c_stats.opcode_count[i])
+	}
+	for i := 0; i < 4; i++ {
+		stats.RegisterLatency[i] = int(c_stats.latency[i])
+		stats.RegisterASICLatency[i] = int(c_stats.asic_latency[i])
+		if stats.RegisterLatency[i] > stats.CPULatency {
+			stats.CPULatency = stats.RegisterLatency[i]
+		}
+		if stats.RegisterASICLatency[i] > stats.ASICLatency {
+			stats.ASICLatency = stats.RegisterASICLatency[i]
+		}
+	}
+	for i := range stats.ALUInstructions {
+		stats.ALUInstructions[i] = int(c_stats.alu_ops[i])
+	}
+	return code[:code_size+1], stats
+}
+
+// Runs the interpreter on the program for block_height, the way
+// variant 4's main loop does.
+func (h *Hasher) runV4Program(block_height uint64, registers *[9]uint64) {
+	code, _ := h.generateV4Program(block_height)
+	reg64 := h != nil && h.v4_config.RegisterBits == 64
+	C.v4_run_program(&code[0], (*C.uint64_t)(&registers[0]), boolToCInt(reg64))
+}
+
+var default_c_v4_config = DefaultV4Config.toC()
@@ -0,0 +1,81 @@
+package cryptonight
+
+import (
+	"testing"
+)
+
+func checkV4ProgramStats(t *testing.T, config V4Config, block_height uint64, stats V4ProgramStats) {
+	if stats.Instructions < config.InstructionsMin || stats.Instructions > config.InstructionsMax {
+		t.Error("Unexpected instruction count at height ", block_height, ": ", stats.Instructions, " versus ", config.InstructionsMin, "-", config.InstructionsMax)
+	}
+	total := 0
+	for _, count := range stats.OpcodeCounts {
+		total += count
+	}
+	if total != stats.Instructions {
+		t.Error("Unexpected opcode count total at height ", block_height, ": ", total, " versus ", stats.Instructions)
+	}
+	scheduled := 0
+	for _, count := range stats.ALUInstructions {
+		scheduled += count
+	}
+	if scheduled+stats.ASICPadding != stats.Instructions {
+		t.Error("Unexpected scheduled and padding instructions at height ", block_height, ": ", scheduled, "+", stats.ASICPadding, " versus ", stats.Instructions)
+	}
+	// The generator keeps going until it reaches the ASIC latency, or
+	// runs out of instructions.
+	if stats.ASICLatency < config.TotalLatency && stats.Instructions < config.InstructionsMax {
+		t.Error("Unexpected ASIC latency at height ", block_height, ": ", stats.ASICLatency, " versus ", config.TotalLatency)
+	}
+	for i := 0; i < 4; i++ {
+		if stats.RegisterLatency[i] < stats.RegisterASICLatency[i] {
+			t.Error("Unexpected latency of R", i, " at height ", block_height, ": ", stats.RegisterLatency[i], " versus ", stats.RegisterASICLatency[i], " on the ASIC")
+		}
+	}
+	if stats.RegistersWritten&^0xF != 0 || stats.RegistersRead&^0x1FF != 0 {
+		t.Error("Unexpected registers at height ", block_height, ": read ", stats.RegistersRead, ", written ", stats.RegistersWritten)
+	}
+	if !stats.R8Used {
+		t.Error("R8 unused at height ", block_height)
+	}
+}
+
+func TestAnalyzeV4Program(t *testing.T) {
+	retries := 0
+	for block_height := uint64(1806260); block_height < 1806260+500; block_height++ {
+		stats := AnalyzeV4Program(block_height)
+		checkV4ProgramStats(t, DefaultV4Config, block_height, stats)
+		if stats.CPULatency < DefaultV4Config.TotalLatency {
+			t.Error("Unexpected CPU latency at height ", block_height, ": ", stats.CPULatency, " versus ", DefaultV4Config.TotalLatency)
+		}
+		// Only the first ALU can multiply, apart from the padding at
+		// the end which isn't scheduled.
+		if stats.OpcodeCounts[V4Mul] > stats.ALUInstructions[0]+stats.ASICPadding {
+			t.Error("Unexpected MUL count at height ", block_height, ": ", stats.OpcodeCounts[V4Mul], " versus ", stats.ALUInstructions[0], " instructions on the first ALU")
+		}
+		retries += stats.Retries
+	}
+	// About 1.85% of programs need a retry, see variant4_random_math.h.
+	if retries == 0 || retries > 50 {
+		t.Error("Unexpected retries for 500 programs: ", retries)
+	}
+}
+
+func TestHasherAnalyzeV4Program(t *testing.T) {
+	config := DefaultV4Config
+	config.TotalLatency = 90
+	config.InstructionsMin = 120
+	config.InstructionsMax = 140
+	config.ALUCount = 4
+	hasher, err := NewHasher(config)
+	if err != nil {
+		t.Fatal("Config rejected: ", err)
+	}
+	for block_height := uint64(0); block_height < 100; block_height++ {
+		stats := hasher.AnalyzeV4Program(block_height)
+		checkV4ProgramStats(t, config, block_height, stats)
+		if len(stats.ALUInstructions) != 4 {
+			t.Error("Unexpected ALU count at height ", block_height, ": ", len(stats.ALUInstructions), " versus ", 4)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package cryptonight
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Languages GenerateV4Source can emit a random math program in.
+type V4SourceLanguage int
+
+const (
+	// C99, registers are uint32_t (uint64_t for 64 bit configs).
+	V4SourceC V4SourceLanguage = iota
+	// OpenCL C, registers are uint (ulong for 64 bit configs).
+	V4SourceOpenCL
+)
+
+func (language V4SourceLanguage) String() string {
+	switch language {
+	case V4SourceC:
+		return "C"
+	case V4SourceOpenCL:
+		return "OpenCL"
+	}
+	return fmt.Sprintf("V4SourceLanguage(%d)", int(language))
+}
+
+// Translates the variant 4 program for the given block height (or
+// SeedPolicy.ProgramSeed) into straight-line source code, one statement
+// per instruction, for GPU kernels and other miners that can't use the
+// interpreter. The statements work on variables r0 to r8, which the
+// surrounding code declares and initializes the way variant 4's main
+// loop does: r0-r3 carry over between iterations, r4-r8 are the inputs.
+func GenerateV4Source(block_height uint64, language V4SourceLanguage) string {
+	return (*Hasher)(nil).GenerateV4Source(block_height, language)
+}
+
+// Same as GenerateV4Source, but with the Hasher's program generator
+// settings.
+func (h *Hasher) GenerateV4Source(block_height uint64, language V4SourceLanguage) string {
+	v4_config := DefaultV4Config
+	if h != nil {
+		v4_config = h.v4_config
+	}
+	shift_mask := v4_config.RegisterBits - 1
+	code, stats := h.generateV4Program(block_height)
+
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "// CryptonightR program for seed %d, %d instructions, %d bit registers\n", block_height, stats.Instructions, v4_config.RegisterBits)
+	for _, op := range code {
+		opcode := V4Opcode(op.opcode)
+		dst := fmt.Sprintf("r%d", op.dst_index)
+		src := fmt.Sprintf("r%d", op.src_index)
+		switch {
+		case opcode == V4Mul:
+			fmt.Fprintf(&source, "%s *= %s;\n", dst, src)
+		case opcode == V4Add:
+			fmt.Fprintf(&source, "%s += %s + 0x%08xU;\n", dst, src, uint32(op.C))
+		case opcode == V4Sub:
+			fmt.Fprintf(&source, "%s -= %s;\n", dst, src)
+		case opcode == V4Xor:
+			fmt.Fprintf(&source, "%s ^= %s;\n", dst, src)
+		// OpenCL's rotate() is a left rotation that takes the amount
+		// modulo the register size.
+		case opcode == V4Ror && language == V4SourceOpenCL:
+			fmt.Fprintf(&source, "%s = rotate(%s, -%s);\n", dst, dst, src)
+		case opcode == V4Rol && language == V4SourceOpenCL:
+			fmt.Fprintf(&source, "%s = rotate(%s, %s);\n", dst, dst, src)
+		case opcode == V4Ror:
+			fmt.Fprintf(&source, "%s = (%s >> (%s & %d)) | (%s << ((%d - %s) & %d));\n", dst, dst, src, shift_mask, dst, shift_mask+1, src, shift_mask)
+		case opcode == V4Rol:
+			fmt.Fprintf(&source, "%s = (%s << (%s & %d)) | (%s >> ((%d - %s) & %d));\n", dst, dst, src, shift_mask, dst, shift_mask+1, src, shift_mask)
+		}
+	}
+	return source.String()
+}
@@ -0,0 +1,151 @@
+package cryptonight
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Compiles the C source of the programs for the given heights with
+// the host compiler, runs each on random registers and compares the
+// result with the interpreter.
+func checkV4SourceC(t *testing.T, h *Hasher, heights []uint64) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler: ", err)
+	}
+	register_type := "uint32_t"
+	if h != nil && h.v4_config.RegisterBits == 64 {
+		register_type = "uint64_t"
+	}
+
+	var program bytes.Buffer
+	fmt.Fprintf(&program, "#include <inttypes.h>\n#include <stdio.h>\n\ntypedef %s v4_reg;\n\n", register_type)
+	for i, block_height := range heights {
+		fmt.Fprintf(&program, "static void program_%d(uint64_t* r)\n{\n", i)
+		fmt.Fprintf(&program, "\tv4_reg r0 = r[0], r1 = r[1], r2 = r[2], r3 = r[3], r4 = r[4], r5 = r[5], r6 = r[6], r7 = r[7], r8 = r[8];\n")
+		for _, line := range strings.Split(strings.TrimSpace(h.GenerateV4Source(block_height, V4SourceC)), "\n") {
+			fmt.Fprintf(&program, "\t%s\n", line)
+		}
+		fmt.Fprintf(&program, "\tr[0] = r0; r[1] = r1; r[2] = r2; r[3] = r3;\n}\n\n")
+	}
+	// Reads "program r0 ... r8" lines, prints R0-R3 after running the
+	// program.
+	fmt.Fprintf(&program, "int main(void)\n{\n\tint index;\n\tuint64_t r[9];\n")
+	fmt.Fprintf(&program, "\twhile (scanf(\"%%d\"")
+	for i := 0; i < 9; i++ {
+		fmt.Fprintf(&program, " \"%%\" SCNu64")
+	}
+	fmt.Fprintf(&program, ", &index")
+	for i := 0; i < 9; i++ {
+		fmt.Fprintf(&program, ", &r[%d]", i)
+	}
+	fmt.Fprintf(&program, ") == 10)\n\t{\n\t\tswitch (index)\n\t\t{\n")
+	for i := range heights {
+		fmt.Fprintf(&program, "\t\tcase %d: program_%d(r); break;\n", i, i)
+	}
+	fmt.Fprintf(&program, "\t\t}\n\t\tprintf(\"%%\" PRIu64 \" %%\" PRIu64 \" %%\" PRIu64 \" %%\" PRIu64 \"\\n\", r[0], r[1], r[2], r[3]);\n\t}\n\treturn 0;\n}\n")
+
+	dir, err := ioutil.TempDir("", "v4source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source_path := filepath.Join(dir, "program.c")
+	binary_path := filepath.Join(dir, "program")
+	if err := ioutil.WriteFile(source_path, program.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command(cc, "-std=c99", "-O1", "-o", binary_path, source_path).CombinedOutput(); err != nil {
+		t.Fatal("Compilation failed: ", err, "\n", string(output))
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	var input, expected bytes.Buffer
+	for i, block_height := range heights {
+		for n := 0; n < 8; n++ {
+			var registers [9]uint64
+			fmt.Fprintf(&input, "%d", i)
+			for j := range registers {
+				registers[j] = rng.Uint64()
+				if register_type == "uint32_t" {
+					registers[j] = uint64(uint32(registers[j]))
+				}
+				fmt.Fprintf(&input, " %d", registers[j])
+			}
+			fmt.Fprintln(&input)
+			h.runV4Program(block_height, &registers)
+			fmt.Fprintf(&expected, "%d %d %d %d\n", registers[0], registers[1], registers[2], registers[3])
+		}
+	}
+	cmd := exec.Command(binary_path)
+	cmd.Stdin = &input
+	actual, err := cmd.Output()
+	if err != nil {
+		t.Fatal("Program failed: ", err)
+	}
+	actual_lines := strings.Split(string(actual), "\n")
+	expected_lines := strings.Split(expected.String(), "\n")
+	if len(actual_lines) != len(expected_lines) {
+		t.Fatal("Unexpected output length: ", len(actual_lines), " versus ", len(expected_lines))
+	}
+	for i := range expected_lines {
+		if actual_lines[i] != expected_lines[i] {
+			t.Error("Height ", heights[i/8], ": unexpected registers ", actual_lines[i], " versus ", expected_lines[i])
+		}
+	}
+}
+
+func TestGenerateV4SourceC(t *testing.T) {
+	var heights []uint64
+	for block_height := uint64(1806260); block_height < 1806260+32; block_height++ {
+		heights = append(heights, block_height)
+	}
+	checkV4SourceC(t, nil, heights)
+}
+
+func TestHasherGenerateV4SourceC(t *testing.T) {
+	config := DefaultV4Config
+	config.InstructionsMin = 100
+	config.InstructionsMax = 120
+	config.RegisterBits = 64
+	hasher, err := NewHasher(config)
+	if err != nil {
+		t.Fatal("Config rejected: ", err)
+	}
+	checkV4SourceC(t, hasher, []uint64{0, 1, 1806260, 8111222})
+}
+
+func TestGenerateV4SourceOpenCL(t *testing.T) {
+	stats := AnalyzeV4Program(1806260)
+	source := GenerateV4Source(1806260, V4SourceOpenCL)
+	lines := strings.Split(strings.TrimSpace(source), "\n")
+	if len(lines) != stats.Instructions+1 {
+		t.Fatal("Unexpected line count: ", len(lines), " versus ", stats.Instructions+1)
+	}
+	rotations := 0
+	for _, line := range lines[1:] {
+		if strings.Contains(line, "rotate(") {
+			rotations++
+		}
+		if strings.Contains(line, ">>") || strings.Contains(line, "<<") {
+			t.Error("Shift in OpenCL source: ", line)
+		}
+	}
+	if rotations != stats.OpcodeCounts[V4Ror]+stats.OpcodeCounts[V4Rol] {
+		t.Error("Unexpected rotation count: ", rotations, " versus ", stats.OpcodeCounts[V4Ror]+stats.OpcodeCounts[V4Rol])
+	}
+	// Everything but the rotations is the same as in C.
+	c_lines := strings.Split(strings.TrimSpace(GenerateV4Source(1806260, V4SourceC)), "\n")
+	for i := range lines {
+		if !strings.Contains(lines[i], "rotate(") && lines[i] != c_lines[i] {
+			t.Error("Unexpected line: ", lines[i], " versus ", c_lines[i])
+		}
+	}
+}
@@ -1,7 +1,8 @@
 #ifndef VARIANT4_RANDOM_MATH_H
 #define VARIANT4_RANDOM_MATH_H
 
-// Register size can be configured to either 32 bit (uint32_t) or 64 bit (uint64_t)
+// Register size of the default configuration. V4_Config.reg_bits can switch
+// to 64 bit registers at runtime, those are interpreted by v4_random_math64
 typedef uint32_t v4_reg;
 
 enum V4_Settings
@@ -24,6 +25,44 @@ enum V4_Settings
 	ALU_COUNT = 3,
 };
 
+// Upper bounds for every V4_Config, they size the generator's scratch arrays
+// and the "code" arrays passed to v4_random_math_init_config
+enum V4_Limits
+{
+	V4_MAX_TOTAL_LATENCY = 256,
+	V4_MAX_INSTRUCTIONS = 256,
+	V4_MAX_ALU_COUNT = 8,
+
+	// The generator retries until R8 is used and the program is long enough.
+	// With the default settings it never needs more than 4 attempts, this only
+	// guarantees termination for unusual configurations
+	V4_MAX_ATTEMPTS = 1024,
+};
+
+// Generator parameters. Everything in V4_Settings plus the seed tweak and the
+// register size can be changed here to evaluate alternative programs on
+// research networks; v4_default_config reproduces CryptonightR exactly
+struct V4_Config
+{
+	int total_latency;		// 1..V4_MAX_TOTAL_LATENCY
+	int num_instructions_min;	// 1..num_instructions_max
+	int num_instructions_max;	// num_instructions_min..V4_MAX_INSTRUCTIONS
+	int alu_count_mul;		// 1..alu_count
+	int alu_count;			// alu_count_mul..V4_MAX_ALU_COUNT
+	int8_t seed_tweak;		// stored in byte 20 of the seed before hashing it
+	int reg_bits;			// 32 or 64
+};
+
+static const struct V4_Config v4_default_config = {
+	TOTAL_LATENCY,
+	NUM_INSTRUCTIONS_MIN,
+	NUM_INSTRUCTIONS_MAX,
+	ALU_COUNT_MUL,
+	ALU_COUNT,
+	-38,
+	32,
+};
+
 enum V4_InstructionList
 {
 	MUL,	// a*b
@@ -58,6 +97,20 @@ struct V4_Instruction
 	uint32_t C;
 };
 
+// What the generator knows about the program it produced, see v4_random_math_init_stats
+struct V4_Stats
+{
+	int code_size;					// instructions, excluding the final RET
+	int opcode_count[V4_INSTRUCTION_COUNT];		// instruction mix
+	int asic_padding;				// ROR/MUL instructions appended to reach the ASIC latency
+	int latency[4];					// R0-R3 latency in cycles on the abstract CPU
+	int asic_latency[4];				// R0-R3 latency in cycles on the theoretical ASIC
+	int alu_ops[V4_MAX_ALU_COUNT];			// instructions scheduled on each ALU (padding excluded)
+	uint16_t registers_read;			// bit i set if Ri is used as a source
+	uint16_t registers_written;			// bit i set if Ri is used as a destination
+	int retries;					// programs discarded because R8 was unused or the size was wrong
+};
+
 #ifndef FORCEINLINE
 #if defined(__GNUC__)
 #define FORCEINLINE __attribute__((always_inline)) inline
@@ -163,10 +216,49 @@ static FORCEINLINE void v4_random_math(const struct V4_Instruction* code, v4_reg
 	V4_EXEC_10(50);		// instructions 50-59
 	V4_EXEC_10(60);		// instructions 60-69
 
+	// Only programs from a V4_Config with more than NUM_INSTRUCTIONS_MAX instructions get here
+	for (int i = NUM_INSTRUCTIONS_MAX;; ++i)
+		V4_EXEC(i);
+
 #undef V4_EXEC_10
 #undef V4_EXEC
 }
 
+// Interpreter for V4_Config.reg_bits == 64. Only research configurations use it,
+// so it isn't unrolled
+static inline void v4_random_math64(const struct V4_Instruction* code, uint64_t* r)
+{
+	for (const struct V4_Instruction* op = code;; ++op)
+	{
+		const uint64_t src = r[op->src_index];
+		uint64_t* dst = r + op->dst_index;
+		const uint32_t shift = src % 64;
+		switch (op->opcode)
+		{
+		case MUL:
+			*dst *= src;
+			break;
+		case ADD:
+			*dst += src + op->C;
+			break;
+		case SUB:
+			*dst -= src;
+			break;
+		case ROR:
+			*dst = (*dst >> shift) | (*dst << ((64 - shift) % 64));
+			break;
+		case ROL:
+			*dst = (*dst << shift) | (*dst >> ((64 - shift) % 64));
+			break;
+		case XOR:
+			*dst ^= src;
+			break;
+		default:
+			return;
+		}
+	}
+}
+
 // If we don't have enough data available, generate more
 static FORCEINLINE void check_data(size_t* data_index, const size_t bytes_needed, int8_t* data, const size_t data_size)
 {
@@ -178,9 +270,14 @@ static FORCEINLINE void check_data(size_t* data_index, const size_t bytes_needed
 }
 
 // Generates as many random math operations as possible with given latency and ALU restrictions
-// "code" array must have space for NUM_INSTRUCTIONS_MAX+1 instructions
-static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_t height)
+// "code" array must have space for config->num_instructions_max+1 instructions
+// "stats" can be NULL, otherwise it receives the generator's view of the returned program
+static inline int v4_random_math_init_stats(struct V4_Instruction* code, const uint64_t height, const struct V4_Config* config, struct V4_Stats* stats)
 {
+	const int total_latency = config->total_latency;
+	const int num_instructions_min = config->num_instructions_min;
+	const int num_instructions_max = config->num_instructions_max;
+
 	// MUL is 3 cycles, 3-way addition and rotations are 2 cycles, SUB/XOR are 1 cycle
 	// These latencies match real-life instruction latencies for Intel CPUs starting from Sandy Bridge and up to Skylake/Coffee lake
 	//
@@ -194,13 +291,13 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 	const int asic_op_latency[V4_INSTRUCTION_COUNT] = { 3, 1, 1, 1, 1, 1 };
 
 	// Available ALUs for each instruction
-	const int op_ALUs[V4_INSTRUCTION_COUNT] = { ALU_COUNT_MUL, ALU_COUNT, ALU_COUNT, ALU_COUNT, ALU_COUNT, ALU_COUNT };
+	const int op_ALUs[V4_INSTRUCTION_COUNT] = { config->alu_count_mul, config->alu_count, config->alu_count, config->alu_count, config->alu_count, config->alu_count };
 
 	int8_t data[32];
 	memset(data, 0, sizeof(data));
 	uint64_t tmp = SWAP64LE(height);
 	memcpy(data, &tmp, sizeof(uint64_t));
-	data[20] = -38; // change seed
+	data[20] = config->seed_tweak; // change seed
 
 	// Set data_index past the last byte in data
 	// to trigger full data update with blake hash
@@ -212,7 +309,11 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 	// There is a small chance (1.8%) that register R8 won't be used in the generated program
 	// So we keep track of it and try again if it's not used
 	bool r8_used;
+	int attempts = 0;
+	int programs = 0;
 	do {
+		++programs;
+
 		int latency[9];
 		int asic_latency[9];
 
@@ -225,7 +326,8 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 		// the same operation twice with two constant source registers, it can be optimized into a single operation
 		uint32_t inst_data[9] = { 0, 1, 2, 3, 0xFFFFFF, 0xFFFFFF, 0xFFFFFF, 0xFFFFFF, 0xFFFFFF };
 
-		bool alu_busy[TOTAL_LATENCY + 1][ALU_COUNT];
+		bool alu_busy[V4_MAX_TOTAL_LATENCY + 1][V4_MAX_ALU_COUNT];
+		int alu_ops[V4_MAX_ALU_COUNT];
 		bool is_rotation[V4_INSTRUCTION_COUNT];
 		bool rotated[4];
 		int rotate_count = 0;
@@ -233,6 +335,7 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 		memset(latency, 0, sizeof(latency));
 		memset(asic_latency, 0, sizeof(asic_latency));
 		memset(alu_busy, 0, sizeof(alu_busy));
+		memset(alu_ops, 0, sizeof(alu_ops));
 		memset(is_rotation, 0, sizeof(is_rotation));
 		memset(rotated, 0, sizeof(rotated));
 		is_rotation[ROR] = true;
@@ -246,7 +349,7 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 
 		// Generate random code to achieve minimal required latency for our abstract CPU
 		// Try to get this latency for all 4 registers
-		while (((latency[0] < TOTAL_LATENCY) || (latency[1] < TOTAL_LATENCY) || (latency[2] < TOTAL_LATENCY) || (latency[3] < TOTAL_LATENCY)) && (num_retries < 64))
+		while (((latency[0] < total_latency) || (latency[1] < total_latency) || (latency[2] < total_latency) || (latency[3] < total_latency)) && (num_retries < 64))
 		{
 			// Fail-safe to guarantee loop termination
 			++total_iterations;
@@ -308,7 +411,7 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 			// Find which ALU is available (and when) for this instruction
 			int next_latency = (latency[a] > latency[b]) ? latency[a] : latency[b];
 			int alu_index = -1;
-			while (next_latency < TOTAL_LATENCY)
+			while (next_latency < total_latency)
 			{
 				for (int i = op_ALUs[opcode] - 1; i >= 0; --i)
 				{
@@ -345,7 +448,7 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 
 			next_latency += op_latency[opcode];
 
-			if (next_latency <= TOTAL_LATENCY)
+			if (next_latency <= total_latency)
 			{
 				if (is_rotation[opcode])
 				{
@@ -354,6 +457,7 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 
 				// Mark ALU as busy only for the first cycle when it starts executing the instruction because ALUs are fully pipelined
 				alu_busy[next_latency - op_latency[opcode]][alu_index] = true;
+				++alu_ops[alu_index];
 				latency[a] = next_latency;
 
 				// ASIC is supposed to have enough ALUs to run as many independent instructions per cycle as possible, so latency calculation for ASIC is simple
@@ -387,7 +491,7 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 				}
 
 				++code_size;
-				if (code_size >= NUM_INSTRUCTIONS_MIN)
+				if (code_size >= num_instructions_min)
 				{
 					break;
 				}
@@ -402,7 +506,7 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 		// We need to add a few more MUL and ROR instructions to achieve minimal required latency for ASIC
 		// Get this latency for at least 1 of the 4 registers
 		const int prev_code_size = code_size;
-		while ((code_size < NUM_INSTRUCTIONS_MAX) && (asic_latency[0] < TOTAL_LATENCY) && (asic_latency[1] < TOTAL_LATENCY) && (asic_latency[2] < TOTAL_LATENCY) && (asic_latency[3] < TOTAL_LATENCY))
+		while ((code_size < num_instructions_max) && (asic_latency[0] < total_latency) && (asic_latency[1] < total_latency) && (asic_latency[2] < total_latency) && (asic_latency[3] < total_latency))
 		{
 			int min_idx = 0;
 			int max_idx = 0;
@@ -424,11 +528,29 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 			++code_size;
 		}
 
+		if (stats)
+		{
+			memset(stats, 0, sizeof(*stats));
+			stats->code_size = code_size;
+			stats->asic_padding = code_size - prev_code_size;
+			memcpy(stats->latency, latency, sizeof(stats->latency));
+			memcpy(stats->asic_latency, asic_latency, sizeof(stats->asic_latency));
+			memcpy(stats->alu_ops, alu_ops, sizeof(stats->alu_ops));
+			for (int i = 0; i < code_size; ++i)
+			{
+				++stats->opcode_count[code[i].opcode];
+				stats->registers_read |= 1 << code[i].src_index;
+				stats->registers_written |= 1 << code[i].dst_index;
+			}
+			stats->retries = programs - 1;
+		}
+
 	// There is ~98.15% chance that loop condition is false, so this loop will execute only 1 iteration most of the time
 	// It never does more than 4 iterations for all block heights < 10,000,000
-	}  while (!r8_used || (code_size < NUM_INSTRUCTIONS_MIN) || (code_size > NUM_INSTRUCTIONS_MAX));
+	// For other configurations V4_MAX_ATTEMPTS makes sure we stop eventually, keeping the last (still deterministic) program
+	}  while ((!r8_used || (code_size < num_instructions_min) || (code_size > num_instructions_max)) && (++attempts < V4_MAX_ATTEMPTS));
 
-	// It's guaranteed that NUM_INSTRUCTIONS_MIN <= code_size <= NUM_INSTRUCTIONS_MAX here
+	// It's guaranteed that NUM_INSTRUCTIONS_MIN <= code_size <= NUM_INSTRUCTIONS_MAX here for the default configuration
 	// Add final instruction to stop the interpreter
 	code[code_size].opcode = RET;
 	code[code_size].dst_index = 0;
@@ -438,4 +560,15 @@ static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_
 	return code_size;
 }
 
+static inline int v4_random_math_init_config(struct V4_Instruction* code, const uint64_t height, const struct V4_Config* config)
+{
+	return v4_random_math_init_stats(code, height, config, NULL);
+}
+
+// "code" array must have space for NUM_INSTRUCTIONS_MAX+1 instructions
+static inline int v4_random_math_init(struct V4_Instruction* code, const uint64_t height)
+{
+	return v4_random_math_init_config(code, height, &v4_default_config);
+}
+
 #endif